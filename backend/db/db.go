@@ -11,11 +11,13 @@ import (
 
 var DB *sql.DB
 
+// connStr is the connection string DB was opened with
+var connStr string
+
 // InitDB initializes the database connection
 func InitDB() error {
         // First check for DATABASE_URL which is provided by Replit
         databaseURL := os.Getenv("DATABASE_URL")
-        var connStr string
         
         if databaseURL != "" {
                 // Use the DATABASE_URL if available (Replit environment)
@@ -69,6 +71,12 @@ func InitDB() error {
         return nil
 }
 
+// ConnectionString returns the connection string of the database, for
+// features that need a dedicated connection such as LISTEN
+func ConnectionString() string {
+        return connStr
+}
+
 // createTables creates all necessary tables in the database
 func createTables() error {
         queries := []string{
@@ -122,6 +130,252 @@ func createTables() error {
                         response TEXT NOT NULL,
                         created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
                 )`,
+                // Listings flagged by the duplicate/spam checks wait in 'pending_review'
+                `ALTER TABLE books ADD COLUMN IF NOT EXISTS image_hash VARCHAR(16)`,
+                `ALTER TABLE books DROP CONSTRAINT IF EXISTS books_status_check`,
+                `ALTER TABLE books ADD CONSTRAINT books_status_check
+                        CHECK (status IN ('available', 'sold', 'reserved', 'pending_review', 'rejected'))`,
+                `ALTER TABLE users DROP CONSTRAINT IF EXISTS users_role_check`,
+                `ALTER TABLE users ADD CONSTRAINT users_role_check CHECK (role IN ('buyer', 'seller', 'admin'))`,
+                `ALTER TABLE user_book_interactions DROP CONSTRAINT IF EXISTS user_book_interactions_interaction_type_check`,
+                `ALTER TABLE user_book_interactions ADD CONSTRAINT user_book_interactions_interaction_type_check
+                        CHECK (interaction_type IN ('view', 'search', 'favorite', 'purchase'))`,
+                `CREATE INDEX IF NOT EXISTS idx_user_book_interactions_user ON user_book_interactions (user_id, created_at)`,
+                `CREATE TABLE IF NOT EXISTS recommendation_feedback (
+                        id SERIAL PRIMARY KEY,
+                        user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+                        book_id INTEGER REFERENCES books(id) ON DELETE CASCADE,
+                        feedback_type VARCHAR(20) NOT NULL CHECK (feedback_type IN ('not_interested', 'already_own')),
+                        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+                        UNIQUE (user_id, book_id)
+                )`,
+                `CREATE TABLE IF NOT EXISTS recommendation_events (
+                        id SERIAL PRIMARY KEY,
+                        user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+                        book_id INTEGER REFERENCES books(id) ON DELETE CASCADE,
+                        event_type VARCHAR(20) NOT NULL CHECK (event_type IN ('impression', 'click')),
+                        position INTEGER,
+                        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+                )`,
+                `CREATE INDEX IF NOT EXISTS idx_recommendation_events_created ON recommendation_events (created_at)`,
+                `CREATE TABLE IF NOT EXISTS listing_moderation_queue (
+                        id SERIAL PRIMARY KEY,
+                        book_id INTEGER REFERENCES books(id) ON DELETE CASCADE,
+                        seller_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+                        reasons TEXT NOT NULL,
+                        status VARCHAR(20) DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+                        reviewed_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+                        reviewed_at TIMESTAMP WITH TIME ZONE,
+                        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+                )`,
+                // Which LLM provider answered each chatbot query and how many tokens it used
+                `ALTER TABLE chatbot_interactions ADD COLUMN IF NOT EXISTS provider VARCHAR(20)`,
+                `ALTER TABLE chatbot_interactions ADD COLUMN IF NOT EXISTS model VARCHAR(100)`,
+                `ALTER TABLE chatbot_interactions ADD COLUMN IF NOT EXISTS prompt_tokens INTEGER DEFAULT 0`,
+                `ALTER TABLE chatbot_interactions ADD COLUMN IF NOT EXISTS completion_tokens INTEGER DEFAULT 0`,
+                // Multi-turn chatbot conversations; turns older than summarized_through are folded into summary
+                `CREATE TABLE IF NOT EXISTS chatbot_conversations (
+                        id SERIAL PRIMARY KEY,
+                        user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+                        title VARCHAR(100) NOT NULL,
+                        summary TEXT NOT NULL DEFAULT '',
+                        summarized_through INTEGER NOT NULL DEFAULT 0,
+                        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+                        updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+                )`,
+                `CREATE INDEX IF NOT EXISTS idx_chatbot_conversations_user ON chatbot_conversations (user_id, updated_at)`,
+                `ALTER TABLE chatbot_interactions ADD COLUMN IF NOT EXISTS conversation_id INTEGER REFERENCES chatbot_conversations(id) ON DELETE CASCADE`,
+                `ALTER TABLE chatbot_interactions ADD COLUMN IF NOT EXISTS intent JSONB`,
+                `ALTER TABLE chatbot_interactions ADD COLUMN IF NOT EXISTS book_ids INTEGER[] NOT NULL DEFAULT '{}'`,
+                `CREATE INDEX IF NOT EXISTS idx_chatbot_interactions_conversation ON chatbot_interactions (conversation_id, id)`,
+                `CREATE TABLE IF NOT EXISTS favorites (
+                        id SERIAL PRIMARY KEY,
+                        user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+                        book_id INTEGER REFERENCES books(id) ON DELETE CASCADE,
+                        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+                        UNIQUE (user_id, book_id)
+                )`,
+                // Audit log of every tool the chatbot calls on a user's behalf
+                `CREATE TABLE IF NOT EXISTS chatbot_tool_calls (
+                        id SERIAL PRIMARY KEY,
+                        user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+                        conversation_id INTEGER REFERENCES chatbot_conversations(id) ON DELETE SET NULL,
+                        tool VARCHAR(50) NOT NULL,
+                        arguments JSONB NOT NULL DEFAULT '{}',
+                        result JSONB,
+                        error TEXT,
+                        duration_ms INTEGER NOT NULL DEFAULT 0,
+                        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+                )`,
+                `CREATE INDEX IF NOT EXISTS idx_chatbot_tool_calls_user ON chatbot_tool_calls (user_id, created_at)`,
+                // Per-user daily chatbot quota; NULL uses CHATBOT_DAILY_QUOTA
+                `ALTER TABLE users ADD COLUMN IF NOT EXISTS chatbot_daily_quota INTEGER`,
+                `CREATE INDEX IF NOT EXISTS idx_chatbot_interactions_user_created ON chatbot_interactions (user_id, created_at)`,
+                // WebSocket broadcasts too large for a NOTIFY payload, read by other instances
+                `CREATE TABLE IF NOT EXISTS pubsub_payloads (
+                        id BIGSERIAL PRIMARY KEY,
+                        payload TEXT NOT NULL,
+                        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+                )`,
+                // Read receipts and presence for buyer-seller chat
+                `ALTER TABLE messages ADD COLUMN IF NOT EXISTS read_at TIMESTAMP WITH TIME ZONE`,
+                `CREATE INDEX IF NOT EXISTS idx_messages_unread ON messages (chat_id, sender_id) WHERE read_at IS NULL`,
+                `ALTER TABLE users ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMP WITH TIME ZONE`,
+                `ALTER TABLE users ADD COLUMN IF NOT EXISTS online_until TIMESTAMP WITH TIME ZONE`,
+                // Client-generated message IDs, so retried sends are stored once
+                `ALTER TABLE messages ADD COLUMN IF NOT EXISTS client_message_id VARCHAR(64)`,
+                `CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_chat_client_message_id ON messages (chat_id, sender_id, client_message_id)`,
+                // Notifications for users who were away, one unread entry per user, type and subject
+                `CREATE TABLE IF NOT EXISTS notifications (
+                        id SERIAL PRIMARY KEY,
+                        user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+                        type VARCHAR(50) NOT NULL,
+                        ref_id INTEGER NOT NULL DEFAULT 0,
+                        title VARCHAR(255) NOT NULL,
+                        body TEXT NOT NULL DEFAULT '',
+                        link VARCHAR(255) NOT NULL DEFAULT '',
+                        count INTEGER NOT NULL DEFAULT 1,
+                        read_at TIMESTAMP WITH TIME ZONE,
+                        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+                )`,
+                `CREATE UNIQUE INDEX IF NOT EXISTS idx_notifications_unread ON notifications (user_id, type, ref_id) WHERE read_at IS NULL`,
+                `CREATE INDEX IF NOT EXISTS idx_notifications_user_created ON notifications (user_id, created_at)`,
+                // Community chat rooms, their history and moderator sanctions
+                `CREATE TABLE IF NOT EXISTS community_rooms (
+                        id SERIAL PRIMARY KEY,
+                        slug VARCHAR(50) UNIQUE NOT NULL,
+                        name VARCHAR(100) NOT NULL,
+                        category VARCHAR(20) NOT NULL DEFAULT 'general',
+                        description TEXT NOT NULL DEFAULT '',
+                        created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+                        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+                )`,
+                `INSERT INTO community_rooms (slug, name, category, description) VALUES
+                        ('general', 'General', 'general', 'Chat with fellow book lovers'),
+                        ('fiction', 'Fiction', 'genre', 'Novels, short stories and recommendations'),
+                        ('exam-prep', 'Exam Prep', 'exam', 'Study together and swap exam textbooks')
+                        ON CONFLICT (slug) DO NOTHING`,
+                `CREATE TABLE IF NOT EXISTS community_messages (
+                        id SERIAL PRIMARY KEY,
+                        room_id INTEGER REFERENCES community_rooms(id) ON DELETE CASCADE,
+                        sender_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+                        content TEXT NOT NULL,
+                        deleted_at TIMESTAMP WITH TIME ZONE,
+                        deleted_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+                        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+                )`,
+                `CREATE INDEX IF NOT EXISTS idx_community_messages_room ON community_messages (room_id, id)`,
+                `CREATE TABLE IF NOT EXISTS community_sanctions (
+                        id SERIAL PRIMARY KEY,
+                        user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+                        room_id INTEGER REFERENCES community_rooms(id) ON DELETE CASCADE,
+                        kind VARCHAR(10) NOT NULL CHECK (kind IN ('mute', 'ban')),
+                        reason TEXT NOT NULL DEFAULT '',
+                        expires_at TIMESTAMP WITH TIME ZONE,
+                        created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+                        lifted_at TIMESTAMP WITH TIME ZONE,
+                        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+                )`,
+                `CREATE INDEX IF NOT EXISTS idx_community_sanctions_user ON community_sanctions (user_id) WHERE lifted_at IS NULL`,
+                // Uploaded files, stored on disk under stored_name
+                `CREATE TABLE IF NOT EXISTS uploads (
+                        id SERIAL PRIMARY KEY,
+                        user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+                        stored_name VARCHAR(64) UNIQUE NOT NULL,
+                        original_name VARCHAR(255) NOT NULL DEFAULT '',
+                        content_type VARCHAR(50) NOT NULL,
+                        size BIGINT NOT NULL,
+                        width INTEGER NOT NULL DEFAULT 0,
+                        height INTEGER NOT NULL DEFAULT 0,
+                        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+                )`,
+                // Typed chat messages: images, listing cards and meetup locations
+                `ALTER TABLE messages ADD COLUMN IF NOT EXISTS kind VARCHAR(20) NOT NULL DEFAULT 'text'`,
+                `ALTER TABLE messages ADD COLUMN IF NOT EXISTS payload JSONB`,
+                // Users a user has blocked; blocks apply to chats in both directions
+                `CREATE TABLE IF NOT EXISTS user_blocks (
+                        blocker_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+                        blocked_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+                        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+                        PRIMARY KEY (blocker_id, blocked_id),
+                        CHECK (blocker_id <> blocked_id)
+                )`,
+                `CREATE INDEX IF NOT EXISTS idx_user_blocks_blocked ON user_blocks (blocked_id)`,
+                // Reports of users and messages, reviewed by moderators
+                `CREATE TABLE IF NOT EXISTS user_reports (
+                        id SERIAL PRIMARY KEY,
+                        reporter_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+                        reported_user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+                        message_id INTEGER REFERENCES messages(id) ON DELETE SET NULL,
+                        community_message_id INTEGER REFERENCES community_messages(id) ON DELETE SET NULL,
+                        message_content TEXT NOT NULL DEFAULT '',
+                        reason VARCHAR(20) NOT NULL,
+                        details TEXT NOT NULL DEFAULT '',
+                        status VARCHAR(20) NOT NULL DEFAULT 'pending',
+                        reviewed_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+                        reviewed_at TIMESTAMP WITH TIME ZONE,
+                        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+                )`,
+                `CREATE UNIQUE INDEX IF NOT EXISTS idx_user_reports_pending ON user_reports
+                        (reporter_id, reported_user_id, COALESCE(message_id, 0), COALESCE(community_message_id, 0))
+                        WHERE status = 'pending'`,
+                // Chats a participant doesn't want notifications from
+                `CREATE TABLE IF NOT EXISTS chat_mutes (
+                        user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+                        chat_id INTEGER REFERENCES chats(id) ON DELETE CASCADE,
+                        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+                        PRIMARY KEY (user_id, chat_id)
+                )`,
+                // When a book sold, which starts the clock on its chats' retention
+                `ALTER TABLE books ADD COLUMN IF NOT EXISTS sold_at TIMESTAMP WITH TIME ZONE`,
+                `UPDATE books b SET sold_at = (
+                        SELECT MAX(i.created_at) FROM user_book_interactions i
+                        WHERE i.book_id = b.id AND i.interaction_type = 'purchase'
+                ) WHERE b.status = 'sold' AND b.sold_at IS NULL`,
+                // Chat messages moved out of messages by the retention job, keeping their IDs
+                `CREATE TABLE IF NOT EXISTS archived_messages (
+                        id INTEGER PRIMARY KEY,
+                        chat_id INTEGER REFERENCES chats(id) ON DELETE CASCADE,
+                        sender_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+                        kind VARCHAR(20) NOT NULL DEFAULT 'text',
+                        payload JSONB,
+                        content TEXT NOT NULL,
+                        client_message_id VARCHAR(64),
+                        read_at TIMESTAMP WITH TIME ZONE,
+                        created_at TIMESTAMP WITH TIME ZONE,
+                        archived_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+                )`,
+                `CREATE INDEX IF NOT EXISTS idx_archived_messages_chat ON archived_messages (chat_id, id)`,
+                // Chat list lookups: a user's chats and the latest message of each
+                `CREATE INDEX IF NOT EXISTS idx_chats_buyer ON chats (buyer_id)`,
+                `CREATE INDEX IF NOT EXISTS idx_chats_seller ON chats (seller_id)`,
+                `CREATE INDEX IF NOT EXISTS idx_messages_chat_latest ON messages (chat_id, created_at DESC, id DESC)`,
+                // Chatbot queries per user per day, kept apart from chatbot_interactions
+                // so deleting a conversation doesn't give its queries back
+                `CREATE TABLE IF NOT EXISTS chatbot_usage (
+                        user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+                        day DATE NOT NULL,
+                        queries INTEGER NOT NULL DEFAULT 0,
+                        PRIMARY KEY (user_id, day)
+                )`,
+                `INSERT INTO chatbot_usage (user_id, day, queries)
+                        SELECT user_id, CURRENT_DATE, COUNT(*) FROM chatbot_interactions
+                        WHERE user_id IS NOT NULL AND created_at >= CURRENT_DATE
+                        GROUP BY user_id
+                        ON CONFLICT (user_id, day) DO NOTHING`,
+                // A report keeps the ID of the message it's about after retention
+                // archives or purges it; nulling it could collide with another
+                // pending report and left archived messages unlinked from theirs
+                `ALTER TABLE user_reports DROP CONSTRAINT IF EXISTS user_reports_message_id_fkey`,
+                // Chats each user has open on some connection, renewed like users.online_until
+                `CREATE TABLE IF NOT EXISTS chat_viewers (
+                        user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+                        chat_id INTEGER REFERENCES chats(id) ON DELETE CASCADE,
+                        online_until TIMESTAMP WITH TIME ZONE NOT NULL,
+                        PRIMARY KEY (user_id, chat_id)
+                )`,
+                // Client message IDs used to be unique per sender across all their chats
+                `DROP INDEX IF EXISTS idx_messages_client_message_id`,
         }
 
         for _, query := range queries {
@@ -0,0 +1,92 @@
+package evaluation
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"reselling-app/pricemodel"
+)
+
+// PriceResult holds the error metrics of one price model
+type PriceResult struct {
+	Name         string  `json:"name"`
+	Predictions  int     `json:"predictions"`
+	MAE          float64 `json:"mae"`
+	MAPE         float64 `json:"mape"`            // mean absolute percentage error, 0.15 = 15%
+	WithinTwenty float64 `json:"within_20_pct"`   // share of predictions within ±20% of the sold price
+	Error        string  `json:"error,omitempty"` // set when the model could not be trained
+	Version      string  `json:"model_version,omitempty"`
+}
+
+// predictor prices a listing
+type predictor func(pricemodel.Input) float64
+
+// EvaluatePriceModels trains on listings sold before the cutoff and measures
+// prediction error on those sold after it. Samples must be in the order they sold.
+func EvaluatePriceModels(samples []pricemodel.Sample, opts Options) (Split, []PriceResult) {
+	split := cutoffIndex(len(samples), opts.TrainFraction, func(i int) time.Time { return samples[i].SoldAt })
+	train, test := samples[:split], samples[split:]
+
+	info := Split{Train: len(train), Test: len(test)}
+	if len(test) > 0 {
+		info.Cutoff = test[0].SoldAt
+	}
+
+	var results []PriceResult
+
+	ridge := PriceResult{Name: "ridge_regression"}
+	if model, err := pricemodel.Train(train, pricemodel.DefaultOptions()); err != nil {
+		ridge.Error = err.Error()
+	} else {
+		ridge = scorePredictor(ridge.Name, model.Predict, test)
+		ridge.Version = model.Version
+	}
+	results = append(results, ridge)
+
+	median := medianPrice(train)
+	results = append(results, scorePredictor("training_median", func(pricemodel.Input) float64 { return median }, test))
+
+	return info, results
+}
+
+// scorePredictor computes MAE, MAPE and the ±20% hit rate over the test listings
+func scorePredictor(name string, predict predictor, test []pricemodel.Sample) PriceResult {
+	result := PriceResult{Name: name, Predictions: len(test)}
+	if len(test) == 0 {
+		return result
+	}
+
+	for _, s := range test {
+		diff := math.Abs(predict(s.Input) - s.Price)
+		result.MAE += diff
+		result.MAPE += diff / s.Price
+		if diff <= 0.2*s.Price {
+			result.WithinTwenty++
+		}
+	}
+
+	n := float64(len(test))
+	result.MAE /= n
+	result.MAPE /= n
+	result.WithinTwenty /= n
+	return result
+}
+
+// medianPrice returns the median sold price, or 0 with no samples
+func medianPrice(samples []pricemodel.Sample) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	prices := make([]float64, len(samples))
+	for i, s := range samples {
+		prices[i] = s.Price
+	}
+	sort.Float64s(prices)
+
+	mid := len(prices) / 2
+	if len(prices)%2 == 0 {
+		return (prices[mid-1] + prices[mid]) / 2
+	}
+	return prices[mid]
+}
@@ -0,0 +1,109 @@
+package evaluation
+
+import (
+	"math"
+	"time"
+
+	"reselling-app/recommender"
+)
+
+// RecommenderResult holds the ranking metrics of one recommender
+type RecommenderResult struct {
+	Name      string  `json:"name"`
+	Users     int     `json:"users"` // test users with at least one relevant book
+	Precision float64 `json:"precision_at_k"`
+	Recall    float64 `json:"recall_at_k"`
+	NDCG      float64 `json:"ndcg_at_k"`
+	Coverage  float64 `json:"coverage"` // share of training books recommended to anyone
+}
+
+// ranker produces the top k books for a user's training history
+type ranker func(history map[int]float64, k int) []int
+
+// EvaluateRecommenders trains on interactions before the cutoff and checks how
+// well each recommender predicts the books users went on to interact with
+func EvaluateRecommenders(interactions []recommender.Interaction, opts Options) (Split, []RecommenderResult) {
+	split := cutoffIndex(len(interactions), opts.TrainFraction, func(i int) time.Time { return interactions[i].At })
+	train, test := interactions[:split], interactions[split:]
+
+	info := Split{Train: len(train), Test: len(test)}
+	if len(test) > 0 {
+		info.Cutoff = test[0].At
+	}
+
+	ratings := recommender.Ratings(train)
+	model := recommender.BuildModel(ratings)
+
+	// Books each user interacted with for the first time after the cutoff
+	relevant := make(map[int]map[int]bool)
+	for _, in := range test {
+		if _, seen := ratings[in.UserID][in.BookID]; seen {
+			continue
+		}
+		if relevant[in.UserID] == nil {
+			relevant[in.UserID] = make(map[int]bool)
+		}
+		relevant[in.UserID][in.BookID] = true
+	}
+
+	rankers := []struct {
+		name string
+		rank ranker
+	}{
+		{"item_item_cf", model.TopN},
+		{"popularity", func(history map[int]float64, k int) []int {
+			var picks []int
+			for _, id := range model.PopularN(len(history) + k) {
+				if _, seen := history[id]; !seen && len(picks) < k {
+					picks = append(picks, id)
+				}
+			}
+			return picks
+		}},
+	}
+
+	results := make([]RecommenderResult, 0, len(rankers))
+	for _, r := range rankers {
+		results = append(results, scoreRanker(r.name, r.rank, ratings, relevant, len(model.Popularity), opts.K))
+	}
+	return info, results
+}
+
+// scoreRanker averages precision, recall and NDCG at k over test users
+func scoreRanker(name string, rank ranker, ratings map[int]map[int]float64, relevant map[int]map[int]bool, catalog, k int) RecommenderResult {
+	result := RecommenderResult{Name: name}
+	recommended := make(map[int]bool)
+
+	for userID, books := range relevant {
+		picks := rank(ratings[userID], k)
+
+		var hits int
+		var dcg float64
+		for i, id := range picks {
+			recommended[id] = true
+			if books[id] {
+				hits++
+				dcg += 1 / math.Log2(float64(i+2))
+			}
+		}
+		var ideal float64
+		for i := 0; i < len(books) && i < k; i++ {
+			ideal += 1 / math.Log2(float64(i+2))
+		}
+
+		result.Users++
+		result.Precision += float64(hits) / float64(k)
+		result.Recall += float64(hits) / float64(len(books))
+		result.NDCG += dcg / ideal
+	}
+
+	if result.Users > 0 {
+		result.Precision /= float64(result.Users)
+		result.Recall /= float64(result.Users)
+		result.NDCG /= float64(result.Users)
+	}
+	if catalog > 0 {
+		result.Coverage = float64(len(recommended)) / float64(catalog)
+	}
+	return result
+}
@@ -0,0 +1,99 @@
+// Package evaluation replays historical interactions and sold listings to score
+// recommenders and price models offline.
+//
+// Both datasets are split on time: everything before the cutoff is used for
+// training and everything after it for testing, so results reflect how a model
+// trained today would have done on tomorrow's activity.
+package evaluation
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"reselling-app/pricemodel"
+	"reselling-app/recommender"
+)
+
+// Options controls an evaluation run
+type Options struct {
+	K             int     // recommendation list length scored by the ranking metrics
+	TrainFraction float64 // share of each dataset, oldest first, used for training
+}
+
+// DefaultOptions returns the options used by the evaluate command
+func DefaultOptions() Options {
+	return Options{K: 10, TrainFraction: 0.8}
+}
+
+// Split describes where a dataset was cut into train and test
+type Split struct {
+	Cutoff time.Time `json:"cutoff"`
+	Train  int       `json:"train"`
+	Test   int       `json:"test"`
+}
+
+// Report is the JSON document written by the evaluate command
+type Report struct {
+	GeneratedAt      time.Time           `json:"generated_at"`
+	K                int                 `json:"k"`
+	TrainFraction    float64             `json:"train_fraction"`
+	InteractionSplit Split               `json:"interaction_split"`
+	PriceSplit       Split               `json:"price_split"`
+	Recommenders     []RecommenderResult `json:"recommenders"`
+	PriceModels      []PriceResult       `json:"price_models"`
+}
+
+// Run loads interactions and sold listings and evaluates every model against them
+func Run(database *sql.DB, opts Options) (*Report, error) {
+	if opts.K <= 0 {
+		return nil, fmt.Errorf("k must be positive, got %d", opts.K)
+	}
+	if opts.TrainFraction <= 0 || opts.TrainFraction >= 1 {
+		return nil, fmt.Errorf("train fraction must be between 0 and 1, got %g", opts.TrainFraction)
+	}
+
+	interactions, err := recommender.LoadInteractions(database, time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("loading interactions: %w", err)
+	}
+	samples, err := pricemodel.LoadSoldListings(database)
+	if err != nil {
+		return nil, fmt.Errorf("loading sold listings: %w", err)
+	}
+
+	report := &Report{
+		GeneratedAt:   time.Now().UTC(),
+		K:             opts.K,
+		TrainFraction: opts.TrainFraction,
+	}
+	report.InteractionSplit, report.Recommenders = EvaluateRecommenders(interactions, opts)
+	report.PriceSplit, report.PriceModels = EvaluatePriceModels(samples, opts)
+	return report, nil
+}
+
+// Write saves the report as indented JSON
+func (r *Report) Write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// cutoffIndex returns the index of the first test element in a time-sorted
+// dataset of size n. Elements sharing the cutoff timestamp stay together.
+func cutoffIndex(n int, fraction float64, at func(int) time.Time) int {
+	if n == 0 {
+		return 0
+	}
+	idx := int(float64(n) * fraction)
+	if idx >= n {
+		return n
+	}
+	cutoff := at(idx)
+	return sort.Search(n, func(i int) bool { return !at(i).Before(cutoff) })
+}
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"reselling-app/db"
+	"reselling-app/models"
+)
+
+// usersBlocked reports whether either user has blocked the other
+func usersBlocked(a, b int) (bool, error) {
+	var blocked bool
+	err := db.DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM user_blocks
+			WHERE (blocker_id = $1 AND blocked_id = $2) OR (blocker_id = $2 AND blocked_id = $1)
+		)`,
+		a, b,
+	).Scan(&blocked)
+	return blocked, err
+}
+
+// chatBlocked reports whether either participant of a chat has blocked the other
+func chatBlocked(chatID int) (bool, error) {
+	var blocked bool
+	err := db.DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM chats c
+			JOIN user_blocks ub
+			  ON (ub.blocker_id = c.buyer_id AND ub.blocked_id = c.seller_id)
+			  OR (ub.blocker_id = c.seller_id AND ub.blocked_id = c.buyer_id)
+			WHERE c.id = $1
+		)`,
+		chatID,
+	).Scan(&blocked)
+	return blocked, err
+}
+
+// blockedByUser returns the IDs of the users a user has blocked, whose
+// listings are hidden from them
+func blockedByUser(userID int) (map[int]bool, error) {
+	blocked := make(map[int]bool)
+	if userID == 0 {
+		return blocked, nil
+	}
+	rows, err := db.DB.Query("SELECT blocked_id FROM user_blocks WHERE blocker_id = $1", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		blocked[id] = true
+	}
+	return blocked, rows.Err()
+}
+
+// refreshCommunityBlocks updates which users' community messages reach a
+// user's open connections after they block or unblock someone
+func refreshCommunityBlocks(userID int) {
+	blocked, err := blockedByUser(userID)
+	if err != nil {
+		log.Printf("Database error fetching blocked users: %v", err)
+		return
+	}
+	communityHub.SetBlocked(userID, blocked)
+}
+
+// withoutBlockedSellers drops the listings of sellers the viewer has blocked;
+// viewerID is 0 for anonymous users
+func withoutBlockedSellers(books []models.Book, viewerID int) ([]models.Book, error) {
+	blocked, err := blockedByUser(viewerID)
+	if err != nil || len(blocked) == 0 {
+		return books, err
+	}
+	visible := books[:0]
+	for _, book := range books {
+		if !blocked[book.SellerID] {
+			visible = append(visible, book)
+		}
+	}
+	return visible, nil
+}
+
+// GetBlockedUsers lists the users the current user has blocked
+func GetBlockedUsers(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	rows, err := db.DB.Query(`
+		SELECT ub.blocked_id, u.username, ub.created_at
+		FROM user_blocks ub
+		JOIN users u ON u.id = ub.blocked_id
+		WHERE ub.blocker_id = $1
+		ORDER BY ub.created_at DESC`,
+		userID,
+	)
+	if err != nil {
+		log.Printf("Database error fetching blocked users: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch blocked users"})
+		return
+	}
+	defer rows.Close()
+
+	blocked := []models.BlockedUser{}
+	for rows.Next() {
+		var user models.BlockedUser
+		if err := rows.Scan(&user.UserID, &user.Username, &user.CreatedAt); err != nil {
+			log.Printf("Error scanning blocked user row: %v", err)
+			continue
+		}
+		blocked = append(blocked, user)
+	}
+
+	c.JSON(http.StatusOK, blocked)
+}
+
+// BlockUser blocks a user. Neither user can start a chat with or message the
+// other while the block stands, and the blocked user's listings and community
+// messages are hidden from the current user.
+func BlockUser(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	blockedID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	if blockedID == userID.(int) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You can't block yourself"})
+		return
+	}
+
+	var username string
+	err = db.DB.QueryRow("SELECT username FROM users WHERE id = $1", blockedID).Scan(&username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		log.Printf("Database error fetching user to block: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	_, err = db.DB.Exec(
+		"INSERT INTO user_blocks (blocker_id, blocked_id) VALUES ($1, $2) ON CONFLICT (blocker_id, blocked_id) DO NOTHING",
+		userID, blockedID,
+	)
+	if err != nil {
+		log.Printf("Database error blocking user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to block user"})
+		return
+	}
+	refreshCommunityBlocks(userID.(int))
+
+	c.JSON(http.StatusOK, gin.H{"message": "User blocked", "user_id": blockedID, "username": username})
+}
+
+// UnblockUser lifts the current user's block on a user
+func UnblockUser(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	blockedID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	result, err := db.DB.Exec("DELETE FROM user_blocks WHERE blocker_id = $1 AND blocked_id = $2", userID, blockedID)
+	if err != nil {
+		log.Printf("Database error unblocking user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unblock user"})
+		return
+	}
+	if removed, _ := result.RowsAffected(); removed == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User is not blocked"})
+		return
+	}
+	refreshCommunityBlocks(userID.(int))
+
+	c.JSON(http.StatusOK, gin.H{"message": "User unblocked", "user_id": blockedID})
+}
@@ -1,106 +1,47 @@
 package handlers
 
 import (
-        "bytes"
+        "context"
         "database/sql"
-        "encoding/json"
         "fmt"
         "log"
         "math"
         "net/http"
         "strconv"
         "strings"
-        "time"
 
         "github.com/gin-gonic/gin"
         "reselling-app/db"
+        "reselling-app/mlclient"
         "reselling-app/models"
+        "reselling-app/pricemodel"
+        "reselling-app/recommender"
 )
 
 // GetAllBooks returns all book listings
 func GetAllBooks(c *gin.Context) {
-        // Get query parameters for filtering
-        genre := c.Query("genre")
-        minPrice := c.Query("min_price")
-        maxPrice := c.Query("max_price")
-        query := c.Query("search")
-
-        // Build SQL query with optional filters
-        sqlQuery := `
-                SELECT b.id, b.seller_id, u.username, b.title, b.author, b.description, 
-                       b.price, b.image_url, b.genre, b.condition, b.status, b.created_at
-                FROM books b
-                JOIN users u ON b.seller_id = u.id
-                WHERE b.status = 'available'
-        `
-        var params []interface{}
-        paramCounter := 1
-
-        // Add filters if provided
-        if genre != "" {
-                sqlQuery += fmt.Sprintf(" AND b.genre = $%d", paramCounter)
-                params = append(params, genre)
-                paramCounter++
-        }
-
-        if minPrice != "" {
-                minPriceFloat, err := strconv.ParseFloat(minPrice, 64)
-                if err == nil {
-                        sqlQuery += fmt.Sprintf(" AND b.price >= $%d", paramCounter)
-                        params = append(params, minPriceFloat)
-                        paramCounter++
-                }
+        // Get query parameters for filtering; unparseable prices are ignored
+        filter := bookFilter{
+                Genre:  c.Query("genre"),
+                Search: c.Query("search"),
         }
-
-        if maxPrice != "" {
-                maxPriceFloat, err := strconv.ParseFloat(maxPrice, 64)
-                if err == nil {
-                        sqlQuery += fmt.Sprintf(" AND b.price <= $%d", paramCounter)
-                        params = append(params, maxPriceFloat)
-                        paramCounter++
-                }
+        if minPrice, err := strconv.ParseFloat(c.Query("min_price"), 64); err == nil {
+                filter.MinPrice = minPrice
         }
-
-        if query != "" {
-                sqlQuery += fmt.Sprintf(" AND (b.title ILIKE $%d OR b.author ILIKE $%d OR b.description ILIKE $%d)",
-                        paramCounter, paramCounter, paramCounter)
-                params = append(params, "%"+query+"%")
-                paramCounter++
+        if maxPrice, err := strconv.ParseFloat(c.Query("max_price"), 64); err == nil {
+                filter.MaxPrice = maxPrice
+        }
+        // Signed-in users don't see listings from sellers they have blocked
+        if userID, exists := c.Get("userID"); exists {
+                filter.ViewerID = userID.(int)
         }
 
-        sqlQuery += " ORDER BY b.created_at DESC"
-
-        // Execute query
-        rows, err := db.DB.Query(sqlQuery, params...)
+        books, err := searchBooks(filter)
         if err != nil {
                 log.Printf("Database error fetching books: %v", err)
                 c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch books"})
                 return
         }
-        defer rows.Close()
-
-        // Initialize an empty array to avoid null JSON response
-        books := []models.Book{}
-        
-        // Parse results
-        for rows.Next() {
-                var book models.Book
-                if err := rows.Scan(
-                        &book.ID, &book.SellerID, &book.SellerUsername, &book.Title, &book.Author,
-                        &book.Description, &book.Price, &book.ImageURL, &book.Genre, &book.Condition,
-                        &book.Status, &book.CreatedAt,
-                ); err != nil {
-                        log.Printf("Error scanning book row: %v", err)
-                        continue
-                }
-                books = append(books, book)
-        }
-
-        if err := rows.Err(); err != nil {
-                log.Printf("Error iterating book rows: %v", err)
-                c.JSON(http.StatusInternalServerError, gin.H{"error": "Error processing book data"})
-                return
-        }
 
         // Even if no books found, this will return an empty array instead of null
         c.JSON(http.StatusOK, books)
@@ -143,6 +84,28 @@ func GetBook(c *gin.Context) {
                 return
         }
 
+        // Listings awaiting or failing moderation are only visible to their seller
+        if book.Status == "pending_review" || book.Status == "rejected" {
+                if !exists || userID.(int) != book.SellerID {
+                        c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+                        return
+                }
+        }
+
+        // Listings from sellers the user has blocked are hidden from them
+        if exists {
+                blocked, err := blockedByUser(userID.(int))
+                if err != nil {
+                        log.Printf("Database error checking blocks: %v", err)
+                        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch book details"})
+                        return
+                }
+                if blocked[book.SellerID] {
+                        c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+                        return
+                }
+        }
+
         // Record user interaction for recommendation system if user is authenticated
         if exists {
                 // Don't block the response for this operation
@@ -197,8 +160,20 @@ func AddBook(c *gin.Context) {
                 log.Printf("Condition truncated to stay within database limits")
         }
 
+        // Enforce the per-seller posting limit
+        overLimit, err := sellerOverPostingLimit(userID.(int))
+        if err != nil {
+                log.Printf("Database error checking posting limit: %v", err)
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create book listing"})
+                return
+        }
+        if overLimit {
+                c.JSON(http.StatusTooManyRequests, gin.H{"error": "Daily listing limit reached, please try again tomorrow"})
+                return
+        }
+
         // Call ML service to predict price
-        predictedPrice, err := getPredictedPrice(input)
+        predictedPrice, err := getPredictedPrice(c.Request.Context(), input)
         if err != nil {
                 log.Printf("Error predicting price: %v", err)
                 c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to predict book price"})
@@ -214,14 +189,30 @@ func AddBook(c *gin.Context) {
                 return
         }
 
-        // Insert book into database
+        // Run duplicate and spam detection; flagged listings wait for moderation
+        check := checkListing(userID.(int), 0, input)
+        status := "available"
+        if check.flagged() {
+                status = "pending_review"
+        }
+
+        // Insert book into database, together with its moderation queue entry
+        // if it was flagged
+        tx, err := db.DB.Begin()
+        if err != nil {
+                log.Printf("Database error starting transaction: %v", err)
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create book listing"})
+                return
+        }
+        defer tx.Rollback()
+
         var bookID int
-        err = db.DB.QueryRow(`
-                INSERT INTO books (seller_id, title, author, description, price, predicted_price, image_url, genre, condition) 
-                VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+        err = tx.QueryRow(`
+                INSERT INTO books (seller_id, title, author, description, price, predicted_price, image_url, genre, condition, status) 
+                VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
                 RETURNING id`,
                 userID, input.Title, input.Author, input.Description, input.Price, 
-                predictedPrice, input.ImageURL, input.Genre, input.Condition,
+                predictedPrice, input.ImageURL, input.Genre, input.Condition, status,
         ).Scan(&bookID)
 
         if err != nil {
@@ -230,6 +221,25 @@ func AddBook(c *gin.Context) {
                 return
         }
 
+        if check.flagged() {
+                if err := enqueueListingForModeration(tx, bookID, userID.(int), check.Reasons); err != nil {
+                        log.Printf("Database error queueing book for moderation: %v", err)
+                        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create book listing"})
+                        return
+                }
+        }
+
+        if err := tx.Commit(); err != nil {
+                log.Printf("Database error creating book: %v", err)
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create book listing"})
+                return
+        }
+
+        // Compare the image with the seller's other listings once it's hashed
+        if input.ImageURL != "" {
+                go recheckListingImage(bookID, userID.(int), input.ImageURL)
+        }
+
         // Return created book
         var book models.Book
         err = db.DB.QueryRow(`
@@ -254,6 +264,15 @@ func AddBook(c *gin.Context) {
                 return
         }
 
+        if check.flagged() {
+                c.JSON(http.StatusAccepted, gin.H{
+                        "message": "Listing submitted for review",
+                        "reasons": check.Reasons,
+                        "book":    book,
+                })
+                return
+        }
+
         c.JSON(http.StatusCreated, book)
 }
 
@@ -298,18 +317,93 @@ func DeleteBook(c *gin.Context) {
         c.JSON(http.StatusOK, gin.H{"message": "Book successfully deleted"})
 }
 
+// Number of books returned by the recommendations endpoint
+const recommendationLimit = 10
+
+// GetSimilarBooks returns other available listings similar to a book, with
+// cheaper copies of the same title first
+func GetSimilarBooks(c *gin.Context) {
+        bookID, err := strconv.Atoi(c.Param("id"))
+        if err != nil {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid book ID"})
+                return
+        }
+
+        limit, err := strconv.Atoi(c.DefaultQuery("limit", "8"))
+        if err != nil || limit <= 0 || limit > 20 {
+                limit = 8
+        }
+
+        var book models.Book
+        err = db.DB.QueryRow(`
+                SELECT id, seller_id, title, author, COALESCE(description, ''), price,
+                       COALESCE(genre, ''), COALESCE(condition, ''), status
+                FROM books
+                WHERE id = $1`,
+                bookID,
+        ).Scan(
+                &book.ID, &book.SellerID, &book.Title, &book.Author, &book.Description,
+                &book.Price, &book.Genre, &book.Condition, &book.Status,
+        )
+        if err != nil {
+                if err == sql.ErrNoRows {
+                        c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+                        return
+                }
+                log.Printf("Database error fetching book for similar books: %v", err)
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch book details"})
+                return
+        }
+
+        similar, err := recommender.Default.SimilarBooks(db.DB, book, limit)
+        if err != nil {
+                log.Printf("Error finding similar books: %v", err)
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find similar books"})
+                return
+        }
+
+        viewerID, _ := c.Get("userID")
+        id, _ := viewerID.(int)
+        similar, err = withoutBlockedSellers(similar, id)
+        if err != nil {
+                log.Printf("Database error checking blocks: %v", err)
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find similar books"})
+                return
+        }
+
+        c.JSON(http.StatusOK, similar)
+}
+
 // GetRecommendedBooks returns book recommendations for the user
 func GetRecommendedBooks(c *gin.Context) {
         userID, _ := c.Get("userID")
 
         // Call recommender service to get book recommendations
-        recommendations, err := getRecommendations(userID.(int))
+        recommendations, err := getRecommendations(c.Request.Context(), userID.(int))
         if err != nil {
                 log.Printf("Error getting recommendations: %v", err)
                 c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get recommendations"})
                 return
         }
 
+        // Drop listings from sellers the user has blocked
+        blocked, err := blockedByUser(userID.(int))
+        if err != nil {
+                log.Printf("Database error checking blocks: %v", err)
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get recommendations"})
+                return
+        }
+        visible := recommendations[:0]
+        for _, r := range recommendations {
+                if !blocked[r.SellerID] {
+                        visible = append(visible, r)
+                }
+        }
+        recommendations = visible
+
+        // Log impressions for click-through measurement without blocking the response
+        go logRecommendationImpressions(userID.(int), recommendations)
+
         c.JSON(http.StatusOK, recommendations)
 }
 
@@ -414,7 +508,8 @@ func UpdateBook(c *gin.Context) {
 
     // Check if the book exists and belongs to the current user
     var sellerID int
-    err = db.DB.QueryRow("SELECT seller_id FROM books WHERE id = $1", bookID).Scan(&sellerID)
+    var currentStatus string
+    err = db.DB.QueryRow("SELECT seller_id, status FROM books WHERE id = $1", bookID).Scan(&sellerID, &currentStatus)
     if err != nil {
         if err == sql.ErrNoRows {
             c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
@@ -465,6 +560,18 @@ func UpdateBook(c *gin.Context) {
         log.Printf("Condition truncated to stay within database limits")
     }
 
+    // Re-run duplicate and spam detection; edits to live listings can send them back to review
+    check := checkListing(sellerID, bookID, models.BookInput{
+        Title:       input.Title,
+        Author:      input.Author,
+        Description: input.Description,
+        ImageURL:    input.ImageURL,
+    })
+    status := currentStatus
+    if check.flagged() && (currentStatus == "available" || currentStatus == "pending_review") {
+        status = "pending_review"
+    }
+
     // Only update image URL if one is provided
     var updateQuery string
     var params []interface{}
@@ -473,30 +580,58 @@ func UpdateBook(c *gin.Context) {
         updateQuery = `
             UPDATE books 
             SET title = $1, author = $2, description = $3, price = $4, 
-                image_url = $5, genre = $6, condition = $7 
-            WHERE id = $8
+                image_url = $5, genre = $6, condition = $7, status = $8,
+                image_hash = CASE WHEN image_url = $5 THEN image_hash END
+            WHERE id = $9
         `
         params = append(params, input.Title, input.Author, input.Description, input.Price, 
-                        input.ImageURL, input.Genre, input.Condition, bookID)
+                        input.ImageURL, input.Genre, input.Condition, status, bookID)
     } else {
         updateQuery = `
             UPDATE books 
             SET title = $1, author = $2, description = $3, price = $4, 
-                genre = $5, condition = $6 
-            WHERE id = $7
+                genre = $5, condition = $6, status = $7
+            WHERE id = $8
         `
         params = append(params, input.Title, input.Author, input.Description, 
-                        input.Price, input.Genre, input.Condition, bookID)
+                        input.Price, input.Genre, input.Condition, status, bookID)
     }
 
-    // Execute update
-    _, err = db.DB.Exec(updateQuery, params...)
+    // Execute update, together with the moderation queue entry if it was flagged
+    tx, err := db.DB.Begin()
     if err != nil {
+        log.Printf("Database error starting transaction: %v", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update book"})
+        return
+    }
+    defer tx.Rollback()
+
+    _, err = tx.Exec(updateQuery, params...)
+    if err != nil {
+        log.Printf("Database error updating book: %v", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update book"})
+        return
+    }
+
+    if status == "pending_review" && check.flagged() {
+        if err := enqueueListingForModeration(tx, bookID, sellerID, check.Reasons); err != nil {
+            log.Printf("Database error queueing book for moderation: %v", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update book"})
+            return
+        }
+    }
+
+    if err := tx.Commit(); err != nil {
         log.Printf("Database error updating book: %v", err)
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update book"})
         return
     }
 
+    // Re-check a new image against the seller's other listings once it's hashed
+    if input.ImageURL != "" {
+        go recheckListingImage(bookID, sellerID, input.ImageURL)
+    }
+
     // Fetch updated book details
     var book models.Book
     err = db.DB.QueryRow(`
@@ -521,48 +656,41 @@ func UpdateBook(c *gin.Context) {
         return
     }
 
+    if status == "pending_review" && check.flagged() {
+        c.JSON(http.StatusAccepted, gin.H{
+            "message": "Listing submitted for review",
+            "reasons": check.Reasons,
+            "book":    book,
+        })
+        return
+    }
+
     c.JSON(http.StatusOK, book)
 }
 
-// Helper function to predict book price using ML service
-func getPredictedPrice(book models.BookInput) (float64, error) {
-        // Prepare request to ML service
-        requestData := models.PredictPriceRequest{
+// Helper function to predict book price using the in-process model, falling back
+// to the ML service and then the lookup table while no model has been trained
+func getPredictedPrice(ctx context.Context, book models.BookInput) (float64, error) {
+        if model := pricemodel.Current(); model != nil {
+                return model.Predict(pricemodel.Input{
+                        Title:     book.Title,
+                        Author:    book.Author,
+                        Genre:     book.Genre,
+                        Condition: book.Condition,
+                }), nil
+        }
+
+        // Call ML service; the client handles timeouts, retries and the circuit breaker
+        prediction, err := mlclient.Default().PredictPrice(ctx, models.PredictPriceRequest{
                 Title:     book.Title,
                 Author:    book.Author,
                 Genre:     book.Genre,
                 Condition: book.Condition,
-        }
-        
-        requestJSON, err := json.Marshal(requestData)
-        if err != nil {
-                return fallbackPricePrediction(book), nil
-        }
-
-        // Call ML service with timeout
-        client := &http.Client{
-                Timeout: 3 * time.Second, // 3 second timeout
-        }
-        
-        resp, err := client.Post("http://localhost:5001/predict-price", "application/json", bytes.NewBuffer(requestJSON))
+        })
         if err != nil {
                 log.Printf("ML service error: %v. Using fallback pricing.", err)
                 return fallbackPricePrediction(book), nil
         }
-        defer resp.Body.Close()
-
-        // Check response status
-        if resp.StatusCode != http.StatusOK {
-                log.Printf("ML service returned non-200 status code: %d. Using fallback pricing.", resp.StatusCode)
-                return fallbackPricePrediction(book), nil
-        }
-
-        // Parse response
-        var prediction models.PredictPriceResponse
-        if err := json.NewDecoder(resp.Body).Decode(&prediction); err != nil {
-                log.Printf("Error decoding ML service response: %v. Using fallback pricing.", err)
-                return fallbackPricePrediction(book), nil
-        }
 
         // Validate the predicted price
         if prediction.PredictedPrice <= 0 {
@@ -575,6 +703,23 @@ func getPredictedPrice(book models.BookInput) (float64, error) {
 
 // Fallback price prediction in case ML service is unavailable
 func fallbackPricePrediction(book models.BookInput) float64 {
+        basePrice, conditionFactor := fallbackPriceFactors(book)
+
+        // Calculate adjusted price
+        adjustedPrice := basePrice * conditionFactor
+        
+        // Ensure price is within reasonable bounds
+        if adjustedPrice < 100.0 {
+                adjustedPrice = 100.0
+        } else if adjustedPrice > 2000.0 {
+                adjustedPrice = 2000.0
+        }
+        
+        return math.Round(adjustedPrice)
+}
+
+// fallbackPriceFactors returns the lookup-table base price for the genre and the condition multiplier
+func fallbackPriceFactors(book models.BookInput) (float64, float64) {
         // Base price depends on genre
         basePrice := 350.0 // Default base price
         
@@ -608,55 +753,32 @@ func fallbackPricePrediction(book models.BookInput) float64 {
                 conditionFactor = 0.3
         }
         
-        // Calculate adjusted price
-        adjustedPrice := basePrice * conditionFactor
-        
-        // Ensure price is within reasonable bounds
-        if adjustedPrice < 100.0 {
-                adjustedPrice = 100.0
-        } else if adjustedPrice > 2000.0 {
-                adjustedPrice = 2000.0
-        }
-        
-        return math.Round(adjustedPrice)
+        return basePrice, conditionFactor
 }
 
 // Helper function to get book recommendations
-func getRecommendations(userID int) ([]models.Book, error) {
-        // Prepare request to recommender service
-        requestData := models.RecommendationRequest{
-                UserID: userID,
-        }
-        
-        requestJSON, err := json.Marshal(requestData)
-        if err != nil {
-                log.Printf("Error marshaling recommendation request: %v", err)
-                return getFallbackRecommendations()
+func getRecommendations(ctx context.Context, userID int) ([]models.RecommendedBook, error) {
+        // Personalised recommendations from the in-process collaborative filter
+        scored, err := recommender.Default.Recommend(db.DB, userID, recommendationLimit)
+        if err == nil {
+                recommendations := []models.RecommendedBook{}
+                for _, r := range scored {
+                        recommendations = append(recommendations, models.RecommendedBook{Book: r.Book, Reason: r.Reason})
+                }
+                return recommendations, nil
         }
+        log.Printf("Error getting in-process recommendations: %v", err)
 
         // Call recommender service
-        resp, err := http.Post("http://localhost:5001/recommend", "application/json", bytes.NewBuffer(requestJSON))
+        recommendations, err := mlclient.Default().Recommend(ctx, userID)
         if err != nil {
                 // Fallback to database query for top books if service is unavailable
-                log.Printf("Error connecting to recommendation service: %v", err)
-                return getFallbackRecommendations()
+                log.Printf("Error getting recommendations from ML service: %v", err)
+                newest, err := getFallbackRecommendations()
+                return withReason(newest, "New on BookBridge"), err
         }
-        defer resp.Body.Close()
 
-        // Check response status
-        if resp.StatusCode != http.StatusOK {
-                log.Printf("Recommendation service returned non-OK status: %d", resp.StatusCode)
-                return getFallbackRecommendations()
-        }
-
-        // Parse response
-        recommendations := []models.Book{} // Initialize as empty array
-        if err := json.NewDecoder(resp.Body).Decode(&recommendations); err != nil {
-                log.Printf("Error decoding recommendation response: %v", err)
-                return getFallbackRecommendations()
-        }
-
-        return recommendations, nil
+        return withReason(recommendations, "Recommended for you"), nil
 }
 
 // PredictPrice returns a book price prediction based on ML model
@@ -691,18 +813,15 @@ func PredictPrice(c *gin.Context) {
                 Price:     0, // Dummy value, not used for prediction
         }
 
-        // Call ML service to predict price
-        predictedPrice, err := getPredictedPrice(bookInput)
+        // Predict the price along with its range, explanation and comparable sales
+        estimate, err := estimatePrice(c.Request.Context(), bookInput)
         if err != nil {
                 log.Printf("Error predicting price: %v", err)
                 c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to predict book price"})
                 return
         }
 
-        // Return the predicted price
-        c.JSON(http.StatusOK, models.PredictPriceResponse{
-                PredictedPrice: predictedPrice,
-        })
+        c.JSON(http.StatusOK, estimate)
 }
 
 // Fallback recommendation method if ML service is unavailable
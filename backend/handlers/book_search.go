@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+
+	"reselling-app/db"
+	"reselling-app/models"
+)
+
+// bookFilter holds the listing filters shared by the books API and the chatbot's
+// search tool. Zero values mean "no filter".
+type bookFilter struct {
+	Genre    string
+	MinPrice float64
+	MaxPrice float64
+	Search   string // matched against title, author and description
+	Limit    int
+	ViewerID int // hides the listings of sellers this user has blocked
+}
+
+// searchBooks returns available listings matching a filter, newest first
+func searchBooks(filter bookFilter) ([]models.Book, error) {
+	sqlQuery := `
+		SELECT b.id, b.seller_id, u.username, b.title, b.author, b.description,
+		       b.price, b.image_url, b.genre, b.condition, b.status, b.created_at
+		FROM books b
+		JOIN users u ON b.seller_id = u.id
+		WHERE b.status = 'available'
+	`
+	var params []interface{}
+	addParam := func(value interface{}) int {
+		params = append(params, value)
+		return len(params)
+	}
+
+	if filter.Genre != "" {
+		sqlQuery += fmt.Sprintf(" AND b.genre = $%d", addParam(filter.Genre))
+	}
+	if filter.MinPrice > 0 {
+		sqlQuery += fmt.Sprintf(" AND b.price >= $%d", addParam(filter.MinPrice))
+	}
+	if filter.MaxPrice > 0 {
+		sqlQuery += fmt.Sprintf(" AND b.price <= $%d", addParam(filter.MaxPrice))
+	}
+	if filter.Search != "" {
+		n := addParam("%" + filter.Search + "%")
+		sqlQuery += fmt.Sprintf(" AND (b.title ILIKE $%d OR b.author ILIKE $%d OR b.description ILIKE $%d)", n, n, n)
+	}
+
+	if filter.ViewerID > 0 {
+		sqlQuery += fmt.Sprintf(" AND NOT EXISTS (SELECT 1 FROM user_blocks ub WHERE ub.blocker_id = $%d AND ub.blocked_id = b.seller_id)", addParam(filter.ViewerID))
+	}
+
+	sqlQuery += " ORDER BY b.created_at DESC"
+	if filter.Limit > 0 {
+		sqlQuery += fmt.Sprintf(" LIMIT $%d", addParam(filter.Limit))
+	}
+
+	rows, err := db.DB.Query(sqlQuery, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Initialize an empty array to avoid null JSON response
+	books := []models.Book{}
+	for rows.Next() {
+		var book models.Book
+		if err := rows.Scan(
+			&book.ID, &book.SellerID, &book.SellerUsername, &book.Title, &book.Author,
+			&book.Description, &book.Price, &book.ImageURL, &book.Genre, &book.Condition,
+			&book.Status, &book.CreatedAt,
+		); err != nil {
+			log.Printf("Error scanning book row: %v", err)
+			continue
+		}
+		books = append(books, book)
+	}
+	return books, rows.Err()
+}
@@ -2,9 +2,12 @@ package handlers
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"reselling-app/db"
@@ -23,12 +26,6 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-// Active connections by chat ID
-var activeConnections = make(map[int]map[*websocket.Conn]bool)
-
-// --- Community Chat ---
-var communityClients = make(map[*websocket.Conn]bool)
-
 // HandleWebSocket handles WebSocket connections for chat
 func HandleWebSocket(c *gin.Context) {
 	// Upgrade HTTP connection to WebSocket
@@ -43,7 +40,7 @@ func HandleWebSocket(c *gin.Context) {
 	token := c.Query("token")
 	if token == "" {
 		log.Printf("No token provided")
-		conn.WriteJSON(map[string]interface{}{"type": "error", "content": "Authentication required"})
+		conn.WriteJSON(wsError(models.WSErrorAuthRequired, 0, "Authentication required"))
 		return
 	}
 
@@ -51,32 +48,63 @@ func HandleWebSocket(c *gin.Context) {
 	claims, err := utils.ValidateToken(token)
 	if err != nil {
 		log.Printf("Invalid token: %v", err)
-		conn.WriteJSON(map[string]interface{}{"type": "error", "content": "Invalid authentication"})
+		conn.WriteJSON(wsError(models.WSErrorAuthRequired, 0, "Invalid authentication"))
 		return
 	}
 	userID := claims.UserID
 	role := claims.Role
 
-	// Get book and seller info from query parameters
+	// Get book and seller info, or an existing chat to join, from query parameters
 	bookIDStr := c.Query("book_id")
 	sellerIDStr := c.Query("seller_id")
+	chatIDStr := c.Query("chat_id")
+
+	// A reconnecting client passes the last message ID it has to get what it missed
+	since, err := strconv.Atoi(c.DefaultQuery("since", "0"))
+	if err != nil || since < 0 {
+		conn.WriteJSON(wsError(models.WSErrorInvalidRequest, 0, "Invalid since message ID"))
+		return
+	}
 
-	var bookID, sellerID int
+	var bookID, sellerID, chatID int
 	var bookTitle string
+	var chatCreated bool
+
+	if chatIDStr != "" && chatIDStr != "0" {
+		chatID, err = strconv.Atoi(chatIDStr)
+		if err != nil {
+			conn.WriteJSON(wsError(models.WSErrorInvalidRequest, 0, "Invalid chat ID"))
+			return
+		}
 
-	if bookIDStr != "" && sellerIDStr != "" {
+		// Both the buyer and the seller may open an existing chat
+		switch err := chatMember(chatID, userID); err {
+		case nil:
+		case errChatNotFound:
+			conn.WriteJSON(wsError(models.WSErrorNotFound, chatID, "Chat not found"))
+			return
+		case errNotChatMember:
+			log.Printf("User %d tried to open chat %d without being a member", userID, chatID)
+			conn.WriteJSON(wsError(models.WSErrorNotChatMember, chatID, "You are not a member of this chat"))
+			return
+		default:
+			log.Printf("Database error checking chat membership: %v", err)
+			conn.WriteJSON(wsError(models.WSErrorInternal, chatID, "Database error"))
+			return
+		}
+	} else if bookIDStr != "" && sellerIDStr != "" {
 		// Convert IDs to integers
 		bookID, err = strconv.Atoi(bookIDStr)
 		if err != nil {
 			log.Printf("Invalid book ID: %v", err)
-			conn.WriteJSON(map[string]interface{}{"type": "error", "content": "Invalid book ID"})
+			conn.WriteJSON(wsError(models.WSErrorInvalidRequest, 0, "Invalid book ID"))
 			return
 		}
 
 		sellerID, err = strconv.Atoi(sellerIDStr)
 		if err != nil {
 			log.Printf("Invalid seller ID: %v", err)
-			conn.WriteJSON(map[string]interface{}{"type": "error", "content": "Invalid seller ID"})
+			conn.WriteJSON(wsError(models.WSErrorInvalidRequest, 0, "Invalid seller ID"))
 			return
 		}
 
@@ -85,11 +113,11 @@ func HandleWebSocket(c *gin.Context) {
 		if err != nil {
 			if err == sql.ErrNoRows {
 				log.Printf("Book not found: %d", bookID)
-				conn.WriteJSON(map[string]interface{}{"type": "error", "content": "Book not found"})
+				conn.WriteJSON(wsError(models.WSErrorNotFound, 0, "Book not found"))
 				return
 			}
 			log.Printf("Database error fetching book details: %v", err)
-			conn.WriteJSON(map[string]interface{}{"type": "error", "content": "Database error"})
+			conn.WriteJSON(wsError(models.WSErrorInternal, 0, "Database error"))
 			return
 		}
 
@@ -97,16 +125,15 @@ func HandleWebSocket(c *gin.Context) {
 
 		// Check if user is either the seller or a buyer
 		if role == "seller" && userID != sellerID {
-			conn.WriteJSON(map[string]interface{}{"type": "error", "content": "You are not the seller of this book"})
+			conn.WriteJSON(wsError(models.WSErrorNotChatMember, 0, "You are not the seller of this book"))
 			return
 		}
 
-		// Get or create chat session
-		var chatID int
-
+		// Get or create chat session. Sellers have no chat until a buyer starts
+		// one; they join existing chats by chat_id.
 		log.Printf("Processing chat for user ID: %d, role: %s, book ID: %d, seller ID: %d", userID, role, bookID, sellerID)
 
-		if role == "buyer" {
+		if role == "buyer" && userID != sellerID {
 			// Check if chat already exists
 			err = db.DB.QueryRow(
 				"SELECT id FROM chats WHERE book_id = $1 AND buyer_id = $2 AND seller_id = $3",
@@ -115,6 +142,18 @@ func HandleWebSocket(c *gin.Context) {
 
 			if err != nil {
 				if err == sql.ErrNoRows {
+					// No new chats between users where either has blocked the other
+					blocked, err := usersBlocked(userID, sellerID)
+					if err != nil {
+						log.Printf("Database error checking blocks: %v", err)
+						conn.WriteJSON(wsError(models.WSErrorInternal, 0, "Database error"))
+						return
+					}
+					if blocked {
+						conn.WriteJSON(wsError(models.WSErrorBlocked, 0, "You can't start a chat with this seller"))
+						return
+					}
+
 					// Create new chat session
 					log.Printf("Creating new chat for buyer ID: %d with seller ID: %d about book ID: %d", userID, sellerID, bookID)
 					err = db.DB.QueryRow(
@@ -123,22 +162,14 @@ func HandleWebSocket(c *gin.Context) {
 					).Scan(&chatID)
 					if err != nil {
 						log.Printf("Database error creating chat: %v", err)
-						conn.WriteJSON(map[string]interface{}{"type": "error", "content": "Failed to create chat session"})
+						conn.WriteJSON(wsError(models.WSErrorInternal, 0, "Failed to create chat session"))
 						return
 					}
 					log.Printf("Created new chat with ID: %d", chatID)
-
-					// Notify the client that a new chat was created
-					conn.WriteJSON(map[string]interface{}{
-						"type":       "chat_created",
-						"chat_id":    chatID,
-						"book_id":    bookID,
-						"book_title": bookTitle,
-						"seller_id":  sellerID,
-					})
+					chatCreated = true
 				} else {
 					log.Printf("Database error checking chat: %v", err)
-					conn.WriteJSON(map[string]interface{}{"type": "error", "content": "Database error"})
+					conn.WriteJSON(wsError(models.WSErrorInternal, 0, "Database error"))
 					return
 				}
 			} else {
@@ -147,42 +178,147 @@ func HandleWebSocket(c *gin.Context) {
 		}
 	}
 
-	// Handle incoming messages
-	for {
-		var msg models.WebSocketMessage
-		err := conn.ReadJSON(&msg)
-		if err != nil {
-			log.Printf("Error reading message: %v", err)
-			break
+	// From here on only the client's writer goroutine writes to the connection.
+	// The connection may only use the chats bound to it.
+	client := chatHub.Register(conn, userID, claims.Username, 0)
+	presence.connect(userID)
+	defer presence.disconnect(userID)
+	chats := newChatBinding(client)
+	defer chats.close()
+	if chatCreated {
+		// Notify the client that a new chat was created
+		client.Send(map[string]interface{}{
+			"type":       "chat_created",
+			"chat_id":    chatID,
+			"book_id":    bookID,
+			"book_title": bookTitle,
+			"seller_id":  sellerID,
+		})
+	}
+	if chatID != 0 {
+		chats.bind(chatID)
+		if since > 0 {
+			chats.replay(chatID, since)
 		}
+	}
 
+	// Handle incoming messages
+	client.ReadMessages(func(msg models.WebSocketMessage) {
 		// Process message based on type
 		switch msg.Type {
+		case "join":
+			// Open another chat the user belongs to, such as a seller answering a
+			// buyer, replaying what was missed after msg.Since
+			if chats.join(msg.ChatID) && msg.Since > 0 {
+				chats.replay(msg.ChatID, msg.Since)
+			}
+
+		case "sync":
+			// Replay messages after msg.Since in a chat already joined
+			chatID, ok := chats.resolve(msg)
+			if !ok {
+				return
+			}
+			chats.replay(chatID, msg.Since)
+
 		case "message":
+			chatID, ok := chats.resolve(msg)
+			if !ok {
+				return
+			}
+			// Chats stay readable after a block, but neither side can post
+			blocked, err := chatBlocked(chatID)
+			if err != nil {
+				log.Printf("Database error checking blocks: %v", err)
+				client.SendError(models.WSErrorInternal, chatID, "Failed to send message")
+				return
+			}
+			if blocked {
+				client.SendError(models.WSErrorBlocked, chatID, "You can't send messages in this chat")
+				return
+			}
+
+			// Check the text and any image, book card or location it carries
+			problem, err := validateChatMessage(&msg, userID)
+			if err != nil {
+				log.Printf("Database error validating message: %v", err)
+				client.SendError(models.WSErrorInternal, chatID, "Failed to send message")
+				return
+			}
+			if problem != "" {
+				client.SendError(models.WSErrorInvalidRequest, chatID, problem)
+				return
+			}
+			if len(msg.ClientID) > maxClientMessageIDLength {
+				client.SendError(models.WSErrorInvalidRequest, chatID, "client_id is too long")
+				return
+			}
+
 			// Save message to database
-			err = db.DB.QueryRow(
-				"INSERT INTO messages (chat_id, sender_id, content) VALUES ($1, $2, $3) RETURNING id",
-				msg.ChatID, userID, msg.Content,
-			).Scan(&msg.ID)
+			msg.ChatID = chatID
+			msg.SenderID = userID
+			msg.SenderName = claims.Username
+			duplicate, err := saveChatMessage(&msg)
 			if err != nil {
 				log.Printf("Error saving message: %v", err)
-				conn.WriteJSON(map[string]interface{}{"type": "error", "content": "Failed to send message"})
-				continue
+				client.SendError(models.WSErrorInternal, chatID, "Failed to send message")
+				return
+			}
+			if duplicate {
+				// A retry of a message already stored; confirm it to the sender only
+				client.Send(msg)
+				return
 			}
 
-			// Broadcast message to all connected clients in the chat
-			msg.SenderID = userID
-			msg.Timestamp = time.Now()
-			broadcastToChat(msg.ChatID, msg)
+			// Broadcast message to all connected clients in the chat, including the sender
+			chatHub.Broadcast(chatID, msg)
+			notifyUndelivered(msg)
+
+		case "read":
+			// Mark the other participant's messages read, up to msg.ID if given
+			chatID, ok := chats.resolve(msg)
+			if !ok {
+				return
+			}
+			lastRead, err := markChatRead(chatID, userID, msg.ID)
+			if err != nil {
+				log.Printf("Database error marking messages read: %v", err)
+				client.SendError(models.WSErrorInternal, chatID, "Failed to mark messages read")
+				return
+			}
+			if err := clearNotifications(userID, "chat_message", chatID); err != nil {
+				log.Printf("Database error clearing notifications: %v", err)
+			}
+			if lastRead > 0 {
+				// Tell the sender their messages up to lastRead were read
+				chatHub.Broadcast(chatID, models.WebSocketMessage{
+					ID:        lastRead,
+					Type:      "read",
+					ChatID:    chatID,
+					SenderID:  userID,
+					Timestamp: time.Now(),
+				})
+			}
 
 		case "typing":
-			// Handle typing indicator
-			// You can implement this if needed
+			// Relay typing indicators, at most one per typingThrottle
+			chatID, ok := chats.resolve(msg)
+			if !ok || !chats.typing(chatID) {
+				return
+			}
+			chatHub.Broadcast(chatID, models.WebSocketMessage{
+				Type:       "typing",
+				ChatID:     chatID,
+				SenderID:   userID,
+				SenderName: claims.Username,
+				Timestamp:  time.Now(),
+			})
 
 		default:
 			log.Printf("Unknown message type: %s", msg.Type)
+			client.SendError(models.WSErrorInvalidRequest, msg.ChatID, "Unknown message type")
 		}
-	}
+	})
 }
 
 // min returns the minimum of two integers
@@ -196,7 +332,8 @@ func min(a, b int) int {
 // Helper function to get chat history
 func getChatHistory(chatID int) ([]models.ChatMessage, error) {
 	rows, err := db.DB.Query(`
-			SELECT m.id, m.chat_id, m.sender_id, u.username, m.content, m.created_at
+			SELECT m.id, m.chat_id, m.sender_id, u.username, m.kind, m.payload, m.content,
+			       COALESCE(m.client_message_id, ''), m.created_at, m.read_at
 			FROM messages m
 			JOIN users u ON m.sender_id = u.id
 			WHERE m.chat_id = $1
@@ -211,116 +348,197 @@ func getChatHistory(chatID int) ([]models.ChatMessage, error) {
 	var messages []models.ChatMessage
 	for rows.Next() {
 		var msg models.ChatMessage
+		var payload []byte
 		if err := rows.Scan(
-			&msg.ID, &msg.ChatID, &msg.SenderID, &msg.SenderName, &msg.Content, &msg.CreatedAt,
+			&msg.ID, &msg.ChatID, &msg.SenderID, &msg.SenderName, &msg.Kind, &payload, &msg.Content,
+			&msg.ClientID, &msg.CreatedAt, &msg.ReadAt,
 		); err != nil {
 			log.Printf("Error scanning message row: %v", err)
 			continue
 		}
+		msg.Payload = decodeChatPayload(payload)
 		messages = append(messages, msg)
 	}
 
+	// Shared listings show their current price and status
+	refreshBookCards(messages)
+
 	return messages, nil
 }
 
-// Helper function to send error message to client
-func sendErrorMessage(conn *websocket.Conn, errorMsg string) {
-	errMsg := models.WebSocketMessage{
-		Type:      "error",
-		Content:   errorMsg,
-		Timestamp: time.Now(),
-	}
-	if err := conn.WriteJSON(errMsg); err != nil {
-		log.Printf("Error sending error message: %v", err)
-	}
+const (
+	// Chats returned per page of a user's chat list, by default and at most
+	chatListLimit     = 20
+	chatListPageLimit = 100
+)
+
+// chatCursor is where a page of the chat list starts: after the chat with
+// this last activity and ID. Its string form is the activity in Unix
+// microseconds, which Postgres timestamps hold exactly, and the chat ID.
+type chatCursor struct {
+	Activity time.Time
+	ChatID   int
 }
 
-// Helper function to broadcast message to all clients in a chat
-func broadcastToChat(chatID int, message models.WebSocketMessage) {
-	if connections, ok := activeConnections[chatID]; ok {
-		for conn := range connections {
-			if err := conn.WriteJSON(message); err != nil {
-				log.Printf("Broadcast error: %v", err)
-				conn.Close()
-				delete(connections, conn)
-			}
-		}
+func (c chatCursor) String() string {
+	return fmt.Sprintf("%d_%d", c.Activity.UnixMicro(), c.ChatID)
+}
+
+// parseChatCursor reads a cursor from its string form
+func parseChatCursor(s string) (chatCursor, error) {
+	micros, id, ok := strings.Cut(s, "_")
+	if !ok {
+		return chatCursor{}, errors.New("malformed chat cursor")
+	}
+	activity, err := strconv.ParseInt(micros, 10, 64)
+	if err != nil {
+		return chatCursor{}, err
 	}
+	chatID, err := strconv.Atoi(id)
+	if err != nil {
+		return chatCursor{}, err
+	}
+	return chatCursor{Activity: time.UnixMicro(activity), ChatID: chatID}, nil
 }
 
-// GetUserChats returns all chat sessions for a user
-func GetUserChats(c *gin.Context) {
-	userID, _ := c.Get("userID")
-	userRole, _ := c.Get("userRole")
-
-	var rows *sql.Rows
-	var err error
-
-	// Different query based on user role
-	if userRole == "buyer" {
-		rows, err = db.DB.Query(`
-				SELECT c.id, c.book_id, b.title, c.buyer_id, u1.username, c.seller_id, u2.username, c.created_at
-				FROM chats c
-				JOIN books b ON c.book_id = b.id
-				JOIN users u1 ON c.buyer_id = u1.id
-				JOIN users u2 ON c.seller_id = u2.id
-				WHERE c.buyer_id = $1
-				ORDER BY c.created_at DESC`,
-			userID,
-		)
-	} else {
-		rows, err = db.DB.Query(`
-				SELECT c.id, c.book_id, b.title, c.buyer_id, u1.username, c.seller_id, u2.username, c.created_at
-				FROM chats c
-				JOIN books b ON c.book_id = b.id
-				JOIN users u1 ON c.buyer_id = u1.id
-				JOIN users u2 ON c.seller_id = u2.id
-				WHERE c.seller_id = $1
-				ORDER BY c.created_at DESC`,
-			userID,
-		)
+// userChatSessions returns a page of the chats a user takes part in, most
+// recently active first, starting after the before cursor when it is not nil,
+// and the number of chats in the whole list, which the cursor doesn't change. Each chat comes with its last
+// message, unread count and the other participant's name and presence, all
+// from one query. unanswered keeps only chats whose last message came from
+// the other participant.
+func userChatSessions(userID int, unanswered bool, before *chatCursor, limit int) ([]models.ChatSession, int, error) {
+	var beforeActivity interface{}
+	var beforeChatID int
+	if before != nil {
+		beforeActivity, beforeChatID = before.Activity, before.ChatID
 	}
 
+	rows, err := db.DB.Query(`
+		SELECT l.id, l.book_id, l.title, l.buyer_id, l.buyer_name, l.seller_id, l.seller_name, l.created_at,
+		       l.counterpart_id, l.counterpart_name, l.counterpart_online, l.counterpart_last_seen,
+		       l.last_id, l.last_sender_id, l.last_sender_name, l.last_kind, l.last_content, l.last_created_at,
+		       l.activity, l.total,
+		       (SELECT COUNT(*) FROM messages m
+		        WHERE m.chat_id = l.id AND m.sender_id <> $1 AND m.read_at IS NULL),
+		       EXISTS (SELECT 1 FROM chat_mutes cm WHERE cm.chat_id = l.id AND cm.user_id = $1),
+		       EXISTS (SELECT 1 FROM user_blocks ub
+		               WHERE (ub.blocker_id = l.buyer_id AND ub.blocked_id = l.seller_id)
+		                  OR (ub.blocker_id = l.seller_id AND ub.blocked_id = l.buyer_id))
+		FROM (
+			SELECT c.id, c.book_id, b.title, c.buyer_id, buyer.username AS buyer_name,
+			       c.seller_id, seller.username AS seller_name, c.created_at,
+			       cp.id AS counterpart_id, cp.username AS counterpart_name,
+			       COALESCE(cp.online_until > NOW(), false) AS counterpart_online,
+			       cp.last_seen_at AS counterpart_last_seen,
+			       last.id AS last_id, last.sender_id AS last_sender_id, last.sender_name AS last_sender_name,
+			       last.kind AS last_kind, last.content AS last_content, last.created_at AS last_created_at,
+			       COALESCE(last.created_at, c.created_at) AS activity,
+			       COUNT(*) OVER () AS total
+			FROM chats c
+			JOIN books b ON b.id = c.book_id
+			JOIN users buyer ON buyer.id = c.buyer_id
+			JOIN users seller ON seller.id = c.seller_id
+			JOIN users cp ON cp.id = CASE WHEN c.buyer_id = $1 THEN c.seller_id ELSE c.buyer_id END
+			LEFT JOIN LATERAL (
+				SELECT m.id, m.sender_id, u.username AS sender_name, m.kind, m.content, m.created_at
+				FROM messages m
+				JOIN users u ON u.id = m.sender_id
+				WHERE m.chat_id = c.id
+				ORDER BY m.created_at DESC, m.id DESC
+				LIMIT 1
+			) last ON true
+			WHERE (c.buyer_id = $1 OR c.seller_id = $1)
+			  AND (NOT $2 OR last.sender_id <> $1)
+		) l
+		WHERE $3::timestamptz IS NULL OR (l.activity, l.id) < ($3::timestamptz, $4)
+		ORDER BY l.activity DESC, l.id DESC
+		LIMIT $5`,
+		userID, unanswered, beforeActivity, beforeChatID, limit,
+	)
 	if err != nil {
-		log.Printf("Database error fetching chats: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chat sessions"})
-		return
+		return nil, 0, err
 	}
 	defer rows.Close()
 
-	var chats []models.ChatSession
+	chats := []models.ChatSession{}
+	total := 0
 	for rows.Next() {
 		var chat models.ChatSession
+		var lastSeen sql.NullTime
+		var lastID, lastSenderID sql.NullInt64
+		var lastSenderName, lastKind, lastContent sql.NullString
+		var lastCreatedAt sql.NullTime
 		if err := rows.Scan(
 			&chat.ChatID, &chat.BookID, &chat.BookTitle, &chat.BuyerID, &chat.BuyerName,
 			&chat.SellerID, &chat.SellerName, &chat.CreatedAt,
+			&chat.Counterpart.UserID, &chat.CounterpartName, &chat.Counterpart.Online, &lastSeen,
+			&lastID, &lastSenderID, &lastSenderName, &lastKind, &lastContent, &lastCreatedAt,
+			&chat.LastActivityAt, &total, &chat.UnreadCount, &chat.Muted, &chat.Blocked,
 		); err != nil {
-			log.Printf("Error scanning chat row: %v", err)
-			continue
+			return nil, 0, err
+		}
+		if lastSeen.Valid {
+			chat.Counterpart.LastSeenAt = &lastSeen.Time
+		}
+		if lastID.Valid {
+			chat.LastMessage = &models.ChatMessage{
+				ID:         int(lastID.Int64),
+				ChatID:     chat.ChatID,
+				SenderID:   int(lastSenderID.Int64),
+				SenderName: lastSenderName.String,
+				Kind:       lastKind.String,
+				Content:    lastContent.String,
+				CreatedAt:  lastCreatedAt.Time,
+			}
+			chat.AwaitingReply = chat.LastMessage.SenderID != userID
 		}
+		chats = append(chats, chat)
+	}
+	return chats, total, rows.Err()
+}
 
-		// Get last message preview
-		var lastMessage models.ChatMessage
-		err := db.DB.QueryRow(`
-				SELECT m.id, m.sender_id, u.username, m.content, m.created_at
-				FROM messages m
-				JOIN users u ON m.sender_id = u.id
-				WHERE m.chat_id = $1
-				ORDER BY m.created_at DESC
-				LIMIT 1`,
-			chat.ChatID,
-		).Scan(
-			&lastMessage.ID, &lastMessage.SenderID, &lastMessage.SenderName,
-			&lastMessage.Content, &lastMessage.CreatedAt,
-		)
-		if err == nil {
-			chat.Messages = []models.ChatMessage{lastMessage}
+// GetUserChats returns a page of the user's chats, most recently active first,
+// each with its last message, unread count, the other participant's name and
+// presence, and whether the chat is muted or blocked. ?before= takes the
+// next_before of the previous page and ?limit= sets the page size.
+// ?unanswered=true lists only chats whose last message came from the other participant.
+func GetUserChats(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	var before *chatCursor
+	if value := c.Query("before"); value != "" {
+		cursor, err := parseChatCursor(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid before cursor"})
+			return
 		}
+		before = &cursor
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(chatListLimit)))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+	if limit > chatListPageLimit {
+		limit = chatListPageLimit
+	}
 
-		chats = append(chats, chat)
+	// One extra chat tells whether there is another page
+	chats, total, err := userChatSessions(userID.(int), c.Query("unanswered") == "true", before, limit+1)
+	if err != nil {
+		log.Printf("Database error fetching chats: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chat sessions"})
+		return
 	}
 
-	c.JSON(http.StatusOK, chats)
+	page := models.ChatSessionPage{Chats: chats, Total: total}
+	if len(chats) > limit {
+		page.Chats = chats[:limit]
+		last := page.Chats[limit-1]
+		page.NextBefore = chatCursor{Activity: last.LastActivityAt, ChatID: last.ChatID}.String()
+	}
+	c.JSON(http.StatusOK, page)
 }
 
 // GetChatMessages returns all messages for a specific chat
@@ -366,62 +584,3 @@ func GetChatMessages(c *gin.Context) {
 	}
 	c.JSON(http.StatusOK, messages)
 }
-
-// HandleCommunityWebSocket handles WebSocket connections for community chat
-func HandleCommunityWebSocket(c *gin.Context) {
-	// Upgrade HTTP connection to WebSocket
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-	if err != nil {
-		log.Printf("[COMMUNITY] Failed to upgrade connection: %v", err)
-		return
-	}
-	defer conn.Close()
-
-	// Authenticate user
-	token := c.Query("token")
-	if token == "" {
-		conn.WriteJSON(map[string]interface{}{"type": "error", "content": "Authentication required"})
-		return
-	}
-	claims, err := utils.ValidateToken(token)
-	if err != nil {
-		conn.WriteJSON(map[string]interface{}{"type": "error", "content": "Invalid authentication"})
-		return
-	}
-	userID := claims.UserID
-	username := claims.Username
-
-	// Register client
-	communityClients[conn] = true
-	log.Printf("[COMMUNITY] User %s (ID %d) joined community chat", username, userID)
-	defer func() {
-		delete(communityClients, conn)
-		log.Printf("[COMMUNITY] User %s (ID %d) left community chat", username, userID)
-	}()
-
-	// Listen for messages
-	for {
-		var msg models.WebSocketMessage
-		err := conn.ReadJSON(&msg)
-		if err != nil {
-			log.Printf("[COMMUNITY] Error reading message: %v", err)
-			break
-		}
-		if msg.Type == "message" {
-			msg.SenderID = userID
-			msg.SenderName = username
-			msg.Timestamp = time.Now()
-			broadcastCommunityMessage(msg)
-		}
-	}
-}
-
-func broadcastCommunityMessage(msg models.WebSocketMessage) {
-	for conn := range communityClients {
-		if err := conn.WriteJSON(msg); err != nil {
-			log.Printf("[COMMUNITY] Broadcast error: %v", err)
-			conn.Close()
-			delete(communityClients, conn)
-		}
-	}
-}
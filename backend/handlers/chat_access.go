@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"reselling-app/db"
+	"reselling-app/models"
+)
+
+var (
+	// errChatNotFound is returned for a chat ID with no chat
+	errChatNotFound = errors.New("chat not found")
+	// errNotChatMember is returned when the user is neither the buyer nor the seller of a chat
+	errNotChatMember = errors.New("not a member of this chat")
+)
+
+// chatMember checks that a user is the buyer or seller of a chat
+func chatMember(chatID, userID int) error {
+	var buyerID, sellerID int
+	err := db.DB.QueryRow("SELECT buyer_id, seller_id FROM chats WHERE id = $1", chatID).Scan(&buyerID, &sellerID)
+	if err == sql.ErrNoRows {
+		return errChatNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if userID != buyerID && userID != sellerID {
+		return errNotChatMember
+	}
+	return nil
+}
+
+// chatBinding is the set of chats a connection may read and post in. It is
+// only used from the connection's read loop, so it needs no locking.
+type chatBinding struct {
+	client *HubClient
+	chats  map[int]bool
+	// current is the chat used for messages that don't name one
+	current int
+	// lastTyping is when a typing indicator was last relayed to each chat
+	lastTyping map[int]time.Time
+}
+
+func newChatBinding(client *HubClient) *chatBinding {
+	return &chatBinding{client: client, chats: make(map[int]bool), lastTyping: make(map[int]time.Time)}
+}
+
+// bind adds a chat the user is known to belong to, such as one just created for them
+func (b *chatBinding) bind(chatID int) {
+	if !b.chats[chatID] {
+		b.chats[chatID] = true
+		chatHub.Join(b.client, chatID)
+		presence.view(b.client.UserID, chatID)
+	}
+	b.current = chatID
+	b.client.Send(models.WebSocketMessage{Type: "chat_joined", ChatID: chatID, Timestamp: time.Now()})
+
+	// Show whether the other participant is around
+	status, err := counterpartPresence(chatID, b.client.UserID)
+	if err != nil {
+		log.Printf("Database error fetching presence: %v", err)
+		return
+	}
+	b.client.Send(models.WebSocketMessage{Type: "presence", ChatID: chatID, SenderID: status.UserID, Timestamp: time.Now(), Data: status})
+}
+
+// close marks the connection's chats closed once it ends
+func (b *chatBinding) close() {
+	for chatID := range b.chats {
+		presence.leave(b.client.UserID, chatID)
+	}
+}
+
+// typing reports whether a typing indicator for a chat should be relayed,
+// dropping those sent within typingThrottle of the last one
+func (b *chatBinding) typing(chatID int) bool {
+	now := time.Now()
+	if now.Sub(b.lastTyping[chatID]) < typingThrottle {
+		return false
+	}
+	b.lastTyping[chatID] = now
+	return true
+}
+
+// join binds a chat after checking the user belongs to it, sending a typed
+// error frame and returning false if they don't
+func (b *chatBinding) join(chatID int) bool {
+	if chatID <= 0 {
+		b.client.SendError(models.WSErrorInvalidRequest, 0, "A chat_id is required to join a chat")
+		return false
+	}
+	switch err := chatMember(chatID, b.client.UserID); err {
+	case nil:
+		b.bind(chatID)
+		return true
+	case errChatNotFound:
+		b.client.SendError(models.WSErrorNotFound, chatID, "Chat not found")
+	case errNotChatMember:
+		log.Printf("User %d tried to join chat %d without being a member", b.client.UserID, chatID)
+		b.client.SendError(models.WSErrorNotChatMember, chatID, "You are not a member of this chat")
+	default:
+		log.Printf("Database error checking chat membership: %v", err)
+		b.client.SendError(models.WSErrorInternal, chatID, "Database error")
+	}
+	return false
+}
+
+// resolve returns the chat an inbound message is for, which must be bound to
+// the connection. A message without a chat_id goes to the current chat.
+func (b *chatBinding) resolve(msg models.WebSocketMessage) (int, bool) {
+	chatID := msg.ChatID
+	if chatID == 0 {
+		chatID = b.current
+	}
+	if chatID == 0 {
+		b.client.SendError(models.WSErrorInvalidRequest, 0, "Join a chat before sending messages")
+		return 0, false
+	}
+	if !b.chats[chatID] {
+		log.Printf("User %d sent a %s to chat %d without joining it", b.client.UserID, msg.Type, chatID)
+		b.client.SendError(models.WSErrorChatNotJoined, chatID, "Join this chat before sending messages to it")
+		return 0, false
+	}
+	return chatID, true
+}
+
+// chatReplayBatch is the most missed messages replayed at once. It stays well
+// under wsSendBuffer so a replay can't get the client evicted as slow.
+const chatReplayBatch = 32
+
+// replay sends the messages in a chat after since, oldest first, then a
+// "synced" frame with the last ID sent and whether more remain; the client
+// syncs again from that ID to get the rest. The connection has already joined
+// the chat, so live messages may arrive alongside the replay and clients
+// should drop message IDs they have already seen.
+func (b *chatBinding) replay(chatID, since int) {
+	rows, err := db.DB.Query(`
+		SELECT m.id, m.sender_id, u.username, m.kind, m.payload, m.content, COALESCE(m.client_message_id, ''), m.created_at
+		FROM messages m
+		JOIN users u ON m.sender_id = u.id
+		WHERE m.chat_id = $1 AND m.id > $2
+		ORDER BY m.id
+		LIMIT $3`,
+		chatID, since, chatReplayBatch+1,
+	)
+	if err != nil {
+		log.Printf("Database error fetching missed messages: %v", err)
+		b.client.SendError(models.WSErrorInternal, chatID, "Failed to fetch missed messages")
+		return
+	}
+	defer rows.Close()
+
+	last, sent, more := since, 0, false
+	for rows.Next() {
+		if sent == chatReplayBatch {
+			more = true
+			break
+		}
+		msg := models.WebSocketMessage{Type: "message", ChatID: chatID}
+		var payload []byte
+		if err := rows.Scan(&msg.ID, &msg.SenderID, &msg.SenderName, &msg.Kind, &payload, &msg.Content, &msg.ClientID, &msg.Timestamp); err != nil {
+			log.Printf("Error scanning message row: %v", err)
+			continue
+		}
+		msg.Payload = decodeChatPayload(payload)
+		b.client.Send(msg)
+		last = msg.ID
+		sent++
+	}
+
+	b.client.Send(models.WebSocketMessage{
+		ID:        last,
+		Type:      "synced",
+		ChatID:    chatID,
+		Timestamp: time.Now(),
+		Data:      map[string]interface{}{"replayed": sent, "more": more},
+	})
+}
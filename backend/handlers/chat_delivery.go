@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"reselling-app/db"
+	"reselling-app/models"
+)
+
+const (
+	// Longest client-generated message ID accepted
+	maxClientMessageIDLength = 64
+	// Characters of a message shown in its notification
+	notificationPreviewLength = 100
+)
+
+// saveChatMessage stores a chat message, setting its ID and timestamp. A message
+// whose client ID the sender already used in the same chat is a retry: nothing
+// is stored, msg is filled in from the original and duplicate is true.
+func saveChatMessage(msg *models.WebSocketMessage) (duplicate bool, err error) {
+	var clientID interface{}
+	if msg.ClientID != "" {
+		clientID = msg.ClientID
+	}
+	payload, err := encodeChatPayload(msg.Payload)
+	if err != nil {
+		return false, err
+	}
+
+	err = db.DB.QueryRow(`
+		INSERT INTO messages (chat_id, sender_id, kind, payload, content, client_message_id)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (chat_id, sender_id, client_message_id) DO NOTHING
+		RETURNING id, created_at`,
+		msg.ChatID, msg.SenderID, msg.Kind, payload, msg.Content, clientID,
+	).Scan(&msg.ID, &msg.Timestamp)
+	if err != sql.ErrNoRows {
+		return false, err
+	}
+
+	var stored []byte
+	err = db.DB.QueryRow(
+		"SELECT id, kind, payload, content, created_at FROM messages WHERE chat_id = $1 AND sender_id = $2 AND client_message_id = $3",
+		msg.ChatID, msg.SenderID, msg.ClientID,
+	).Scan(&msg.ID, &msg.Kind, &stored, &msg.Content, &msg.Timestamp)
+	msg.Payload = decodeChatPayload(stored)
+	return true, err
+}
+
+// notifyUndelivered notifies the other participant of a chat message when
+// they don't have the chat open to receive it and haven't muted it. Being
+// online with other chats open doesn't count. Messages in the same chat fold
+// into one notification until it is read.
+func notifyUndelivered(msg models.WebSocketMessage) {
+	recipient, err := counterpartPresence(msg.ChatID, msg.SenderID)
+	if err != nil {
+		log.Printf("Database error fetching presence: %v", err)
+		return
+	}
+	viewing, err := viewingChat(recipient.UserID, msg.ChatID)
+	if err != nil {
+		log.Printf("Database error checking chat viewers: %v", err)
+		return
+	}
+	if viewing {
+		return
+	}
+	muted, err := chatMuted(recipient.UserID, msg.ChatID)
+	if err != nil {
+		log.Printf("Database error checking chat mute: %v", err)
+		return
+	}
+	if muted {
+		return
+	}
+
+	preview := []rune(msg.Content)
+	if len(preview) > notificationPreviewLength {
+		preview = append(preview[:notificationPreviewLength], '…')
+	}
+	err = notify(
+		recipient.UserID, "chat_message", msg.ChatID,
+		fmt.Sprintf("New message from %s", msg.SenderName),
+		string(preview),
+		fmt.Sprintf("chat.html?chat_id=%d", msg.ChatID),
+	)
+	if err != nil {
+		log.Printf("Database error creating notification: %v", err)
+	}
+}
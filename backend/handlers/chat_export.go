@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"reselling-app/db"
+	"reselling-app/models"
+)
+
+// loadChatTranscript loads a chat and all its messages, live and archived, oldest first
+func loadChatTranscript(chatID int) (models.ChatTranscript, error) {
+	transcript := models.ChatTranscript{ChatID: chatID, ExportedAt: time.Now().UTC(), Messages: []models.ChatMessage{}}
+	err := db.DB.QueryRow(`
+		SELECT c.book_id, b.title, c.buyer_id, buyer.username, c.seller_id, seller.username, c.created_at
+		FROM chats c
+		JOIN books b ON c.book_id = b.id
+		JOIN users buyer ON c.buyer_id = buyer.id
+		JOIN users seller ON c.seller_id = seller.id
+		WHERE c.id = $1`,
+		chatID,
+	).Scan(
+		&transcript.BookID, &transcript.BookTitle, &transcript.BuyerID, &transcript.BuyerName,
+		&transcript.SellerID, &transcript.SellerName, &transcript.CreatedAt,
+	)
+	if err != nil {
+		return transcript, err
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT m.id, m.sender_id, u.username, m.kind, m.payload, m.content, m.created_at, m.read_at, m.archived
+		FROM (
+			SELECT id, sender_id, kind, payload, content, created_at, read_at, FALSE AS archived
+			FROM messages WHERE chat_id = $1
+			UNION ALL
+			SELECT id, sender_id, kind, payload, content, created_at, read_at, TRUE
+			FROM archived_messages WHERE chat_id = $1
+		) m
+		JOIN users u ON m.sender_id = u.id
+		ORDER BY m.created_at, m.id`,
+		chatID,
+	)
+	if err != nil {
+		return transcript, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		msg := models.ChatMessage{ChatID: chatID}
+		var payload []byte
+		if err := rows.Scan(
+			&msg.ID, &msg.SenderID, &msg.SenderName, &msg.Kind, &payload, &msg.Content,
+			&msg.CreatedAt, &msg.ReadAt, &msg.Archived,
+		); err != nil {
+			return transcript, err
+		}
+		msg.Payload = decodeChatPayload(payload)
+		transcript.Messages = append(transcript.Messages, msg)
+	}
+	return transcript, rows.Err()
+}
+
+// transcriptText renders a transcript as plain text, one message per line in UTC
+func transcriptText(t models.ChatTranscript) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "BookBridge chat #%d about \"%s\" (book #%d)\n", t.ChatID, t.BookTitle, t.BookID)
+	fmt.Fprintf(&b, "Buyer: %s (user #%d)\n", t.BuyerName, t.BuyerID)
+	fmt.Fprintf(&b, "Seller: %s (user #%d)\n", t.SellerName, t.SellerID)
+	fmt.Fprintf(&b, "Started: %s\n", t.CreatedAt.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "Exported: %s\n\n", t.ExportedAt.Format(time.RFC3339))
+
+	for _, msg := range t.Messages {
+		line := msg.Content
+		if p := msg.Payload; p != nil {
+			switch {
+			case p.Image != nil:
+				line += fmt.Sprintf(" [photo: %s]", p.Image.URL)
+			case p.Book != nil:
+				line += fmt.Sprintf(" [listing #%d: %s, %.2f]", p.Book.BookID, p.Book.Title, p.Book.Price)
+			case p.Location != nil:
+				line += fmt.Sprintf(" [location: %.6f, %.6f]", p.Location.Latitude, p.Location.Longitude)
+			}
+		}
+		fmt.Fprintf(&b, "[%s] %s: %s\n", msg.CreatedAt.UTC().Format("2006-01-02 15:04:05"), msg.SenderName, line)
+	}
+	return b.String()
+}
+
+// ExportChat downloads a chat's transcript, including archived messages, for
+// one of its participants. ?format=text gives plain text instead of JSON.
+func ExportChat(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	chatID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "text" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or text"})
+		return
+	}
+
+	switch err := chatMember(chatID, userID.(int)); err {
+	case nil:
+	case errChatNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
+		return
+	case errNotChatMember:
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this chat"})
+		return
+	default:
+		log.Printf("Database error checking chat membership: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	transcript, err := loadChatTranscript(chatID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
+			return
+		}
+		log.Printf("Database error exporting chat: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export chat"})
+		return
+	}
+
+	if format == "text" {
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="bookbridge-chat-%d.txt"`, chatID))
+		c.String(http.StatusOK, transcriptText(transcript))
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="bookbridge-chat-%d.json"`, chatID))
+	c.JSON(http.StatusOK, transcript)
+}
@@ -0,0 +1,405 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"reselling-app/models"
+	"reselling-app/pubsub"
+)
+
+const (
+	// Time allowed to write a frame to a client
+	wsWriteWait = 10 * time.Second
+	// Time allowed between pongs before a client is considered gone
+	wsPongWait = 60 * time.Second
+	// How often clients are pinged; must be shorter than wsPongWait
+	wsPingPeriod = wsPongWait * 9 / 10
+	// Largest frame accepted from a client
+	wsMaxMessageSize = 16 << 10
+	// Frames queued for a client before it is evicted as a slow consumer
+	wsSendBuffer = 64
+)
+
+// HubClient is one WebSocket connection registered with a Hub. Only its
+// writer goroutine writes to the connection; everything else queues frames.
+type HubClient struct {
+	hub      *Hub
+	conn     *websocket.Conn
+	UserID   int
+	Username string
+	// blocked holds the users whose broadcasts this client skips. Only the
+	// hub's run loop reads or replaces it.
+	blocked map[int]bool
+
+	mu     sync.Mutex
+	send   chan []byte
+	closed bool
+}
+
+// hubMembership adds a client to a room
+type hubMembership struct {
+	client *HubClient
+	room   int
+}
+
+// hubBroadcast is an encoded frame for every client in a room, from sender
+// or from no one in particular when sender is 0
+type hubBroadcast struct {
+	room    int
+	sender  int
+	payload []byte
+}
+
+// hubBlocks replaces the users a user's clients skip broadcasts from
+type hubBlocks struct {
+	userID  int
+	blocked map[int]bool
+}
+
+// hubKick disconnects a user's clients in a room, or in every room when room
+// is 0, after sending them a notice
+type hubKick struct {
+	room   int
+	userID int
+	notice []byte
+}
+
+// Hub fans messages out to the clients in each room. Rooms are chat IDs for
+// buyer-seller chats and a fixed room for the community chat. Broadcasts go
+// through a broker so clients on other backend instances receive them too.
+// All hub state is owned by the run goroutine and changed only through its channels.
+type Hub struct {
+	name       string
+	broker     pubsub.Broker
+	register   chan hubMembership
+	unregister chan *HubClient
+	join       chan hubMembership
+	broadcast  chan hubBroadcast
+	kick       chan hubKick
+	blocks     chan hubBlocks
+
+	rooms   map[int]map[*HubClient]bool
+	clients map[*HubClient]map[int]bool
+}
+
+// NewHub creates a hub, subscribes it to its topic on the broker and starts its run loop
+func NewHub(name string, broker pubsub.Broker) (*Hub, error) {
+	h := &Hub{
+		name:       name,
+		broker:     broker,
+		register:   make(chan hubMembership),
+		unregister: make(chan *HubClient),
+		join:       make(chan hubMembership),
+		broadcast:  make(chan hubBroadcast, 256),
+		kick:       make(chan hubKick, 16),
+		blocks:     make(chan hubBlocks),
+		rooms:      make(map[int]map[*HubClient]bool),
+		clients:    make(map[*HubClient]map[int]bool),
+	}
+	err := broker.Subscribe(name, func(room int, payload json.RawMessage) {
+		// Frames without a sender_id come from no one and reach every client
+		var frame struct {
+			SenderID int `json:"sender_id"`
+		}
+		json.Unmarshal(payload, &frame)
+		h.broadcast <- hubBroadcast{room: room, sender: frame.SenderID, payload: payload}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = broker.Subscribe(name+"_kick", func(room int, payload json.RawMessage) {
+		var kick struct {
+			UserID int             `json:"user_id"`
+			Notice json.RawMessage `json:"notice"`
+		}
+		if err := json.Unmarshal(payload, &kick); err != nil {
+			log.Printf("[%s] Error decoding kick: %v", name, err)
+			return
+		}
+		h.kick <- hubKick{room: room, userID: kick.UserID, notice: kick.Notice}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = broker.Subscribe(name+"_blocks", func(room int, payload json.RawMessage) {
+		var update struct {
+			UserID  int   `json:"user_id"`
+			Blocked []int `json:"blocked"`
+		}
+		if err := json.Unmarshal(payload, &update); err != nil {
+			log.Printf("[%s] Error decoding block update: %v", name, err)
+			return
+		}
+		blocked := make(map[int]bool, len(update.Blocked))
+		for _, id := range update.Blocked {
+			blocked[id] = true
+		}
+		h.blocks <- hubBlocks{userID: update.UserID, blocked: blocked}
+	})
+	if err != nil {
+		return nil, err
+	}
+	go h.run()
+	return h, nil
+}
+
+var (
+	// chatHub delivers buyer-seller chat messages, one room per chat
+	chatHub *Hub
+	// communityHub delivers community chat messages
+	communityHub *Hub
+)
+
+// InitChatHubs creates the chat and community hubs on a broker. It must be
+// called before the WebSocket routes are served.
+func InitChatHubs(broker pubsub.Broker) error {
+	var err error
+	if chatHub, err = NewHub("chat", broker); err != nil {
+		return err
+	}
+	communityHub, err = NewHub("community", broker)
+	return err
+}
+
+func (h *Hub) run() {
+	for {
+		select {
+		case m := <-h.register:
+			h.clients[m.client] = make(map[int]bool)
+			h.addToRoom(m.client, m.room)
+
+		case m := <-h.join:
+			if _, ok := h.clients[m.client]; ok {
+				h.addToRoom(m.client, m.room)
+			}
+
+		case client := <-h.unregister:
+			h.remove(client)
+
+		case b := <-h.blocks:
+			for client := range h.clients {
+				if client.UserID == b.userID {
+					client.blocked = b.blocked
+				}
+			}
+
+		case k := <-h.kick:
+			for client, rooms := range h.clients {
+				if client.UserID == k.userID && (k.room == 0 || rooms[k.room]) {
+					// The writer sends queued frames before closing the connection
+					client.enqueue(k.notice)
+					h.remove(client)
+				}
+			}
+
+		case b := <-h.broadcast:
+			for client := range h.rooms[b.room] {
+				if client.blocked[b.sender] {
+					continue
+				}
+				if !client.enqueue(b.payload) {
+					log.Printf("[%s] Evicting slow client for user %d", h.name, client.UserID)
+					h.remove(client)
+				}
+			}
+		}
+	}
+}
+
+// addToRoom adds a client to a room; room 0 means no room yet
+func (h *Hub) addToRoom(client *HubClient, room int) {
+	if room == 0 {
+		return
+	}
+	if h.rooms[room] == nil {
+		h.rooms[room] = make(map[*HubClient]bool)
+	}
+	h.rooms[room][client] = true
+	h.clients[client][room] = true
+}
+
+// remove drops a client from every room and closes its queue, which stops its writer
+func (h *Hub) remove(client *HubClient) {
+	rooms, ok := h.clients[client]
+	if !ok {
+		return
+	}
+	for room := range rooms {
+		delete(h.rooms[room], client)
+		if len(h.rooms[room]) == 0 {
+			delete(h.rooms, room)
+		}
+	}
+	delete(h.clients, client)
+	client.close()
+}
+
+// Register adds a connection to the hub, in a room if room is not 0, and starts
+// its writer goroutine. The caller must run ReadMessages on the returned client.
+func (h *Hub) Register(conn *websocket.Conn, userID int, username string, room int) *HubClient {
+	return h.RegisterBlocking(conn, userID, username, room, nil)
+}
+
+// RegisterBlocking is Register for a user who doesn't want broadcasts from the
+// users in blocked. SetBlocked changes the set while they are connected.
+func (h *Hub) RegisterBlocking(conn *websocket.Conn, userID int, username string, room int, blocked map[int]bool) *HubClient {
+	client := &HubClient{hub: h, conn: conn, UserID: userID, Username: username, blocked: blocked, send: make(chan []byte, wsSendBuffer)}
+	go client.writePump()
+	h.register <- hubMembership{client: client, room: room}
+	return client
+}
+
+// Join adds a registered client to another room
+func (h *Hub) Join(client *HubClient, room int) {
+	h.join <- hubMembership{client: client, room: room}
+}
+
+// Broadcast sends a message to every client in a room, on every instance
+func (h *Hub) Broadcast(room int, message models.WebSocketMessage) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("[%s] Error encoding broadcast: %v", h.name, err)
+		return
+	}
+	if err := h.broker.Publish(h.name, room, payload); err != nil {
+		log.Printf("[%s] Error publishing broadcast: %v", h.name, err)
+	}
+}
+
+// Kick disconnects a user's clients in a room, or in every room when room is 0,
+// on every instance, sending each the notice first
+func (h *Hub) Kick(room, userID int, notice models.WebSocketMessage) {
+	payload, err := json.Marshal(map[string]interface{}{"user_id": userID, "notice": notice})
+	if err != nil {
+		log.Printf("[%s] Error encoding kick: %v", h.name, err)
+		return
+	}
+	if err := h.broker.Publish(h.name+"_kick", room, payload); err != nil {
+		log.Printf("[%s] Error publishing kick: %v", h.name, err)
+	}
+}
+
+// SetBlocked replaces the users whose broadcasts a user's clients skip, on every instance
+func (h *Hub) SetBlocked(userID int, blocked map[int]bool) {
+	ids := make([]int, 0, len(blocked))
+	for id := range blocked {
+		ids = append(ids, id)
+	}
+	payload, err := json.Marshal(map[string]interface{}{"user_id": userID, "blocked": ids})
+	if err != nil {
+		log.Printf("[%s] Error encoding block update: %v", h.name, err)
+		return
+	}
+	if err := h.broker.Publish(h.name+"_blocks", 0, payload); err != nil {
+		log.Printf("[%s] Error publishing block update: %v", h.name, err)
+	}
+}
+
+// enqueue queues a frame without blocking, reporting false if the client's
+// buffer is full or it has been closed
+func (c *HubClient) enqueue(payload []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	select {
+	case c.send <- payload:
+		return true
+	default:
+		return false
+	}
+}
+
+// close closes the client's queue; it is safe to call more than once
+func (c *HubClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
+}
+
+// Send queues a frame for this client only. A client too slow to keep up is
+// disconnected, and the hub drops it when its read loop ends.
+func (c *HubClient) Send(frame interface{}) {
+	payload, err := json.Marshal(frame)
+	if err != nil {
+		log.Printf("[%s] Error encoding message: %v", c.hub.name, err)
+		return
+	}
+	if !c.enqueue(payload) {
+		c.close()
+	}
+}
+
+// SendError queues a typed error frame for this client; chatID is 0 when the
+// error is not about a particular chat
+func (c *HubClient) SendError(code string, chatID int, content string) {
+	c.Send(wsError(code, chatID, content))
+}
+
+// wsError builds an error frame with one of the models.WSError codes
+func wsError(code string, chatID int, content string) models.WebSocketMessage {
+	return models.WebSocketMessage{Type: "error", Code: code, ChatID: chatID, Content: content, Timestamp: time.Now()}
+}
+
+// writePump writes queued frames and pings to the connection until the queue
+// is closed or a write fails
+func (c *HubClient) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case payload, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "connection closed"))
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// ReadMessages calls handle with each message the client sends until the
+// connection closes or stops answering pings, then unregisters the client
+func (c *HubClient) ReadMessages(handle func(msg models.WebSocketMessage)) {
+	defer func() {
+		c.hub.unregister <- c
+	}()
+
+	c.conn.SetReadLimit(wsMaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		var msg models.WebSocketMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("[%s] Error reading message: %v", c.hub.name, err)
+			}
+			return
+		}
+		handle(msg)
+	}
+}
@@ -0,0 +1,347 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"reselling-app/models"
+	"reselling-app/pubsub"
+)
+
+// testHub serves a hub over WebSockets. Each connection registers as the user
+// and room in its query string, and its server-side client is sent on clients.
+type testHub struct {
+	hub     *Hub
+	server  *httptest.Server
+	clients chan *HubClient
+}
+
+func newTestHub(t *testing.T) *testHub {
+	t.Helper()
+	return newTestHubOn(t, "test", pubsub.NewMemoryBroker())
+}
+
+// newTestHubOn serves a hub on a broker, standing in for one server instance
+func newTestHubOn(t *testing.T, name string, broker pubsub.Broker) *testHub {
+	t.Helper()
+	hub, err := NewHub(name, broker)
+	if err != nil {
+		t.Fatalf("NewHub: %v", err)
+	}
+
+	th := &testHub{hub: hub, clients: make(chan *HubClient, 16)}
+	th.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		userID, _ := strconv.Atoi(r.URL.Query().Get("user"))
+		room, _ := strconv.Atoi(r.URL.Query().Get("room"))
+		client := hub.Register(conn, userID, fmt.Sprintf("user%d", userID), room)
+		th.clients <- client
+		client.ReadMessages(func(models.WebSocketMessage) {})
+	}))
+	t.Cleanup(th.server.Close)
+	return th
+}
+
+// dial connects as a user in a room and returns both ends of the connection.
+// The server-side client is registered by the time dial returns.
+func (th *testHub) dial(t *testing.T, userID, room int) (*websocket.Conn, *HubClient) {
+	t.Helper()
+	url := fmt.Sprintf("ws%s?user=%d&room=%d", strings.TrimPrefix(th.server.URL, "http"), userID, room)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	select {
+	case client := <-th.clients:
+		return conn, client
+	case <-time.After(2 * time.Second):
+		t.Fatal("client was not registered")
+		return nil, nil
+	}
+}
+
+// readFrame reads the next frame, failing the test if none arrives
+func readFrame(t *testing.T, conn *websocket.Conn) models.WebSocketMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var msg models.WebSocketMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("reading frame: %v", err)
+	}
+	return msg
+}
+
+// expectNoFrame checks nothing arrives for a while. The connection can't be
+// read from afterwards, so it must be the last check on conn.
+func expectNoFrame(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	var msg models.WebSocketMessage
+	if err := conn.ReadJSON(&msg); err == nil {
+		t.Fatalf("unexpected frame %+v", msg)
+	}
+}
+
+// isClosed reports whether the hub has closed a client's queue
+func isClosed(client *HubClient) bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.closed
+}
+
+// waitClosed waits for the hub to close a client's queue
+func waitClosed(t *testing.T, client *HubClient) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !isClosed(client) {
+		if time.Now().After(deadline) {
+			t.Fatalf("client for user %d was not closed", client.UserID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHubBroadcastJoinAndUnregister(t *testing.T) {
+	th := newTestHub(t)
+	alice, _ := th.dial(t, 1, 10)
+	bob, _ := th.dial(t, 2, 10)
+	carol, carolClient := th.dial(t, 3, 20)
+
+	th.hub.Broadcast(10, models.WebSocketMessage{Type: "message", ChatID: 10, Content: "hello"})
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		if msg := readFrame(t, conn); msg.Content != "hello" || msg.ChatID != 10 {
+			t.Fatalf("got %+v, want hello in room 10", msg)
+		}
+	}
+
+	// Carol only hears room 10 after joining it, and still hears room 20
+	th.hub.Join(carolClient, 10)
+	th.hub.Broadcast(10, models.WebSocketMessage{Type: "message", ChatID: 10, Content: "joined"})
+	th.hub.Broadcast(20, models.WebSocketMessage{Type: "message", ChatID: 20, Content: "own room"})
+	if msg := readFrame(t, carol); msg.Content != "joined" {
+		t.Fatalf("got %+v, want the room 10 message", msg)
+	}
+	if msg := readFrame(t, carol); msg.Content != "own room" {
+		t.Fatalf("got %+v, want the room 20 message", msg)
+	}
+	readFrame(t, alice)
+	readFrame(t, bob)
+	expectNoFrame(t, alice)
+}
+
+func TestHubUnregistersClosedConnections(t *testing.T) {
+	th := newTestHub(t)
+	alice, aliceClient := th.dial(t, 1, 10)
+	bob, _ := th.dial(t, 2, 10)
+
+	alice.Close()
+	waitClosed(t, aliceClient)
+
+	// Broadcasting to a room a client left still reaches the others
+	th.hub.Broadcast(10, models.WebSocketMessage{Type: "message", ChatID: 10, Content: "still here"})
+	if msg := readFrame(t, bob); msg.Content != "still here" {
+		t.Fatalf("got %+v, want still here", msg)
+	}
+}
+
+func TestHubEvictsSlowConsumers(t *testing.T) {
+	th := newTestHub(t)
+	bob, _ := th.dial(t, 2, 10)
+
+	// A client whose writer never drains its queue, like one stuck on a slow network
+	stalled := &HubClient{hub: th.hub, UserID: 1, Username: "user1", send: make(chan []byte, wsSendBuffer)}
+	th.hub.register <- hubMembership{client: stalled, room: 10}
+
+	for i := 0; i <= wsSendBuffer; i++ {
+		th.hub.Broadcast(10, models.WebSocketMessage{Type: "message", ChatID: 10, Content: strconv.Itoa(i)})
+	}
+	waitClosed(t, stalled)
+	if len(stalled.send) != wsSendBuffer {
+		t.Fatalf("stalled client queued %d frames, want %d", len(stalled.send), wsSendBuffer)
+	}
+
+	// Bob keeps up and gets every frame
+	for i := 0; i <= wsSendBuffer; i++ {
+		if msg := readFrame(t, bob); msg.Content != strconv.Itoa(i) {
+			t.Fatalf("frame %d: got %q", i, msg.Content)
+		}
+	}
+}
+
+func TestHubKickDuringBroadcast(t *testing.T) {
+	th := newTestHub(t)
+	alice, aliceClient := th.dial(t, 1, 10)
+	bob, _ := th.dial(t, 2, 10)
+
+	// Bob reads everything sent to him in the background
+	bobFrames := make(chan models.WebSocketMessage, 256)
+	go func() {
+		defer close(bobFrames)
+		for {
+			var msg models.WebSocketMessage
+			bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if err := bob.ReadJSON(&msg); err != nil {
+				return
+			}
+			bobFrames <- msg
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			th.hub.Broadcast(10, models.WebSocketMessage{Type: "message", ChatID: 10, Content: "busy"})
+		}
+	}()
+	th.hub.Kick(10, 1, models.WebSocketMessage{Type: "error", Code: models.WSErrorBanned, Content: "kicked"})
+	wg.Wait()
+
+	// Alice gets the notice before her connection is closed
+	var sawNotice bool
+	for {
+		alice.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var msg models.WebSocketMessage
+		if err := alice.ReadJSON(&msg); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+				t.Fatalf("alice's connection ended with %v, want a close frame", err)
+			}
+			break
+		}
+		if msg.Code == models.WSErrorBanned {
+			sawNotice = true
+		}
+	}
+	if !sawNotice {
+		t.Fatal("alice did not get the kick notice")
+	}
+	waitClosed(t, aliceClient)
+
+	// Bob stays connected
+	th.hub.Broadcast(10, models.WebSocketMessage{Type: "message", ChatID: 10, Content: "after"})
+	for msg := range bobFrames {
+		if msg.Code == models.WSErrorBanned {
+			t.Fatal("bob got alice's kick notice")
+		}
+		if msg.Content == "after" {
+			return
+		}
+	}
+	t.Fatal("bob was disconnected by alice's kick")
+}
+
+func TestHubSkipsBroadcastsFromBlockedSenders(t *testing.T) {
+	th := newTestHub(t)
+	alice, _ := th.dial(t, 1, 10)
+	bob, _ := th.dial(t, 2, 10)
+
+	// Alice blocks user 3; bob still hears everyone
+	th.hub.SetBlocked(1, map[int]bool{3: true})
+	th.hub.Broadcast(10, models.WebSocketMessage{Type: "message", SenderID: 3, Content: "from carol"})
+	th.hub.Broadcast(10, models.WebSocketMessage{Type: "message", SenderID: 2, Content: "from bob"})
+	if msg := readFrame(t, alice); msg.Content != "from bob" {
+		t.Fatalf("got %+v, want only bob's message", msg)
+	}
+	for _, want := range []string{"from carol", "from bob"} {
+		if msg := readFrame(t, bob); msg.Content != want {
+			t.Fatalf("got %+v, want %s", msg, want)
+		}
+	}
+
+	// Unblocking lets carol's messages through again
+	th.hub.SetBlocked(1, map[int]bool{})
+	th.hub.Broadcast(10, models.WebSocketMessage{Type: "message", SenderID: 3, Content: "again"})
+	if msg := readFrame(t, alice); msg.Content != "again" {
+		t.Fatalf("got %+v, want carol's message after unblocking", msg)
+	}
+}
+
+func TestHubClientConcurrentSendAndClose(t *testing.T) {
+	th := newTestHub(t)
+	_, client := th.dial(t, 1, 10)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				client.Send(models.WebSocketMessage{Type: "system", Content: fmt.Sprintf("%d-%d", i, j)})
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(time.Millisecond)
+		client.close()
+		client.close()
+	}()
+	wg.Wait()
+
+	if !isClosed(client) {
+		t.Fatal("client is not closed")
+	}
+	// Sends after close are dropped rather than panicking
+	client.Send(models.WebSocketMessage{Type: "system", Content: "late"})
+}
+
+// TestHubAcrossInstances runs two hubs on Postgres brokers sharing one database,
+// as two server instances would. It is skipped unless DATABASE_URL is set.
+func TestHubAcrossInstances(t *testing.T) {
+	connStr := os.Getenv("DATABASE_URL")
+	if connStr == "" {
+		t.Skip("DATABASE_URL not set; skipping cross-instance hub test")
+	}
+	database, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	// Both instances use the same hub name, so they share its topics
+	name := fmt.Sprintf("test_hub_%d", time.Now().UnixNano())
+	instances := make([]*testHub, 2)
+	for i := range instances {
+		broker, err := pubsub.NewPostgresBroker(database, connStr)
+		if err != nil {
+			t.Fatalf("starting broker: %v", err)
+		}
+		t.Cleanup(func() { broker.Close() })
+		instances[i] = newTestHubOn(t, name, broker)
+	}
+	alice, aliceClient := instances[0].dial(t, 1, 10)
+	bob, _ := instances[1].dial(t, 2, 10)
+
+	// A broadcast on one instance reaches clients on both, once each
+	instances[1].hub.Broadcast(10, models.WebSocketMessage{Type: "message", ChatID: 10, Content: "hello"})
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		if msg := readFrame(t, conn); msg.Content != "hello" {
+			t.Fatalf("got %+v, want hello", msg)
+		}
+	}
+
+	// A kick on bob's instance disconnects alice on the other one
+	instances[1].hub.Kick(10, 1, models.WebSocketMessage{Type: "error", Code: models.WSErrorBanned, Content: "kicked"})
+	if msg := readFrame(t, alice); msg.Code != models.WSErrorBanned {
+		t.Fatalf("got %+v, want the kick notice", msg)
+	}
+	waitClosed(t, aliceClient)
+	expectNoFrame(t, bob)
+}
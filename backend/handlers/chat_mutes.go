@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"reselling-app/db"
+)
+
+// chatMuted reports whether a user has muted notifications for a chat
+func chatMuted(userID, chatID int) (bool, error) {
+	var muted bool
+	err := db.DB.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM chat_mutes WHERE user_id = $1 AND chat_id = $2)",
+		userID, chatID,
+	).Scan(&muted)
+	return muted, err
+}
+
+// MuteChat turns off notifications for a chat the user belongs to. Messages
+// are still delivered to open connections.
+func MuteChat(c *gin.Context) {
+	setChatMuted(c, true)
+}
+
+// UnmuteChat turns notifications for a chat back on
+func UnmuteChat(c *gin.Context) {
+	setChatMuted(c, false)
+}
+
+func setChatMuted(c *gin.Context, muted bool) {
+	userID, _ := c.Get("userID")
+
+	chatID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	switch err := chatMember(chatID, userID.(int)); err {
+	case nil:
+	case errChatNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
+		return
+	case errNotChatMember:
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this chat"})
+		return
+	default:
+		log.Printf("Database error checking chat membership: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if muted {
+		_, err = db.DB.Exec(
+			"INSERT INTO chat_mutes (user_id, chat_id) VALUES ($1, $2) ON CONFLICT (user_id, chat_id) DO NOTHING",
+			userID, chatID,
+		)
+	} else {
+		_, err = db.DB.Exec("DELETE FROM chat_mutes WHERE user_id = $1 AND chat_id = $2", userID, chatID)
+	}
+	if err != nil {
+		log.Printf("Database error updating chat mute: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update chat notifications"})
+		return
+	}
+
+	if muted {
+		// Muting also clears what is already waiting for the chat
+		if err := clearNotifications(userID.(int), "chat_message", chatID); err != nil {
+			log.Printf("Database error clearing notifications: %v", err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"chat_id": chatID, "muted": muted})
+}
@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+
+	"reselling-app/models"
+)
+
+const (
+	// Longest chat message or caption, in characters
+	maxChatMessageLength = 2000
+	// Longest location label, in characters
+	maxLocationLabelLength = 100
+)
+
+// validateChatMessage checks a chat message from a client and fills in its
+// payload from the server's records, so only the IDs and coordinates the
+// sender gave are trusted. It returns a reason the message was refused, or
+// "" when it is fine.
+func validateChatMessage(msg *models.WebSocketMessage, senderID int) (string, error) {
+	msg.Content = strings.TrimSpace(msg.Content)
+	if len([]rune(msg.Content)) > maxChatMessageLength {
+		return fmt.Sprintf("Messages can be at most %d characters", maxChatMessageLength), nil
+	}
+	if msg.Kind == "" {
+		msg.Kind = models.ChatMessageText
+	}
+
+	payload := msg.Payload
+	if payload == nil {
+		payload = &models.ChatPayload{}
+	}
+
+	switch msg.Kind {
+	case models.ChatMessageText:
+		if msg.Content == "" {
+			return "Message can't be empty", nil
+		}
+		msg.Payload = nil
+		return "", nil
+
+	case models.ChatMessageImage:
+		if payload.Image == nil || payload.Image.UploadID <= 0 {
+			return "An image message needs the upload_id of an uploaded image", nil
+		}
+		upload, err := userUpload(payload.Image.UploadID, senderID)
+		if err == errUploadNotFound {
+			return "Image not found; upload it before sending", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		msg.Payload = &models.ChatPayload{Image: &models.ChatImage{
+			UploadID: upload.ID,
+			URL:      upload.URL,
+			Width:    upload.Width,
+			Height:   upload.Height,
+		}}
+		if msg.Content == "" {
+			msg.Content = "Sent a photo"
+		}
+		return "", nil
+
+	case models.ChatMessageBook:
+		if payload.Book == nil || payload.Book.BookID <= 0 {
+			return "A book card needs the book_id of a listing", nil
+		}
+		book, err := visibleBook(payload.Book.BookID, senderID)
+		if err == errBookNotFound {
+			return "Book not found", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		msg.Payload = &models.ChatPayload{Book: bookCard(book)}
+		if msg.Content == "" {
+			msg.Content = fmt.Sprintf("Shared \"%s\" by %s", book.Title, book.Author)
+		}
+		return "", nil
+
+	case models.ChatMessageLocation:
+		location := payload.Location
+		if location == nil {
+			return "A location message needs a latitude and longitude", nil
+		}
+		if math.IsNaN(location.Latitude) || location.Latitude < -90 || location.Latitude > 90 ||
+			math.IsNaN(location.Longitude) || location.Longitude < -180 || location.Longitude > 180 {
+			return "Latitude must be between -90 and 90 and longitude between -180 and 180", nil
+		}
+		label := strings.TrimSpace(location.Label)
+		if len([]rune(label)) > maxLocationLabelLength {
+			return fmt.Sprintf("Location labels can be at most %d characters", maxLocationLabelLength), nil
+		}
+		msg.Payload = &models.ChatPayload{Location: &models.ChatLocation{
+			Latitude:  location.Latitude,
+			Longitude: location.Longitude,
+			Label:     label,
+		}}
+		if msg.Content == "" {
+			msg.Content = "Shared a meetup location"
+			if label != "" {
+				msg.Content += ": " + label
+			}
+		}
+		return "", nil
+
+	default:
+		return fmt.Sprintf("Unknown message kind %q", msg.Kind), nil
+	}
+}
+
+// bookCard is the card shown for a shared listing
+func bookCard(book models.Book) *models.ChatBookCard {
+	return &models.ChatBookCard{
+		BookID:   book.ID,
+		Title:    book.Title,
+		Author:   book.Author,
+		Price:    book.Price,
+		ImageURL: book.ImageURL,
+		Status:   book.Status,
+	}
+}
+
+// encodeChatPayload returns a payload for the messages.payload column
+func encodeChatPayload(payload *models.ChatPayload) (interface{}, error) {
+	if payload == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// decodeChatPayload reads a messages.payload column
+func decodeChatPayload(data []byte) *models.ChatPayload {
+	if len(data) == 0 {
+		return nil
+	}
+	var payload models.ChatPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		log.Printf("Error decoding chat payload: %v", err)
+		return nil
+	}
+	return &payload
+}
+
+// refreshBookCards updates shared listings to their current title, price and
+// status, marking listings that no longer exist as removed
+func refreshBookCards(messages []models.ChatMessage) {
+	var ids []int64
+	for _, msg := range messages {
+		if msg.Payload != nil && msg.Payload.Book != nil {
+			ids = append(ids, int64(msg.Payload.Book.BookID))
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	books, err := loadBooksByID(ids)
+	if err != nil {
+		log.Printf("Database error refreshing book cards: %v", err)
+		return
+	}
+	current := make(map[int]models.Book, len(books))
+	for _, book := range books {
+		current[book.ID] = book
+	}
+
+	for _, msg := range messages {
+		if msg.Payload == nil || msg.Payload.Book == nil {
+			continue
+		}
+		// Listings taken down by moderation read as removed, as in visibleBook
+		if book, ok := current[msg.Payload.Book.BookID]; ok && book.Status != "pending_review" && book.Status != "rejected" {
+			msg.Payload.Book = bookCard(book)
+		} else {
+			msg.Payload.Book.Status = "removed"
+		}
+	}
+}
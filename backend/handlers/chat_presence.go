@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"reselling-app/db"
+	"reselling-app/models"
+)
+
+const (
+	// How often connected users' presence is renewed
+	presenceRefreshInterval = time.Minute
+	// Presence lapses this long after its last renewal, so users of an
+	// instance that stopped without marking them offline are shown offline
+	presenceTTL = 2*presenceRefreshInterval + 30*time.Second
+	// Typing indicators are relayed at most this often per connection and chat
+	typingThrottle = 2 * time.Second
+)
+
+// presenceTracker counts this instance's chat connections per user, and per
+// user and chat for connections that joined it. A user is online while any
+// instance renews their users.online_until, and has a chat open while any
+// instance renews their chat_viewers row for it.
+type presenceTracker struct {
+	mu          sync.Mutex
+	connections map[int]int
+	viewers     map[chatViewer]int
+	start       sync.Once
+}
+
+// chatViewer is a user with a chat open
+type chatViewer struct {
+	userID int
+	chatID int
+}
+
+var presence = &presenceTracker{connections: make(map[int]int), viewers: make(map[chatViewer]int)}
+
+// connect records a connection, announcing the user online on their first one
+func (p *presenceTracker) connect(userID int) {
+	p.start.Do(func() { go p.refresh() })
+
+	p.mu.Lock()
+	p.connections[userID]++
+	first := p.connections[userID] == 1
+	p.mu.Unlock()
+
+	if first {
+		p.update(userID, true)
+	}
+}
+
+// disconnect records a closed connection, announcing the user offline with
+// their last-seen time when it was their last one
+func (p *presenceTracker) disconnect(userID int) {
+	p.mu.Lock()
+	p.connections[userID]--
+	last := p.connections[userID] <= 0
+	if last {
+		delete(p.connections, userID)
+	}
+	p.mu.Unlock()
+
+	if last {
+		p.update(userID, false)
+	}
+}
+
+// view records a connection joining a chat, marking the chat open for the
+// user on their first such connection
+func (p *presenceTracker) view(userID, chatID int) {
+	viewer := chatViewer{userID: userID, chatID: chatID}
+	p.mu.Lock()
+	p.viewers[viewer]++
+	first := p.viewers[viewer] == 1
+	p.mu.Unlock()
+
+	if !first {
+		return
+	}
+	_, err := db.DB.Exec(`
+		INSERT INTO chat_viewers (user_id, chat_id, online_until) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, chat_id) DO UPDATE SET online_until = EXCLUDED.online_until`,
+		userID, chatID, time.Now().Add(presenceTTL),
+	)
+	if err != nil {
+		log.Printf("Database error recording chat viewer: %v", err)
+	}
+}
+
+// leave records a connection that joined a chat closing, marking the chat
+// closed for the user when it was their last one
+func (p *presenceTracker) leave(userID, chatID int) {
+	viewer := chatViewer{userID: userID, chatID: chatID}
+	p.mu.Lock()
+	p.viewers[viewer]--
+	last := p.viewers[viewer] <= 0
+	if last {
+		delete(p.viewers, viewer)
+	}
+	p.mu.Unlock()
+
+	if !last {
+		return
+	}
+	_, err := db.DB.Exec("DELETE FROM chat_viewers WHERE user_id = $1 AND chat_id = $2", userID, chatID)
+	if err != nil {
+		log.Printf("Database error removing chat viewer: %v", err)
+	}
+}
+
+// update stores a user's presence and tells the other participant of each of their chats
+func (p *presenceTracker) update(userID int, online bool) {
+	var onlineUntil interface{}
+	if online {
+		onlineUntil = time.Now().Add(presenceTTL)
+	}
+	status := models.Presence{UserID: userID, Online: online}
+	err := db.DB.QueryRow(
+		"UPDATE users SET last_seen_at = NOW(), online_until = $1 WHERE id = $2 RETURNING last_seen_at",
+		onlineUntil, userID,
+	).Scan(&status.LastSeenAt)
+	if err != nil {
+		log.Printf("Database error updating presence: %v", err)
+		return
+	}
+
+	rows, err := db.DB.Query("SELECT id FROM chats WHERE buyer_id = $1 OR seller_id = $1", userID)
+	if err != nil {
+		log.Printf("Database error fetching chats for presence: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var chatID int
+		if err := rows.Scan(&chatID); err != nil {
+			log.Printf("Error scanning chat row: %v", err)
+			continue
+		}
+		chatHub.Broadcast(chatID, models.WebSocketMessage{
+			Type:      "presence",
+			ChatID:    chatID,
+			SenderID:  userID,
+			Timestamp: time.Now(),
+			Data:      status,
+		})
+	}
+}
+
+// refresh renews the presence of every user connected to this instance
+func (p *presenceTracker) refresh() {
+	ticker := time.NewTicker(presenceRefreshInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		p.renew()
+	}
+}
+
+// renew extends online_until for the users connected to this instance and the
+// chats they have open. The lock is held through the writes so a connection
+// closing meanwhile marks its user offline, or its chat closed, only after
+// the renewal, not before it.
+func (p *presenceTracker) renew() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.connections) == 0 {
+		return
+	}
+	userIDs := make([]int64, 0, len(p.connections))
+	for userID := range p.connections {
+		userIDs = append(userIDs, int64(userID))
+	}
+	until := time.Now().Add(presenceTTL)
+	_, err := db.DB.Exec(
+		"UPDATE users SET last_seen_at = NOW(), online_until = $1 WHERE id = ANY($2)",
+		until, pq.Array(userIDs),
+	)
+	if err != nil {
+		log.Printf("Database error refreshing presence: %v", err)
+	}
+
+	if len(p.viewers) == 0 {
+		return
+	}
+	viewerIDs := make([]int64, 0, len(p.viewers))
+	chatIDs := make([]int64, 0, len(p.viewers))
+	for viewer := range p.viewers {
+		viewerIDs = append(viewerIDs, int64(viewer.userID))
+		chatIDs = append(chatIDs, int64(viewer.chatID))
+	}
+	_, err = db.DB.Exec(`
+		UPDATE chat_viewers v SET online_until = $1
+		FROM unnest($2::int[], $3::int[]) AS open (user_id, chat_id)
+		WHERE v.user_id = open.user_id AND v.chat_id = open.chat_id`,
+		until, pq.Array(viewerIDs), pq.Array(chatIDs),
+	)
+	if err != nil {
+		log.Printf("Database error refreshing chat viewers: %v", err)
+	}
+}
+
+// viewingChat reports whether a user has a chat open on any instance
+func viewingChat(userID, chatID int) (bool, error) {
+	var viewing bool
+	err := db.DB.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM chat_viewers WHERE user_id = $1 AND chat_id = $2 AND online_until > NOW())",
+		userID, chatID,
+	).Scan(&viewing)
+	return viewing, err
+}
+
+// counterpartPresence returns the presence of the other participant of a chat
+func counterpartPresence(chatID, userID int) (models.Presence, error) {
+	var status models.Presence
+	var lastSeen sql.NullTime
+	err := db.DB.QueryRow(`
+		SELECT u.id, COALESCE(u.online_until > NOW(), false), u.last_seen_at
+		FROM chats c
+		JOIN users u ON u.id = CASE WHEN c.buyer_id = $2 THEN c.seller_id ELSE c.buyer_id END
+		WHERE c.id = $1`,
+		chatID, userID,
+	).Scan(&status.UserID, &status.Online, &lastSeen)
+	if lastSeen.Valid {
+		status.LastSeenAt = &lastSeen.Time
+	}
+	return status, err
+}
+
+// markChatRead marks the other participant's messages in a chat as read, up
+// to and including upTo when it is not 0, and returns the newest message marked
+func markChatRead(chatID, userID, upTo int) (int, error) {
+	var lastRead int
+	err := db.DB.QueryRow(`
+		WITH marked AS (
+			UPDATE messages SET read_at = NOW()
+			WHERE chat_id = $1 AND sender_id <> $2 AND read_at IS NULL AND ($3 = 0 OR id <= $3)
+			RETURNING id
+		)
+		SELECT COALESCE(MAX(id), 0) FROM marked`,
+		chatID, userID, upTo,
+	).Scan(&lastRead)
+	return lastRead, err
+}
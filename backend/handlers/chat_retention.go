@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"reselling-app/db"
+)
+
+const (
+	// Default days after a book sells before its chat messages are retired
+	defaultChatRetentionDays = 365
+	// Default time between retention runs
+	defaultChatRetentionInterval = 24 * time.Hour
+	// Messages moved or deleted per statement, to keep locks short
+	chatRetentionBatch = 1000
+)
+
+// Chat retention modes. Archived messages leave the live chat but stay in
+// exported transcripts; purged messages are deleted, archived ones included.
+const (
+	ChatRetentionArchive = "archive"
+	ChatRetentionPurge   = "purge"
+	ChatRetentionOff     = "off"
+)
+
+// ChatRetentionPolicy says what happens to the messages of chats about a book
+// once Days have passed since it sold
+type ChatRetentionPolicy struct {
+	Mode     string
+	Days     int
+	Interval time.Duration
+}
+
+// ChatRetentionResult counts the messages one retention run touched
+type ChatRetentionResult struct {
+	Archived int64
+	Purged   int64
+}
+
+// ChatRetentionPolicyFromEnv reads the policy from CHAT_RETENTION_MODE,
+// CHAT_RETENTION_DAYS and CHAT_RETENTION_INTERVAL. An unknown mode turns
+// retention off rather than risk deleting messages.
+func ChatRetentionPolicyFromEnv() ChatRetentionPolicy {
+	policy := ChatRetentionPolicy{Mode: ChatRetentionArchive, Days: defaultChatRetentionDays, Interval: defaultChatRetentionInterval}
+
+	switch mode := os.Getenv("CHAT_RETENTION_MODE"); mode {
+	case "":
+	case ChatRetentionArchive, ChatRetentionPurge, ChatRetentionOff:
+		policy.Mode = mode
+	default:
+		log.Printf("Unknown CHAT_RETENTION_MODE %q, chat retention is off", mode)
+		policy.Mode = ChatRetentionOff
+	}
+	if days, err := strconv.Atoi(os.Getenv("CHAT_RETENTION_DAYS")); err == nil && days > 0 {
+		policy.Days = days
+	}
+	if interval, err := time.ParseDuration(os.Getenv("CHAT_RETENTION_INTERVAL")); err == nil && interval > 0 {
+		policy.Interval = interval
+	}
+	return policy
+}
+
+// expiredMessages selects a batch of live messages in chats whose book sold
+// more than $1 days ago
+const expiredMessages = `
+	SELECT m.id
+	FROM messages m
+	JOIN chats c ON c.id = m.chat_id
+	JOIN books b ON b.id = c.book_id
+	WHERE b.status = 'sold' AND b.sold_at < NOW() - make_interval(days => $1)
+	ORDER BY m.id
+	LIMIT $2`
+
+// Apply archives or purges the messages the policy has expired
+func (p ChatRetentionPolicy) Apply() (ChatRetentionResult, error) {
+	var result ChatRetentionResult
+	switch p.Mode {
+	case ChatRetentionArchive:
+		moved, err := retireInBatches(`
+			WITH expired AS (`+expiredMessages+`),
+			moved AS (
+				DELETE FROM messages m USING expired e
+				WHERE m.id = e.id
+				RETURNING m.id, m.chat_id, m.sender_id, m.kind, m.payload, m.content,
+				          m.client_message_id, m.read_at, m.created_at
+			)
+			INSERT INTO archived_messages
+				(id, chat_id, sender_id, kind, payload, content, client_message_id, read_at, created_at)
+			SELECT * FROM moved
+			ON CONFLICT (id) DO NOTHING`,
+			p.Days,
+		)
+		result.Archived = moved
+		return result, err
+
+	case ChatRetentionPurge:
+		deleted, err := retireInBatches(`
+			WITH expired AS (`+expiredMessages+`)
+			DELETE FROM messages m USING expired e
+			WHERE m.id = e.id`,
+			p.Days,
+		)
+		result.Purged = deleted
+		if err != nil {
+			return result, err
+		}
+
+		// Messages archived under an earlier policy go too
+		deleted, err = retireInBatches(`
+			DELETE FROM archived_messages
+			WHERE id IN (
+				SELECT a.id
+				FROM archived_messages a
+				JOIN chats c ON c.id = a.chat_id
+				JOIN books b ON b.id = c.book_id
+				WHERE b.status = 'sold' AND b.sold_at < NOW() - make_interval(days => $1)
+				ORDER BY a.id
+				LIMIT $2
+			)`,
+			p.Days,
+		)
+		result.Purged += deleted
+		return result, err
+	}
+	return result, nil
+}
+
+// retireInBatches runs a statement taking the retention days and a batch size
+// until it touches fewer rows than a full batch, returning the total touched
+func retireInBatches(query string, days int) (int64, error) {
+	var total int64
+	for {
+		res, err := db.DB.Exec(query, days, chatRetentionBatch)
+		if err != nil {
+			return total, err
+		}
+		touched, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += touched
+		if touched < chatRetentionBatch {
+			return total, nil
+		}
+	}
+}
+
+// StartChatRetention applies the policy now and then every policy.Interval
+// in the background, logging how many messages each run touched
+func StartChatRetention(policy ChatRetentionPolicy) {
+	if policy.Mode == ChatRetentionOff {
+		log.Printf("Chat retention is off")
+		return
+	}
+
+	run := func() {
+		result, err := policy.Apply()
+		if err != nil {
+			log.Printf("Error applying chat retention: %v", err)
+		}
+		log.Printf("Chat retention (%s after %d days): archived %d, purged %d messages",
+			policy.Mode, policy.Days, result.Archived, result.Purged)
+	}
+
+	go func() {
+		run()
+		ticker := time.NewTicker(policy.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			run()
+		}
+	}()
+}
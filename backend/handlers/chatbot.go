@@ -2,17 +2,42 @@ package handlers
 
 import (
 	"context"
-	"database/sql"
+	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
 	"reselling-app/db"
 	"reselling-app/models"
 	"reselling-app/utils"
 )
 
+const (
+	// How long a non-streaming chatbot reply may take
+	chatbotTimeout = 10 * time.Second
+	// How long a streamed chatbot reply may take; tokens arrive as they're generated
+	chatbotStreamTimeout = 60 * time.Second
+)
+
+// chatbotError carries the status and message shown to the client for a failed query
+type chatbotError struct {
+	Status  int
+	Message string
+	Err     error
+}
+
+func (e *chatbotError) Error() string {
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *chatbotError) Unwrap() error {
+	return e.Err
+}
+
 // ChatbotResponse handles book recommendation requests via the chatbot
 func ChatbotResponse(c *gin.Context) {
 	var input models.ChatbotQuery
@@ -30,95 +55,254 @@ func ChatbotResponse(c *gin.Context) {
 		userID = userIDValue.(int)
 	}
 
-	// Create a context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// Create a context with timeout, cancelled early if the client goes away
+	ctx, cancel := context.WithTimeout(c.Request.Context(), chatbotTimeout)
 	defer cancel()
 
-	// Create a new Gemini client
-	geminiClient, err := utils.NewGeminiClient()
+	response, err := answerChatbotQuery(ctx, userID, input, nil)
 	if err != nil {
-		log.Printf("Error creating Gemini client: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to initialize AI service"})
+		log.Printf("Error answering chatbot query: %v", err)
+		var chatErr *chatbotError
+		if errors.As(err, &chatErr) {
+			c.JSON(chatErr.Status, gin.H{"error": chatErr.Message})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": chatbotErrorMessage(err)})
 		return
 	}
 
-	// Create the prompt for book recommendations
-	prompt := utils.CreateBookRecommendationPrompt(input.Query, userID)
+	c.JSON(http.StatusOK, response)
+}
 
-	// Generate content using the Gemini API
-	response, err := geminiClient.GenerateContent(ctx, prompt)
-	if err != nil {
-		log.Printf("Error generating content: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recommendations"})
-		return
+// answerChatbotQuery retrieves listings for a query, generates a reply grounded
+// in them and stores the turn. When onToken is set the reply is streamed
+// through it as it is generated.
+func answerChatbotQuery(ctx context.Context, userID int, input models.ChatbotQuery, onToken func(string) error) (models.ChatbotResponse, error) {
+	// Refuse attempts to override the assistant's instructions before they reach a model
+	if reason := utils.CheckChatbotInput(input.Query); reason != "" {
+		log.Printf("Refused chatbot query from user %d: %s", userID, reason)
+		return models.ChatbotResponse{}, &chatbotError{Status: http.StatusBadRequest, Message: "Sorry, I can't help with that. Ask me about books on BookBridge.", Err: errors.New(reason)}
+	}
+	if userID > 0 {
+		reserved, err := reserveChatbotQuery(userID)
+		if err != nil {
+			return models.ChatbotResponse{}, &chatbotError{Status: http.StatusInternalServerError, Message: "Failed to check chatbot quota", Err: err}
+		}
+		if !reserved {
+			return models.ChatbotResponse{}, &chatbotError{Status: http.StatusTooManyRequests, Message: "You've reached today's chatbot limit. Please try again tomorrow.", Err: errChatbotQuotaExceeded}
+		}
 	}
 
-	// If the user is authenticated, store the interaction
+	// Authenticated users get server-side memory: follow-ups like "something
+	// cheaper" build on the previous turn and recent turns go into the prompt.
+	// Their history also personalises the listings and the reply.
+	intent := utils.ExtractBookIntent(input.Query)
+	var conversation *chatbotConversation
+	var profile readerProfile
 	if userID > 0 {
-		go storeUserChatbotInteraction(userID, input.Query, response)
+		var err error
+		conversation, err = openConversation(userID, input.ConversationID, input.Query)
+		if errors.Is(err, errConversationNotFound) {
+			releaseChatbotQuery(userID)
+			return models.ChatbotResponse{}, &chatbotError{Status: http.StatusNotFound, Message: "Conversation not found", Err: err}
+		}
+		if err != nil {
+			// Nothing reached a model, so the query doesn't count
+			releaseChatbotQuery(userID)
+			return models.ChatbotResponse{}, &chatbotError{Status: http.StatusInternalServerError, Message: "Failed to load conversation", Err: err}
+		}
+		intent = conversation.resolveIntent(input.Query, intent)
+		if profile, err = loadReaderProfile(userID); err != nil {
+			log.Printf("Error loading reader profile for chatbot: %v", err)
+		}
 	}
 
-	// Find relevant books based on the query
-	relevantBooks, err := findRelevantBooks(input.Query)
+	// Retrieve listings matching what the user asked for and ground the prompt
+	// in them; signed-in users who don't say what they want get recommendations
+	retrieved, err := retrieveChatbotListings(userID, intent, profile)
 	if err != nil {
-		log.Printf("Error finding relevant books: %v", err)
-		// Continue with the response even if book search fails
+		log.Printf("Error retrieving listings for chatbot: %v", err)
+		// Continue without listings; the model is told nothing matched
+		retrieved = []models.Book{}
+	}
+	prompt := utils.CreateBookRecommendationPrompt(input.Query, intent, retrieved)
+	if conversation != nil {
+		conversation.addHistory(&prompt)
+		prompt = prompt.WithReaderProfile(profile.Genres, profile.Authors)
 	}
 
-	// Return the response
-	c.JSON(http.StatusOK, models.ChatbotResponse{
-		Response: response,
-		Books:    relevantBooks,
-	})
-}
+	// Tools run as the user who asked; actions like adding to the cart need a signed-in user
+	var conversationID int
+	if conversation != nil {
+		conversationID = conversation.ID
+	}
+	tools := newChatbotTools(ctx, userID, conversationID)
+	tools.addBooks(retrieved...)
+	prompt = prompt.WithTools(tools.definitions())
 
-// storeUserChatbotInteraction stores the user's interaction with the chatbot
-func storeUserChatbotInteraction(userID int, query, response string) {
-	// Store the interaction in the database for future reference
-	_, err := db.DB.Exec(
-		"INSERT INTO chatbot_interactions (user_id, query, response, created_at) VALUES ($1, $2, $3, $4)",
-		userID, query, response, time.Now(),
-	)
+	// A query cancelled before reaching a model doesn't count against the quota;
+	// once generation starts it does, whether or not the reply completes
+	if ctx.Err() != nil {
+		if userID > 0 {
+			releaseChatbotQuery(userID)
+		}
+		if conversation != nil && input.ConversationID == 0 {
+			discardEmptyConversation(conversation.ID)
+		}
+		return models.ChatbotResponse{}, ctx.Err()
+	}
+	completion, err := generateChatbotReply(ctx, prompt, retrieved, tools, onToken)
 	if err != nil {
-		log.Printf("Error storing chatbot interaction: %v", err)
+		// A conversation started by this query has nothing in it to keep
+		if conversation != nil && input.ConversationID == 0 {
+			discardEmptyConversation(conversation.ID)
+		}
+		if ctx.Err() != nil {
+			return models.ChatbotResponse{}, ctx.Err()
+		}
+		return models.ChatbotResponse{}, &chatbotError{Status: http.StatusInternalServerError, Message: "Failed to generate recommendations", Err: err}
 	}
+
+	// Keep only citations of retrieved listings and those tools returned, and
+	// return exactly the books the reply mentions. Streamed text is corrected
+	// by the final response if the reply is replaced.
+	reply, reason := utils.ModerateChatbotReply(completion.Text)
+	var relevantBooks []models.Book
+	if reason != "" {
+		log.Printf("Replaced chatbot reply for user %d: %s", userID, reason)
+	} else {
+		reply, relevantBooks = citedBooks(reply, tools.books)
+	}
+	completion.Text = reply
+
+	// Store the turn before responding so an immediate follow-up sees it
+	response := models.ChatbotResponse{Response: reply, Books: relevantBooks, Actions: tools.actions}
+	if conversation != nil {
+		storeUserChatbotInteraction(userID, conversation.ID, input.Query, intent, relevantBooks, completion)
+		go summarizeConversation(conversation.ID)
+		response.ConversationID = conversation.ID
+	}
+	return response, nil
 }
 
-// findRelevantBooks finds books relevant to the user's query
-func findRelevantBooks(query string) ([]models.Book, error) {
-	// Search for books that match the query in title, author, or description
-	rows, err := db.DB.Query(`
-		SELECT b.id, b.seller_id, u.username, b.title, b.author, b.description, 
-			   b.price, b.image_url, b.genre, b.condition, b.status, b.created_at
-		FROM books b
-		JOIN users u ON b.seller_id = u.id
-		WHERE b.status = 'available' AND 
-			  (b.title ILIKE $1 OR b.author ILIKE $1 OR b.description ILIKE $1 OR b.genre ILIKE $1)
-		ORDER BY b.created_at DESC
-		LIMIT 5
-	`, "%"+query+"%")
+// generateChatbotReply runs the prompt through the configured provider, running
+// any tools the model calls and passing their results back until it answers.
+// The reply is the text of every round, so streamed text matches it.
+func generateChatbotReply(ctx context.Context, prompt utils.LLMRequest, retrieved []models.Book, tools *chatbotTools, onToken func(string) error) (utils.LLMCompletion, error) {
+	provider := utils.DefaultLLMProvider()
+	var stream *citationStream
+	if onToken != nil {
+		// Hold back partial listing markers until they can be checked
+		stream = newCitationStream(retrieved, onToken)
+	}
 
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return []models.Book{}, nil
+	var reply strings.Builder
+	var usage utils.LLMUsage
+	for round := 0; ; round++ {
+		// Separate text written before a tool call from what follows it
+		if reply.Len() > 0 {
+			reply.WriteString("\n\n")
+			if stream != nil {
+				if err := stream.write("\n\n"); err != nil {
+					return utils.LLMCompletion{}, err
+				}
+			}
+		}
+
+		completion, err := generateChatbotRound(ctx, &provider, prompt, stream)
+		if err != nil {
+			return utils.LLMCompletion{}, err
+		}
+		reply.WriteString(completion.Text)
+		usage.PromptTokens += completion.Usage.PromptTokens
+		usage.CompletionTokens += completion.Usage.CompletionTokens
+		usage.TotalTokens += completion.Usage.TotalTokens
+
+		if len(completion.ToolCalls) == 0 || round == chatbotToolRounds {
+			if len(completion.ToolCalls) > 0 {
+				log.Printf("Chatbot still calling tools after %d rounds, stopping", chatbotToolRounds)
+			}
+			completion.Text = strings.TrimSpace(reply.String())
+			completion.ToolCalls = nil
+			completion.Usage = usage
+			if completion.Text == "" {
+				completion.Text = "Sorry, I couldn't finish that request. Please try asking another way."
+				if stream != nil {
+					if err := stream.write(completion.Text); err != nil {
+						return utils.LLMCompletion{}, err
+					}
+				}
+			}
+			if stream != nil {
+				return completion, stream.flush()
+			}
+			return completion, nil
+		}
+
+		prompt.Messages = append(prompt.Messages, utils.LLMMessage{Role: "assistant", Content: completion.Text, ToolCalls: completion.ToolCalls})
+		for _, call := range completion.ToolCalls {
+			prompt.Messages = append(prompt.Messages, tools.call(call))
+		}
+		if stream != nil {
+			stream.allow(tools.books)
 		}
-		return nil, err
 	}
-	defer rows.Close()
+}
 
-	var books []models.Book
-	for rows.Next() {
-		var book models.Book
-		if err := rows.Scan(
-			&book.ID, &book.SellerID, &book.SellerUsername, &book.Title, &book.Author,
-			&book.Description, &book.Price, &book.ImageURL, &book.Genre, &book.Condition,
-			&book.Status, &book.CreatedAt,
-		); err != nil {
-			log.Printf("Error scanning book row: %v", err)
-			continue
+// generateChatbotRound generates one round of a reply, switching to the offline
+// provider for the rest of the reply if the configured one fails before
+// producing any text
+func generateChatbotRound(ctx context.Context, provider *utils.LLMProvider, prompt utils.LLMRequest, stream *citationStream) (utils.LLMCompletion, error) {
+	current := *provider
+	if stream == nil {
+		completion, err := current.Generate(ctx, prompt)
+		if err != nil && current.Name() != utils.ProviderOffline && ctx.Err() == nil {
+			// Keep answering with the rule-based provider while the model is unavailable
+			log.Printf("Error generating content with %s provider, falling back to offline: %v", current.Name(), err)
+			*provider = utils.NewOfflineProvider()
+			return (*provider).Generate(ctx, prompt)
 		}
-		books = append(books, book)
+		return completion, err
 	}
 
-	return books, nil
+	completion, err := current.Stream(ctx, prompt, stream.write)
+	if err != nil && current.Name() != utils.ProviderOffline && ctx.Err() == nil && !stream.started {
+		log.Printf("Error streaming content with %s provider, falling back to offline: %v", current.Name(), err)
+		*provider = utils.NewOfflineProvider()
+		return (*provider).Stream(ctx, prompt, stream.write)
+	}
+	return completion, err
+}
+
+// storeUserChatbotInteraction stores a conversation turn along with what was
+// searched for, the books shown, the provider that answered and its token usage.
+// Email addresses and phone numbers are removed before anything is stored.
+func storeUserChatbotInteraction(userID, conversationID int, query string, intent utils.BookIntent, books []models.Book, completion utils.LLMCompletion) {
+	intentJSON, err := json.Marshal(intent)
+	if err != nil {
+		log.Printf("Error encoding chatbot intent: %v", err)
+		intentJSON = []byte("{}")
+	}
+	intentJSON = []byte(utils.RedactPII(string(intentJSON)))
+	bookIDs := make([]int64, len(books))
+	for i, book := range books {
+		bookIDs[i] = int64(book.ID)
+	}
+
+	_, err = db.DB.Exec(`
+		INSERT INTO chatbot_interactions
+			(user_id, conversation_id, query, response, intent, book_ids, provider, model, prompt_tokens, completion_tokens, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		userID, conversationID, utils.RedactPII(query), utils.RedactPII(completion.Text), string(intentJSON), pq.Array(bookIDs),
+		completion.Provider, completion.Model, completion.Usage.PromptTokens, completion.Usage.CompletionTokens, time.Now(),
+	)
+	if err != nil {
+		log.Printf("Error storing chatbot interaction: %v", err)
+		return
+	}
+
+	_, err = db.DB.Exec("UPDATE chatbot_conversations SET updated_at = CURRENT_TIMESTAMP WHERE id = $1", conversationID)
+	if err != nil {
+		log.Printf("Error updating chatbot conversation: %v", err)
+	}
 }
@@ -0,0 +1,427 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"reselling-app/db"
+	"reselling-app/models"
+	"reselling-app/utils"
+)
+
+const (
+	// Most recent turns loaded into the prompt, unless CHATBOT_HISTORY_TURNS overrides it
+	defaultChatbotHistoryTurns = 6
+	// Estimated tokens of unsummarised history allowed before older turns are
+	// summarised, unless CHATBOT_HISTORY_TOKENS overrides it
+	defaultChatbotHistoryTokens = 1500
+	// Turns left verbatim when the rest of a conversation is summarised
+	chatbotKeepTurns = 2
+	// Longest conversation title, taken from the first query
+	conversationTitleLength = 60
+)
+
+// errConversationNotFound is returned for conversations that don't exist or belong to someone else
+var errConversationNotFound = errors.New("conversation not found")
+
+// chatbotHistoryTurns returns how many recent turns are loaded into the prompt
+func chatbotHistoryTurns() int {
+	turns, err := strconv.Atoi(os.Getenv("CHATBOT_HISTORY_TURNS"))
+	if err != nil || turns < 0 {
+		return defaultChatbotHistoryTurns
+	}
+	return turns
+}
+
+// chatbotHistoryTokens returns the token budget for verbatim history
+func chatbotHistoryTokens() int {
+	tokens, err := strconv.Atoi(os.Getenv("CHATBOT_HISTORY_TOKENS"))
+	if err != nil || tokens <= 0 {
+		return defaultChatbotHistoryTokens
+	}
+	return tokens
+}
+
+// chatbotTurn is a stored query and reply with what was searched and shown
+type chatbotTurn struct {
+	ID       int
+	Query    string
+	Response string
+	Intent   utils.BookIntent
+	BookIDs  []int64
+}
+
+// tokens estimates the prompt tokens the turn takes up
+func (t chatbotTurn) tokens() int {
+	return utils.EstimateTokens(t.Query) + utils.EstimateTokens(t.Response)
+}
+
+// chatbotConversation is the server-side memory of a conversation
+type chatbotConversation struct {
+	ID      int
+	Summary string
+	Turns   []chatbotTurn // recent unsummarised turns, oldest first
+}
+
+// openConversation loads a user's conversation, or starts a new one titled
+// after the first query when conversationID is 0
+func openConversation(userID, conversationID int, query string) (*chatbotConversation, error) {
+	if conversationID == 0 {
+		title := []rune(utils.RedactPII(query))
+		if len(title) > conversationTitleLength {
+			title = append(title[:conversationTitleLength-1], '…')
+		}
+		conversation := &chatbotConversation{}
+		err := db.DB.QueryRow(
+			"INSERT INTO chatbot_conversations (user_id, title) VALUES ($1, $2) RETURNING id",
+			userID, string(title),
+		).Scan(&conversation.ID)
+		return conversation, err
+	}
+
+	conversation := &chatbotConversation{ID: conversationID}
+	var summarizedThrough int
+	err := db.DB.QueryRow(
+		"SELECT summary, summarized_through FROM chatbot_conversations WHERE id = $1 AND user_id = $2",
+		conversationID, userID,
+	).Scan(&conversation.Summary, &summarizedThrough)
+	if err == sql.ErrNoRows {
+		return nil, errConversationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conversation.Turns, err = loadConversationTurns(conversationID, summarizedThrough, chatbotHistoryTurns())
+	if err != nil {
+		return nil, err
+	}
+	return conversation, nil
+}
+
+// discardEmptyConversation deletes a conversation that has no turns, such as
+// one whose first reply failed
+func discardEmptyConversation(conversationID int) {
+	_, err := db.DB.Exec(`
+		DELETE FROM chatbot_conversations c
+		WHERE c.id = $1 AND NOT EXISTS (SELECT 1 FROM chatbot_interactions i WHERE i.conversation_id = c.id)`,
+		conversationID,
+	)
+	if err != nil {
+		log.Printf("Error discarding empty chatbot conversation: %v", err)
+	}
+}
+
+// loadConversationTurns returns up to limit of the latest turns after the given
+// interaction ID, oldest first. A negative limit loads them all.
+func loadConversationTurns(conversationID, afterID, limit int) ([]chatbotTurn, error) {
+	query := `
+		SELECT id, query, response, COALESCE(intent, '{}'), book_ids
+		FROM chatbot_interactions
+		WHERE conversation_id = $1 AND id > $2
+		ORDER BY id DESC`
+	args := []interface{}{conversationID, afterID}
+	if limit >= 0 {
+		query += " LIMIT $3"
+		args = append(args, limit)
+	}
+
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var turns []chatbotTurn
+	for rows.Next() {
+		var turn chatbotTurn
+		var intent []byte
+		if err := rows.Scan(&turn.ID, &turn.Query, &turn.Response, &intent, pq.Array(&turn.BookIDs)); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(intent, &turn.Intent); err != nil {
+			log.Printf("Error decoding chatbot intent for interaction %d: %v", turn.ID, err)
+		}
+		turns = append(turns, turn)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Reverse into chronological order
+	for i, j := 0, len(turns)-1; i < j; i, j = i+1, j-1 {
+		turns[i], turns[j] = turns[j], turns[i]
+	}
+	return turns, nil
+}
+
+// lastTurn returns the most recent turn, or nil for a new conversation
+func (c *chatbotConversation) lastTurn() *chatbotTurn {
+	if len(c.Turns) == 0 {
+		return nil
+	}
+	return &c.Turns[len(c.Turns)-1]
+}
+
+// resolveIntent fills in what a follow-up query leaves implicit from the previous turn
+func (c *chatbotConversation) resolveIntent(query string, intent utils.BookIntent) utils.BookIntent {
+	last := c.lastTurn()
+	if last == nil {
+		return intent
+	}
+	shown, err := loadBooksByID(last.BookIDs)
+	if err != nil {
+		log.Printf("Error loading previously shown books: %v", err)
+	}
+	return utils.ResolveFollowUp(query, intent, last.Intent, shown)
+}
+
+// addHistory prepends the summary and as many recent turns as fit the token budget to a prompt
+func (c *chatbotConversation) addHistory(prompt *utils.LLMRequest) {
+	if c.Summary != "" {
+		prompt.System += "\n\nSummary of the earlier conversation: " + utils.QuoteUntrusted("conversation_summary", c.Summary)
+	}
+
+	budget := chatbotHistoryTokens()
+	var history []utils.LLMMessage
+	for i := len(c.Turns) - 1; i >= 0; i-- {
+		turn := c.Turns[i]
+		budget -= turn.tokens()
+		if budget < 0 {
+			break
+		}
+		history = append([]utils.LLMMessage{
+			{Role: "user", Content: utils.QuoteUntrusted("user_message", turn.Query)},
+			{Role: "assistant", Content: turn.Response},
+		}, history...)
+	}
+	prompt.Messages = append(history, prompt.Messages...)
+}
+
+// summarizeConversation folds older turns into the conversation summary once
+// the unsummarised history exceeds the token budget
+func summarizeConversation(conversationID int) {
+	var summary string
+	var summarizedThrough int
+	err := db.DB.QueryRow(
+		"SELECT summary, summarized_through FROM chatbot_conversations WHERE id = $1",
+		conversationID,
+	).Scan(&summary, &summarizedThrough)
+	if err != nil {
+		log.Printf("Error loading chatbot conversation %d for summarisation: %v", conversationID, err)
+		return
+	}
+
+	turns, err := loadConversationTurns(conversationID, summarizedThrough, -1)
+	if err != nil {
+		log.Printf("Error loading chatbot turns for summarisation: %v", err)
+		return
+	}
+
+	var tokens int
+	for _, turn := range turns {
+		tokens += turn.tokens()
+	}
+	if tokens <= chatbotHistoryTokens() || len(turns) <= chatbotKeepTurns {
+		return
+	}
+
+	folded := turns[:len(turns)-chatbotKeepTurns]
+	var messages []utils.LLMMessage
+	for _, turn := range folded {
+		messages = append(messages,
+			utils.LLMMessage{Role: "user", Content: turn.Query},
+			utils.LLMMessage{Role: "assistant", Content: turn.Response},
+		)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	summary, usage, err := utils.SummarizeConversation(ctx, utils.DefaultLLMProvider(), summary, messages)
+	if err != nil {
+		log.Printf("Error summarising chatbot conversation %d: %v", conversationID, err)
+		return
+	}
+
+	_, err = db.DB.Exec(
+		"UPDATE chatbot_conversations SET summary = $1, summarized_through = $2 WHERE id = $3",
+		summary, folded[len(folded)-1].ID, conversationID,
+	)
+	if err != nil {
+		log.Printf("Error saving chatbot conversation summary: %v", err)
+		return
+	}
+	log.Printf("Summarised %d turns of chatbot conversation %d using %d tokens", len(folded), conversationID, usage.TotalTokens)
+}
+
+// loadBooksByID returns the given books in the same order
+func loadBooksByID(ids []int64) ([]models.Book, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT b.id, b.seller_id, u.username, b.title, b.author, COALESCE(b.description, ''),
+		       b.price, COALESCE(b.image_url, ''), COALESCE(b.genre, ''), COALESCE(b.condition, ''),
+		       b.status, b.created_at
+		FROM books b
+		JOIN users u ON b.seller_id = u.id
+		WHERE b.id = ANY($1)`,
+		pq.Array(ids),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byID := make(map[int]models.Book, len(ids))
+	for rows.Next() {
+		var book models.Book
+		if err := rows.Scan(
+			&book.ID, &book.SellerID, &book.SellerUsername, &book.Title, &book.Author,
+			&book.Description, &book.Price, &book.ImageURL, &book.Genre, &book.Condition,
+			&book.Status, &book.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		byID[book.ID] = book
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	books := make([]models.Book, 0, len(ids))
+	for _, id := range ids {
+		if book, ok := byID[int(id)]; ok {
+			books = append(books, book)
+		}
+	}
+	return books, nil
+}
+
+// GetChatbotConversations lists the user's chatbot conversations, most recent first
+func GetChatbotConversations(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	rows, err := db.DB.Query(`
+		SELECT c.id, c.title, c.summary, COUNT(i.id), c.created_at, c.updated_at
+		FROM chatbot_conversations c
+		LEFT JOIN chatbot_interactions i ON i.conversation_id = c.id
+		WHERE c.user_id = $1
+		GROUP BY c.id
+		ORDER BY c.updated_at DESC`,
+		userID,
+	)
+	if err != nil {
+		log.Printf("Database error listing chatbot conversations: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve conversations"})
+		return
+	}
+	defer rows.Close()
+
+	conversations := []models.ChatbotConversation{}
+	for rows.Next() {
+		var conversation models.ChatbotConversation
+		if err := rows.Scan(
+			&conversation.ID, &conversation.Title, &conversation.Summary, &conversation.TurnCount,
+			&conversation.CreatedAt, &conversation.UpdatedAt,
+		); err != nil {
+			log.Printf("Error scanning chatbot conversation: %v", err)
+			continue
+		}
+		conversations = append(conversations, conversation)
+	}
+
+	c.JSON(http.StatusOK, conversations)
+}
+
+// GetChatbotConversation returns one of the user's conversations with every turn
+func GetChatbotConversation(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	conversationID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid conversation ID"})
+		return
+	}
+
+	var conversation models.ChatbotConversation
+	err = db.DB.QueryRow(`
+		SELECT id, title, summary, created_at, updated_at
+		FROM chatbot_conversations
+		WHERE id = $1 AND user_id = $2`,
+		conversationID, userID,
+	).Scan(&conversation.ID, &conversation.Title, &conversation.Summary, &conversation.CreatedAt, &conversation.UpdatedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Database error loading chatbot conversation: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve conversation"})
+		return
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT id, query, response, book_ids, created_at
+		FROM chatbot_interactions
+		WHERE conversation_id = $1
+		ORDER BY id ASC`,
+		conversationID,
+	)
+	if err != nil {
+		log.Printf("Database error loading chatbot turns: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve conversation"})
+		return
+	}
+	defer rows.Close()
+
+	conversation.Turns = []models.ChatbotTurn{}
+	for rows.Next() {
+		var turn models.ChatbotTurn
+		if err := rows.Scan(&turn.ID, &turn.Query, &turn.Response, pq.Array(&turn.BookIDs), &turn.CreatedAt); err != nil {
+			log.Printf("Error scanning chatbot turn: %v", err)
+			continue
+		}
+		conversation.Turns = append(conversation.Turns, turn)
+	}
+	conversation.TurnCount = len(conversation.Turns)
+
+	c.JSON(http.StatusOK, conversation)
+}
+
+// DeleteChatbotConversation deletes one of the user's conversations and all its turns
+func DeleteChatbotConversation(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	conversationID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid conversation ID"})
+		return
+	}
+
+	result, err := db.DB.Exec(
+		"DELETE FROM chatbot_conversations WHERE id = $1 AND user_id = $2",
+		conversationID, userID,
+	)
+	if err != nil {
+		log.Printf("Database error deleting chatbot conversation: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete conversation"})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Conversation deleted"})
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"sort"
+
+	"reselling-app/db"
+	"reselling-app/models"
+	"reselling-app/recommender"
+	"reselling-app/utils"
+)
+
+const (
+	// Genres and authors kept in a reader profile
+	readerProfileGenres  = 3
+	readerProfileAuthors = 3
+	// Days of activity a reader profile is built from
+	readerProfileWindowDays = 180
+)
+
+// readerProfile is what a signed-in user tends to like, from the listings they
+// viewed, saved and bought and the genres they asked the chatbot about
+type readerProfile struct {
+	Genres  []string
+	Authors []string
+}
+
+// loadReaderProfile builds a user's profile, weighting interactions like the recommender
+func loadReaderProfile(userID int) (readerProfile, error) {
+	var profile readerProfile
+
+	genres, err := topPreferences(`
+		SELECT genre, SUM(weight) AS weight
+		FROM (
+			SELECT b.genre,
+			       CASE i.interaction_type WHEN 'purchase' THEN 5 WHEN 'favorite' THEN 3 WHEN 'search' THEN 1.5 ELSE 1 END AS weight
+			FROM user_book_interactions i
+			JOIN books b ON b.id = i.book_id
+			WHERE i.user_id = $1 AND i.created_at > NOW() - make_interval(days => $2)
+			UNION ALL
+			SELECT jsonb_array_elements_text(ci.intent->'genres'), 1
+			FROM chatbot_interactions ci
+			WHERE ci.user_id = $1 AND ci.created_at > NOW() - make_interval(days => $2)
+			  AND jsonb_typeof(ci.intent->'genres') = 'array'
+		) preferences
+		WHERE COALESCE(genre, '') <> ''
+		GROUP BY genre
+		ORDER BY weight DESC, genre
+		LIMIT $3`,
+		userID, readerProfileWindowDays, readerProfileGenres,
+	)
+	if err != nil {
+		return profile, err
+	}
+	profile.Genres = genres
+
+	authors, err := topPreferences(`
+		SELECT b.author,
+		       SUM(CASE i.interaction_type WHEN 'purchase' THEN 5 WHEN 'favorite' THEN 3 WHEN 'search' THEN 1.5 ELSE 1 END) AS weight
+		FROM user_book_interactions i
+		JOIN books b ON b.id = i.book_id
+		WHERE i.user_id = $1 AND i.created_at > NOW() - make_interval(days => $2)
+		GROUP BY b.author
+		-- A single view says little about liking an author
+		HAVING SUM(CASE i.interaction_type WHEN 'view' THEN 1 ELSE 3 END) >= 3
+		ORDER BY weight DESC, b.author
+		LIMIT $3`,
+		userID, readerProfileWindowDays, readerProfileAuthors,
+	)
+	if err != nil {
+		return profile, err
+	}
+	profile.Authors = authors
+	return profile, nil
+}
+
+// topPreferences returns the names selected by a ranked preference query
+func topPreferences(query string, args ...interface{}) ([]string, error) {
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		var weight float64
+		if err := rows.Scan(&name, &weight); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// rank moves listings matching the profile ahead of the rest, keeping the
+// retrieval order otherwise
+func (p readerProfile) rank(books []models.Book) {
+	score := func(book models.Book) int {
+		s := 0
+		for _, genre := range p.Genres {
+			if book.Genre == genre {
+				s += 2
+			}
+		}
+		for _, author := range p.Authors {
+			if book.Author == author {
+				s++
+			}
+		}
+		return s
+	}
+	sort.SliceStable(books, func(i, j int) bool {
+		return score(books[i]) > score(books[j])
+	})
+}
+
+// personalizedListings returns recommender picks for queries that don't say
+// what the user wants, such as "recommend me something"
+func personalizedListings(userID int) ([]models.Book, error) {
+	recommendations, err := recommender.Default.Recommend(db.DB, userID, chatbotContextListings)
+	if err != nil {
+		return nil, err
+	}
+	books := make([]models.Book, 0, len(recommendations))
+	for _, r := range recommendations {
+		books = append(books, r.Book)
+	}
+	return books, nil
+}
+
+// retrieveChatbotListings retrieves listings for a query, ranked by the
+// user's profile, or recommends listings when a signed-in user's query
+// names nothing to search for. Listings from sellers the user has blocked
+// are left out.
+func retrieveChatbotListings(userID int, intent utils.BookIntent, profile readerProfile) ([]models.Book, error) {
+	if userID > 0 && intent.Empty() {
+		books, err := personalizedListings(userID)
+		if err != nil {
+			return nil, err
+		}
+		return withoutBlockedSellers(books, userID)
+	}
+	books, err := retrieveListings(intent)
+	if err != nil {
+		return nil, err
+	}
+	profile.rank(books)
+	return withoutBlockedSellers(books, userID)
+}
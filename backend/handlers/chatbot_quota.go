@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"reselling-app/db"
+	"reselling-app/models"
+)
+
+// Default number of chatbot queries a user may make per day, unless
+// CHATBOT_DAILY_QUOTA or the user's own quota overrides it
+const defaultChatbotDailyQuota = 50
+
+// errChatbotQuotaExceeded is returned once a user has used up today's queries
+var errChatbotQuotaExceeded = errors.New("chatbot daily quota exceeded")
+
+// chatbotDailyQuota returns the default per-user daily quota from the environment
+func chatbotDailyQuota() int {
+	quota, err := strconv.Atoi(os.Getenv("CHATBOT_DAILY_QUOTA"))
+	if err != nil || quota <= 0 {
+		return defaultChatbotDailyQuota
+	}
+	return quota
+}
+
+// reserveChatbotQuery counts a query against the user's quota for today
+// before it is answered, reporting false without counting it if the quota is
+// used up. A quota set on the user replaces the default; 0 turns the chatbot
+// off for them. The count is kept apart from conversations, so deleting one
+// doesn't give its queries back.
+func reserveChatbotQuery(userID int) (bool, error) {
+	var quota sql.NullInt64
+	err := db.DB.QueryRow("SELECT chatbot_daily_quota FROM users WHERE id = $1", userID).Scan(&quota)
+	if err != nil {
+		return false, err
+	}
+	limit := chatbotDailyQuota()
+	if quota.Valid {
+		limit = int(quota.Int64)
+	}
+	if limit <= 0 {
+		return false, nil
+	}
+
+	// The increment only happens under the limit, so concurrent queries can't overshoot it
+	var used int
+	err = db.DB.QueryRow(`
+		INSERT INTO chatbot_usage (user_id, day, queries) VALUES ($1, CURRENT_DATE, 1)
+		ON CONFLICT (user_id, day) DO UPDATE SET queries = chatbot_usage.queries + 1
+		WHERE chatbot_usage.queries < $2
+		RETURNING queries`,
+		userID, limit,
+	).Scan(&used)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// releaseChatbotQuery gives back a reserved query that failed before anything
+// was sent to a model provider
+func releaseChatbotQuery(userID int) {
+	_, err := db.DB.Exec(
+		"UPDATE chatbot_usage SET queries = queries - 1 WHERE user_id = $1 AND day = CURRENT_DATE AND queries > 0",
+		userID,
+	)
+	if err != nil {
+		log.Printf("Error releasing chatbot query: %v", err)
+	}
+}
+
+// SetChatbotQuota sets or clears a user's daily chatbot quota (admin only).
+// A null daily_quota returns the user to the default.
+func SetChatbotQuota(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var input models.ChatbotQuotaInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.DailyQuota != nil && *input.DailyQuota < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Daily quota can't be negative"})
+		return
+	}
+
+	result, err := db.DB.Exec("UPDATE users SET chatbot_daily_quota = $1 WHERE id = $2", input.DailyQuota, userID)
+	if err != nil {
+		log.Printf("Database error updating chatbot quota: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update chatbot quota"})
+		return
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	dailyQuota := chatbotDailyQuota()
+	if input.DailyQuota != nil {
+		dailyQuota = *input.DailyQuota
+	}
+	c.JSON(http.StatusOK, gin.H{"user_id": userID, "daily_quota": dailyQuota})
+}
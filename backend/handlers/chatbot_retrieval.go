@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+	"reselling-app/db"
+	"reselling-app/models"
+	"reselling-app/utils"
+)
+
+// chatbotContextListings is how many listings are retrieved into the chatbot prompt
+const chatbotContextListings = 8
+
+// retrieveListings finds available listings matching an extracted intent.
+// Genre, author and budget are hard filters; keywords and the exam name rank
+// the results, and are required to match only when nothing else narrows the search.
+func retrieveListings(intent utils.BookIntent) ([]models.Book, error) {
+	if intent.Empty() {
+		return []models.Book{}, nil
+	}
+
+	terms := append([]string{}, intent.Keywords...)
+	if intent.Exam != "" {
+		terms = append(terms, intent.Exam)
+	}
+	// Non-nil slices, since pq sends a nil slice as NULL rather than an empty array
+	genres := append([]string{}, intent.Genres...)
+	requireTerms := len(genres) == 0 && intent.Author == "" && intent.MinPrice == 0 && intent.MaxPrice == 0
+
+	rows, err := db.DB.Query(`
+		SELECT id, seller_id, username, title, author, description, price, image_url, genre, condition, status, created_at
+		FROM (
+			SELECT b.id, b.seller_id, u.username, b.title, b.author, COALESCE(b.description, '') AS description,
+			       b.price, COALESCE(b.image_url, '') AS image_url, COALESCE(b.genre, '') AS genre,
+			       COALESCE(b.condition, '') AS condition, b.status, b.created_at,
+			       (SELECT COUNT(*) FROM unnest($5::text[]) AS k(term)
+			        WHERE b.title ILIKE '%' || k.term || '%'
+			           OR b.author ILIKE '%' || k.term || '%'
+			           OR COALESCE(b.description, '') ILIKE '%' || k.term || '%') AS matches
+			FROM books b
+			JOIN users u ON b.seller_id = u.id
+			WHERE b.status = 'available'
+			  AND (cardinality($1::text[]) = 0 OR b.genre ILIKE ANY($1::text[]))
+			  AND ($2::text = '' OR b.author ILIKE '%' || $2::text || '%')
+			  AND ($3::numeric = 0 OR b.price >= $3::numeric)
+			  AND ($4::numeric = 0 OR b.price <= $4::numeric)
+		) candidates
+		WHERE NOT $6::boolean OR matches > 0
+		ORDER BY matches DESC, created_at DESC
+		LIMIT $7`,
+		pq.Array(genres), intent.Author, intent.MinPrice, intent.MaxPrice,
+		pq.Array(terms), requireTerms, chatbotContextListings,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	books := []models.Book{}
+	for rows.Next() {
+		var book models.Book
+		if err := rows.Scan(
+			&book.ID, &book.SellerID, &book.SellerUsername, &book.Title, &book.Author,
+			&book.Description, &book.Price, &book.ImageURL, &book.Genre, &book.Condition,
+			&book.Status, &book.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		books = append(books, book)
+	}
+	return books, rows.Err()
+}
+
+// citedBooks removes citations of listings that weren't retrieved and returns
+// the cited listings in the order the reply mentions them. If the reply cites
+// nothing, every retrieved listing is returned.
+func citedBooks(reply string, retrieved []models.Book) (string, []models.Book) {
+	byID := make(map[int]models.Book, len(retrieved))
+	allowed := make(map[int]bool, len(retrieved))
+	for _, book := range retrieved {
+		byID[book.ID] = book
+		allowed[book.ID] = true
+	}
+
+	reply = utils.StripCitations(reply, allowed)
+	ids := utils.CitedIDs(reply)
+	if len(ids) == 0 {
+		return reply, retrieved
+	}
+
+	books := make([]models.Book, 0, len(ids))
+	for _, id := range ids {
+		books = append(books, byID[id])
+	}
+	return reply, books
+}
+
+var (
+	// partialCitation matches the start of a listing marker still being streamed
+	partialCitation = regexp.MustCompile(`^\[(#\d*)?$`)
+	// fullCitation matches a complete listing marker
+	fullCitation = regexp.MustCompile(`^\[#\d+\]$`)
+)
+
+// citationStream forwards streamed reply text while holding back partial
+// listing markers until they can be checked, so streamed text matches the
+// final reply with citations of unretrieved listings removed
+type citationStream struct {
+	allowed map[int]bool
+	pending string
+	emit    func(string) error
+	started bool // whether any text has been forwarded
+}
+
+// newCitationStream creates a stream that allows citations of the retrieved listings
+func newCitationStream(retrieved []models.Book, emit func(string) error) *citationStream {
+	allowed := make(map[int]bool, len(retrieved))
+	for _, book := range retrieved {
+		allowed[book.ID] = true
+	}
+	return &citationStream{allowed: allowed, emit: emit}
+}
+
+// allow permits citations of listings returned after the stream started
+func (s *citationStream) allow(books []models.Book) {
+	for _, book := range books {
+		s.allowed[book.ID] = true
+	}
+}
+
+// write accepts the next piece of generated text
+func (s *citationStream) write(text string) error {
+	s.pending += text
+
+	var out strings.Builder
+	for {
+		i := strings.IndexByte(s.pending, '[')
+		if i < 0 {
+			out.WriteString(s.pending)
+			s.pending = ""
+			break
+		}
+		out.WriteString(s.pending[:i])
+		s.pending = s.pending[i:]
+
+		end := strings.IndexByte(s.pending, ']')
+		if end < 0 {
+			if partialCitation.MatchString(s.pending) {
+				break // wait for the rest of the marker
+			}
+			out.WriteByte('[')
+			s.pending = s.pending[1:]
+			continue
+		}
+		if candidate := s.pending[:end+1]; fullCitation.MatchString(candidate) {
+			out.WriteString(utils.StripCitations(candidate, s.allowed))
+			s.pending = s.pending[end+1:]
+			continue
+		}
+		out.WriteByte('[')
+		s.pending = s.pending[1:]
+	}
+
+	return s.forward(out.String())
+}
+
+// flush forwards any text still held back at the end of the stream
+func (s *citationStream) flush() error {
+	text := s.pending
+	s.pending = ""
+	return s.forward(text)
+}
+
+func (s *citationStream) forward(text string) error {
+	if text == "" {
+		return nil
+	}
+	s.started = true
+	return s.emit(text)
+}
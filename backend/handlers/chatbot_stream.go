@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"reselling-app/middleware"
+	"reselling-app/models"
+)
+
+// StreamChatbotResponse streams a chatbot reply as server-sent events. "token"
+// events carry text as it is generated, then a final "books" event carries the
+// whole reply, the cited books and the conversation ID. Generation stops when
+// the client disconnects.
+func StreamChatbotResponse(c *gin.Context) {
+	input := models.ChatbotQuery{Query: strings.TrimSpace(c.Query("query"))}
+	if input.Query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Query is required"})
+		return
+	}
+	if raw := c.Query("conversation_id"); raw != "" {
+		conversationID, err := strconv.Atoi(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid conversation ID"})
+			return
+		}
+		input.ConversationID = conversationID
+	}
+
+	// Get user ID from context if authenticated
+	var userID int
+	if userIDValue, exists := c.Get("userID"); exists {
+		userID = userIDValue.(int)
+	}
+
+	// The request context is cancelled when the client disconnects
+	ctx, cancel := context.WithTimeout(c.Request.Context(), chatbotStreamTimeout)
+	defer cancel()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	response, err := answerChatbotQuery(ctx, userID, input, func(text string) error {
+		c.SSEvent("token", gin.H{"text": text})
+		c.Writer.Flush()
+		return ctx.Err()
+	})
+	if err != nil {
+		if c.Request.Context().Err() != nil {
+			log.Printf("Chatbot stream cancelled by client")
+			return
+		}
+		log.Printf("Error streaming chatbot reply: %v", err)
+		c.SSEvent("error", gin.H{"error": chatbotErrorMessage(err)})
+		c.Writer.Flush()
+		return
+	}
+
+	c.SSEvent("books", response)
+	c.Writer.Flush()
+}
+
+// HandleChatbotWebSocket serves chatbot queries over a WebSocket. Clients send
+// {"type": "chatbot_query", "content": "...", "data": {"conversation_id": 3}} and
+// receive "chatbot_token" frames followed by a "chatbot_response" frame whose
+// data holds the reply and book cards. "chatbot_cancel" stops the current reply,
+// as does sending a new query or closing the socket. Pass ?token= to sign in.
+func HandleChatbotWebSocket(c *gin.Context) {
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade chatbot connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// Authentication is optional; signed-in users get conversation memory
+	var userID int
+	if userIDValue, exists := c.Get("userID"); exists {
+		userID = userIDValue.(int)
+	}
+	// The route's rate limit only covers the upgrade, so each query is limited too
+	limits, limited := middleware.RateLimitsFromContext(c)
+	clientIP := c.ClientIP()
+
+	// Streams and the read loop share the connection, so writes are serialised
+	var writeMu sync.Mutex
+	send := func(msg models.WebSocketMessage) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		msg.Timestamp = time.Now()
+		return conn.WriteJSON(msg)
+	}
+
+	connCtx, cancelConn := context.WithCancel(context.Background())
+	defer cancelConn()
+	cancelQuery := context.CancelFunc(func() {})
+
+	for {
+		var msg models.WebSocketMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			break
+		}
+
+		switch msg.Type {
+		case "chatbot_query":
+			input := models.ChatbotQuery{Query: strings.TrimSpace(msg.Content), ConversationID: dataInt(msg.Data, "conversation_id")}
+			if input.Query == "" {
+				send(models.WebSocketMessage{Type: "error", Content: "Query is required"})
+				continue
+			}
+			if limited {
+				if ok, _ := limits.Allow(userID, clientIP); !ok {
+					send(models.WebSocketMessage{Type: "error", Content: "Too many requests, please slow down"})
+					continue
+				}
+			}
+
+			// A new query replaces the one in flight
+			cancelQuery()
+			ctx, cancel := context.WithTimeout(connCtx, chatbotStreamTimeout)
+			cancelQuery = cancel
+			go streamChatbotOverWebSocket(ctx, cancel, userID, input, send)
+
+		case "chatbot_cancel":
+			cancelQuery()
+
+		default:
+			send(models.WebSocketMessage{Type: "error", Content: "Unknown message type"})
+		}
+	}
+	cancelQuery()
+}
+
+// streamChatbotOverWebSocket answers one query, sending tokens then the final response
+func streamChatbotOverWebSocket(ctx context.Context, cancel context.CancelFunc, userID int, input models.ChatbotQuery, send func(models.WebSocketMessage) error) {
+	defer cancel()
+
+	response, err := answerChatbotQuery(ctx, userID, input, func(text string) error {
+		if err := send(models.WebSocketMessage{Type: "chatbot_token", Content: text}); err != nil {
+			return err
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		log.Printf("Error streaming chatbot reply: %v", err)
+		send(models.WebSocketMessage{Type: "error", Content: chatbotErrorMessage(err)})
+		return
+	}
+
+	send(models.WebSocketMessage{Type: "chatbot_response", Content: response.Response, Data: response})
+}
+
+// chatbotErrorMessage returns the client-facing message for a failed chatbot query
+func chatbotErrorMessage(err error) string {
+	var chatErr *chatbotError
+	switch {
+	case errors.As(err, &chatErr):
+		return chatErr.Message
+	case errors.Is(err, context.DeadlineExceeded):
+		return "The assistant took too long to respond"
+	default:
+		return "Failed to generate recommendations"
+	}
+}
+
+// dataInt reads an integer field from a WebSocket message's decoded data object
+func dataInt(data interface{}, key string) int {
+	fields, ok := data.(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	value, _ := fields[key].(float64)
+	return int(value)
+}
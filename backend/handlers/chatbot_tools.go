@@ -0,0 +1,427 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"reselling-app/db"
+	"reselling-app/models"
+	"reselling-app/utils"
+)
+
+const (
+	// chatbotToolRounds caps how many rounds of tool calls one reply may make
+	chatbotToolRounds = 3
+	// chatbotToolListings caps how many listings a search returns to the model
+	chatbotToolListings = 5
+	// chatbotToolDescriptionLength caps the listing description returned by get_book
+	chatbotToolDescriptionLength = 500
+)
+
+// chatbotToolError is a tool failure the model may explain to the user.
+// Other errors are logged and reported to the model as a generic failure.
+type chatbotToolError struct {
+	message string
+}
+
+func (e *chatbotToolError) Error() string {
+	return e.message
+}
+
+func toolErrorf(format string, args ...interface{}) error {
+	return &chatbotToolError{message: fmt.Sprintf(format, args...)}
+}
+
+// chatbotTool is a function the chatbot may call. Tools that act for the
+// user are only offered to, and only run for, signed-in users.
+type chatbotTool struct {
+	definition   utils.LLMTool
+	requiresAuth bool
+	run          func(t *chatbotTools, args json.RawMessage) (interface{}, error)
+}
+
+// bookIDParameter is the schema of tools that take a single listing
+var bookIDParameter = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"book_id": map[string]interface{}{"type": "integer", "description": "Listing ID, the number in a marker such as [#12]"},
+	},
+	"required": []string{"book_id"},
+}
+
+// chatbotToolbox lists every tool in the order they're offered to the model
+var chatbotToolbox = []chatbotTool{
+	{
+		definition: utils.LLMTool{
+			Name:        "search_books",
+			Description: "Search available BookBridge listings, newest first. All filters are optional.",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"query":     map[string]interface{}{"type": "string", "description": "Text to match in the title, author or description"},
+					"genre":     map[string]interface{}{"type": "string", "description": "Exact genre, e.g. Fiction, Mystery, Fantasy, Self-help, Physics"},
+					"min_price": map[string]interface{}{"type": "number", "description": "Minimum price in rupees"},
+					"max_price": map[string]interface{}{"type": "number", "description": "Maximum price in rupees"},
+				},
+			},
+		},
+		run: searchBooksTool,
+	},
+	{
+		definition: utils.LLMTool{
+			Name:        "get_book",
+			Description: "Get the full details of one listing, including its description and whether it is still available.",
+			Parameters:  bookIDParameter,
+		},
+		run: getBookTool,
+	},
+	{
+		definition: utils.LLMTool{
+			Name:        "get_price_estimate",
+			Description: "Estimate a fair resale price range in rupees, either for an existing listing or for a book described by title, author, genre and condition.",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"book_id":   map[string]interface{}{"type": "integer", "description": "Listing ID to estimate, instead of describing the book"},
+					"title":     map[string]interface{}{"type": "string"},
+					"author":    map[string]interface{}{"type": "string"},
+					"genre":     map[string]interface{}{"type": "string"},
+					"condition": map[string]interface{}{"type": "string", "description": "New, Like New, Very Good, Good, Acceptable or Poor"},
+				},
+			},
+		},
+		run: priceEstimateTool,
+	},
+	{
+		definition: utils.LLMTool{
+			Name:        "add_to_favorites",
+			Description: "Save a listing to the signed-in user's favourites. Only call this when the user asks.",
+			Parameters:  bookIDParameter,
+		},
+		requiresAuth: true,
+		run:          addToFavoritesTool,
+	},
+	{
+		definition: utils.LLMTool{
+			Name:        "add_to_cart",
+			Description: "Add an available listing to the signed-in user's cart. Only call this when the user asks.",
+			Parameters:  bookIDParameter,
+		},
+		requiresAuth: true,
+		run:          addToCartTool,
+	},
+}
+
+// chatbotTools runs the tool calls made while answering one query, as the
+// user who asked it, and collects what the reply may show
+type chatbotTools struct {
+	ctx            context.Context
+	userID         int
+	conversationID int
+	books          []models.Book // retrieved listings and those returned by tools, which the reply may cite
+	actions        []models.ChatbotAction
+}
+
+// newChatbotTools creates a tool runner for a query; userID is 0 for anonymous users
+func newChatbotTools(ctx context.Context, userID, conversationID int) *chatbotTools {
+	return &chatbotTools{ctx: ctx, userID: userID, conversationID: conversationID}
+}
+
+// definitions returns the tools the user may use
+func (t *chatbotTools) definitions() []utils.LLMTool {
+	var tools []utils.LLMTool
+	for _, tool := range chatbotToolbox {
+		if tool.requiresAuth && t.userID == 0 {
+			continue
+		}
+		tools = append(tools, tool.definition)
+	}
+	return tools
+}
+
+// call runs one tool call, audit-logs it and returns the result for the model
+func (t *chatbotTools) call(call utils.LLMToolCall) utils.LLMMessage {
+	start := time.Now()
+	result, err := t.run(call)
+	t.audit(call, result, err, time.Since(start))
+
+	if err != nil {
+		var toolErr *chatbotToolError
+		if !errors.As(err, &toolErr) {
+			log.Printf("Error running chatbot tool %s: %v", call.Name, err)
+			err = toolErrorf("something went wrong, please try again later")
+		}
+		return utils.ToolResult(call, map[string]string{"error": err.Error()})
+	}
+	return utils.ToolResult(call, result)
+}
+
+func (t *chatbotTools) run(call utils.LLMToolCall) (interface{}, error) {
+	for _, tool := range chatbotToolbox {
+		if tool.definition.Name != call.Name {
+			continue
+		}
+		// Checked again here since the model can name any tool
+		if tool.requiresAuth && t.userID == 0 {
+			return nil, toolErrorf("the user must sign in to do that")
+		}
+		if err := t.ctx.Err(); err != nil {
+			return nil, err
+		}
+		return tool.run(t, call.Arguments)
+	}
+	return nil, toolErrorf("unknown tool %q", call.Name)
+}
+
+// audit records a tool call and its outcome
+func (t *chatbotTools) audit(call utils.LLMToolCall, result interface{}, callErr error, elapsed time.Duration) {
+	arguments := utils.RedactPII(string(call.Arguments))
+	if len(call.Arguments) == 0 {
+		arguments = "{}"
+	} else if !json.Valid([]byte(arguments)) {
+		encoded, _ := json.Marshal(map[string]string{"raw": arguments})
+		arguments = string(encoded)
+	}
+	var resultJSON, errText interface{}
+	if callErr != nil {
+		errText = callErr.Error()
+	} else if encoded, err := json.Marshal(result); err == nil {
+		resultJSON = string(encoded)
+	}
+
+	_, err := db.DB.Exec(`
+		INSERT INTO chatbot_tool_calls (user_id, conversation_id, tool, arguments, result, error, duration_ms)
+		VALUES (NULLIF($1, 0), NULLIF($2, 0), $3, $4, $5, $6, $7)`,
+		t.userID, t.conversationID, call.Name, arguments, resultJSON, errText, elapsed.Milliseconds(),
+	)
+	if err != nil {
+		log.Printf("Error recording chatbot tool call: %v", err)
+	}
+}
+
+// addBooks makes listings citable in the reply
+func (t *chatbotTools) addBooks(books ...models.Book) {
+	for _, book := range books {
+		known := false
+		for _, existing := range t.books {
+			if existing.ID == book.ID {
+				known = true
+				break
+			}
+		}
+		if !known {
+			t.books = append(t.books, book)
+		}
+	}
+}
+
+// decodeToolArguments decodes a call's arguments, treating none as an empty object
+func decodeToolArguments(args json.RawMessage, v interface{}) error {
+	if len(args) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(args, v); err != nil {
+		return toolErrorf("invalid arguments: %v", err)
+	}
+	return nil
+}
+
+// toolListing is how a listing is described to the model in tool results
+type toolListing struct {
+	ID          int     `json:"id"`
+	Title       string  `json:"title"`
+	Author      string  `json:"author"`
+	Genre       string  `json:"genre,omitempty"`
+	Condition   string  `json:"condition,omitempty"`
+	Price       float64 `json:"price"`
+	Status      string  `json:"status"`
+	Seller      string  `json:"seller"`
+	Description string  `json:"description,omitempty"`
+}
+
+func newToolListing(book models.Book) toolListing {
+	return toolListing{
+		ID: book.ID, Title: book.Title, Author: book.Author, Genre: book.Genre,
+		Condition: book.Condition, Price: book.Price, Status: book.Status, Seller: book.SellerUsername,
+	}
+}
+
+// toolBooksResult is the result of a tool that returns listings
+type toolBooksResult struct {
+	Message string        `json:"message"`
+	Books   []toolListing `json:"books"`
+}
+
+// toolBook loads a listing for a tool, failing if the user may not see it
+func (t *chatbotTools) toolBook(bookID int) (models.Book, error) {
+	if bookID <= 0 {
+		return models.Book{}, toolErrorf("book_id is required")
+	}
+	book, err := visibleBook(bookID, t.userID)
+	if errors.Is(err, errBookNotFound) {
+		return models.Book{}, toolErrorf("listing %d was not found", bookID)
+	}
+	return book, err
+}
+
+// searchBooksTool searches listings with the same filters as the books API
+func searchBooksTool(t *chatbotTools, args json.RawMessage) (interface{}, error) {
+	var input struct {
+		Query    string  `json:"query"`
+		Genre    string  `json:"genre"`
+		MinPrice float64 `json:"min_price"`
+		MaxPrice float64 `json:"max_price"`
+	}
+	if err := decodeToolArguments(args, &input); err != nil {
+		return nil, err
+	}
+
+	books, err := searchBooks(bookFilter{
+		Genre:    strings.TrimSpace(input.Genre),
+		MinPrice: input.MinPrice,
+		MaxPrice: input.MaxPrice,
+		Search:   strings.TrimSpace(input.Query),
+		Limit:    chatbotToolListings,
+		ViewerID: t.userID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.addBooks(books...)
+
+	result := toolBooksResult{Message: fmt.Sprintf("Found %d matching listings.", len(books)), Books: []toolListing{}}
+	if len(books) == 0 {
+		result.Message = "No available listings match that search."
+	}
+	for _, book := range books {
+		result.Books = append(result.Books, newToolListing(book))
+	}
+	return result, nil
+}
+
+// getBookTool returns one listing with its description
+func getBookTool(t *chatbotTools, args json.RawMessage) (interface{}, error) {
+	var input struct {
+		BookID int `json:"book_id"`
+	}
+	if err := decodeToolArguments(args, &input); err != nil {
+		return nil, err
+	}
+	book, err := t.toolBook(input.BookID)
+	if err != nil {
+		return nil, err
+	}
+	t.addBooks(book)
+
+	listing := newToolListing(book)
+	description := book.Description
+	if runes := []rune(description); len(runes) > chatbotToolDescriptionLength {
+		description = string(runes[:chatbotToolDescriptionLength]) + "…"
+	}
+	// Descriptions are written by sellers, so they're delimited as untrusted text
+	listing.Description = utils.QuoteUntrusted("listing", description)
+	return toolBooksResult{
+		Message: fmt.Sprintf("%s %q by %s is %s at ₹%.0f.", utils.CitationMarker(book.ID), book.Title, book.Author, book.Status, book.Price),
+		Books:   []toolListing{listing},
+	}, nil
+}
+
+// priceEstimateTool estimates a resale price with the same model as the price API
+func priceEstimateTool(t *chatbotTools, args json.RawMessage) (interface{}, error) {
+	var input struct {
+		BookID    int    `json:"book_id"`
+		Title     string `json:"title"`
+		Author    string `json:"author"`
+		Genre     string `json:"genre"`
+		Condition string `json:"condition"`
+	}
+	if err := decodeToolArguments(args, &input); err != nil {
+		return nil, err
+	}
+
+	book := models.BookInput{Title: input.Title, Author: input.Author, Genre: input.Genre, Condition: input.Condition}
+	name := fmt.Sprintf("%q", input.Title)
+	if input.BookID > 0 {
+		listing, err := t.toolBook(input.BookID)
+		if err != nil {
+			return nil, err
+		}
+		book = models.BookInput{Title: listing.Title, Author: listing.Author, Genre: listing.Genre, Condition: listing.Condition}
+		name = fmt.Sprintf("%s %q", utils.CitationMarker(listing.ID), listing.Title)
+	}
+	if strings.TrimSpace(book.Title) == "" {
+		return nil, toolErrorf("either book_id or title is required")
+	}
+
+	estimate, err := estimatePrice(t.ctx, book)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		Message        string  `json:"message"`
+		PredictedPrice float64 `json:"predicted_price"`
+		LowPrice       float64 `json:"low_price"`
+		HighPrice      float64 `json:"high_price"`
+	}{
+		Message: fmt.Sprintf("A fair resale price for %s is about ₹%.0f (typically ₹%.0f–₹%.0f).",
+			name, estimate.PredictedPrice, estimate.LowPrice, estimate.HighPrice),
+		PredictedPrice: estimate.PredictedPrice,
+		LowPrice:       estimate.LowPrice,
+		HighPrice:      estimate.HighPrice,
+	}, nil
+}
+
+// addToFavoritesTool saves a listing to the user's favourites
+func addToFavoritesTool(t *chatbotTools, args json.RawMessage) (interface{}, error) {
+	var input struct {
+		BookID int `json:"book_id"`
+	}
+	if err := decodeToolArguments(args, &input); err != nil {
+		return nil, err
+	}
+	book, err := t.toolBook(input.BookID)
+	if err != nil {
+		return nil, err
+	}
+	if err := addFavorite(t.userID, book.ID); err != nil {
+		return nil, err
+	}
+
+	t.addBooks(book)
+	t.actions = append(t.actions, models.ChatbotAction{Type: "add_to_favorites", Book: book})
+	return map[string]string{
+		"message": fmt.Sprintf("Saved %s %q to your favourites.", utils.CitationMarker(book.ID), book.Title),
+	}, nil
+}
+
+// addToCartTool checks a listing can be bought by the user and asks the client
+// to add it to the cart, which lives in the browser
+func addToCartTool(t *chatbotTools, args json.RawMessage) (interface{}, error) {
+	var input struct {
+		BookID int `json:"book_id"`
+	}
+	if err := decodeToolArguments(args, &input); err != nil {
+		return nil, err
+	}
+	book, err := t.toolBook(input.BookID)
+	if err != nil {
+		return nil, err
+	}
+	if book.Status != "available" {
+		return nil, toolErrorf("%q is no longer available", book.Title)
+	}
+	if book.SellerID == t.userID {
+		return nil, toolErrorf("users can't buy their own listing %q", book.Title)
+	}
+
+	t.addBooks(book)
+	t.actions = append(t.actions, models.ChatbotAction{Type: "add_to_cart", Book: book})
+	return map[string]string{
+		"message": fmt.Sprintf("Added %s %q to your cart for ₹%.0f.", utils.CitationMarker(book.ID), book.Title, book.Price),
+	}, nil
+}
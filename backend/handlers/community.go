@@ -0,0 +1,513 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"reselling-app/db"
+	"reselling-app/middleware"
+	"reselling-app/models"
+	"reselling-app/utils"
+)
+
+const (
+	// Room a community connection joins when it doesn't name one
+	defaultCommunityRoom = "general"
+	// Messages sent to a client when it joins a room
+	communityHistoryLimit = 50
+	// Largest page of room history served over REST
+	communityPageLimit = 100
+	// Longest community message, in characters
+	maxCommunityMessageLength = 500
+)
+
+// communityRateLimiter limits how fast each user posts in the community
+var communityRateLimiter = middleware.NewCommunityRateLimiter()
+
+// errCommunityRoomNotFound is returned for an unknown room slug
+var errCommunityRoomNotFound = errors.New("community room not found")
+
+// communityRoomBySlug looks up a room
+func communityRoomBySlug(slug string) (models.CommunityRoom, error) {
+	var room models.CommunityRoom
+	err := db.DB.QueryRow(
+		"SELECT id, slug, name, category, description, created_at FROM community_rooms WHERE slug = $1",
+		slug,
+	).Scan(&room.ID, &room.Slug, &room.Name, &room.Category, &room.Description, &room.CreatedAt)
+	if err == sql.ErrNoRows {
+		return room, errCommunityRoomNotFound
+	}
+	return room, err
+}
+
+// communitySanction returns "ban" or "mute" if the user has an active sanction
+// in the room or the whole community, or "" if they have none
+func communitySanction(userID, roomID int) (string, error) {
+	var kind string
+	err := db.DB.QueryRow(`
+		SELECT kind FROM community_sanctions
+		WHERE user_id = $1 AND (room_id IS NULL OR room_id = $2)
+		  AND lifted_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+		ORDER BY kind = 'ban' DESC
+		LIMIT 1`,
+		userID, roomID,
+	).Scan(&kind)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return kind, err
+}
+
+// communityMessages returns up to limit messages of a room before the given
+// message ID, or the latest when before is 0, oldest first. Messages from
+// users the viewer has blocked are left out.
+func communityMessages(roomID, viewerID, before, limit int) ([]models.CommunityMessage, error) {
+	rows, err := db.DB.Query(`
+		SELECT m.id, m.room_id, m.sender_id, u.username, m.content, m.created_at
+		FROM community_messages m
+		JOIN users u ON m.sender_id = u.id
+		WHERE m.room_id = $1 AND m.deleted_at IS NULL AND ($2 = 0 OR m.id < $2)
+		  AND NOT EXISTS (SELECT 1 FROM user_blocks WHERE blocker_id = $4 AND blocked_id = m.sender_id)
+		ORDER BY m.id DESC
+		LIMIT $3`,
+		roomID, before, limit, viewerID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []models.CommunityMessage{}
+	for rows.Next() {
+		var msg models.CommunityMessage
+		if err := rows.Scan(&msg.ID, &msg.RoomID, &msg.SenderID, &msg.SenderName, &msg.Content, &msg.CreatedAt); err != nil {
+			log.Printf("Error scanning community message row: %v", err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Newest were fetched first; return them in reading order
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// communityFrame is the broadcast for a community message. It is built from
+// the stored message only, never from fields the client sent.
+func communityFrame(msg models.CommunityMessage) models.WebSocketMessage {
+	return models.WebSocketMessage{
+		ID:         msg.ID,
+		Type:       "message",
+		Content:    msg.Content,
+		SenderID:   msg.SenderID,
+		SenderName: msg.SenderName,
+		Timestamp:  msg.CreatedAt,
+	}
+}
+
+// HandleCommunityWebSocket handles WebSocket connections for a community room,
+// given by ?room= and defaulting to the general room
+func HandleCommunityWebSocket(c *gin.Context) {
+	// Upgrade HTTP connection to WebSocket
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("[COMMUNITY] Failed to upgrade connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// Authenticate user
+	token := c.Query("token")
+	if token == "" {
+		conn.WriteJSON(wsError(models.WSErrorAuthRequired, 0, "Authentication required"))
+		return
+	}
+	claims, err := utils.ValidateToken(token)
+	if err != nil {
+		conn.WriteJSON(wsError(models.WSErrorAuthRequired, 0, "Invalid authentication"))
+		return
+	}
+	userID := claims.UserID
+	username := claims.Username
+
+	room, err := communityRoomBySlug(c.DefaultQuery("room", defaultCommunityRoom))
+	if err != nil {
+		if err == errCommunityRoomNotFound {
+			conn.WriteJSON(wsError(models.WSErrorNotFound, 0, "Room not found"))
+			return
+		}
+		log.Printf("[COMMUNITY] Database error fetching room: %v", err)
+		conn.WriteJSON(wsError(models.WSErrorInternal, 0, "Database error"))
+		return
+	}
+
+	// Banned users can't read the room either
+	if sanction, err := communitySanction(userID, room.ID); err != nil {
+		log.Printf("[COMMUNITY] Database error checking sanctions: %v", err)
+		conn.WriteJSON(wsError(models.WSErrorInternal, 0, "Database error"))
+		return
+	} else if sanction == "ban" {
+		conn.WriteJSON(wsError(models.WSErrorBanned, 0, "You have been banned from this room"))
+		return
+	}
+
+	// Messages from users they blocked don't reach them
+	blocked, err := blockedByUser(userID)
+	if err != nil {
+		log.Printf("[COMMUNITY] Database error fetching blocked users: %v", err)
+		conn.WriteJSON(wsError(models.WSErrorInternal, 0, "Database error"))
+		return
+	}
+
+	// Register client and catch it up on the room
+	client := communityHub.RegisterBlocking(conn, userID, username, room.ID, blocked)
+	log.Printf("[COMMUNITY] User %s (ID %d) joined room %s", username, userID, room.Slug)
+	defer log.Printf("[COMMUNITY] User %s (ID %d) left room %s", username, userID, room.Slug)
+
+	history, err := communityMessages(room.ID, userID, 0, communityHistoryLimit)
+	if err != nil {
+		log.Printf("[COMMUNITY] Database error fetching history: %v", err)
+		history = []models.CommunityMessage{}
+	}
+	client.Send(models.WebSocketMessage{
+		Type:      "history",
+		Timestamp: time.Now(),
+		Data:      gin.H{"room": room, "messages": history},
+	})
+
+	// Listen for messages
+	client.ReadMessages(func(msg models.WebSocketMessage) {
+		if msg.Type != "message" {
+			client.SendError(models.WSErrorInvalidRequest, 0, "Unknown message type")
+			return
+		}
+
+		content := strings.TrimSpace(msg.Content)
+		if content == "" {
+			client.SendError(models.WSErrorInvalidRequest, 0, "Message can't be empty")
+			return
+		}
+		if len([]rune(content)) > maxCommunityMessageLength {
+			client.SendError(models.WSErrorInvalidRequest, 0, fmt.Sprintf("Messages can be at most %d characters", maxCommunityMessageLength))
+			return
+		}
+		if ok, _ := communityRateLimiter.Allow(fmt.Sprintf("user:%d", userID)); !ok {
+			client.SendError(models.WSErrorRateLimited, 0, "You're sending messages too quickly, please slow down")
+			return
+		}
+
+		switch sanction, err := communitySanction(userID, room.ID); {
+		case err != nil:
+			log.Printf("[COMMUNITY] Database error checking sanctions: %v", err)
+			client.SendError(models.WSErrorInternal, 0, "Failed to send message")
+			return
+		case sanction == "mute":
+			client.SendError(models.WSErrorMuted, 0, "You have been muted in this room")
+			return
+		case sanction == "ban":
+			client.SendError(models.WSErrorBanned, 0, "You have been banned from this room")
+			return
+		}
+
+		saved := models.CommunityMessage{RoomID: room.ID, SenderID: userID, SenderName: username, Content: content}
+		err := db.DB.QueryRow(
+			"INSERT INTO community_messages (room_id, sender_id, content) VALUES ($1, $2, $3) RETURNING id, created_at",
+			room.ID, userID, content,
+		).Scan(&saved.ID, &saved.CreatedAt)
+		if err != nil {
+			log.Printf("[COMMUNITY] Error saving message: %v", err)
+			client.SendError(models.WSErrorInternal, 0, "Failed to send message")
+			return
+		}
+
+		communityHub.Broadcast(room.ID, communityFrame(saved))
+	})
+}
+
+// GetCommunityRooms lists the community rooms, optionally only one ?category=
+func GetCommunityRooms(c *gin.Context) {
+	category := c.Query("category")
+
+	rows, err := db.DB.Query(`
+		SELECT id, slug, name, category, description, created_at
+		FROM community_rooms
+		WHERE $1 = '' OR category = $1
+		ORDER BY category = 'general' DESC, name`,
+		category,
+	)
+	if err != nil {
+		log.Printf("Database error fetching community rooms: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch rooms"})
+		return
+	}
+	defer rows.Close()
+
+	rooms := []models.CommunityRoom{}
+	for rows.Next() {
+		var room models.CommunityRoom
+		if err := rows.Scan(&room.ID, &room.Slug, &room.Name, &room.Category, &room.Description, &room.CreatedAt); err != nil {
+			log.Printf("Error scanning community room row: %v", err)
+			continue
+		}
+		rooms = append(rooms, room)
+	}
+
+	c.JSON(http.StatusOK, rooms)
+}
+
+// GetCommunityMessages returns a page of a room's history, newest page first.
+// ?before= takes the next_before of the previous page; ?limit= sets the page size.
+func GetCommunityMessages(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	before, err := strconv.Atoi(c.DefaultQuery("before", "0"))
+	if err != nil || before < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid before message ID"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(communityHistoryLimit)))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+	if limit > communityPageLimit {
+		limit = communityPageLimit
+	}
+
+	room, err := communityRoomBySlug(c.Param("slug"))
+	if err != nil {
+		if err == errCommunityRoomNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+			return
+		}
+		log.Printf("Database error fetching community room: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	sanction, err := communitySanction(userID.(int), room.ID)
+	if err != nil {
+		log.Printf("Database error checking community sanctions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if sanction == "ban" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You have been banned from this room"})
+		return
+	}
+
+	messages, err := communityMessages(room.ID, userID.(int), before, limit)
+	if err != nil {
+		log.Printf("Database error fetching community messages: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
+		return
+	}
+
+	page := models.CommunityMessagePage{Messages: messages}
+	if len(messages) == limit {
+		page.NextBefore = &messages[0].ID
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// CreateCommunityRoom adds a community room (moderators only)
+func CreateCommunityRoom(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	var input models.CommunityRoomInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	room := models.CommunityRoom{
+		Slug:        strings.ToLower(strings.TrimSpace(input.Slug)),
+		Name:        strings.TrimSpace(input.Name),
+		Category:    input.Category,
+		Description: strings.TrimSpace(input.Description),
+	}
+	err := db.DB.QueryRow(`
+		INSERT INTO community_rooms (slug, name, category, description, created_by)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`,
+		room.Slug, room.Name, room.Category, room.Description, userID,
+	).Scan(&room.ID, &room.CreatedAt)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			c.JSON(http.StatusConflict, gin.H{"error": "A room with this slug already exists"})
+			return
+		}
+		log.Printf("Database error creating community room: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create room"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, room)
+}
+
+// DeleteCommunityMessage removes a message from its room (moderators only)
+func DeleteCommunityMessage(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	messageID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	var roomID int
+	err = db.DB.QueryRow(`
+		UPDATE community_messages SET deleted_at = NOW(), deleted_by = $2
+		WHERE id = $1 AND deleted_at IS NULL
+		RETURNING room_id`,
+		messageID, userID,
+	).Scan(&roomID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+			return
+		}
+		log.Printf("Database error deleting community message: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete message"})
+		return
+	}
+
+	// Take it off the screens of everyone in the room
+	communityHub.Broadcast(roomID, models.WebSocketMessage{ID: messageID, Type: "message_deleted", Timestamp: time.Now()})
+	c.JSON(http.StatusOK, gin.H{"message": "Message deleted"})
+}
+
+// SanctionCommunityUser mutes or bans a user (moderators only). Banned users
+// are disconnected from the rooms the ban covers.
+func SanctionCommunityUser(c *gin.Context) {
+	moderatorID, _ := c.Get("userID")
+
+	var input models.CommunitySanctionInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// No room means every room
+	var roomID sql.NullInt64
+	if input.Room != "" {
+		room, err := communityRoomBySlug(input.Room)
+		if err != nil {
+			if err == errCommunityRoomNotFound {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+				return
+			}
+			log.Printf("Database error fetching community room: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		roomID = sql.NullInt64{Int64: int64(room.ID), Valid: true}
+	}
+
+	var expiresAt *time.Time
+	if input.DurationMinutes > 0 {
+		expiry := time.Now().Add(time.Duration(input.DurationMinutes) * time.Minute)
+		expiresAt = &expiry
+	}
+
+	sanction := models.CommunitySanction{
+		UserID:    input.UserID,
+		Kind:      input.Kind,
+		Reason:    strings.TrimSpace(input.Reason),
+		ExpiresAt: expiresAt,
+		CreatedBy: moderatorID.(int),
+	}
+	if input.Room != "" {
+		sanction.Room = &input.Room
+	}
+	err := db.DB.QueryRow("SELECT username FROM users WHERE id = $1", input.UserID).Scan(&sanction.Username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		log.Printf("Database error fetching user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	err = db.DB.QueryRow(`
+		INSERT INTO community_sanctions (user_id, room_id, kind, reason, expires_at, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`,
+		input.UserID, roomID, input.Kind, sanction.Reason, expiresAt, moderatorID,
+	).Scan(&sanction.ID, &sanction.CreatedAt)
+	if err != nil {
+		log.Printf("Database error creating community sanction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save sanction"})
+		return
+	}
+
+	if input.Kind == "ban" {
+		communityHub.Kick(int(roomID.Int64), input.UserID, wsError(models.WSErrorBanned, 0, "You have been banned from this room"))
+	}
+	c.JSON(http.StatusCreated, sanction)
+}
+
+// GetCommunitySanctions lists the mutes and bans in force (moderators only)
+func GetCommunitySanctions(c *gin.Context) {
+	rows, err := db.DB.Query(`
+		SELECT s.id, s.user_id, u.username, r.slug, s.kind, s.reason, s.expires_at, COALESCE(s.created_by, 0), s.created_at
+		FROM community_sanctions s
+		JOIN users u ON s.user_id = u.id
+		LEFT JOIN community_rooms r ON s.room_id = r.id
+		WHERE s.lifted_at IS NULL AND (s.expires_at IS NULL OR s.expires_at > NOW())
+		ORDER BY s.created_at DESC`)
+	if err != nil {
+		log.Printf("Database error fetching community sanctions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sanctions"})
+		return
+	}
+	defer rows.Close()
+
+	sanctions := []models.CommunitySanction{}
+	for rows.Next() {
+		var s models.CommunitySanction
+		if err := rows.Scan(&s.ID, &s.UserID, &s.Username, &s.Room, &s.Kind, &s.Reason, &s.ExpiresAt, &s.CreatedBy, &s.CreatedAt); err != nil {
+			log.Printf("Error scanning community sanction row: %v", err)
+			continue
+		}
+		sanctions = append(sanctions, s)
+	}
+
+	c.JSON(http.StatusOK, sanctions)
+}
+
+// LiftCommunitySanction ends a mute or ban early (moderators only)
+func LiftCommunitySanction(c *gin.Context) {
+	sanctionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sanction ID"})
+		return
+	}
+
+	result, err := db.DB.Exec("UPDATE community_sanctions SET lifted_at = NOW() WHERE id = $1 AND lifted_at IS NULL", sanctionID)
+	if err != nil {
+		log.Printf("Database error lifting community sanction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to lift sanction"})
+		return
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sanction not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Sanction lifted"})
+}
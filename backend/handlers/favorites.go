@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"reselling-app/db"
+	"reselling-app/models"
+)
+
+// errBookNotFound is returned for listings that don't exist or that the user may not see
+var errBookNotFound = errors.New("book not found")
+
+// visibleBook loads a listing the user may see. Listings awaiting or failing
+// moderation are only visible to their seller, and listings from sellers the
+// user has blocked are hidden.
+func visibleBook(bookID, userID int) (models.Book, error) {
+	books, err := loadBooksByID([]int64{int64(bookID)})
+	if err != nil {
+		return models.Book{}, err
+	}
+	if len(books) == 0 {
+		return models.Book{}, errBookNotFound
+	}
+	book := books[0]
+	if (book.Status == "pending_review" || book.Status == "rejected") && book.SellerID != userID {
+		return models.Book{}, errBookNotFound
+	}
+	blocked, err := blockedByUser(userID)
+	if err != nil {
+		return models.Book{}, err
+	}
+	if blocked[book.SellerID] {
+		return models.Book{}, errBookNotFound
+	}
+	return book, nil
+}
+
+// addFavorite saves a listing to the user's favourites, recording the
+// interaction for recommendations the first time it is saved
+func addFavorite(userID, bookID int) error {
+	result, err := db.DB.Exec(
+		"INSERT INTO favorites (user_id, book_id) VALUES ($1, $2) ON CONFLICT (user_id, book_id) DO NOTHING",
+		userID, bookID,
+	)
+	if err != nil {
+		return err
+	}
+	if added, _ := result.RowsAffected(); added == 0 {
+		return nil
+	}
+
+	_, err = db.DB.Exec(
+		"INSERT INTO user_book_interactions (user_id, book_id, interaction_type) VALUES ($1, $2, 'favorite')",
+		userID, bookID,
+	)
+	if err != nil {
+		log.Printf("Error recording user interaction: %v", err)
+	}
+	return nil
+}
+
+// GetFavorites returns the listings the user has saved, most recently saved
+// first, leaving out those of sellers they have blocked
+func GetFavorites(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	rows, err := db.DB.Query(`
+		SELECT b.id, b.seller_id, u.username, b.title, b.author, COALESCE(b.description, ''),
+		       b.price, COALESCE(b.image_url, ''), COALESCE(b.genre, ''), COALESCE(b.condition, ''),
+		       b.status, b.created_at
+		FROM favorites f
+		JOIN books b ON f.book_id = b.id
+		JOIN users u ON b.seller_id = u.id
+		WHERE f.user_id = $1 AND b.status IN ('available', 'sold')
+		ORDER BY f.created_at DESC`,
+		userID,
+	)
+	if err != nil {
+		log.Printf("Database error fetching favorites: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch favorites"})
+		return
+	}
+	defer rows.Close()
+
+	books := []models.Book{}
+	for rows.Next() {
+		var book models.Book
+		if err := rows.Scan(
+			&book.ID, &book.SellerID, &book.SellerUsername, &book.Title, &book.Author,
+			&book.Description, &book.Price, &book.ImageURL, &book.Genre, &book.Condition,
+			&book.Status, &book.CreatedAt,
+		); err != nil {
+			log.Printf("Error scanning favorite row: %v", err)
+			continue
+		}
+		books = append(books, book)
+	}
+
+	// Listings from sellers the user has since blocked stay saved but hidden
+	books, err = withoutBlockedSellers(books, userID.(int))
+	if err != nil {
+		log.Printf("Database error checking blocks: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch favorites"})
+		return
+	}
+
+	c.JSON(http.StatusOK, books)
+}
+
+// AddFavorite saves a listing to the user's favourites
+func AddFavorite(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	bookID, err := strconv.Atoi(c.Param("book_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid book ID"})
+		return
+	}
+
+	if _, err := visibleBook(bookID, userID.(int)); err != nil {
+		if errors.Is(err, errBookNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+			return
+		}
+		log.Printf("Database error fetching book: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save favorite"})
+		return
+	}
+
+	if err := addFavorite(userID.(int), bookID); err != nil {
+		log.Printf("Database error saving favorite: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save favorite"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Book added to favorites"})
+}
+
+// RemoveFavorite removes a listing from the user's favourites
+func RemoveFavorite(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	bookID, err := strconv.Atoi(c.Param("book_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid book ID"})
+		return
+	}
+
+	if _, err := db.DB.Exec("DELETE FROM favorites WHERE user_id = $1 AND book_id = $2", userID, bookID); err != nil {
+		log.Printf("Database error removing favorite: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove favorite"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Book removed from favorites"})
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"reselling-app/db"
+	"reselling-app/mlclient"
+)
+
+// healthReport is the outcome of probing the database and the ML service
+type healthReport struct {
+	status    string
+	code      int
+	dbError   error
+	mlService mlclient.HealthStatus
+}
+
+// checkHealth probes the database and the ML service. The ML service is
+// optional (predictions and recommendations have fallbacks), so an unhealthy
+// ML service degrades the status without failing the check.
+func checkHealth(ctx context.Context) healthReport {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	report := healthReport{status: "ok", code: http.StatusOK}
+	if err := db.DB.PingContext(ctx); err != nil {
+		report.dbError = err
+		report.status = "unhealthy"
+		report.code = http.StatusServiceUnavailable
+	}
+
+	report.mlService = mlclient.Default().Health(ctx)
+	if !report.mlService.Healthy && report.status == "ok" {
+		report.status = "degraded"
+	}
+	return report
+}
+
+// HealthCheck reports whether the database is reachable and whether the ML
+// service's circuit breaker is letting requests through. It is public, so it
+// never contacts the ML service and database errors are logged rather than
+// returned; admins get a live probe and the details from HealthDetails.
+func HealthCheck(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	status, code := "ok", http.StatusOK
+	dbErr := db.DB.PingContext(ctx)
+	if dbErr != nil {
+		log.Printf("Health check: database unhealthy: %v", dbErr)
+		status, code = "unhealthy", http.StatusServiceUnavailable
+	}
+
+	breaker := mlclient.Default().BreakerState()
+	mlHealthy := breaker != mlclient.StateOpen
+	if !mlHealthy && status == "ok" {
+		status = "degraded"
+	}
+
+	c.JSON(code, gin.H{
+		"status":     status,
+		"database":   gin.H{"healthy": dbErr == nil},
+		"ml_service": gin.H{"healthy": mlHealthy, "breaker": breaker},
+	})
+}
+
+// HealthDetails reports the health check with the ML service's URL, latency
+// and any errors (admin only)
+func HealthDetails(c *gin.Context) {
+	report := checkHealth(c.Request.Context())
+
+	database := gin.H{"healthy": true}
+	if report.dbError != nil {
+		database = gin.H{"healthy": false, "error": report.dbError.Error()}
+	}
+	c.JSON(report.code, gin.H{
+		"status":     report.status,
+		"database":   database,
+		"ml_service": report.mlService,
+	})
+}
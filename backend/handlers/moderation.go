@@ -0,0 +1,353 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"reselling-app/db"
+	"reselling-app/models"
+	"reselling-app/utils"
+)
+
+// Default number of listings a seller may create in a rolling 24 hours
+const defaultListingsPerDay = 10
+
+// Maximum Hamming distance between image hashes to treat two images as the same photo
+const duplicateImageDistance = 6
+
+// listingCheckResult holds the outcome of the duplicate and spam checks for a listing
+type listingCheckResult struct {
+	Reasons []string
+}
+
+// flagged reports whether the listing must go through moderation before going live
+func (r listingCheckResult) flagged() bool {
+	return len(r.Reasons) > 0
+}
+
+// listingsPerDayLimit returns the per-seller posting limit from the environment
+func listingsPerDayLimit() int {
+	limit, err := strconv.Atoi(os.Getenv("MAX_LISTINGS_PER_DAY"))
+	if err != nil || limit <= 0 {
+		return defaultListingsPerDay
+	}
+	return limit
+}
+
+// sellerOverPostingLimit reports whether a seller has used up their daily listing allowance
+func sellerOverPostingLimit(sellerID int) (bool, error) {
+	var count int
+	err := db.DB.QueryRow(
+		"SELECT COUNT(*) FROM books WHERE seller_id = $1 AND created_at > NOW() - INTERVAL '24 hours'",
+		sellerID,
+	).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count >= listingsPerDayLimit(), nil
+}
+
+// checkListing runs the duplicate and spam detection pipeline for a listing.
+// bookID is the listing being edited, or 0 for a new listing. Images are
+// compared by hash later, by recheckListingImage, to keep downloads off the
+// request path.
+func checkListing(sellerID, bookID int, input models.BookInput) listingCheckResult {
+	var result listingCheckResult
+
+	// Off-platform contact attempts in the description
+	result.Reasons = append(result.Reasons, utils.FindOffPlatformContact(input.Description)...)
+
+	// Compare against the seller's other live or pending listings
+	rows, err := db.DB.Query(`
+		SELECT id, title, author, COALESCE(image_url, '')
+		FROM books
+		WHERE seller_id = $1 AND id <> $2 AND status IN ('available', 'reserved', 'pending_review')`,
+		sellerID, bookID,
+	)
+	if err != nil {
+		log.Printf("Database error loading seller listings for duplicate check: %v", err)
+		return result
+	}
+	defer rows.Close()
+
+	normalizedTitle := utils.NormalizeListingText(input.Title)
+	normalizedAuthor := utils.NormalizeListingText(input.Author)
+
+	for rows.Next() {
+		var otherID int
+		var title, author, imageURL string
+		if err := rows.Scan(&otherID, &title, &author, &imageURL); err != nil {
+			log.Printf("Error scanning listing row for duplicate check: %v", err)
+			continue
+		}
+
+		if normalizedTitle != "" &&
+			utils.NormalizeListingText(title) == normalizedTitle &&
+			utils.NormalizeListingText(author) == normalizedAuthor {
+			result.Reasons = append(result.Reasons, fmt.Sprintf("same title and author as listing #%d", otherID))
+			continue
+		}
+
+		if input.ImageURL != "" && imageURL == input.ImageURL {
+			result.Reasons = append(result.Reasons, fmt.Sprintf("same image as listing #%d", otherID))
+		}
+	}
+
+	return result
+}
+
+// listingImageHash hashes a listing image. Files uploaded to BookBridge are
+// read from disk; other images are downloaded from public addresses only.
+func listingImageHash(imageURL string) (string, error) {
+	if name := strings.TrimPrefix(imageURL, uploadURL("")); name != imageURL {
+		if !uploadNamePattern.MatchString(name) {
+			return "", fmt.Errorf("unknown upload %q", name)
+		}
+		data, err := os.ReadFile(filepath.Join(uploadDir(), name))
+		if err != nil {
+			return "", err
+		}
+		return utils.ImageDataHash(data)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return utils.ImageHash(ctx, imageURL)
+}
+
+// recheckListingImage hashes a listing's image in the background once it has
+// been saved and compares it with the seller's other listings. A match sends
+// a live listing to moderation, or adds to the reasons of one already there.
+func recheckListingImage(bookID, sellerID int, imageURL string) {
+	hash, err := listingImageHash(imageURL)
+	if err != nil {
+		log.Printf("Could not hash image of listing #%d: %v", bookID, err)
+		return
+	}
+
+	// Skip the listing if its image changed while this one was hashed
+	result, err := db.DB.Exec(
+		"UPDATE books SET image_hash = $1 WHERE id = $2 AND image_url = $3",
+		hash, bookID, imageURL,
+	)
+	if err != nil {
+		log.Printf("Database error storing image hash: %v", err)
+		return
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT id, image_hash
+		FROM books
+		WHERE seller_id = $1 AND id <> $2 AND image_hash IS NOT NULL
+		  AND image_url <> $3 AND status IN ('available', 'reserved', 'pending_review')`,
+		sellerID, bookID, imageURL,
+	)
+	if err != nil {
+		log.Printf("Database error loading seller listings for image check: %v", err)
+		return
+	}
+	var reasons []string
+	for rows.Next() {
+		var otherID int
+		var otherHash string
+		if err := rows.Scan(&otherID, &otherHash); err != nil {
+			log.Printf("Error scanning listing row for image check: %v", err)
+			continue
+		}
+		distance, err := utils.ImageHashDistance(hash, otherHash)
+		if err == nil && distance <= duplicateImageDistance {
+			reasons = append(reasons, fmt.Sprintf("image matches listing #%d", otherID))
+		}
+	}
+	rows.Close()
+	if len(reasons) == 0 {
+		return
+	}
+
+	if err := flagListing(bookID, sellerID, reasons); err != nil {
+		log.Printf("Database error flagging listing #%d: %v", bookID, err)
+	}
+}
+
+// flagListing sends a live listing to moderation for the given reasons. A
+// listing already waiting for review keeps its earlier reasons too; listings
+// that are reserved or sold are left alone.
+func flagListing(bookID, sellerID int, reasons []string) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE listing_moderation_queue SET reasons = reasons || E'\\n' || $1 WHERE book_id = $2 AND status = 'pending'",
+		strings.Join(reasons, "\n"), bookID,
+	)
+	if err != nil {
+		return err
+	}
+	if updated, _ := result.RowsAffected(); updated > 0 {
+		return tx.Commit()
+	}
+
+	result, err = tx.Exec(
+		"UPDATE books SET status = 'pending_review' WHERE id = $1 AND status = 'available'",
+		bookID,
+	)
+	if err != nil {
+		return err
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return nil
+	}
+	if err := enqueueListingForModeration(tx, bookID, sellerID, reasons); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// enqueueListingForModeration records a flagged listing in the moderation
+// queue. It runs in the transaction that sends the listing to review, so a
+// listing is never hidden without a queue entry.
+func enqueueListingForModeration(tx *sql.Tx, bookID, sellerID int, reasons []string) error {
+	// Resolve any earlier pending entry so the queue shows the latest reasons only
+	_, err := tx.Exec(
+		"DELETE FROM listing_moderation_queue WHERE book_id = $1 AND status = 'pending'",
+		bookID,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO listing_moderation_queue (book_id, seller_id, reasons) VALUES ($1, $2, $3)",
+		bookID, sellerID, strings.Join(reasons, "\n"),
+	)
+	return err
+}
+
+// GetModerationQueue lists flagged listings for moderators
+func GetModerationQueue(c *gin.Context) {
+	status := c.DefaultQuery("status", "pending")
+
+	rows, err := db.DB.Query(`
+		SELECT q.id, q.book_id, b.title, q.seller_id, u.username, q.reasons, q.status,
+		       q.reviewed_by, q.reviewed_at, q.created_at
+		FROM listing_moderation_queue q
+		JOIN books b ON q.book_id = b.id
+		JOIN users u ON q.seller_id = u.id
+		WHERE q.status = $1
+		ORDER BY q.created_at ASC`,
+		status,
+	)
+	if err != nil {
+		log.Printf("Database error fetching moderation queue: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch moderation queue"})
+		return
+	}
+	defer rows.Close()
+
+	items := []models.ListingModerationItem{}
+	for rows.Next() {
+		var item models.ListingModerationItem
+		var reasons string
+		var reviewedBy sql.NullInt64
+		var reviewedAt sql.NullTime
+		if err := rows.Scan(
+			&item.ID, &item.BookID, &item.BookTitle, &item.SellerID, &item.SellerUsername,
+			&reasons, &item.Status, &reviewedBy, &reviewedAt, &item.CreatedAt,
+		); err != nil {
+			log.Printf("Error scanning moderation row: %v", err)
+			continue
+		}
+		item.Reasons = strings.Split(reasons, "\n")
+		if reviewedBy.Valid {
+			id := int(reviewedBy.Int64)
+			item.ReviewedBy = &id
+		}
+		if reviewedAt.Valid {
+			item.ReviewedAt = &reviewedAt.Time
+		}
+		items = append(items, item)
+	}
+
+	c.JSON(http.StatusOK, items)
+}
+
+// ReviewModerationItem approves or rejects a flagged listing
+func ReviewModerationItem(c *gin.Context) {
+	moderatorID, _ := c.Get("userID")
+
+	itemID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid moderation item ID"})
+		return
+	}
+
+	var decision models.ModerationDecision
+	if err := c.ShouldBindJSON(&decision); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	queueStatus, bookStatus := "approved", "available"
+	if decision.Action == "reject" {
+		queueStatus, bookStatus = "rejected", "rejected"
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		log.Printf("Database error starting moderation transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var bookID int
+	err = tx.QueryRow(`
+		UPDATE listing_moderation_queue
+		SET status = $1, reviewed_by = $2, reviewed_at = NOW()
+		WHERE id = $3 AND status = 'pending'
+		RETURNING book_id`,
+		queueStatus, moderatorID, itemID,
+	).Scan(&bookID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pending moderation item not found"})
+			return
+		}
+		log.Printf("Database error updating moderation item: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update moderation item"})
+		return
+	}
+
+	_, err = tx.Exec(
+		"UPDATE books SET status = $1 WHERE id = $2 AND status = 'pending_review'",
+		bookStatus, bookID,
+	)
+	if err != nil {
+		log.Printf("Database error updating moderated book: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update book status"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Database error committing moderation decision: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save moderation decision"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Listing " + queueStatus, "book_id": bookID})
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"reselling-app/db"
+	"reselling-app/models"
+)
+
+// Most notifications returned at once
+const notificationListLimit = 50
+
+// notify records a notification for a user. An unread notification of the same
+// type about the same thing (refID, such as a chat ID) is updated and counted
+// instead of adding another.
+func notify(userID int, kind string, refID int, title, body, link string) error {
+	_, err := db.DB.Exec(`
+		INSERT INTO notifications (user_id, type, ref_id, title, body, link)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id, type, ref_id) WHERE read_at IS NULL
+		DO UPDATE SET title = EXCLUDED.title, body = EXCLUDED.body, link = EXCLUDED.link,
+		              count = notifications.count + 1, created_at = CURRENT_TIMESTAMP`,
+		userID, kind, refID, title, body, link,
+	)
+	return err
+}
+
+// GetNotifications returns the user's latest notifications; ?unread=true returns only unread ones
+func GetNotifications(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	unreadOnly := c.Query("unread") == "true"
+
+	rows, err := db.DB.Query(`
+		SELECT id, type, title, body, link, count, read_at, created_at
+		FROM notifications
+		WHERE user_id = $1 AND (NOT $2 OR read_at IS NULL)
+		ORDER BY created_at DESC
+		LIMIT $3`,
+		userID, unreadOnly, notificationListLimit,
+	)
+	if err != nil {
+		log.Printf("Database error fetching notifications: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch notifications"})
+		return
+	}
+	defer rows.Close()
+
+	notifications := []models.Notification{}
+	for rows.Next() {
+		var n models.Notification
+		if err := rows.Scan(&n.ID, &n.Type, &n.Title, &n.Body, &n.Link, &n.Count, &n.ReadAt, &n.CreatedAt); err != nil {
+			log.Printf("Error scanning notification row: %v", err)
+			continue
+		}
+		notifications = append(notifications, n)
+	}
+
+	c.JSON(http.StatusOK, notifications)
+}
+
+// MarkNotificationRead marks one of the user's notifications as read
+func MarkNotificationRead(c *gin.Context) {
+	userID, _ := c.Get("userID")
+	notificationID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification ID"})
+		return
+	}
+
+	result, err := db.DB.Exec(
+		"UPDATE notifications SET read_at = COALESCE(read_at, NOW()) WHERE id = $1 AND user_id = $2",
+		notificationID, userID,
+	)
+	if err != nil {
+		log.Printf("Database error marking notification read: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notification"})
+		return
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Notification marked as read"})
+}
+
+// MarkAllNotificationsRead marks all of the user's notifications as read
+func MarkAllNotificationsRead(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	result, err := db.DB.Exec("UPDATE notifications SET read_at = NOW() WHERE user_id = $1 AND read_at IS NULL", userID)
+	if err != nil {
+		log.Printf("Database error marking notifications read: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notifications"})
+		return
+	}
+	updated, _ := result.RowsAffected()
+
+	c.JSON(http.StatusOK, gin.H{"updated": updated})
+}
+
+// clearNotifications marks a user's unread notifications of a type about refID
+// as read, once they have seen what they were about
+func clearNotifications(userID int, kind string, refID int) error {
+	_, err := db.DB.Exec(
+		"UPDATE notifications SET read_at = NOW() WHERE user_id = $1 AND type = $2 AND ref_id = $3 AND read_at IS NULL",
+		userID, kind, refID,
+	)
+	return err
+}
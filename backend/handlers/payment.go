@@ -1,15 +1,20 @@
 package handlers
 
 import (
+        "database/sql"
+        "errors"
         "fmt"
         "log"
+        "math"
         "net/http"
         "os"
         "strconv"
 
         "github.com/gin-gonic/gin"
+        "github.com/lib/pq"
         "github.com/stripe/stripe-go/v72"
         "github.com/stripe/stripe-go/v72/paymentintent"
+        "reselling-app/db"
         "reselling-app/models"
         "reselling-app/utils"
 )
@@ -32,9 +37,9 @@ func CreatePaymentIntent(c *gin.Context) {
                 return
         }
 
-        // Parse request body
+        // Parse request body. Any amount the client sends is ignored; the
+        // books are priced from their listings.
         var req struct {
-                Amount    float64           `json:"amount"`
                 Currency  string            `json:"currency"`
                 CartItems []models.CartItem `json:"cart_items"`
         }
@@ -45,8 +50,8 @@ func CreatePaymentIntent(c *gin.Context) {
         }
 
         // Validate request
-        if req.Amount <= 0 {
-                c.JSON(http.StatusBadRequest, gin.H{"error": "Amount must be greater than 0"})
+        if len(req.CartItems) == 0 {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "Cart is empty"})
                 return
         }
 
@@ -54,20 +59,34 @@ func CreatePaymentIntent(c *gin.Context) {
                 // Default to INR if not specified
                 req.Currency = "inr"
         }
+        // Listings are priced in INR, and payments are checked against those prices
+        if req.Currency != "inr" {
+                c.JSON(http.StatusBadRequest, gin.H{"error": "Only INR payments are supported"})
+                return
+        }
 
-        // Convert amount to cents/paisa (Stripe uses smallest currency unit)
-        amountInSmallestUnit := int64(req.Amount * 100)
+        bookIDs := make([]int, len(req.CartItems))
+        for i, item := range req.CartItems {
+                bookIDs[i] = item.ID
+        }
+        bookIDs, amountInSmallestUnit, problem, err := priceCart(userID, bookIDs)
+        if err != nil {
+                log.Printf("Database error pricing cart: %v", err)
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payment intent"})
+                return
+        }
+        if problem != "" {
+                c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+                return
+        }
 
         // Create metadata map for the payment intent
         metadata := make(map[string]string)
         metadata["user_id"] = strconv.Itoa(userID)
 
-        // Add cart item details to the metadata
-        if len(req.CartItems) > 0 {
-                for i, item := range req.CartItems {
-                        metadata[fmt.Sprintf("item_%d_id", i)] = strconv.Itoa(item.ID)
-                        metadata[fmt.Sprintf("item_%d_quantity", i)] = strconv.Itoa(item.Quantity)
-                }
+        // Add the priced books to the metadata
+        for i, bookID := range bookIDs {
+                metadata[fmt.Sprintf("item_%d_id", i)] = strconv.Itoa(bookID)
         }
 
         // Create payment intent params
@@ -96,6 +115,7 @@ func CreatePaymentIntent(c *gin.Context) {
         c.JSON(http.StatusOK, gin.H{
                 "id":            pi.ID,
                 "client_secret": pi.ClientSecret,
+                "amount":        float64(amountInSmallestUnit) / 100,
         })
 }
 
@@ -133,7 +153,7 @@ func RecordPaymentSuccess(c *gin.Context) {
         }
 
         // Check if the payment was successful
-        if pi.Status != stripe.PaymentIntentStatusSucceeded {
+        if pi.Status != stripe.PaymentIntentStatusSucceeded || pi.Currency != string(stripe.CurrencyINR) {
                 c.JSON(http.StatusBadRequest, gin.H{"error": "Payment has not been completed successfully"})
                 return
         }
@@ -145,13 +165,142 @@ func RecordPaymentSuccess(c *gin.Context) {
                 return
         }
 
+        // Mark purchased books as sold and record the purchase for recommendations
+        var bookIDs []int
+        for i := 0; ; i++ {
+                idStr, ok := pi.Metadata[fmt.Sprintf("item_%d_id", i)]
+                if !ok {
+                        break
+                }
+                bookID, err := strconv.Atoi(idStr)
+                if err != nil {
+                        continue
+                }
+                bookIDs = append(bookIDs, bookID)
+        }
+        if err := recordPurchase(userID, bookIDs, pi.Amount); err != nil {
+                if err == errPaymentShort {
+                        log.Printf("Payment %s by user %d doesn't cover books %v", pi.ID, userID, bookIDs)
+                        c.JSON(http.StatusBadRequest, gin.H{"error": "Payment doesn't cover the books purchased"})
+                        return
+                }
+                log.Printf("Database error recording purchase: %v", err)
+                c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record purchase"})
+                return
+        }
+
         // TODO: Update the database to mark the order as paid
         // This would include:
         // 1. Creating an order record
         // 2. Creating order line items
-        // 3. Updating book status to 'sold'
-        // 4. Sending email notifications
+        // 3. Sending email notifications
 
         // Return success
         c.JSON(http.StatusOK, gin.H{"status": "success", "message": "Payment recorded successfully"})
 }
+
+// errPaymentShort is returned when a payment is less than the books it is for cost
+var errPaymentShort = errors.New("payment doesn't cover the books")
+
+// priceCart prices a buyer's cart from the listings, in the smallest currency
+// unit. Each listing is a single copy, so repeated books count once and
+// quantities are ignored. It returns the books priced, or a problem for the
+// buyer if one isn't for sale.
+func priceCart(buyerID int, bookIDs []int) ([]int, int64, string, error) {
+        var priced []int
+        var total int64
+        seen := make(map[int]bool)
+        for _, bookID := range bookIDs {
+                if seen[bookID] {
+                        continue
+                }
+                seen[bookID] = true
+
+                var price float64
+                var sellerID int
+                var status string
+                err := db.DB.QueryRow("SELECT price, seller_id, status FROM books WHERE id = $1", bookID).Scan(&price, &sellerID, &status)
+                if err == sql.ErrNoRows {
+                        return nil, 0, fmt.Sprintf("Book %d not found", bookID), nil
+                }
+                if err != nil {
+                        return nil, 0, "", err
+                }
+                if status != "available" && status != "reserved" {
+                        return nil, 0, fmt.Sprintf("Book %d is no longer for sale", bookID), nil
+                }
+                if sellerID == buyerID {
+                        return nil, 0, "You can't buy your own book", nil
+                }
+
+                priced = append(priced, bookID)
+                total += int64(math.Round(price * 100))
+        }
+        return priced, total, "", nil
+}
+
+// recordPurchase marks the books of a payment as sold and stores a purchase
+// interaction for each, in one transaction. The payment must cover the listed
+// price of every book still for sale; books already sold are skipped so
+// replaying a payment doesn't double count.
+func recordPurchase(userID int, bookIDs []int, amountPaid int64) error {
+        if len(bookIDs) == 0 {
+                return nil
+        }
+
+        tx, err := db.DB.Begin()
+        if err != nil {
+                return err
+        }
+        defer tx.Rollback()
+
+        ids := make([]int64, len(bookIDs))
+        for i, id := range bookIDs {
+                ids[i] = int64(id)
+        }
+        rows, err := tx.Query(`
+                SELECT id, price FROM books
+                WHERE id = ANY($1) AND status IN ('available', 'reserved') AND seller_id <> $2
+                FOR UPDATE`,
+                pq.Array(ids), userID,
+        )
+        if err != nil {
+                return err
+        }
+        var forSale []int64
+        var total int64
+        for rows.Next() {
+                var id int64
+                var price float64
+                if err := rows.Scan(&id, &price); err != nil {
+                        rows.Close()
+                        return err
+                }
+                forSale = append(forSale, id)
+                total += int64(math.Round(price * 100))
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+                return err
+        }
+        if len(forSale) == 0 {
+                return nil
+        }
+        if amountPaid < total {
+                return errPaymentShort
+        }
+
+        _, err = tx.Exec("UPDATE books SET status = 'sold', sold_at = NOW() WHERE id = ANY($1)", pq.Array(forSale))
+        if err != nil {
+                return err
+        }
+        _, err = tx.Exec(`
+                INSERT INTO user_book_interactions (user_id, book_id, interaction_type)
+                SELECT $1, unnest($2::int[]), 'purchase'`,
+                userID, pq.Array(forSale),
+        )
+        if err != nil {
+                return err
+        }
+        return tx.Commit()
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"math"
+	"sort"
+	"strings"
+
+	"reselling-app/db"
+	"reselling-app/models"
+	"reselling-app/pricemodel"
+	"reselling-app/utils"
+)
+
+const (
+	// Relative width of the price range when no trained model is available
+	fallbackPriceSpread = 0.2
+	// Number of comparable sold listings returned with a price estimate
+	maxComparables = 5
+	// Number of recent sales scanned when looking for comparables
+	comparableCandidates = 500
+)
+
+// estimatePrice predicts a price and explains it with a range, per-feature
+// contributions and comparable sold listings
+func estimatePrice(ctx context.Context, book models.BookInput) (models.PredictPriceResponse, error) {
+	var estimate models.PredictPriceResponse
+
+	if model := pricemodel.Current(); model != nil {
+		explanation := model.Explain(pricemodel.Input{
+			Title:     book.Title,
+			Author:    book.Author,
+			Genre:     book.Genre,
+			Condition: book.Condition,
+		})
+		estimate.PredictedPrice = explanation.Price
+		estimate.LowPrice = explanation.Low
+		estimate.HighPrice = explanation.High
+		estimate.ModelVersion = model.Version
+		for _, contribution := range explanation.Contributions {
+			estimate.Contributions = append(estimate.Contributions, models.PriceContribution(contribution))
+		}
+	} else {
+		price, err := getPredictedPrice(ctx, book)
+		if err != nil {
+			return estimate, err
+		}
+		estimate.PredictedPrice = price
+		estimate.LowPrice = math.Round(price * (1 - fallbackPriceSpread))
+		estimate.HighPrice = math.Round(price * (1 + fallbackPriceSpread))
+		estimate.Contributions = fallbackPriceContributions(book)
+	}
+
+	estimate.Comparables = findComparableListings(book)
+	return estimate, nil
+}
+
+// fallbackPriceContributions explains the lookup-table price relative to a
+// typical listing (base price 350 in Good condition)
+func fallbackPriceContributions(book models.BookInput) []models.PriceContribution {
+	basePrice, conditionFactor := fallbackPriceFactors(book)
+
+	var contributions []models.PriceContribution
+	if book.Genre != "" {
+		contributions = append(contributions,
+			models.PriceContribution(pricemodel.NewContribution("genre", book.Genre, basePrice/350.0-1)))
+	}
+	if book.Condition != "" {
+		contributions = append(contributions,
+			models.PriceContribution(pricemodel.NewContribution("condition", book.Condition, conditionFactor/0.7-1)))
+	}
+	return contributions
+}
+
+// findComparableListings returns recently sold books most similar in title,
+// genre and condition. Books sold before sale times were recorded come last
+// and are dated by when they were listed.
+func findComparableListings(book models.BookInput) []models.ComparableListing {
+	rows, err := db.DB.Query(`
+		SELECT id, title, author, COALESCE(genre, ''), COALESCE(condition, ''), price,
+		       COALESCE(sold_at, created_at)
+		FROM books
+		WHERE status = 'sold'
+		ORDER BY sold_at DESC NULLS LAST, created_at DESC
+		LIMIT $1`,
+		comparableCandidates,
+	)
+	if err != nil {
+		log.Printf("Database error fetching comparable listings: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	titleTokens := tokenSet(book.Title)
+
+	type scored struct {
+		listing models.ComparableListing
+		score   float64
+	}
+	var candidates []scored
+
+	for rows.Next() {
+		var listing models.ComparableListing
+		if err := rows.Scan(
+			&listing.ID, &listing.Title, &listing.Author, &listing.Genre,
+			&listing.Condition, &listing.Price, &listing.SoldAt,
+		); err != nil {
+			log.Printf("Error scanning comparable listing: %v", err)
+			continue
+		}
+
+		titleSimilarity := jaccard(titleTokens, tokenSet(listing.Title))
+		sameGenre := book.Genre != "" && strings.EqualFold(listing.Genre, book.Genre)
+		if titleSimilarity == 0 && !sameGenre {
+			continue
+		}
+
+		score := 3 * titleSimilarity
+		if sameGenre {
+			score++
+		}
+		if strings.EqualFold(listing.Condition, book.Condition) {
+			score += 0.5
+		}
+		candidates = append(candidates, scored{listing: listing, score: score})
+	}
+
+	// Rows arrive newest first, so a stable sort keeps recent sales ahead on ties
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+
+	comparables := []models.ComparableListing{}
+	for i := 0; i < len(candidates) && i < maxComparables; i++ {
+		comparables = append(comparables, candidates[i].listing)
+	}
+	return comparables
+}
+
+// tokenSet returns the distinct normalized words of a text
+func tokenSet(text string) map[string]bool {
+	set := make(map[string]bool)
+	for _, token := range strings.Fields(utils.NormalizeListingText(text)) {
+		set[token] = true
+	}
+	return set
+}
+
+// jaccard returns the Jaccard similarity of two token sets
+func jaccard(a, b map[string]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	intersection := 0
+	for token := range a {
+		if b[token] {
+			intersection++
+		}
+	}
+	return float64(intersection) / float64(len(a)+len(b)-intersection)
+}
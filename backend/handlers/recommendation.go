@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"reselling-app/db"
+	"reselling-app/models"
+)
+
+// withReason wraps plain books as recommendations sharing one reason
+func withReason(books []models.Book, reason string) []models.RecommendedBook {
+	recommendations := []models.RecommendedBook{}
+	for _, book := range books {
+		recommendations = append(recommendations, models.RecommendedBook{Book: book, Reason: reason})
+	}
+	return recommendations
+}
+
+// logRecommendationImpressions records which books were shown to a user and in what position
+func logRecommendationImpressions(userID int, recommendations []models.RecommendedBook) {
+	if len(recommendations) == 0 {
+		return
+	}
+
+	bookIDs := make([]int64, len(recommendations))
+	positions := make([]int64, len(recommendations))
+	for i, r := range recommendations {
+		bookIDs[i] = int64(r.ID)
+		positions[i] = int64(i + 1)
+	}
+
+	_, err := db.DB.Exec(`
+		INSERT INTO recommendation_events (user_id, book_id, event_type, position)
+		SELECT $1, book_id, 'impression', position
+		FROM unnest($2::int[], $3::int[]) AS shown(book_id, position)`,
+		userID, pq.Array(bookIDs), pq.Array(positions),
+	)
+	if err != nil {
+		log.Printf("Error logging recommendation impressions: %v", err)
+	}
+}
+
+// RecordRecommendationFeedback stores "not interested" or "already own" feedback
+// for a recommended book; the recommender excludes it and adjusts ranking
+func RecordRecommendationFeedback(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	bookID, err := strconv.Atoi(c.Param("book_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid book ID"})
+		return
+	}
+
+	var input models.RecommendationFeedback
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = db.DB.Exec(`
+		INSERT INTO recommendation_feedback (user_id, book_id, feedback_type)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, book_id)
+		DO UPDATE SET feedback_type = EXCLUDED.feedback_type, created_at = CURRENT_TIMESTAMP`,
+		userID, bookID, input.Type,
+	)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+			return
+		}
+		log.Printf("Database error saving recommendation feedback: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save feedback"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Feedback recorded"})
+}
+
+// RecordRecommendationClick logs that a user opened a recommended book
+func RecordRecommendationClick(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	bookID, err := strconv.Atoi(c.Param("book_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid book ID"})
+		return
+	}
+
+	var input struct {
+		Position int `json:"position"`
+	}
+	// The position is optional, so an empty body is fine
+	_ = c.ShouldBindJSON(&input)
+
+	_, err = db.DB.Exec(
+		"INSERT INTO recommendation_events (user_id, book_id, event_type, position) VALUES ($1, $2, 'click', NULLIF($3, 0))",
+		userID, bookID, input.Position,
+	)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Book not found"})
+			return
+		}
+		log.Printf("Database error logging recommendation click: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record click"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Click recorded"})
+}
+
+// GetRecommendationMetrics reports impressions, clicks, click-through rate and
+// feedback counts over the last ?days= days (default 30)
+func GetRecommendationMetrics(c *gin.Context) {
+	days, err := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if err != nil || days <= 0 {
+		days = 30
+	}
+
+	metrics := models.RecommendationMetrics{Days: days, FeedbackCounts: map[string]int{}}
+
+	err = db.DB.QueryRow(`
+		SELECT COUNT(*) FILTER (WHERE event_type = 'impression'),
+		       COUNT(*) FILTER (WHERE event_type = 'click')
+		FROM recommendation_events
+		WHERE created_at > NOW() - make_interval(days => $1)`,
+		days,
+	).Scan(&metrics.Impressions, &metrics.Clicks)
+	if err != nil {
+		log.Printf("Database error computing recommendation metrics: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute metrics"})
+		return
+	}
+	if metrics.Impressions > 0 {
+		metrics.ClickThrough = float64(metrics.Clicks) / float64(metrics.Impressions)
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT feedback_type, COUNT(*)
+		FROM recommendation_feedback
+		WHERE created_at > NOW() - make_interval(days => $1)
+		GROUP BY feedback_type`,
+		days,
+	)
+	if err != nil {
+		log.Printf("Database error counting recommendation feedback: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute metrics"})
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind string
+		var count int
+		if err := rows.Scan(&kind, &count); err != nil {
+			log.Printf("Error scanning feedback count: %v", err)
+			continue
+		}
+		metrics.FeedbackCounts[kind] = count
+	}
+
+	c.JSON(http.StatusOK, metrics)
+}
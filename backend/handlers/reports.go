@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"reselling-app/db"
+	"reselling-app/models"
+)
+
+// reportTarget finds the user a report is about and a copy of the reported
+// message, if any. It returns a status and error message when the reporter
+// can't report the target.
+func reportTarget(reporterID int, input models.UserReportInput) (int, string, int, string) {
+	targets := 0
+	for _, id := range []int{input.UserID, input.MessageID, input.CommunityMessageID} {
+		if id != 0 {
+			targets++
+		}
+	}
+	if targets != 1 {
+		return 0, "", http.StatusBadRequest, "Report exactly one of user_id, message_id or community_message_id"
+	}
+
+	var reportedID int
+	var content string
+	var err error
+	switch {
+	case input.MessageID != 0:
+		// Only the participants of a chat can see, and so report, its messages
+		var member bool
+		err = db.DB.QueryRow(`
+			SELECT m.sender_id, m.content, (c.buyer_id = $2 OR c.seller_id = $2)
+			FROM messages m
+			JOIN chats c ON c.id = m.chat_id
+			WHERE m.id = $1`,
+			input.MessageID, reporterID,
+		).Scan(&reportedID, &content, &member)
+		if err == nil && !member {
+			return 0, "", http.StatusNotFound, "Message not found"
+		}
+	case input.CommunityMessageID != 0:
+		err = db.DB.QueryRow(
+			"SELECT sender_id, content FROM community_messages WHERE id = $1",
+			input.CommunityMessageID,
+		).Scan(&reportedID, &content)
+	default:
+		err = db.DB.QueryRow("SELECT id FROM users WHERE id = $1", input.UserID).Scan(&reportedID)
+	}
+	if err == sql.ErrNoRows {
+		if input.UserID != 0 {
+			return 0, "", http.StatusNotFound, "User not found"
+		}
+		return 0, "", http.StatusNotFound, "Message not found"
+	}
+	if err != nil {
+		log.Printf("Database error finding report target: %v", err)
+		return 0, "", http.StatusInternalServerError, "Database error"
+	}
+
+	if reportedID == reporterID {
+		return 0, "", http.StatusBadRequest, "You can't report yourself"
+	}
+	return reportedID, content, 0, ""
+}
+
+// CreateReport reports a user, a chat message or a community message to the moderators
+func CreateReport(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	var input models.UserReportInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	reportedID, content, status, problem := reportTarget(userID.(int), input)
+	if problem != "" {
+		c.JSON(status, gin.H{"error": problem})
+		return
+	}
+
+	// Optional references are stored as NULL rather than 0
+	nullable := func(id int) interface{} {
+		if id == 0 {
+			return nil
+		}
+		return id
+	}
+
+	var reportID int
+	err := db.DB.QueryRow(`
+		INSERT INTO user_reports
+			(reporter_id, reported_user_id, message_id, community_message_id, message_content, reason, details)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id`,
+		userID, reportedID, nullable(input.MessageID), nullable(input.CommunityMessageID),
+		content, input.Reason, strings.TrimSpace(input.Details),
+	).Scan(&reportID)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			c.JSON(http.StatusConflict, gin.H{"error": "You have already reported this"})
+			return
+		}
+		log.Printf("Database error creating report: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit report"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Report submitted", "report_id": reportID})
+}
+
+// GetReportQueue lists user and message reports for moderators
+func GetReportQueue(c *gin.Context) {
+	status := c.DefaultQuery("status", "pending")
+
+	rows, err := db.DB.Query(`
+		SELECT r.id, r.reporter_id, reporter.username, r.reported_user_id, reported.username,
+		       r.message_id, r.community_message_id, r.message_content, r.reason, r.details,
+		       r.status, r.reviewed_by, r.reviewed_at, r.created_at
+		FROM user_reports r
+		JOIN users reporter ON r.reporter_id = reporter.id
+		JOIN users reported ON r.reported_user_id = reported.id
+		WHERE r.status = $1
+		ORDER BY r.created_at ASC`,
+		status,
+	)
+	if err != nil {
+		log.Printf("Database error fetching report queue: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch reports"})
+		return
+	}
+	defer rows.Close()
+
+	reports := []models.UserReport{}
+	for rows.Next() {
+		var report models.UserReport
+		var messageID, communityMessageID, reviewedBy sql.NullInt64
+		var reviewedAt sql.NullTime
+		if err := rows.Scan(
+			&report.ID, &report.ReporterID, &report.ReporterUsername, &report.ReportedUserID,
+			&report.ReportedUsername, &messageID, &communityMessageID, &report.MessageContent,
+			&report.Reason, &report.Details, &report.Status, &reviewedBy, &reviewedAt, &report.CreatedAt,
+		); err != nil {
+			log.Printf("Error scanning report row: %v", err)
+			continue
+		}
+		if messageID.Valid {
+			id := int(messageID.Int64)
+			report.MessageID = &id
+		}
+		if communityMessageID.Valid {
+			id := int(communityMessageID.Int64)
+			report.CommunityMessageID = &id
+		}
+		if reviewedBy.Valid {
+			id := int(reviewedBy.Int64)
+			report.ReviewedBy = &id
+		}
+		if reviewedAt.Valid {
+			report.ReviewedAt = &reviewedAt.Time
+		}
+		reports = append(reports, report)
+	}
+
+	c.JSON(http.StatusOK, reports)
+}
+
+// ReviewReport resolves or dismisses a pending report. Any action against
+// the reported user, such as a community ban, is taken separately.
+func ReviewReport(c *gin.Context) {
+	moderatorID, _ := c.Get("userID")
+
+	reportID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid report ID"})
+		return
+	}
+
+	var decision models.ReportDecision
+	if err := c.ShouldBindJSON(&decision); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	status := "resolved"
+	if decision.Action == "dismiss" {
+		status = "dismissed"
+	}
+
+	result, err := db.DB.Exec(`
+		UPDATE user_reports
+		SET status = $1, reviewed_by = $2, reviewed_at = NOW()
+		WHERE id = $3 AND status = 'pending'`,
+		status, moderatorID, reportID,
+	)
+	if err != nil {
+		log.Printf("Database error updating report: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update report"})
+		return
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Pending report not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Report " + status, "report_id": reportID})
+}
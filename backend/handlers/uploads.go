@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"reselling-app/db"
+	"reselling-app/models"
+)
+
+const (
+	// Largest file accepted by UploadFile
+	maxUploadBytes = 5 << 20
+	// Default directory uploads are stored in, unless UPLOAD_DIR is set
+	defaultUploadDir = "uploads"
+)
+
+// uploadTypes are the accepted content types, as sniffed from the file, and
+// the extension each is stored with
+var uploadTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// uploadNamePattern matches the names uploads are stored under
+var uploadNamePattern = regexp.MustCompile(`^[0-9a-f]{32}\.(jpg|png|gif)$`)
+
+// errUploadNotFound is returned for an upload ID that doesn't exist or isn't the user's
+var errUploadNotFound = errors.New("upload not found")
+
+// uploadDir returns the directory uploads are stored in
+func uploadDir() string {
+	if dir := os.Getenv("UPLOAD_DIR"); dir != "" {
+		return dir
+	}
+	return defaultUploadDir
+}
+
+// uploadURL is where an upload stored under name is served
+func uploadURL(name string) string {
+	return "/uploads/" + name
+}
+
+// userUpload loads one of a user's uploads
+func userUpload(uploadID, userID int) (models.Upload, error) {
+	var upload models.Upload
+	var name string
+	err := db.DB.QueryRow(
+		"SELECT id, stored_name, content_type, size, width, height, created_at FROM uploads WHERE id = $1 AND user_id = $2",
+		uploadID, userID,
+	).Scan(&upload.ID, &name, &upload.ContentType, &upload.Size, &upload.Width, &upload.Height, &upload.CreatedAt)
+	if err == sql.ErrNoRows {
+		return upload, errUploadNotFound
+	}
+	upload.URL = uploadURL(name)
+	return upload, err
+}
+
+// UploadFile stores an image sent as the multipart field "file". The type is
+// taken from the file's content, not its name, and the file must decode as an image.
+func UploadFile(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadBytes+1<<20)
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A file is required"})
+		return
+	}
+	if fileHeader.Size > maxUploadBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Files can be at most 5 MB"})
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		log.Printf("Error opening upload: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read the file"})
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxUploadBytes+1))
+	if err != nil || len(data) > maxUploadBytes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read the file"})
+		return
+	}
+
+	contentType := http.DetectContentType(data)
+	extension, ok := uploadTypes[contentType]
+	if !ok {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Only JPEG, PNG and GIF images can be uploaded"})
+		return
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "The file is not a valid image"})
+		return
+	}
+
+	// Random names keep uploads from being guessed or overwritten
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Printf("Error generating upload name: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store the file"})
+		return
+	}
+	name := hex.EncodeToString(id) + extension
+
+	if err := os.MkdirAll(uploadDir(), 0o755); err != nil {
+		log.Printf("Error creating upload directory: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store the file"})
+		return
+	}
+	if err := os.WriteFile(filepath.Join(uploadDir(), name), data, 0o644); err != nil {
+		log.Printf("Error writing upload: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store the file"})
+		return
+	}
+
+	upload := models.Upload{
+		URL:         uploadURL(name),
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		Width:       config.Width,
+		Height:      config.Height,
+	}
+	err = db.DB.QueryRow(`
+		INSERT INTO uploads (user_id, stored_name, original_name, content_type, size, width, height)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at`,
+		userID, name, filepath.Base(fileHeader.Filename), contentType, upload.Size, upload.Width, upload.Height,
+	).Scan(&upload.ID, &upload.CreatedAt)
+	if err != nil {
+		log.Printf("Database error saving upload: %v", err)
+		os.Remove(filepath.Join(uploadDir(), name))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store the file"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, upload)
+}
+
+// ServeUpload serves an uploaded file by its stored name. Names are random, so
+// a file is only reachable by someone it was shared with.
+func ServeUpload(c *gin.Context) {
+	name := c.Param("name")
+	if !uploadNamePattern.MatchString(name) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	var contentType string
+	err := db.DB.QueryRow("SELECT content_type FROM uploads WHERE stored_name = $1", name).Scan(&contentType)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+		log.Printf("Database error fetching upload: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Cache-Control", "private, max-age=31536000, immutable")
+	c.File(filepath.Join(uploadDir(), name))
+}
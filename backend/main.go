@@ -1,14 +1,20 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"reselling-app/db"
+	"reselling-app/evaluation"
 	"reselling-app/handlers"
 	"reselling-app/middleware"
+	"reselling-app/pricemodel"
+	"reselling-app/pubsub"
+	"reselling-app/recommender"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -39,9 +45,61 @@ func main() {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 
+	// Subcommands run against the database and exit instead of starting the server
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "train-price-model":
+			trainPriceModel()
+			return
+		case "evaluate":
+			evaluateModels(os.Args[2:])
+			return
+		case "apply-chat-retention":
+			applyChatRetention()
+			return
+		default:
+			log.Fatalf("Unknown command: %s", os.Args[1])
+		}
+	}
+
+	// Load the price model and pick up newly trained versions without a restart
+	pricemodel.WatchForUpdates(pricemodel.Dir(), time.Minute)
+
+	// Keep the collaborative-filtering recommender fresh in the background
+	recommenderInterval, err := time.ParseDuration(os.Getenv("RECOMMENDER_REFRESH_INTERVAL"))
+	if err != nil || recommenderInterval <= 0 {
+		recommenderInterval = 15 * time.Minute
+	}
+	recommender.Default.Start(db.DB, recommenderInterval)
+
+	// Chat broadcasts go through a broker so several instances can serve WebSockets
+	chatBroker, err := pubsub.FromEnv(db.DB, db.ConnectionString())
+	if err != nil {
+		log.Fatalf("Failed to start chat broker: %v", err)
+	}
+	if err := handlers.InitChatHubs(chatBroker); err != nil {
+		log.Fatalf("Failed to start chat hubs: %v", err)
+	}
+
+	// Archive or purge the messages of chats about books sold long ago
+	handlers.StartChatRetention(handlers.ChatRetentionPolicyFromEnv())
+
 	// Set up Gin router
 	router := gin.Default()
 
+	// Only proxies listed in TRUSTED_PROXIES (comma-separated IPs or CIDRs) may
+	// set the client IP through X-Forwarded-For; by default none are trusted,
+	// so per-IP rate limits can't be dodged with a forged header
+	var trustedProxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			trustedProxies = append(trustedProxies, proxy)
+		}
+	}
+	if err := router.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
 	// Configure CORS
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
@@ -105,6 +163,9 @@ func main() {
 	// Set up API routes first
 	// Then set up a wildcard handler for all non-API routes
 
+	// Health check from the ML client's breaker state; a live probe with details is at /api/admin/health
+	router.GET("/healthz", handlers.HealthCheck)
+
 	// Auth routes
 	auth := router.Group("/api/auth")
 	{
@@ -115,8 +176,10 @@ func main() {
 	// Book routes
 	books := router.Group("/api/books")
 	{
-		books.GET("", handlers.GetAllBooks)
-		books.GET("/:id", handlers.GetBook)
+		// Signing in is optional; it hides listings from sellers the user has blocked
+		books.GET("", middleware.OptionalAuthMiddleware(), handlers.GetAllBooks)
+		books.GET("/:id", middleware.OptionalAuthMiddleware(), handlers.GetBook)
+		books.GET("/:id/similar", middleware.OptionalAuthMiddleware(), handlers.GetSimilarBooks)
 		books.POST("", middleware.AuthMiddleware(), handlers.AddBook)
 		books.PUT("/:id", middleware.AuthMiddleware(), handlers.UpdateBook)
 		books.DELETE("/:id", middleware.AuthMiddleware(), handlers.DeleteBook)
@@ -124,9 +187,62 @@ func main() {
 		books.POST("/predict-price", handlers.PredictPrice)
 	}
 
-	// Chatbot routes
-	router.POST("/api/chatbot", handlers.ChatbotResponse)
-	router.POST("/api/chatbot/search", handlers.BookSearchChatbotResponse)
+	// Recommendation feedback and click tracking
+	recommendations := router.Group("/api/recommendations")
+	{
+		recommendations.Use(middleware.AuthMiddleware())
+		recommendations.POST("/:book_id/feedback", handlers.RecordRecommendationFeedback)
+		recommendations.POST("/:book_id/click", handlers.RecordRecommendationClick)
+	}
+
+	// Saved listings
+	favorites := router.Group("/api/favorites")
+	{
+		favorites.Use(middleware.AuthMiddleware())
+		favorites.GET("", handlers.GetFavorites)
+		favorites.POST("/:book_id", handlers.AddFavorite)
+		favorites.DELETE("/:book_id", handlers.RemoveFavorite)
+	}
+
+	// Community chat routes
+	community := router.Group("/api/community")
+	{
+		community.GET("/rooms", handlers.GetCommunityRooms)
+		community.GET("/rooms/:slug/messages", middleware.AuthMiddleware(), handlers.GetCommunityMessages)
+	}
+
+	// Upload routes. Files are served by their random stored name.
+	router.POST("/api/uploads", middleware.AuthMiddleware(), handlers.UploadFile)
+	router.GET("/uploads/:name", handlers.ServeUpload)
+
+	// Notification routes
+	notifications := router.Group("/api/notifications")
+	{
+		notifications.Use(middleware.AuthMiddleware())
+		notifications.GET("", handlers.GetNotifications)
+		notifications.PUT("/read", handlers.MarkAllNotificationsRead)
+		notifications.PUT("/:id/read", handlers.MarkNotificationRead)
+	}
+
+	// Chatbot routes; signing in is optional but gives conversation memory,
+	// personalised answers and a higher rate limit
+	chatbotLimits := middleware.NewChatbotRateLimits()
+	chatbot := router.Group("/api/chatbot")
+	{
+		chatbot.Use(middleware.OptionalAuthMiddleware(), middleware.RateLimitMiddleware(chatbotLimits))
+		chatbot.POST("", handlers.ChatbotResponse)
+		chatbot.POST("/search", handlers.BookSearchChatbotResponse)
+		chatbot.GET("/stream", handlers.StreamChatbotResponse)
+	}
+
+	// Chatbot conversation history
+	chatbotConversations := router.Group("/api/chatbot/conversations")
+	{
+		chatbotConversations.Use(middleware.AuthMiddleware())
+		chatbotConversations.GET("", handlers.GetChatbotConversations)
+		chatbotConversations.GET("/:id", handlers.GetChatbotConversation)
+		chatbotConversations.DELETE("/:id", handlers.DeleteChatbotConversation)
+	}
 
 	// Chat routes
 	chats := router.Group("/api/chats")
@@ -134,8 +250,23 @@ func main() {
 		chats.Use(middleware.AuthMiddleware())
 		chats.GET("", handlers.GetUserChats)
 		chats.GET("/:id", handlers.GetChatMessages)
+		chats.PUT("/:id/mute", handlers.MuteChat)
+		chats.DELETE("/:id/mute", handlers.UnmuteChat)
+		chats.GET("/:id/export", handlers.ExportChat)
 	}
 
+	// Blocked users
+	blocks := router.Group("/api/blocks")
+	{
+		blocks.Use(middleware.AuthMiddleware())
+		blocks.GET("", handlers.GetBlockedUsers)
+		blocks.POST("/:user_id", handlers.BlockUser)
+		blocks.DELETE("/:user_id", handlers.UnblockUser)
+	}
+
+	// Reports of users and messages
+	router.POST("/api/reports", middleware.AuthMiddleware(), handlers.CreateReport)
+
 	// User/Seller profile routes
 	users := router.Group("/api/users")
 	{
@@ -144,6 +275,24 @@ func main() {
 		users.PUT("/profile", middleware.AuthMiddleware(), handlers.UpdateUserProfile)
 	}
 
+	// Moderation routes
+	admin := router.Group("/api/admin")
+	{
+		admin.Use(middleware.AuthMiddleware(), middleware.RoleMiddleware("admin"))
+		admin.GET("/moderation/listings", handlers.GetModerationQueue)
+		admin.POST("/moderation/listings/:id", handlers.ReviewModerationItem)
+		admin.GET("/moderation/reports", handlers.GetReportQueue)
+		admin.POST("/moderation/reports/:id", handlers.ReviewReport)
+		admin.GET("/recommendations/metrics", handlers.GetRecommendationMetrics)
+		admin.GET("/health", handlers.HealthDetails)
+		admin.PUT("/users/:id/chatbot-quota", handlers.SetChatbotQuota)
+		admin.POST("/community/rooms", handlers.CreateCommunityRoom)
+		admin.DELETE("/community/messages/:id", handlers.DeleteCommunityMessage)
+		admin.GET("/community/sanctions", handlers.GetCommunitySanctions)
+		admin.POST("/community/sanctions", handlers.SanctionCommunityUser)
+		admin.DELETE("/community/sanctions/:id", handlers.LiftCommunitySanction)
+	}
+
 	// Initialize Stripe
 	handlers.InitStripe()
 
@@ -159,6 +308,8 @@ func main() {
 	router.GET("/ws/chat", handlers.HandleWebSocket)
 	// WebSocket handler for community chat
 	router.GET("/ws/community", handlers.HandleCommunityWebSocket)
+	// WebSocket handler for streamed chatbot replies
+	router.GET("/ws/chatbot", middleware.OptionalAuthMiddleware(), middleware.RateLimitMiddleware(chatbotLimits), handlers.HandleChatbotWebSocket)
 
 	// Add explicit routes for common files
 	router.GET("/", func(c *gin.Context) {
@@ -237,3 +388,74 @@ func main() {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
+
+// trainPriceModel fits a price model on sold listings and saves it as the current version
+func trainPriceModel() {
+	samples, err := pricemodel.LoadSoldListings(db.DB)
+	if err != nil {
+		log.Fatalf("Failed to load sold listings: %v", err)
+	}
+
+	model, err := pricemodel.Train(samples, pricemodel.DefaultOptions())
+	if err != nil {
+		log.Fatalf("Failed to train price model: %v", err)
+	}
+
+	path, err := pricemodel.Save(pricemodel.Dir(), model)
+	if err != nil {
+		log.Fatalf("Failed to save price model: %v", err)
+	}
+
+	log.Printf("Trained price model %s on %d listings (residual std %.3f), saved to %s",
+		model.Version, model.Samples, model.ResidualStd, path)
+}
+
+// applyChatRetention runs the chat retention policy once and reports the messages it touched
+func applyChatRetention() {
+	policy := handlers.ChatRetentionPolicyFromEnv()
+	if policy.Mode == handlers.ChatRetentionOff {
+		log.Printf("Chat retention is off, nothing to do")
+		return
+	}
+
+	result, err := policy.Apply()
+	if err != nil {
+		log.Fatalf("Failed to apply chat retention after archiving %d and purging %d messages: %v",
+			result.Archived, result.Purged, err)
+	}
+	log.Printf("Chat retention (%s after %d days): archived %d, purged %d messages",
+		policy.Mode, policy.Days, result.Archived, result.Purged)
+}
+
+// evaluateModels scores the recommenders and price models on a time-based split
+// of historical data and writes the results as a JSON report
+func evaluateModels(args []string) {
+	defaults := evaluation.DefaultOptions()
+	flags := flag.NewFlagSet("evaluate", flag.ExitOnError)
+	k := flags.Int("k", defaults.K, "number of recommendations scored per user")
+	split := flags.Float64("split", defaults.TrainFraction, "share of history, oldest first, used for training")
+	out := flags.String("out", "evaluation-report.json", "path of the JSON report")
+	flags.Parse(args)
+
+	report, err := evaluation.Run(db.DB, evaluation.Options{K: *k, TrainFraction: *split})
+	if err != nil {
+		log.Fatalf("Failed to evaluate models: %v", err)
+	}
+	if err := report.Write(*out); err != nil {
+		log.Fatalf("Failed to write evaluation report: %v", err)
+	}
+
+	for _, r := range report.Recommenders {
+		log.Printf("%s: precision@%d %.4f, recall@%d %.4f, ndcg@%d %.4f, coverage %.4f over %d users",
+			r.Name, report.K, r.Precision, report.K, r.Recall, report.K, r.NDCG, r.Coverage, r.Users)
+	}
+	for _, p := range report.PriceModels {
+		if p.Error != "" {
+			log.Printf("%s: skipped (%s)", p.Name, p.Error)
+			continue
+		}
+		log.Printf("%s: MAE %.2f, MAPE %.2f%%, within 20%% %.2f%% over %d listings",
+			p.Name, p.MAE, 100*p.MAPE, 100*p.WithinTwenty, p.Predictions)
+	}
+	log.Printf("Wrote evaluation report to %s", *out)
+}
@@ -66,3 +66,26 @@ func RoleMiddleware(role string) gin.HandlerFunc {
                 c.Next()
         }
 }
+
+// OptionalAuthMiddleware sets user info in the Gin context when a valid token
+// is present and lets the request through anonymously otherwise. The token may
+// come from the Authorization header or, for EventSource and WebSocket clients
+// that can't set headers, the "token" query parameter.
+func OptionalAuthMiddleware() gin.HandlerFunc {
+        return func(c *gin.Context) {
+                tokenString := c.Query("token")
+                if authHeader := c.GetHeader("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+                        tokenString = strings.TrimPrefix(authHeader, "Bearer ")
+                }
+
+                if tokenString != "" {
+                        if claims, err := utils.ValidateToken(tokenString); err == nil {
+                                c.Set("userID", claims.UserID)
+                                c.Set("username", claims.Username)
+                                c.Set("userRole", claims.Role)
+                        }
+                }
+
+                c.Next()
+        }
+}
@@ -0,0 +1,148 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Default chatbot requests per minute for anonymous callers, by client IP
+	defaultChatbotAnonymousPerMinute = 10
+	// Default chatbot requests per minute for signed-in users
+	defaultChatbotAuthenticatedPerMinute = 30
+	// Default community chat messages per minute per user
+	defaultCommunityMessagesPerMinute = 20
+	// Buckets idle this long are dropped
+	rateLimitIdleTimeout = 10 * time.Minute
+)
+
+// rateLimitsKey is the context key under which RateLimitMiddleware stores its limits,
+// so handlers serving several requests over one connection can apply them too
+const rateLimitsKey = "rateLimits"
+
+// RateLimiter is an in-memory token bucket per key. Each key may make a burst
+// of requests up to its per-minute limit, refilled evenly over the minute.
+type RateLimiter struct {
+	mu        sync.Mutex
+	perMinute int
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a limiter allowing perMinute requests per key
+func NewRateLimiter(perMinute int) *RateLimiter {
+	return &RateLimiter{perMinute: perMinute, buckets: make(map[string]*rateBucket), lastSweep: time.Now()}
+}
+
+// Allow takes a request from the key's bucket. When the bucket is empty it
+// returns false and how long until the next request is allowed.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > rateLimitIdleTimeout {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > rateLimitIdleTimeout {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	capacity := float64(l.perMinute)
+	perSecond := capacity / 60
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: capacity, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// RateLimits applies separate limits to anonymous callers, keyed by client IP,
+// and signed-in users, keyed by user ID
+type RateLimits struct {
+	Anonymous     *RateLimiter
+	Authenticated *RateLimiter
+}
+
+// NewChatbotRateLimits creates the chatbot limits from CHATBOT_RATE_LIMIT_ANONYMOUS
+// and CHATBOT_RATE_LIMIT_AUTHENTICATED, both in requests per minute
+func NewChatbotRateLimits() *RateLimits {
+	return &RateLimits{
+		Anonymous:     NewRateLimiter(perMinuteLimit("CHATBOT_RATE_LIMIT_ANONYMOUS", defaultChatbotAnonymousPerMinute)),
+		Authenticated: NewRateLimiter(perMinuteLimit("CHATBOT_RATE_LIMIT_AUTHENTICATED", defaultChatbotAuthenticatedPerMinute)),
+	}
+}
+
+// NewCommunityRateLimiter creates the per-user community chat limit from
+// COMMUNITY_RATE_LIMIT, in messages per minute
+func NewCommunityRateLimiter() *RateLimiter {
+	return NewRateLimiter(perMinuteLimit("COMMUNITY_RATE_LIMIT", defaultCommunityMessagesPerMinute))
+}
+
+// perMinuteLimit reads a per-minute limit from the environment
+func perMinuteLimit(name string, fallback int) int {
+	limit, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || limit <= 0 {
+		return fallback
+	}
+	return limit
+}
+
+// Allow takes a request for a user, or for the client IP when userID is 0
+func (r *RateLimits) Allow(userID int, clientIP string) (bool, time.Duration) {
+	if userID > 0 {
+		return r.Authenticated.Allow(fmt.Sprintf("user:%d", userID))
+	}
+	return r.Anonymous.Allow("ip:" + clientIP)
+}
+
+// RateLimitMiddleware rejects requests over the caller's limit with 429. It
+// must run after the auth middleware so signed-in users get their own limit.
+func RateLimitMiddleware(limits *RateLimits) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(rateLimitsKey, limits)
+
+		userID, _ := c.Get("userID")
+		id, _ := userID.(int)
+		if ok, retryAfter := limits.Allow(id, c.ClientIP()); !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests, please slow down"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// RateLimitsFromContext returns the limits set by RateLimitMiddleware, if any
+func RateLimitsFromContext(c *gin.Context) (*RateLimits, bool) {
+	value, exists := c.Get(rateLimitsKey)
+	if !exists {
+		return nil, false
+	}
+	limits, ok := value.(*RateLimits)
+	return limits, ok
+}
@@ -0,0 +1,263 @@
+// Package mlclient is the HTTP client for the Python ML service that serves
+// price predictions and recommendations. Every call goes through bounded
+// retries with jittered backoff and a circuit breaker, so callers can fall
+// back immediately while the service is unhealthy.
+package mlclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"reselling-app/models"
+)
+
+// ErrCircuitOpen is returned without contacting the service while the circuit is open
+var ErrCircuitOpen = errors.New("ml service circuit is open")
+
+// errMalformedResponse marks replies that could not be decoded; retrying won't help
+var errMalformedResponse = errors.New("malformed ml service response")
+
+// Config configures the ML service client
+type Config struct {
+	BaseURL          string
+	Timeout          time.Duration // per-attempt timeout
+	MaxRetries       int           // retries after the first attempt
+	RetryBackoff     time.Duration // base delay, doubled per retry with full jitter
+	BreakerThreshold int           // consecutive failures before the circuit opens
+	BreakerCooldown  time.Duration // how long the circuit stays open
+}
+
+// ConfigFromEnv reads the client configuration from ML_SERVICE_* environment variables
+func ConfigFromEnv() Config {
+	cfg := Config{
+		BaseURL:          "http://localhost:5001",
+		Timeout:          3 * time.Second,
+		MaxRetries:       2,
+		RetryBackoff:     100 * time.Millisecond,
+		BreakerThreshold: 5,
+		BreakerCooldown:  30 * time.Second,
+	}
+
+	if url := os.Getenv("ML_SERVICE_URL"); url != "" {
+		cfg.BaseURL = strings.TrimRight(url, "/")
+	}
+	if d, err := time.ParseDuration(os.Getenv("ML_SERVICE_TIMEOUT")); err == nil && d > 0 {
+		cfg.Timeout = d
+	}
+	if n, err := strconv.Atoi(os.Getenv("ML_SERVICE_RETRIES")); err == nil && n >= 0 {
+		cfg.MaxRetries = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("ML_SERVICE_BREAKER_THRESHOLD")); err == nil && n > 0 {
+		cfg.BreakerThreshold = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("ML_SERVICE_BREAKER_COOLDOWN")); err == nil && d > 0 {
+		cfg.BreakerCooldown = d
+	}
+
+	return cfg
+}
+
+// Client talks to the ML service
+type Client struct {
+	cfg     Config
+	http    *http.Client
+	breaker *breaker
+}
+
+// New creates a client with the given configuration
+func New(cfg Config) *Client {
+	return &Client{
+		cfg:     cfg,
+		http:    &http.Client{},
+		breaker: newBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown),
+	}
+}
+
+var (
+	defaultClient     *Client
+	defaultClientOnce sync.Once
+)
+
+// Default returns the shared client configured from the environment
+func Default() *Client {
+	defaultClientOnce.Do(func() {
+		defaultClient = New(ConfigFromEnv())
+	})
+	return defaultClient
+}
+
+// statusError is returned for non-200 responses
+type statusError struct {
+	StatusCode int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("ml service returned status code %d", e.StatusCode)
+}
+
+// PredictPrice asks the service for a price prediction
+func (c *Client) PredictPrice(ctx context.Context, req models.PredictPriceRequest) (models.PredictPriceResponse, error) {
+	var prediction models.PredictPriceResponse
+	err := c.post(ctx, "/predict-price", req, &prediction)
+	return prediction, err
+}
+
+// Recommend asks the service for book recommendations for a user
+func (c *Client) Recommend(ctx context.Context, userID int) ([]models.Book, error) {
+	recommendations := []models.Book{}
+	err := c.post(ctx, "/recommend", models.RecommendationRequest{UserID: userID}, &recommendations)
+	return recommendations, err
+}
+
+// post sends a JSON request through the circuit breaker with retries and decodes the reply
+func (c *Client) post(ctx context.Context, path string, body, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	if !c.breaker.allow() {
+		return ErrCircuitOpen
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= c.cfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			if err := sleepWithJitter(ctx, c.cfg.RetryBackoff, attempt); err != nil {
+				break
+			}
+		}
+
+		lastErr = c.attempt(ctx, path, payload, out)
+		if lastErr == nil {
+			c.breaker.success()
+			return nil
+		}
+		if !retryable(lastErr) || ctx.Err() != nil {
+			break
+		}
+	}
+
+	// A caller cancelling its own request says nothing about the service's health
+	if ctx.Err() != nil {
+		c.breaker.release()
+	} else {
+		c.breaker.failure()
+	}
+	if lastErr == nil {
+		lastErr = ctx.Err()
+	}
+	return lastErr
+}
+
+// attempt performs a single request bounded by the per-attempt timeout
+func (c *Client) attempt(ctx context.Context, path string, payload []byte, out interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.cfg.BaseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return &statusError{StatusCode: resp.StatusCode}
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%w: %v", errMalformedResponse, err)
+	}
+	return nil
+}
+
+// retryable reports whether a failed attempt is worth repeating
+func retryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.StatusCode >= 500 || se.StatusCode == http.StatusTooManyRequests
+	}
+	// Transport errors and timeouts are retried; malformed responses are not
+	return !errors.Is(err, errMalformedResponse)
+}
+
+// sleepWithJitter waits a random duration up to base·2^(attempt-1), or until ctx is done
+func sleepWithJitter(ctx context.Context, base time.Duration, attempt int) error {
+	maxDelay := base << (attempt - 1)
+	if maxDelay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(maxDelay)) + 1))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// BreakerState returns the circuit breaker state without contacting the service
+func (c *Client) BreakerState() string {
+	return c.breaker.current()
+}
+
+// HealthStatus is the result of probing the ML service
+type HealthStatus struct {
+	URL       string `json:"url"`
+	Healthy   bool   `json:"healthy"`
+	Breaker   string `json:"breaker"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Health probes the service's /health endpoint. The probe bypasses the circuit
+// breaker and leaves it alone; only real requests open or close it.
+func (c *Client) Health(ctx context.Context) HealthStatus {
+	status := HealthStatus{URL: c.cfg.BaseURL}
+
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, "GET", c.cfg.BaseURL+"/health", nil)
+	if err == nil {
+		var resp *http.Response
+		resp, err = c.http.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = &statusError{StatusCode: resp.StatusCode}
+			}
+		}
+	}
+	status.LatencyMS = time.Since(start).Milliseconds()
+
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Healthy = true
+	}
+	status.Breaker = c.breaker.current()
+	return status
+}
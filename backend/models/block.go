@@ -0,0 +1,12 @@
+package models
+
+import (
+	"time"
+)
+
+// BlockedUser is a user the requesting user has blocked
+type BlockedUser struct {
+	UserID    int       `json:"user_id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -42,7 +42,31 @@ type PredictPriceRequest struct {
 
 // PredictPriceResponse is the response from the price prediction service
 type PredictPriceResponse struct {
-        PredictedPrice float64 `json:"predicted_price"`
+        PredictedPrice float64             `json:"predicted_price"`
+        LowPrice       float64             `json:"low_price,omitempty"`
+        HighPrice      float64             `json:"high_price,omitempty"`
+        ModelVersion   string              `json:"model_version,omitempty"`
+        Contributions  []PriceContribution `json:"contributions,omitempty"`
+        Comparables    []ComparableListing `json:"comparables,omitempty"`
+}
+
+// PriceContribution explains how one feature moved the predicted price
+type PriceContribution struct {
+        Feature string  `json:"feature"`
+        Value   string  `json:"value"`
+        Effect  float64 `json:"effect"` // relative change, e.g. -0.3 for -30%
+        Label   string  `json:"label"`  // e.g. "condition: Acceptable −30%"
+}
+
+// ComparableListing is a sold book similar to the one being priced
+type ComparableListing struct {
+        ID        int       `json:"id"`
+        Title     string    `json:"title"`
+        Author    string    `json:"author"`
+        Genre     string    `json:"genre"`
+        Condition string    `json:"condition"`
+        Price     float64   `json:"price"`
+        SoldAt    time.Time `json:"sold_at"`
 }
 
 // RecommendationRequest is used to get book recommendations
@@ -55,11 +79,31 @@ type RecommendationResponse struct {
         Books []Book `json:"books"`
 }
 
+// RecommendedBook is a recommended listing with the reason it was picked
+type RecommendedBook struct {
+        Book
+        Reason string `json:"reason"` // e.g. "Because you viewed \"Wings of Fire\"" or "Popular in Academic"
+}
+
+// RecommendationFeedback is a user's reaction to a recommended book
+type RecommendationFeedback struct {
+        Type string `json:"type" binding:"required,oneof=not_interested already_own"`
+}
+
+// RecommendationMetrics summarises how recommendations performed over a period
+type RecommendationMetrics struct {
+        Days           int            `json:"days"`
+        Impressions    int            `json:"impressions"`
+        Clicks         int            `json:"clicks"`
+        ClickThrough   float64        `json:"click_through_rate"`
+        FeedbackCounts map[string]int `json:"feedback_counts"`
+}
+
 // UserBookInteraction represents a user's interaction with a book
 type UserBookInteraction struct {
         ID              int       `json:"id"`
         UserID          int       `json:"user_id"`
         BookID          int       `json:"book_id"`
-        InteractionType string    `json:"interaction_type"` // view, search, favorite
+        InteractionType string    `json:"interaction_type"` // view, search, favorite, purchase
         CreatedAt       time.Time `json:"created_at"`
 }
@@ -22,19 +22,99 @@ type Message struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// Kinds of chat message. Messages other than text carry a ChatPayload, and
+// their content is a caption or a summary of the payload.
+const (
+	ChatMessageText     = "text"
+	ChatMessageImage    = "image"
+	ChatMessageBook     = "book"
+	ChatMessageLocation = "location"
+)
+
+// ChatPayload is the structured part of a chat message, with the field for the message's kind set
+type ChatPayload struct {
+	Image    *ChatImage    `json:"image,omitempty"`
+	Book     *ChatBookCard `json:"book,omitempty"`
+	Location *ChatLocation `json:"location,omitempty"`
+}
+
+// ChatImage is a photo the sender uploaded before sending it
+type ChatImage struct {
+	UploadID int    `json:"upload_id"`
+	URL      string `json:"url"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+}
+
+// ChatBookCard shares a listing. Senders give the book ID; the rest is filled
+// in from the listing when the message is sent and again when it is read.
+type ChatBookCard struct {
+	BookID   int     `json:"book_id"`
+	Title    string  `json:"title"`
+	Author   string  `json:"author"`
+	Price    float64 `json:"price"`
+	ImageURL string  `json:"image_url"`
+	Status   string  `json:"status"` // the listing's status, or "removed"
+}
+
+// ChatLocation is a meeting place
+type ChatLocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Label     string  `json:"label,omitempty"`
+}
+
 // ChatMessage represents a message with additional user information
 type ChatMessage struct {
-	ID           int       `json:"id"`
-	ChatID       int       `json:"chat_id"`
-	SenderID     int       `json:"sender_id"`
-	SenderName   string    `json:"sender_name"`
-	Content      string    `json:"content"`
-	CreatedAt    time.Time `json:"created_at"`
-	IsSelfSender bool      `json:"is_self_sender,omitempty"`
+	ID           int          `json:"id"`
+	ChatID       int          `json:"chat_id"`
+	SenderID     int          `json:"sender_id"`
+	SenderName   string       `json:"sender_name"`
+	Kind         string       `json:"kind"`
+	Payload      *ChatPayload `json:"payload,omitempty"`
+	Content      string       `json:"content"`
+	ClientID     string       `json:"client_id,omitempty"`
+	CreatedAt    time.Time    `json:"created_at"`
+	ReadAt       *time.Time   `json:"read_at,omitempty"`
+	IsSelfSender bool         `json:"is_self_sender,omitempty"`
+	Archived     bool         `json:"archived,omitempty"` // moved out of the live chat by the retention policy
 }
 
-// ChatSession represents the full chat session with book and user details
+// ChatSession is a chat in a user's chat list, with its latest message.
+// UnreadCount and AwaitingReply are from the requesting user's side: messages
+// from the other participant not yet read, and whether they sent the last one.
+// Muted is whether the user turned off notifications for the chat, and Blocked
+// whether either participant has blocked the other.
 type ChatSession struct {
+	ChatID          int          `json:"chat_id"`
+	BookID          int          `json:"book_id"`
+	BookTitle       string       `json:"book_title"`
+	BuyerID         int          `json:"buyer_id"`
+	BuyerName       string       `json:"buyer_name"`
+	SellerID        int          `json:"seller_id"`
+	SellerName      string       `json:"seller_name"`
+	CounterpartName string       `json:"counterpart_name"`
+	LastMessage     *ChatMessage `json:"last_message,omitempty"`
+	LastActivityAt  time.Time    `json:"last_activity_at"` // the last message, or when the chat started
+	CreatedAt       time.Time    `json:"created_at"`
+	UnreadCount     int          `json:"unread_count"`
+	AwaitingReply   bool         `json:"awaiting_reply"`
+	Counterpart     Presence     `json:"counterpart"`
+	Muted           bool         `json:"muted"`
+	Blocked         bool         `json:"blocked"`
+}
+
+// ChatSessionPage is a page of a user's chats, most recently active first.
+// Total counts every chat in the list; NextBefore is passed as ?before= to
+// fetch the next page, and is absent on the last page.
+type ChatSessionPage struct {
+	Chats      []ChatSession `json:"chats"`
+	Total      int           `json:"total"`
+	NextBefore string        `json:"next_before,omitempty"`
+}
+
+// ChatTranscript is a chat's full record, including archived messages, as exported by a participant
+type ChatTranscript struct {
 	ChatID     int           `json:"chat_id"`
 	BookID     int           `json:"book_id"`
 	BookTitle  string        `json:"book_title"`
@@ -42,29 +122,92 @@ type ChatSession struct {
 	BuyerName  string        `json:"buyer_name"`
 	SellerID   int           `json:"seller_id"`
 	SellerName string        `json:"seller_name"`
-	Messages   []ChatMessage `json:"messages"`
 	CreatedAt  time.Time     `json:"created_at"`
+	ExportedAt time.Time     `json:"exported_at"`
+	Messages   []ChatMessage `json:"messages"`
+}
+
+// Presence is whether a chat participant is connected, and when they were last seen
+type Presence struct {
+	UserID     int        `json:"user_id"`
+	Online     bool       `json:"online"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
 }
 
 // WebSocketMessage represents the structure used for websocket communication
 type WebSocketMessage struct {
-	ID         int         `json:"id,omitempty"`
-	Type       string      `json:"type"` // "message", "system", "error"
-	Content    string      `json:"content"`
-	SenderID   int         `json:"sender_id,omitempty"`
-	SenderName string      `json:"sender_name,omitempty"`
-	ChatID     int         `json:"chat_id,omitempty"`
-	Timestamp  time.Time   `json:"timestamp"`
-	Data       interface{} `json:"data,omitempty"`
+	ID         int          `json:"id,omitempty"`
+	Type       string       `json:"type"`           // "message", "join", "chat_joined", "sync", "synced", "read", "typing", "presence", "system", "error"
+	Code       string       `json:"code,omitempty"` // error frames only, one of the WSError codes
+	Content    string       `json:"content"`
+	Kind       string       `json:"kind,omitempty"`    // chat messages only, one of the ChatMessage kinds
+	Payload    *ChatPayload `json:"payload,omitempty"` // chat messages other than text
+	SenderID   int          `json:"sender_id,omitempty"`
+	SenderName string       `json:"sender_name,omitempty"`
+	ChatID     int          `json:"chat_id,omitempty"`
+	ClientID   string       `json:"client_id,omitempty"` // set by the sender so retried messages are stored once
+	Since      int          `json:"since,omitempty"`     // last message ID the client has, on join and sync
+	Timestamp  time.Time    `json:"timestamp"`
+	Data       interface{}  `json:"data,omitempty"`
 }
 
-// ChatbotQuery represents a query sent to the chatbot
+// Codes sent with websocket error frames so clients can tell failures apart
+const (
+	WSErrorAuthRequired   = "auth_required"
+	WSErrorInvalidRequest = "invalid_request"
+	WSErrorNotFound       = "not_found"
+	WSErrorNotChatMember  = "not_chat_member"
+	WSErrorChatNotJoined  = "chat_not_joined"
+	WSErrorRateLimited    = "rate_limited"
+	WSErrorMuted          = "muted"
+	WSErrorBanned         = "banned"
+	WSErrorBlocked        = "blocked"
+	WSErrorInternal       = "internal_error"
+)
+
+// ChatbotQuery represents a query sent to the chatbot. Authenticated users can
+// pass the conversation_id of an earlier response to continue that conversation.
 type ChatbotQuery struct {
-	Query string `json:"query" binding:"required"`
+	Query          string `json:"query" binding:"required"`
+	ConversationID int    `json:"conversation_id"`
 }
 
 // ChatbotResponse represents the response from the chatbot
 type ChatbotResponse struct {
-	Response string `json:"response"`
-	Books    []Book `json:"books,omitempty"`
+	Response       string          `json:"response"`
+	Books          []Book          `json:"books,omitempty"`
+	Actions        []ChatbotAction `json:"actions,omitempty"`
+	ConversationID int             `json:"conversation_id,omitempty"`
+}
+
+// ChatbotAction is something a chatbot tool did that the client should reflect.
+// The cart lives in the browser, so "add_to_cart" asks the client to add the book.
+type ChatbotAction struct {
+	Type string `json:"type"` // add_to_cart, add_to_favorites
+	Book Book   `json:"book"`
+}
+
+// ChatbotQuotaInput sets a user's daily chatbot quota; null restores the default
+type ChatbotQuotaInput struct {
+	DailyQuota *int `json:"daily_quota"`
+}
+
+// ChatbotConversation is a user's conversation with the chatbot
+type ChatbotConversation struct {
+	ID        int           `json:"id"`
+	Title     string        `json:"title"`
+	Summary   string        `json:"summary,omitempty"`
+	TurnCount int           `json:"turn_count"`
+	Turns     []ChatbotTurn `json:"turns,omitempty"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+// ChatbotTurn is one query and reply within a conversation
+type ChatbotTurn struct {
+	ID        int       `json:"id"`
+	Query     string    `json:"query"`
+	Response  string    `json:"response"`
+	BookIDs   []int64   `json:"book_ids"`
+	CreatedAt time.Time `json:"created_at"`
 }
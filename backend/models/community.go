@@ -0,0 +1,64 @@
+package models
+
+import (
+	"time"
+)
+
+// CommunityRoom is a named community chat room, such as for a genre, city or exam
+type CommunityRoom struct {
+	ID          int       `json:"id"`
+	Slug        string    `json:"slug"`
+	Name        string    `json:"name"`
+	Category    string    `json:"category"` // general, genre, city, exam
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// CommunityRoomInput is submitted by a moderator to create a room
+type CommunityRoomInput struct {
+	Slug        string `json:"slug" binding:"required,max=50"`
+	Name        string `json:"name" binding:"required,max=100"`
+	Category    string `json:"category" binding:"required,oneof=general genre city exam"`
+	Description string `json:"description"`
+}
+
+// CommunityMessage is a message posted in a community room
+type CommunityMessage struct {
+	ID         int       `json:"id"`
+	RoomID     int       `json:"room_id"`
+	SenderID   int       `json:"sender_id"`
+	SenderName string    `json:"sender_name"`
+	Content    string    `json:"content"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// CommunityMessagePage is a page of room history, oldest first. NextBefore is
+// passed as ?before= to fetch the page before it, and is absent on the first page.
+type CommunityMessagePage struct {
+	Messages   []CommunityMessage `json:"messages"`
+	NextBefore *int               `json:"next_before,omitempty"`
+}
+
+// CommunitySanction mutes a user, who can read but not post, or bans them from
+// one room or, without a room, from the whole community
+type CommunitySanction struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	Username  string     `json:"username"`
+	Room      *string    `json:"room,omitempty"`
+	Kind      string     `json:"kind"` // mute, ban
+	Reason    string     `json:"reason"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedBy int        `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// CommunitySanctionInput is submitted by a moderator to mute or ban a user.
+// An empty room applies to every room and 0 minutes never expires.
+type CommunitySanctionInput struct {
+	UserID          int    `json:"user_id" binding:"required"`
+	Room            string `json:"room"`
+	Kind            string `json:"kind" binding:"required,oneof=mute ban"`
+	Reason          string `json:"reason"`
+	DurationMinutes int    `json:"duration_minutes" binding:"min=0"`
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"time"
+)
+
+// ListingModerationItem represents a flagged listing waiting in the moderation queue
+type ListingModerationItem struct {
+	ID             int        `json:"id"`
+	BookID         int        `json:"book_id"`
+	BookTitle      string     `json:"book_title"`
+	SellerID       int        `json:"seller_id"`
+	SellerUsername string     `json:"seller_username"`
+	Reasons        []string   `json:"reasons"`
+	Status         string     `json:"status"` // pending, approved, rejected
+	ReviewedBy     *int       `json:"reviewed_by,omitempty"`
+	ReviewedAt     *time.Time `json:"reviewed_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// ModerationDecision is submitted by a moderator to resolve a queue entry
+type ModerationDecision struct {
+	Action string `json:"action" binding:"required,oneof=approve reject"`
+}
+
+// UserReport is a report of a user, or of a chat or community message they
+// sent, waiting in the moderation queue. MessageContent is a copy of the
+// reported message taken when the report was made, so it survives the message
+// being archived or purged by chat retention.
+type UserReport struct {
+	ID                 int        `json:"id"`
+	ReporterID         int        `json:"reporter_id"`
+	ReporterUsername   string     `json:"reporter_username"`
+	ReportedUserID     int        `json:"reported_user_id"`
+	ReportedUsername   string     `json:"reported_username"`
+	MessageID          *int       `json:"message_id,omitempty"`
+	CommunityMessageID *int       `json:"community_message_id,omitempty"`
+	MessageContent     string     `json:"message_content,omitempty"`
+	Reason             string     `json:"reason"`
+	Details            string     `json:"details,omitempty"`
+	Status             string     `json:"status"` // pending, resolved, dismissed
+	ReviewedBy         *int       `json:"reviewed_by,omitempty"`
+	ReviewedAt         *time.Time `json:"reviewed_at,omitempty"`
+	CreatedAt          time.Time  `json:"created_at"`
+}
+
+// UserReportInput reports exactly one of a user, a chat message or a community message
+type UserReportInput struct {
+	UserID             int    `json:"user_id"`
+	MessageID          int    `json:"message_id"`
+	CommunityMessageID int    `json:"community_message_id"`
+	Reason             string `json:"reason" binding:"required,oneof=spam scam harassment inappropriate other"`
+	Details            string `json:"details" binding:"max=1000"`
+}
+
+// ReportDecision is submitted by a moderator to close a report
+type ReportDecision struct {
+	Action string `json:"action" binding:"required,oneof=resolve dismiss"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+)
+
+// Notification tells a user about something that happened while they were away.
+// Repeats of the same unread notification, such as several messages in one
+// chat, are folded into one entry and counted.
+type Notification struct {
+	ID        int        `json:"id"`
+	Type      string     `json:"type"` // chat_message
+	Title     string     `json:"title"`
+	Body      string     `json:"body"`
+	Link      string     `json:"link,omitempty"`
+	Count     int        `json:"count"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+)
+
+// Upload is a file a user uploaded, such as a photo sent in a chat
+type Upload struct {
+	ID          int       `json:"id"`
+	URL         string    `json:"url"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	CreatedAt   time.Time `json:"created_at"`
+}
@@ -0,0 +1,97 @@
+package pricemodel
+
+import (
+	"fmt"
+	"math"
+)
+
+// intervalZ is the z-score for the reported price range (roughly a 90% interval)
+const intervalZ = 1.645
+
+// Contribution is the effect of one input feature on the predicted price
+type Contribution struct {
+	Feature string  `json:"feature"` // genre, condition, title or author
+	Value   string  `json:"value"`
+	Effect  float64 `json:"effect"` // relative change, e.g. -0.3 for -30%
+	Label   string  `json:"label"`
+}
+
+// Explanation is a prediction with its uncertainty and per-feature breakdown
+type Explanation struct {
+	Price         float64        `json:"price"`
+	Low           float64        `json:"low"`
+	High          float64        `json:"high"`
+	Contributions []Contribution `json:"contributions"`
+}
+
+// Explain predicts a price and reports a range and the contribution of each feature.
+// Genre and condition effects are relative to the average genre and condition.
+func (m *Model) Explain(in Input) Explanation {
+	logPrice := m.logPrice(in)
+	spread := intervalZ * m.ResidualStd
+
+	result := Explanation{
+		Price: math.Round(m.clamp(math.Exp(logPrice))),
+		Low:   math.Round(m.clamp(math.Exp(logPrice - spread))),
+		High:  math.Round(m.clamp(math.Exp(logPrice + spread))),
+	}
+
+	if idx, ok := m.Genres[normalizeCategory(in.Genre)]; ok {
+		effect := m.Weights[idx] - meanWeight(m.Weights, 0, len(m.Genres))
+		result.Contributions = append(result.Contributions, NewContribution("genre", in.Genre, math.Exp(effect)-1))
+	}
+
+	offset := len(m.Genres)
+	if idx, ok := m.Conditions[normalizeCategory(in.Condition)]; ok {
+		effect := m.Weights[offset+idx] - meanWeight(m.Weights, offset, len(m.Conditions))
+		result.Contributions = append(result.Contributions, NewContribution("condition", in.Condition, math.Exp(effect)-1))
+	}
+
+	offset += len(m.Conditions)
+	if effect := tokenEffect(m.Weights, hashedTokens(in.Title, offset, m.TitleBuckets)); effect != 0 {
+		result.Contributions = append(result.Contributions, NewContribution("title", in.Title, math.Exp(effect)-1))
+	}
+
+	offset += m.TitleBuckets
+	if effect := tokenEffect(m.Weights, hashedTokens(in.Author, offset, m.AuthorBuckets)); effect != 0 {
+		result.Contributions = append(result.Contributions, NewContribution("author", in.Author, math.Exp(effect)-1))
+	}
+
+	return result
+}
+
+// NewContribution builds a contribution with a label such as "condition: Acceptable −30%"
+func NewContribution(feature, value string, effect float64) Contribution {
+	percent := math.Round(effect * 100)
+	sign := "+"
+	if percent < 0 {
+		sign = "−"
+	}
+	return Contribution{
+		Feature: feature,
+		Value:   value,
+		Effect:  math.Round(effect*1000) / 1000,
+		Label:   fmt.Sprintf("%s: %s %s%.0f%%", feature, value, sign, math.Abs(percent)),
+	}
+}
+
+// meanWeight averages a contiguous block of weights
+func meanWeight(weights []float64, offset, n int) float64 {
+	if n == 0 {
+		return 0
+	}
+	var sum float64
+	for _, w := range weights[offset : offset+n] {
+		sum += w
+	}
+	return sum / float64(n)
+}
+
+// tokenEffect sums the log-price effect of a set of hashed token features
+func tokenEffect(weights []float64, fs []feature) float64 {
+	var effect float64
+	for _, f := range fs {
+		effect += weights[f.Index] * f.Value
+	}
+	return effect
+}
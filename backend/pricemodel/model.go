@@ -0,0 +1,131 @@
+// Package pricemodel implements the in-process book price regression model.
+//
+// The model is a ridge regression over log(price) using one-hot genre and
+// condition features plus hashed title and author tokens. It is trained from
+// sold listings with the train-price-model subcommand and loaded from versioned
+// JSON artifacts on disk.
+package pricemodel
+
+import (
+	"hash/fnv"
+	"math"
+	"strings"
+	"time"
+
+	"reselling-app/utils"
+)
+
+// Model is a trained price model artifact
+type Model struct {
+	Version       string         `json:"version"`
+	TrainedAt     time.Time      `json:"trained_at"`
+	Samples       int            `json:"samples"`
+	Lambda        float64        `json:"lambda"`
+	Genres        map[string]int `json:"genres"`
+	Conditions    map[string]int `json:"conditions"`
+	TitleBuckets  int            `json:"title_buckets"`
+	AuthorBuckets int            `json:"author_buckets"`
+	Intercept     float64        `json:"intercept"`
+	Weights       []float64      `json:"weights"`
+	ResidualStd   float64        `json:"residual_std"` // standard deviation of log-price residuals
+	MinPrice      float64        `json:"min_price"`
+	MaxPrice      float64        `json:"max_price"`
+}
+
+// Input describes the listing attributes the model prices
+type Input struct {
+	Title     string
+	Author    string
+	Genre     string
+	Condition string
+}
+
+// feature is a single non-zero entry of a sparse feature vector
+type feature struct {
+	Index int
+	Value float64
+}
+
+// dimensions returns the length of the model's feature vector
+func (m *Model) dimensions() int {
+	return len(m.Genres) + len(m.Conditions) + m.TitleBuckets + m.AuthorBuckets
+}
+
+// features encodes a listing as a sparse feature vector
+func (m *Model) features(in Input) []feature {
+	var fs []feature
+
+	if idx, ok := m.Genres[normalizeCategory(in.Genre)]; ok {
+		fs = append(fs, feature{Index: idx, Value: 1})
+	}
+
+	offset := len(m.Genres)
+	if idx, ok := m.Conditions[normalizeCategory(in.Condition)]; ok {
+		fs = append(fs, feature{Index: offset + idx, Value: 1})
+	}
+
+	offset += len(m.Conditions)
+	fs = append(fs, hashedTokens(in.Title, offset, m.TitleBuckets)...)
+
+	offset += m.TitleBuckets
+	fs = append(fs, hashedTokens(in.Author, offset, m.AuthorBuckets)...)
+
+	return fs
+}
+
+// logPrice returns the model's raw prediction in log space
+func (m *Model) logPrice(in Input) float64 {
+	value := m.Intercept
+	for _, f := range m.features(in) {
+		value += m.Weights[f.Index] * f.Value
+	}
+	return value
+}
+
+// Predict returns the predicted price for a listing, clamped to the range seen in training
+func (m *Model) Predict(in Input) float64 {
+	return math.Round(m.clamp(math.Exp(m.logPrice(in))))
+}
+
+// clamp keeps a price inside the range of prices the model was trained on
+func (m *Model) clamp(price float64) float64 {
+	if m.MinPrice > 0 && price < m.MinPrice {
+		return m.MinPrice
+	}
+	if m.MaxPrice > 0 && price > m.MaxPrice {
+		return m.MaxPrice
+	}
+	return price
+}
+
+// normalizeCategory folds genre and condition values so "Like New" and "like new" match
+func normalizeCategory(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// hashedTokens maps the words of a text into a fixed number of buckets.
+// Each token contributes 1/sqrt(n) so long titles don't dominate short ones.
+func hashedTokens(text string, offset, buckets int) []feature {
+	if buckets <= 0 {
+		return nil
+	}
+
+	tokens := strings.Fields(utils.NormalizeListingText(text))
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	weight := 1 / math.Sqrt(float64(len(tokens)))
+	counts := make(map[int]float64)
+	for _, token := range tokens {
+		h := fnv.New32a()
+		h.Write([]byte(token))
+		counts[int(h.Sum32()%uint32(buckets))] += weight
+	}
+
+	fs := make([]feature, 0, len(counts))
+	for bucket, value := range counts {
+		fs = append(fs, feature{Index: offset + bucket, Value: value})
+	}
+	return fs
+}
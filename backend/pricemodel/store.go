@@ -0,0 +1,140 @@
+package pricemodel
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// currentFile names the file in the model directory that points at the live artifact
+const currentFile = "CURRENT"
+
+// active holds the model used for predictions; nil until one is loaded
+var active atomic.Pointer[Model]
+
+// Dir returns the directory model artifacts are stored in
+func Dir() string {
+	dir := os.Getenv("PRICE_MODEL_DIR")
+	if dir == "" {
+		return "price_models"
+	}
+	return dir
+}
+
+// Current returns the loaded model, or nil if no model has been trained yet
+func Current() *Model {
+	return active.Load()
+}
+
+// Save writes the model as a new versioned artifact and marks it as current
+func Save(dir string, m *Model) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create model directory: %v", err)
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode model: %v", err)
+	}
+
+	name := artifactName(m.Version)
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return "", fmt.Errorf("failed to write model: %v", err)
+	}
+
+	// Swap the pointer atomically so a running server never reads a half-written file
+	tmp := filepath.Join(dir, currentFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(name+"\n"), 0o644); err != nil {
+		return "", fmt.Errorf("failed to write current model pointer: %v", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, currentFile)); err != nil {
+		return "", fmt.Errorf("failed to update current model pointer: %v", err)
+	}
+
+	return path, nil
+}
+
+// artifactName returns the file name of the model version
+func artifactName(version string) string {
+	return fmt.Sprintf("price-model-%s.json", version)
+}
+
+// currentArtifact returns the file name the CURRENT pointer in dir refers to
+func currentArtifact(dir string) (string, error) {
+	pointer, err := os.ReadFile(filepath.Join(dir, currentFile))
+	if err != nil {
+		return "", err
+	}
+
+	name := strings.TrimSpace(string(pointer))
+	if name == "" || filepath.Base(name) != name {
+		return "", fmt.Errorf("invalid current model pointer %q", name)
+	}
+	return name, nil
+}
+
+// Load reads the current model artifact from dir
+func Load(dir string) (*Model, error) {
+	name, err := currentArtifact(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	var m Model
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to decode model %s: %v", name, err)
+	}
+	if len(m.Weights) != m.dimensions() {
+		return nil, fmt.Errorf("model %s has %d weights, expected %d", name, len(m.Weights), m.dimensions())
+	}
+	return &m, nil
+}
+
+// Reload loads the current artifact from dir and makes it the active model
+// if its version differs from the one already loaded
+func Reload(dir string) error {
+	name, err := currentArtifact(dir)
+	if err != nil {
+		return err
+	}
+	if old := active.Load(); old != nil && artifactName(old.Version) == name {
+		return nil
+	}
+
+	m, err := Load(dir)
+	if err != nil {
+		return err
+	}
+	active.Store(m)
+	log.Printf("Loaded price model %s (%d samples)", m.Version, m.Samples)
+	return nil
+}
+
+// WatchForUpdates polls dir and hot-swaps the active model whenever a new
+// version is saved, so retraining doesn't need a server restart
+func WatchForUpdates(dir string, interval time.Duration) {
+	if err := Reload(dir); err != nil && !os.IsNotExist(err) {
+		log.Printf("Could not load price model: %v", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := Reload(dir); err != nil && !os.IsNotExist(err) {
+				log.Printf("Could not reload price model: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,192 @@
+package pricemodel
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// MinTrainingSamples is the fewest sold listings a model can be trained from
+const MinTrainingSamples = 20
+
+// Sample is one priced listing used for training or evaluation
+type Sample struct {
+	Input
+	Price    float64
+	ListedAt time.Time
+	SoldAt   time.Time
+}
+
+// Options controls model training
+type Options struct {
+	Lambda        float64 // L2 regularisation strength
+	TitleBuckets  int     // hashed title token buckets
+	AuthorBuckets int     // hashed author token buckets
+}
+
+// DefaultOptions returns the training options used by the train-price-model command
+func DefaultOptions() Options {
+	return Options{
+		Lambda:        1.0,
+		TitleBuckets:  256,
+		AuthorBuckets: 128,
+	}
+}
+
+// LoadSoldListings reads all sold listings with a positive price from the
+// database, in the order they sold. Listings sold before sale times were
+// recorded count as sold when they were listed.
+func LoadSoldListings(database *sql.DB) ([]Sample, error) {
+	rows, err := database.Query(`
+		SELECT title, author, COALESCE(genre, ''), COALESCE(condition, ''), price, created_at,
+		       COALESCE(sold_at, created_at) AS sold
+		FROM books
+		WHERE status = 'sold' AND price > 0
+		ORDER BY sold ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var samples []Sample
+	for rows.Next() {
+		var s Sample
+		if err := rows.Scan(&s.Title, &s.Author, &s.Genre, &s.Condition, &s.Price, &s.ListedAt, &s.SoldAt); err != nil {
+			return nil, err
+		}
+		samples = append(samples, s)
+	}
+	return samples, rows.Err()
+}
+
+// Train fits a ridge regression on log(price) for the given samples
+func Train(samples []Sample, opts Options) (*Model, error) {
+	if len(samples) < MinTrainingSamples {
+		return nil, fmt.Errorf("need at least %d sold listings to train, have %d", MinTrainingSamples, len(samples))
+	}
+
+	m := &Model{
+		TrainedAt:     time.Now().UTC(),
+		Samples:       len(samples),
+		Lambda:        opts.Lambda,
+		Genres:        vocabulary(samples, func(s Sample) string { return s.Genre }),
+		Conditions:    vocabulary(samples, func(s Sample) string { return s.Condition }),
+		TitleBuckets:  opts.TitleBuckets,
+		AuthorBuckets: opts.AuthorBuckets,
+		MinPrice:      math.Inf(1),
+	}
+	m.Version = m.TrainedAt.Format("20060102T150405Z")
+
+	// The last column holds the unpenalised intercept
+	dims := m.dimensions()
+	size := dims + 1
+	a := make([][]float64, size)
+	for i := range a {
+		a[i] = make([]float64, size)
+	}
+	b := make([]float64, size)
+
+	encoded := make([][]feature, len(samples))
+	targets := make([]float64, len(samples))
+	for i, s := range samples {
+		fs := append(m.features(s.Input), feature{Index: dims, Value: 1})
+		y := math.Log(s.Price)
+		encoded[i], targets[i] = fs, y
+
+		for _, fi := range fs {
+			b[fi.Index] += fi.Value * y
+			for _, fj := range fs {
+				a[fi.Index][fj.Index] += fi.Value * fj.Value
+			}
+		}
+
+		m.MinPrice = math.Min(m.MinPrice, s.Price)
+		m.MaxPrice = math.Max(m.MaxPrice, s.Price)
+	}
+	for i := 0; i < dims; i++ {
+		a[i][i] += opts.Lambda
+	}
+
+	solution, err := solve(a, b)
+	if err != nil {
+		return nil, err
+	}
+	m.Weights = solution[:dims]
+	m.Intercept = solution[dims]
+
+	var sumSquares float64
+	for i, fs := range encoded {
+		var predicted float64
+		for _, f := range fs {
+			predicted += solution[f.Index] * f.Value
+		}
+		sumSquares += (targets[i] - predicted) * (targets[i] - predicted)
+	}
+	m.ResidualStd = math.Sqrt(sumSquares / float64(len(samples)))
+
+	return m, nil
+}
+
+// vocabulary assigns a stable index to every distinct category value
+func vocabulary(samples []Sample, value func(Sample) string) map[string]int {
+	seen := make(map[string]bool)
+	for _, s := range samples {
+		if v := normalizeCategory(value(s)); v != "" {
+			seen[v] = true
+		}
+	}
+
+	values := make([]string, 0, len(seen))
+	for v := range seen {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+
+	vocab := make(map[string]int, len(values))
+	for i, v := range values {
+		vocab[v] = i
+	}
+	return vocab
+}
+
+// solve solves the linear system a·x = b using Gaussian elimination with partial pivoting.
+// a and b are modified in place.
+func solve(a [][]float64, b []float64) ([]float64, error) {
+	n := len(b)
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-12 {
+			return nil, fmt.Errorf("training matrix is singular")
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		b[col], b[pivot] = b[pivot], b[col]
+
+		for row := col + 1; row < n; row++ {
+			factor := a[row][col] / a[col][col]
+			if factor == 0 {
+				continue
+			}
+			for k := col; k < n; k++ {
+				a[row][k] -= factor * a[col][k]
+			}
+			b[row] -= factor * b[col]
+		}
+	}
+
+	x := make([]float64, n)
+	for row := n - 1; row >= 0; row-- {
+		sum := b[row]
+		for k := row + 1; k < n; k++ {
+			sum -= a[row][k] * x[k]
+		}
+		x[row] = sum / a[row][row]
+	}
+	return x, nil
+}
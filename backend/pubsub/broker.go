@@ -0,0 +1,44 @@
+// Package pubsub carries WebSocket broadcasts between backend instances, so
+// users connected to different instances still see each other's messages.
+//
+// A Broker delivers everything published on a topic to every subscriber of
+// that topic on every instance, including the publishing one. The in-memory
+// broker serves a single instance; the Postgres broker uses LISTEN/NOTIFY on
+// the application database and needs no other infrastructure.
+package pubsub
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Handler receives a payload published to a room of a topic
+type Handler func(room int, payload json.RawMessage)
+
+// Broker publishes JSON payloads to rooms within named topics, such as a
+// hub's name, and delivers them to the topic's subscribers
+type Broker interface {
+	// Publish delivers a payload to every subscriber of the topic
+	Publish(topic string, room int, payload json.RawMessage) error
+	// Subscribe calls handle for every payload published to the topic. Handlers
+	// run on the broker's goroutine and should hand payloads off quickly.
+	Subscribe(topic string, handle Handler) error
+	// Close stops delivery
+	Close() error
+}
+
+// FromEnv returns the broker named by CHAT_BROKER: "memory", the default, for a
+// single instance or "postgres" when several instances share the database.
+// The Postgres broker publishes through db and listens on a connection of its own.
+func FromEnv(db *sql.DB, connStr string) (Broker, error) {
+	switch name := os.Getenv("CHAT_BROKER"); name {
+	case "", "memory":
+		return NewMemoryBroker(), nil
+	case "postgres":
+		return NewPostgresBroker(db, connStr)
+	default:
+		return nil, fmt.Errorf("unknown CHAT_BROKER %q", name)
+	}
+}
@@ -0,0 +1,45 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// MemoryBroker delivers payloads to subscribers in this process only
+type MemoryBroker struct {
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+}
+
+// NewMemoryBroker creates an in-process broker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{handlers: make(map[string][]Handler)}
+}
+
+// Publish calls the topic's handlers before returning
+func (b *MemoryBroker) Publish(topic string, room int, payload json.RawMessage) error {
+	b.mu.RLock()
+	handlers := b.handlers[topic]
+	b.mu.RUnlock()
+
+	for _, handle := range handlers {
+		handle(room, payload)
+	}
+	return nil
+}
+
+// Subscribe adds a handler for a topic
+func (b *MemoryBroker) Subscribe(topic string, handle Handler) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[topic] = append(b.handlers[topic], handle)
+	return nil
+}
+
+// Close drops every handler
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = make(map[string][]Handler)
+	return nil
+}
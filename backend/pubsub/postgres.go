@@ -0,0 +1,179 @@
+package pubsub
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// channelPrefix namespaces the NOTIFY channels used for topics
+	channelPrefix = "bookbridge_"
+	// notifyLimit keeps notifications under Postgres's 8000-byte payload limit.
+	// Larger payloads are stored in pubsub_payloads and sent by reference.
+	notifyLimit = 7900
+	// Stored payloads older than this are deleted; receivers fetch them at once
+	payloadRetention = 5 * time.Minute
+	// How often the idle listener connection is checked
+	listenerPingInterval = 90 * time.Second
+)
+
+// envelope is the body of a notification. Payloads come back to the instance
+// that sent them, which has already delivered them, so each carries its origin.
+type envelope struct {
+	Origin  string          `json:"origin"`
+	Room    int             `json:"room"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// Ref is the pubsub_payloads row of a payload too large to send inline
+	Ref int64 `json:"ref,omitempty"`
+}
+
+// PostgresBroker fans payloads out to every instance connected to the same
+// database using LISTEN/NOTIFY. Notifications sent while an instance's
+// listener is reconnecting are lost to that instance.
+type PostgresBroker struct {
+	db       *sql.DB
+	listener *pq.Listener
+	origin   string
+
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+}
+
+// NewPostgresBroker creates a broker that publishes through db and listens on
+// its own connection opened from connStr
+func NewPostgresBroker(db *sql.DB, connStr string) (*PostgresBroker, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("generating broker ID: %w", err)
+	}
+
+	b := &PostgresBroker{db: db, origin: hex.EncodeToString(id), handlers: make(map[string][]Handler)}
+	b.listener = pq.NewListener(connStr, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventConnectionAttemptFailed, pq.ListenerEventDisconnected:
+			log.Printf("[pubsub] Listener connection problem: %v", err)
+		case pq.ListenerEventReconnected:
+			log.Println("[pubsub] Listener reconnected; messages sent while it was down were missed")
+		}
+	})
+	if err := b.listener.Ping(); err != nil {
+		b.listener.Close()
+		return nil, fmt.Errorf("connecting listener: %w", err)
+	}
+
+	go b.run()
+	log.Printf("[pubsub] Postgres broker %s started", b.origin)
+	return b, nil
+}
+
+// Publish delivers a payload to local subscribers and notifies other instances
+func (b *PostgresBroker) Publish(topic string, room int, payload json.RawMessage) error {
+	b.deliver(topic, room, payload)
+
+	body, err := json.Marshal(envelope{Origin: b.origin, Room: room, Payload: payload})
+	if err != nil {
+		return err
+	}
+	if len(body) > notifyLimit {
+		if body, err = b.store(room, payload); err != nil {
+			return err
+		}
+	}
+
+	_, err = b.db.Exec("SELECT pg_notify($1, $2)", channelPrefix+topic, string(body))
+	return err
+}
+
+// store saves a large payload and returns a notification referring to it
+func (b *PostgresBroker) store(room int, payload json.RawMessage) ([]byte, error) {
+	var ref int64
+	err := b.db.QueryRow("INSERT INTO pubsub_payloads (payload) VALUES ($1) RETURNING id", string(payload)).Scan(&ref)
+	if err != nil {
+		return nil, fmt.Errorf("storing payload: %w", err)
+	}
+	if _, err := b.db.Exec("DELETE FROM pubsub_payloads WHERE created_at < NOW() - make_interval(secs => $1)", payloadRetention.Seconds()); err != nil {
+		log.Printf("[pubsub] Error deleting old payloads: %v", err)
+	}
+	return json.Marshal(envelope{Origin: b.origin, Room: room, Ref: ref})
+}
+
+// Subscribe adds a handler for a topic, listening on its channel the first time
+func (b *PostgresBroker) Subscribe(topic string, handle Handler) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.handlers[topic]) == 0 {
+		if err := b.listener.Listen(channelPrefix + topic); err != nil && err != pq.ErrChannelAlreadyOpen {
+			return fmt.Errorf("listening on %s: %w", topic, err)
+		}
+	}
+	b.handlers[topic] = append(b.handlers[topic], handle)
+	return nil
+}
+
+// Close closes the listener connection
+func (b *PostgresBroker) Close() error {
+	return b.listener.Close()
+}
+
+// run delivers notifications from other instances until the listener is closed
+func (b *PostgresBroker) run() {
+	for {
+		select {
+		case n, ok := <-b.listener.Notify:
+			if !ok {
+				return
+			}
+			// A nil notification follows a reconnect
+			if n != nil {
+				b.receive(n)
+			}
+
+		case <-time.After(listenerPingInterval):
+			go b.listener.Ping()
+		}
+	}
+}
+
+// receive decodes a notification and delivers it unless this instance sent it
+func (b *PostgresBroker) receive(n *pq.Notification) {
+	var env envelope
+	if err := json.Unmarshal([]byte(n.Extra), &env); err != nil {
+		log.Printf("[pubsub] Error decoding notification on %s: %v", n.Channel, err)
+		return
+	}
+	if env.Origin == b.origin {
+		return
+	}
+
+	if env.Ref != 0 {
+		var payload string
+		if err := b.db.QueryRow("SELECT payload FROM pubsub_payloads WHERE id = $1", env.Ref).Scan(&payload); err != nil {
+			log.Printf("[pubsub] Error fetching payload %d: %v", env.Ref, err)
+			return
+		}
+		env.Payload = json.RawMessage(payload)
+	}
+
+	b.deliver(strings.TrimPrefix(n.Channel, channelPrefix), env.Room, env.Payload)
+}
+
+// deliver calls the topic's local handlers
+func (b *PostgresBroker) deliver(topic string, room int, payload json.RawMessage) {
+	b.mu.RLock()
+	handlers := b.handlers[topic]
+	b.mu.RUnlock()
+
+	for _, handle := range handlers {
+		handle(room, payload)
+	}
+}
@@ -0,0 +1,139 @@
+package pubsub
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestDB connects to the database in DATABASE_URL, skipping the test
+// when it isn't set
+func openTestDB(t *testing.T) (*sql.DB, string) {
+	t.Helper()
+	connStr := os.Getenv("DATABASE_URL")
+	if connStr == "" {
+		t.Skip("DATABASE_URL not set; skipping Postgres broker tests")
+	}
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS pubsub_payloads (
+		id BIGSERIAL PRIMARY KEY,
+		payload TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		t.Fatalf("creating pubsub_payloads: %v", err)
+	}
+	return db, connStr
+}
+
+// newTestBroker starts a broker standing in for one server instance
+func newTestBroker(t *testing.T, db *sql.DB, connStr string) *PostgresBroker {
+	t.Helper()
+	b, err := NewPostgresBroker(db, connStr)
+	if err != nil {
+		t.Fatalf("starting broker: %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// delivery is one payload received by a subscriber
+type delivery struct {
+	room    int
+	payload json.RawMessage
+}
+
+// collect subscribes to a topic and returns the payloads it receives
+func collect(t *testing.T, b Broker, topic string) chan delivery {
+	t.Helper()
+	received := make(chan delivery, 16)
+	err := b.Subscribe(topic, func(room int, payload json.RawMessage) {
+		received <- delivery{room: room, payload: payload}
+	})
+	if err != nil {
+		t.Fatalf("subscribing to %s: %v", topic, err)
+	}
+	return received
+}
+
+// testTopic is a topic no other test run listens on
+func testTopic(name string) string {
+	return fmt.Sprintf("test_%s_%d", name, time.Now().UnixNano())
+}
+
+func expectDelivery(t *testing.T, received chan delivery, room int, payload json.RawMessage) {
+	t.Helper()
+	select {
+	case d := <-received:
+		if d.room != room || string(d.payload) != string(payload) {
+			t.Fatalf("got room %d payload %.80s, want room %d payload %.80s", d.room, d.payload, room, payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("payload was not delivered")
+	}
+}
+
+func expectNoDelivery(t *testing.T, received chan delivery) {
+	t.Helper()
+	select {
+	case d := <-received:
+		t.Fatalf("unexpected delivery to room %d: %.80s", d.room, d.payload)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestPostgresBrokerDeliversAcrossInstances(t *testing.T) {
+	db, connStr := openTestDB(t)
+	a := newTestBroker(t, db, connStr)
+	b := newTestBroker(t, db, connStr)
+
+	topic := testTopic("deliver")
+	atA := collect(t, a, topic)
+	atB := collect(t, b, topic)
+
+	payload := json.RawMessage(`{"content":"hello"}`)
+	if err := a.Publish(topic, 7, payload); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	expectDelivery(t, atB, 7, payload)
+
+	// The publisher delivers locally once and ignores its own notification
+	expectDelivery(t, atA, 7, payload)
+	expectNoDelivery(t, atA)
+	expectNoDelivery(t, atB)
+}
+
+func TestPostgresBrokerSendsLargePayloadsByReference(t *testing.T) {
+	db, connStr := openTestDB(t)
+	a := newTestBroker(t, db, connStr)
+	b := newTestBroker(t, db, connStr)
+
+	topic := testTopic("large")
+	atB := collect(t, b, topic)
+
+	payload, err := json.Marshal(map[string]string{"content": strings.Repeat("x", notifyLimit+100)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Publish(topic, 3, payload); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	expectDelivery(t, atB, 3, payload)
+
+	var stored int
+	if err := db.QueryRow("SELECT COUNT(*) FROM pubsub_payloads WHERE payload = $1", string(payload)).Scan(&stored); err != nil {
+		t.Fatalf("counting stored payloads: %v", err)
+	}
+	if stored != 1 {
+		t.Fatalf("%d stored copies of the payload, want 1", stored)
+	}
+}
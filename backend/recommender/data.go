@@ -0,0 +1,200 @@
+package recommender
+
+import (
+	"database/sql"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"reselling-app/models"
+)
+
+// bookSelect is the column list shared by every book query in this package
+const bookSelect = `
+	SELECT b.id, b.seller_id, u.username, b.title, b.author, COALESCE(b.description, ''),
+	       b.price, COALESCE(b.image_url, ''), COALESCE(b.genre, ''), COALESCE(b.condition, ''),
+	       b.status, b.created_at
+	FROM books b
+	JOIN users u ON b.seller_id = u.id`
+
+// loadRatings returns every user's implicit rating per book
+func loadRatings(database *sql.DB) (map[int]map[int]float64, error) {
+	interactions, err := LoadInteractions(database, time.Now().AddDate(0, 0, -interactionWindowDays))
+	if err != nil {
+		return nil, err
+	}
+	return Ratings(interactions), nil
+}
+
+// loadUserRatings returns a single user's implicit rating per book and the
+// strongest interaction type they had with each one
+func loadUserRatings(database *sql.DB, userID int) (map[int]float64, map[int]string, error) {
+	rows, err := database.Query(`
+		SELECT book_id, interaction_type
+		FROM user_book_interactions
+		WHERE user_id = $1 AND created_at > NOW() - make_interval(days => $2)`,
+		userID, interactionWindowDays,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	history := make(map[int]float64)
+	kinds := make(map[int]string)
+	for rows.Next() {
+		var bookID int
+		var interaction string
+		if err := rows.Scan(&bookID, &interaction); err != nil {
+			return nil, nil, err
+		}
+		history[bookID] += interactionWeights[interaction]
+		if interactionWeights[interaction] > interactionWeights[kinds[bookID]] {
+			kinds[bookID] = interaction
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	dampen(history)
+	return history, kinds, nil
+}
+
+// loadUserFeedback returns the feedback a user gave per recommended book
+func loadUserFeedback(database *sql.DB, userID int) (map[int]string, error) {
+	rows, err := database.Query(
+		"SELECT book_id, feedback_type FROM recommendation_feedback WHERE user_id = $1",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	feedback := make(map[int]string)
+	for rows.Next() {
+		var bookID int
+		var kind string
+		if err := rows.Scan(&bookID, &kind); err != nil {
+			return nil, err
+		}
+		feedback[bookID] = kind
+	}
+	return feedback, rows.Err()
+}
+
+// loadBookTitles returns the title of every book keyed in ids
+func loadBookTitles(database *sql.DB, ids map[int]float64) (map[int]string, error) {
+	titles := make(map[int]string, len(ids))
+	if len(ids) == 0 {
+		return titles, nil
+	}
+
+	list := make([]int, 0, len(ids))
+	for id := range ids {
+		list = append(list, id)
+	}
+
+	rows, err := database.Query("SELECT id, title FROM books WHERE id = ANY($1)", pq.Array(list))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var title string
+		if err := rows.Scan(&id, &title); err != nil {
+			return nil, err
+		}
+		titles[id] = title
+	}
+	return titles, rows.Err()
+}
+
+// dampen applies log scaling so twenty views don't outweigh one purchase
+func dampen(history map[int]float64) {
+	for id, sum := range history {
+		history[id] = math.Log1p(sum)
+	}
+}
+
+// loadGenrePopularity sums book popularity per (lowercased) genre
+func loadGenrePopularity(database *sql.DB, bookPopularity map[int]float64) (map[string]float64, error) {
+	genres, err := loadBookGenres(database, bookPopularity)
+	if err != nil {
+		return nil, err
+	}
+
+	popularity := make(map[string]float64)
+	for id, genre := range genres {
+		popularity[genre] += bookPopularity[id]
+	}
+	return popularity, nil
+}
+
+// loadBookGenres returns the lowercased genre of every book keyed in ids
+func loadBookGenres(database *sql.DB, ids map[int]float64) (map[int]string, error) {
+	genres := make(map[int]string, len(ids))
+	if len(ids) == 0 {
+		return genres, nil
+	}
+
+	list := make([]int, 0, len(ids))
+	for id := range ids {
+		list = append(list, id)
+	}
+
+	rows, err := database.Query("SELECT id, COALESCE(genre, '') FROM books WHERE id = ANY($1)", pq.Array(list))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var genre string
+		if err := rows.Scan(&id, &genre); err != nil {
+			return nil, err
+		}
+		genres[id] = strings.ToLower(genre)
+	}
+	return genres, rows.Err()
+}
+
+// loadAvailableBooks fetches the given books that are still for sale and not listed by userID
+func loadAvailableBooks(database *sql.DB, ids []int, userID int) ([]models.Book, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	rows, err := database.Query(bookSelect+`
+		WHERE b.id = ANY($1) AND b.status = 'available' AND b.seller_id <> $2`,
+		pq.Array(ids), userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanBooks(rows)
+}
+
+// scanBooks reads and closes rows produced by a bookSelect query
+func scanBooks(rows *sql.Rows) ([]models.Book, error) {
+	defer rows.Close()
+
+	var books []models.Book
+	for rows.Next() {
+		var book models.Book
+		if err := rows.Scan(
+			&book.ID, &book.SellerID, &book.SellerUsername, &book.Title, &book.Author,
+			&book.Description, &book.Price, &book.ImageURL, &book.Genre, &book.Condition,
+			&book.Status, &book.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		books = append(books, book)
+	}
+	return books, rows.Err()
+}
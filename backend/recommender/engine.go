@@ -0,0 +1,317 @@
+// Package recommender implements the in-process item-item collaborative
+// filtering recommender built from user_book_interactions and purchases.
+//
+// The similarity model is rebuilt periodically in the background; scoring a
+// user reads their latest interactions so new activity is reflected at once.
+package recommender
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"reselling-app/models"
+)
+
+const (
+	// Neighbours kept per book in the similarity model
+	maxNeighbours = 50
+	// Highest-rated books per user considered when building co-occurrences
+	maxHistoryPerUser = 100
+	// Interactions older than this many days are ignored
+	interactionWindowDays = 180
+	// Candidate books scanned for cold-start recommendations
+	coldStartCandidates = 300
+)
+
+// interactionWeights converts interaction types into implicit ratings
+var interactionWeights = map[string]float64{
+	"view":     1,
+	"search":   1.5,
+	"favorite": 3,
+	"purchase": 5,
+}
+
+// Neighbour is a similar book and its cosine similarity
+type Neighbour struct {
+	BookID int
+	Score  float64
+}
+
+// Feedback types users can give on a recommendation
+const (
+	FeedbackNotInterested = "not_interested"
+	FeedbackAlreadyOwn    = "already_own"
+)
+
+// Recommendation is a scored book for a user
+type Recommendation struct {
+	Book          models.Book
+	Score         float64
+	BecauseBookID int    // history book that contributed most, 0 for cold start
+	Reason        string // e.g. "Because you viewed \"Wings of Fire\"" or "Popular in Academic"
+}
+
+// reasonVerbs phrase the interaction behind a collaborative recommendation
+var reasonVerbs = map[string]string{
+	"view":             "viewed",
+	"search":           "searched for",
+	"favorite":         "saved",
+	"purchase":         "bought",
+	FeedbackAlreadyOwn: "own",
+}
+
+// Engine holds the item-item similarity model
+type Engine struct {
+	mu              sync.RWMutex
+	model           *Model
+	genrePopularity map[string]float64
+	builtAt         time.Time
+}
+
+// Default is the engine used by the API handlers
+var Default = &Engine{model: &Model{}}
+
+// Start builds the model and keeps rebuilding it every interval in the background
+func (e *Engine) Start(database *sql.DB, interval time.Duration) {
+	go func() {
+		for {
+			start := time.Now()
+			if err := e.Rebuild(database); err != nil {
+				log.Printf("Error rebuilding recommender: %v", err)
+			} else {
+				log.Printf("Rebuilt recommender in %v", time.Since(start))
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Rebuild recomputes the similarity model and genre popularity from interactions
+func (e *Engine) Rebuild(database *sql.DB) error {
+	ratings, err := loadRatings(database)
+	if err != nil {
+		return err
+	}
+
+	model := BuildModel(ratings)
+
+	genrePopularity, err := loadGenrePopularity(database, model.Popularity)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	e.model = model
+	e.genrePopularity = genrePopularity
+	e.builtAt = time.Now()
+	e.mu.Unlock()
+	return nil
+}
+
+// Neighbours returns the books most similar to bookID according to co-interactions
+func (e *Engine) Neighbours(bookID int) []Neighbour {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.model.Neighbours[bookID]
+}
+
+// Recommend returns up to limit available books for a user, excluding their own
+// listings, books they have already interacted with and books they gave feedback
+// on. "Not interested" feedback also pushes down similar books. Users without
+// enough history get genre-popularity picks.
+func (e *Engine) Recommend(database *sql.DB, userID, limit int) ([]Recommendation, error) {
+	history, kinds, err := loadUserRatings(database, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	feedback, err := loadUserFeedback(database, userID)
+	if err != nil {
+		return nil, err
+	}
+	for bookID, kind := range feedback {
+		switch kind {
+		case FeedbackAlreadyOwn:
+			history[bookID] = math.Max(history[bookID], math.Log1p(interactionWeights["purchase"]))
+			kinds[bookID] = FeedbackAlreadyOwn
+		case FeedbackNotInterested:
+			history[bookID] = -math.Log1p(interactionWeights["favorite"])
+			delete(kinds, bookID)
+		}
+	}
+
+	e.mu.RLock()
+	scores, because := e.model.Score(history)
+	e.mu.RUnlock()
+
+	ids := make([]int, 0, len(scores))
+	for id, score := range scores {
+		if score > 0 {
+			ids = append(ids, id)
+		}
+	}
+	books, err := loadAvailableBooks(database, ids, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	recommendations := make([]Recommendation, 0, len(books))
+	for _, book := range books {
+		recommendations = append(recommendations, Recommendation{
+			Book:          book,
+			Score:         scores[book.ID],
+			BecauseBookID: because[book.ID],
+		})
+	}
+	sort.Slice(recommendations, func(i, j int) bool {
+		return recommendations[i].Score > recommendations[j].Score
+	})
+	if len(recommendations) > limit {
+		recommendations = recommendations[:limit]
+	}
+	if err := explain(database, recommendations, kinds); err != nil {
+		return nil, err
+	}
+	if len(recommendations) == limit {
+		return recommendations, nil
+	}
+
+	// Top up with cold-start picks when collaborative signals run out
+	exclude := make(map[int]bool, len(history)+len(recommendations))
+	for id := range history {
+		exclude[id] = true
+	}
+	for _, r := range recommendations {
+		exclude[r.Book.ID] = true
+	}
+	coldStart, err := e.coldStart(database, userID, history, exclude, limit-len(recommendations))
+	if err != nil {
+		return nil, err
+	}
+	return append(recommendations, coldStart...), nil
+}
+
+// coldStart ranks available books by the popularity of their genre, boosted by
+// the user's own genre affinity when they have any history
+func (e *Engine) coldStart(database *sql.DB, userID int, history map[int]float64, exclude map[int]bool, limit int) ([]Recommendation, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+
+	rows, err := database.Query(bookSelect+`
+		WHERE b.status = 'available' AND b.seller_id <> $1
+		ORDER BY b.created_at DESC
+		LIMIT $2`,
+		userID, coldStartCandidates,
+	)
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := scanBooks(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// The user's own genre preferences from books they've interacted with
+	genres, err := loadBookGenres(database, history)
+	if err != nil {
+		return nil, err
+	}
+	affinity := make(map[string]float64)
+	var maxAffinity float64
+	for id, genre := range genres {
+		affinity[genre] += history[id]
+		maxAffinity = math.Max(maxAffinity, affinity[genre])
+	}
+
+	e.mu.RLock()
+	var maxGenre, maxBook float64
+	for _, p := range e.genrePopularity {
+		maxGenre = math.Max(maxGenre, p)
+	}
+	for _, p := range e.model.Popularity {
+		maxBook = math.Max(maxBook, p)
+	}
+	var recommendations []Recommendation
+	for _, book := range candidates {
+		if exclude[book.ID] {
+			continue
+		}
+		genre := strings.ToLower(book.Genre)
+		score := 0.0
+		if maxGenre > 0 {
+			score += e.genrePopularity[genre] / maxGenre
+		}
+		if maxBook > 0 {
+			score += 0.5 * e.model.Popularity[book.ID] / maxBook
+		}
+		if maxAffinity > 0 {
+			score += affinity[genre] / maxAffinity
+		}
+		reason := "Popular on BookBridge"
+		if book.Genre != "" {
+			reason = "Popular in " + book.Genre
+		}
+		recommendations = append(recommendations, Recommendation{Book: book, Score: score, Reason: reason})
+	}
+	e.mu.RUnlock()
+
+	sort.SliceStable(recommendations, func(i, j int) bool {
+		return recommendations[i].Score > recommendations[j].Score
+	})
+	if len(recommendations) > limit {
+		recommendations = recommendations[:limit]
+	}
+	return recommendations, nil
+}
+
+// explain fills in the reason for collaborative recommendations from the
+// history book that contributed most and how the user interacted with it
+func explain(database *sql.DB, recommendations []Recommendation, kinds map[int]string) error {
+	ids := make(map[int]float64)
+	for _, r := range recommendations {
+		ids[r.BecauseBookID] = 0
+	}
+	titles, err := loadBookTitles(database, ids)
+	if err != nil {
+		return err
+	}
+
+	for i := range recommendations {
+		r := &recommendations[i]
+		verb, ok := reasonVerbs[kinds[r.BecauseBookID]]
+		if !ok {
+			verb = "viewed"
+		}
+		if title, ok := titles[r.BecauseBookID]; ok {
+			r.Reason = fmt.Sprintf("Because you %s %q", verb, title)
+		} else {
+			r.Reason = "Recommended for you"
+		}
+	}
+	return nil
+}
+
+// topItems returns the highest-rated book IDs of a user's history
+func topItems(history map[int]float64, n int) []int {
+	items := make([]int, 0, len(history))
+	for id := range history {
+		items = append(items, id)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if history[items[i]] != history[items[j]] {
+			return history[items[i]] > history[items[j]]
+		}
+		return items[i] < items[j]
+	})
+	if len(items) > n {
+		items = items[:n]
+	}
+	return items
+}
@@ -0,0 +1,186 @@
+package recommender
+
+import (
+	"database/sql"
+	"math"
+	"sort"
+	"time"
+)
+
+// Interaction is a single user_book_interactions row
+type Interaction struct {
+	UserID int
+	BookID int
+	Type   string
+	At     time.Time
+}
+
+// Model is an item-item cosine similarity model built from implicit ratings.
+// It has no database dependency so it can be trained on historical slices.
+type Model struct {
+	Neighbours map[int][]Neighbour
+	Popularity map[int]float64
+}
+
+// LoadInteractions reads every interaction since the given time, oldest first
+func LoadInteractions(database *sql.DB, since time.Time) ([]Interaction, error) {
+	rows, err := database.Query(`
+		SELECT user_id, book_id, interaction_type, created_at
+		FROM user_book_interactions
+		WHERE created_at >= $1
+		ORDER BY created_at ASC`,
+		since,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var interactions []Interaction
+	for rows.Next() {
+		var in Interaction
+		if err := rows.Scan(&in.UserID, &in.BookID, &in.Type, &in.At); err != nil {
+			return nil, err
+		}
+		interactions = append(interactions, in)
+	}
+	return interactions, rows.Err()
+}
+
+// Ratings aggregates interactions into each user's dampened implicit rating per book
+func Ratings(interactions []Interaction) map[int]map[int]float64 {
+	ratings := make(map[int]map[int]float64)
+	for _, in := range interactions {
+		if ratings[in.UserID] == nil {
+			ratings[in.UserID] = make(map[int]float64)
+		}
+		ratings[in.UserID][in.BookID] += interactionWeights[in.Type]
+	}
+	for _, history := range ratings {
+		dampen(history)
+	}
+	return ratings
+}
+
+// BuildModel computes item-item cosine similarities and item popularity
+func BuildModel(ratings map[int]map[int]float64) *Model {
+	// Item norms and pairwise dot products over the user dimension
+	norms := make(map[int]float64)
+	dots := make(map[[2]int]float64)
+	popularity := make(map[int]float64)
+
+	for _, history := range ratings {
+		items := topItems(history, maxHistoryPerUser)
+		for i, a := range items {
+			ra := history[a]
+			norms[a] += ra * ra
+			popularity[a] += ra
+			for _, b := range items[i+1:] {
+				key := [2]int{a, b}
+				if b < a {
+					key = [2]int{b, a}
+				}
+				dots[key] += ra * history[b]
+			}
+		}
+	}
+
+	neighbours := make(map[int][]Neighbour)
+	for key, dot := range dots {
+		score := dot / (math.Sqrt(norms[key[0]]) * math.Sqrt(norms[key[1]]))
+		neighbours[key[0]] = append(neighbours[key[0]], Neighbour{BookID: key[1], Score: score})
+		neighbours[key[1]] = append(neighbours[key[1]], Neighbour{BookID: key[0], Score: score})
+	}
+	for id, list := range neighbours {
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Score != list[j].Score {
+				return list[i].Score > list[j].Score
+			}
+			return list[i].BookID < list[j].BookID
+		})
+		if len(list) > maxNeighbours {
+			list = list[:maxNeighbours]
+		}
+		neighbours[id] = list
+	}
+
+	return &Model{Neighbours: neighbours, Popularity: popularity}
+}
+
+// Score sums neighbour similarities weighted by the user's ratings. Books in the
+// history are skipped; because maps each scored book to the history book that
+// contributed most.
+func (m *Model) Score(history map[int]float64) (scores map[int]float64, because map[int]int) {
+	scores = make(map[int]float64)
+	because = make(map[int]int)
+	best := make(map[int]float64)
+
+	for bookID, rating := range history {
+		for _, n := range m.Neighbours[bookID] {
+			if _, seen := history[n.BookID]; seen {
+				continue
+			}
+			contribution := n.Score * rating
+			scores[n.BookID] += contribution
+			if contribution > best[n.BookID] {
+				best[n.BookID] = contribution
+				because[n.BookID] = bookID
+			}
+		}
+	}
+	return scores, because
+}
+
+// TopN returns the n best-scoring books for a history, filling any remaining
+// slots with the most popular books the user hasn't seen
+func (m *Model) TopN(history map[int]float64, n int) []int {
+	scores, _ := m.Score(history)
+
+	ranked := make([]int, 0, len(scores))
+	for id, score := range scores {
+		if score > 0 {
+			ranked = append(ranked, id)
+		}
+	}
+	sortByScore(ranked, scores)
+	if len(ranked) >= n {
+		return ranked[:n]
+	}
+
+	picked := make(map[int]bool, len(ranked))
+	for _, id := range ranked {
+		picked[id] = true
+	}
+	for _, id := range m.PopularN(len(history) + n) {
+		if len(ranked) == n {
+			break
+		}
+		if _, seen := history[id]; !seen && !picked[id] {
+			ranked = append(ranked, id)
+		}
+	}
+	return ranked
+}
+
+// PopularN returns the n most popular books
+func (m *Model) PopularN(n int) []int {
+	ranked := make([]int, 0, len(m.Popularity))
+	for id := range m.Popularity {
+		ranked = append(ranked, id)
+	}
+	sortByScore(ranked, m.Popularity)
+	if len(ranked) > n {
+		ranked = ranked[:n]
+	}
+	return ranked
+}
+
+// sortByScore orders ids by descending score, breaking ties by ID for stable output
+func sortByScore(ids []int, scores map[int]float64) {
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+}
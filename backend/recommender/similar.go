@@ -0,0 +1,160 @@
+package recommender
+
+import (
+	"database/sql"
+	"math"
+	"sort"
+	"strings"
+
+	"reselling-app/models"
+	"reselling-app/utils"
+)
+
+const (
+	// Available listings compared against when finding similar books
+	similarCandidates = 1000
+	// Share of the similarity score that comes from content; the rest is co-views
+	contentWeight = 0.7
+)
+
+// Field weights for the TF-IDF document of a listing
+var fieldWeights = []struct {
+	weight float64
+	text   func(models.Book) string
+}{
+	{3, func(b models.Book) string { return b.Title }},
+	{2, func(b models.Book) string { return b.Author }},
+	{2, func(b models.Book) string { return b.Genre }},
+	{1, func(b models.Book) string { return b.Description }},
+}
+
+// stopWords are dropped from listing documents
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "the": true, "of": true, "in": true, "on": true,
+	"for": true, "to": true, "with": true, "by": true, "is": true, "it": true, "this": true,
+	"book": true, "copy": true, "edition": true, "condition": true,
+}
+
+// SimilarBooks ranks other available listings by content similarity (TF-IDF
+// over title, author, genre and description) blended with co-view signals.
+// Cheaper copies of the same title always come first, cheapest first.
+func (e *Engine) SimilarBooks(database *sql.DB, book models.Book, limit int) ([]models.Book, error) {
+	rows, err := database.Query(bookSelect+`
+		WHERE b.status = 'available' AND b.id <> $1
+		ORDER BY b.created_at DESC
+		LIMIT $2`,
+		book.ID, similarCandidates,
+	)
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := scanBooks(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// Term frequencies per document, and document frequencies over the corpus
+	docs := make([]map[string]float64, len(candidates))
+	df := make(map[string]int)
+	for i, candidate := range candidates {
+		docs[i] = termFrequencies(candidate)
+		for term := range docs[i] {
+			df[term]++
+		}
+	}
+	target := termFrequencies(book)
+	for term := range target {
+		df[term]++
+	}
+
+	n := float64(len(candidates) + 1)
+	idf := func(term string) float64 {
+		return math.Log(n/float64(df[term])) + 1
+	}
+	targetVector := weigh(target, idf)
+
+	// Co-view neighbours, normalised to [0, 1]
+	coViews := make(map[int]float64)
+	var maxCoView float64
+	for _, neighbour := range e.Neighbours(book.ID) {
+		coViews[neighbour.BookID] = neighbour.Score
+		maxCoView = math.Max(maxCoView, neighbour.Score)
+	}
+
+	title := utils.NormalizeListingText(book.Title)
+
+	type scored struct {
+		book        models.Book
+		score       float64
+		cheaperCopy bool
+	}
+	var results []scored
+	for i, candidate := range candidates {
+		score := contentWeight * cosine(targetVector, weigh(docs[i], idf))
+		if maxCoView > 0 {
+			score += (1 - contentWeight) * coViews[candidate.ID] / maxCoView
+		}
+		cheaperCopy := title != "" && utils.NormalizeListingText(candidate.Title) == title && candidate.Price < book.Price
+		if score <= 0 && !cheaperCopy {
+			continue
+		}
+		results = append(results, scored{book: candidate, score: score, cheaperCopy: cheaperCopy})
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].cheaperCopy != results[j].cheaperCopy {
+			return results[i].cheaperCopy
+		}
+		if results[i].cheaperCopy {
+			return results[i].book.Price < results[j].book.Price
+		}
+		return results[i].score > results[j].score
+	})
+
+	similar := []models.Book{}
+	for i := 0; i < len(results) && i < limit; i++ {
+		similar = append(similar, results[i].book)
+	}
+	return similar, nil
+}
+
+// termFrequencies builds the weighted bag of words for a listing
+func termFrequencies(book models.Book) map[string]float64 {
+	tf := make(map[string]float64)
+	for _, field := range fieldWeights {
+		for _, token := range strings.Fields(utils.NormalizeListingText(field.text(book))) {
+			if len(token) < 2 || stopWords[token] {
+				continue
+			}
+			tf[token] += field.weight
+		}
+	}
+	return tf
+}
+
+// weigh converts term frequencies into a TF-IDF vector
+func weigh(tf map[string]float64, idf func(string) float64) map[string]float64 {
+	vector := make(map[string]float64, len(tf))
+	for term, freq := range tf {
+		vector[term] = (1 + math.Log(freq)) * idf(term)
+	}
+	return vector
+}
+
+// cosine returns the cosine similarity of two sparse vectors
+func cosine(a, b map[string]float64) float64 {
+	var dot, normA, normB float64
+	for term, x := range a {
+		normA += x * x
+		if y, ok := b[term]; ok {
+			dot += x * y
+		}
+	}
+	for _, y := range b {
+		normB += y * y
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
@@ -0,0 +1,229 @@
+package utils
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// BookIntent is what a chatbot query asks for
+type BookIntent struct {
+	Genres   []string `json:"genres,omitempty"` // canonical genre names, e.g. "Physics"
+	Author   string   `json:"author,omitempty"`
+	MinPrice float64  `json:"min_price,omitempty"`
+	MaxPrice float64  `json:"max_price,omitempty"`
+	Exam     string   `json:"exam,omitempty"` // e.g. "JEE", "NEET"
+	Keywords []string `json:"keywords,omitempty"`
+}
+
+// Empty reports whether nothing useful was extracted
+func (i BookIntent) Empty() bool {
+	return len(i.Genres) == 0 && i.Author == "" && i.MinPrice == 0 && i.MaxPrice == 0 &&
+		i.Exam == "" && len(i.Keywords) == 0
+}
+
+// genreSynonyms maps lowercased phrases to the genres used by listings
+var genreSynonyms = map[string]string{
+	"fiction":            "Fiction",
+	"mystery":            "Mystery",
+	"mysteries":          "Mystery",
+	"detective":          "Mystery",
+	"science fiction":    "Science Fiction",
+	"sci-fi":             "Science Fiction",
+	"scifi":              "Science Fiction",
+	"fantasy":            "Fantasy",
+	"biography":          "Biography",
+	"biographies":        "Biography",
+	"memoir":             "Biography",
+	"history":            "History",
+	"romance":            "Romance",
+	"romantic":           "Romance",
+	"thriller":           "Thriller",
+	"thrillers":          "Thriller",
+	"self-help":          "Self-help",
+	"self help":          "Self-help",
+	"mathematics":        "Mathematics",
+	"maths":              "Mathematics",
+	"math":               "Mathematics",
+	"physics":            "Physics",
+	"chemistry":          "Chemistry",
+	"biology":            "Biology",
+	"english literature": "English Literature",
+	"literature":         "English Literature",
+	"computer science":   "Computer Science",
+	"programming":        "Computer Science",
+	"geography":          "Geography",
+	"economics":          "Economics",
+	"linguistics":        "Linguistics",
+	"psychology":         "Psychology",
+	"sociology":          "Sociology",
+	"political science":  "Political Science",
+	"politics":           "Political Science",
+	"philosophy":         "Philosophy",
+}
+
+// examGenres lists the subjects each competitive exam covers
+var examGenres = map[string][]string{
+	"JEE":  {"Physics", "Chemistry", "Mathematics"},
+	"NEET": {"Physics", "Chemistry", "Biology"},
+	"UPSC": {"History", "Geography", "Political Science", "Economics"},
+	"GATE": {"Mathematics", "Computer Science"},
+}
+
+var (
+	budgetRangePattern = regexp.MustCompile(`between\s*(?:₹|rs\.?|inr)?\s*(\d+)\s*(?:and|to|-)\s*(?:₹|rs\.?|inr)?\s*(\d+)`)
+	budgetMaxPattern   = regexp.MustCompile(`(?:under|below|less than|within|up ?to|upto|max(?:imum)?|budget(?: of| is)?|cheaper than)\s*(?:₹|rs\.?|inr)?\s*(\d+)`)
+	budgetMinPattern   = regexp.MustCompile(`(?:over|above|more than|at least|min(?:imum)?)\s*(?:₹|rs\.?|inr)?\s*(\d+)`)
+	currencyPattern    = regexp.MustCompile(`(?:₹|rs\.?|inr)\s*(\d+)|(\d+)\s*(?:₹|rs\b|rupees|inr)`)
+	authorPattern      = regexp.MustCompile(`\b(?:by|author|written by|books of)\s+([a-z][a-z.' ]*)`)
+	examPattern        = regexp.MustCompile(`\b(jee|neet|upsc|gate)\b`)
+)
+
+// authorStopWords end an author name captured after "by"
+var authorStopWords = map[string]bool{
+	"under": true, "below": true, "for": true, "with": true, "in": true, "and": true,
+	"or": true, "that": true, "which": true, "about": true, "on": true, "within": true,
+	"less": true, "around": true, "please": true, "cheap": true, "cheaper": true, "books": true,
+}
+
+// intentStopWords are dropped when collecting free-text keywords
+var intentStopWords = map[string]bool{
+	"a": true, "an": true, "the": true, "i": true, "me": true, "my": true, "we": true, "you": true,
+	"want": true, "need": true, "looking": true, "for": true, "some": true, "any": true, "book": true,
+	"books": true, "recommend": true, "suggest": true, "show": true, "find": true, "please": true,
+	"good": true, "best": true, "under": true, "below": true, "above": true, "over": true, "with": true,
+	"and": true, "or": true, "of": true, "to": true, "in": true, "on": true, "by": true, "about": true,
+	"can": true, "could": true, "would": true, "like": true, "something": true, "rs": true, "inr": true,
+	"rupees": true, "budget": true, "cheap": true, "cheaper": true, "price": true, "is": true, "are": true,
+	"have": true, "has": true, "get": true, "buy": true, "read": true, "reading": true, "what": true,
+	"which": true, "that": true, "this": true, "there": true, "them": true, "less": true, "than": true,
+	"more": true, "between": true, "within": true, "upto": true, "up": true, "hi": true, "hello": true,
+	"preparation": true, "prep": true, "exam": true, "exams": true, "from": true, "written": true, "author": true,
+	"same": true, "another": true, "other": true, "similar": true, "else": true, "one": true, "ones": true,
+	"expensive": true, "lower": true, "affordable": true, "costly": true, "too": true, "him": true, "her": true,
+	"writer": true, "those": true, "these": true, "anything": true, "everything": true,
+}
+
+// ExtractBookIntent pulls genres, author, budget, exam and keywords out of a
+// free-text chatbot query
+func ExtractBookIntent(query string) BookIntent {
+	var intent BookIntent
+	text := strings.ToLower(query)
+	consumed := text
+
+	// Budget
+	if m := budgetRangePattern.FindStringSubmatch(text); m != nil {
+		intent.MinPrice, _ = strconv.ParseFloat(m[1], 64)
+		intent.MaxPrice, _ = strconv.ParseFloat(m[2], 64)
+		if intent.MinPrice > intent.MaxPrice {
+			intent.MinPrice, intent.MaxPrice = intent.MaxPrice, intent.MinPrice
+		}
+		consumed = strings.Replace(consumed, m[0], " ", 1)
+	} else {
+		if m := budgetMaxPattern.FindStringSubmatch(text); m != nil {
+			intent.MaxPrice, _ = strconv.ParseFloat(m[1], 64)
+			consumed = strings.Replace(consumed, m[0], " ", 1)
+		} else if m := currencyPattern.FindStringSubmatch(text); m != nil {
+			// A bare amount like "₹300" is treated as a ceiling
+			amount := m[1] + m[2]
+			intent.MaxPrice, _ = strconv.ParseFloat(amount, 64)
+			consumed = strings.Replace(consumed, m[0], " ", 1)
+		}
+		if m := budgetMinPattern.FindStringSubmatch(text); m != nil {
+			intent.MinPrice, _ = strconv.ParseFloat(m[1], 64)
+			consumed = strings.Replace(consumed, m[0], " ", 1)
+		}
+	}
+
+	// Exam
+	if m := examPattern.FindStringSubmatch(text); m != nil {
+		intent.Exam = strings.ToUpper(m[1])
+		consumed = strings.Replace(consumed, m[0], " ", 1)
+	}
+
+	// Author named after "by"
+	if m := authorPattern.FindStringSubmatch(text); m != nil {
+		var name []string
+		for _, word := range strings.Fields(m[1]) {
+			if authorStopWords[word] || len(name) == 3 {
+				break
+			}
+			name = append(name, word)
+		}
+		if len(name) > 0 {
+			intent.Author = strings.Join(name, " ")
+			consumed = strings.Replace(consumed, intent.Author, " ", 1)
+		}
+	}
+
+	// Genres, longest phrases first so "science fiction" wins over "fiction"
+	for _, phrase := range sortedGenrePhrases {
+		if !containsPhrase(consumed, phrase) {
+			continue
+		}
+		intent.Genres = appendUnique(intent.Genres, genreSynonyms[phrase])
+		consumed = strings.Replace(consumed, phrase, " ", 1)
+	}
+	// An exam without a named subject covers all of its subjects
+	if len(intent.Genres) == 0 && intent.Exam != "" {
+		intent.Genres = append(intent.Genres, examGenres[intent.Exam]...)
+	}
+
+	// Whatever is left becomes free-text keywords
+	for _, word := range strings.FieldsFunc(consumed, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-')
+	}) {
+		if len(word) < 3 || intentStopWords[word] {
+			continue
+		}
+		intent.Keywords = appendUnique(intent.Keywords, word)
+	}
+
+	return intent
+}
+
+// sortedGenrePhrases lists genre synonyms from longest to shortest
+var sortedGenrePhrases = func() []string {
+	phrases := make([]string, 0, len(genreSynonyms))
+	for phrase := range genreSynonyms {
+		phrases = append(phrases, phrase)
+	}
+	sort.Slice(phrases, func(i, j int) bool {
+		if len(phrases[i]) != len(phrases[j]) {
+			return len(phrases[i]) > len(phrases[j])
+		}
+		return phrases[i] < phrases[j]
+	})
+	return phrases
+}()
+
+// containsPhrase reports whether phrase appears in text on word boundaries
+func containsPhrase(text, phrase string) bool {
+	for start := 0; ; {
+		idx := strings.Index(text[start:], phrase)
+		if idx < 0 {
+			return false
+		}
+		idx += start
+		end := idx + len(phrase)
+		if (idx == 0 || !isWordByte(text[idx-1])) && (end == len(text) || !isWordByte(text[end])) {
+			return true
+		}
+		start = idx + 1
+	}
+}
+
+func isWordByte(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= '0' && b <= '9' || b == '-'
+}
+
+// appendUnique appends value unless it is already present
+func appendUnique(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
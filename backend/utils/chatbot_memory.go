@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+
+	"reselling-app/models"
+)
+
+// offlineSummaryLength caps the extractive summary kept by the offline provider
+const offlineSummaryLength = 800
+
+var (
+	cheaperPattern    = regexp.MustCompile(`\b(cheaper|less expensive|lower price|more affordable|too expensive|too costly)\b`)
+	sameAuthorPattern = regexp.MustCompile(`\b(same author|same writer|more by (him|her|them)|more from (this|that) author|by (him|her|them))\b`)
+)
+
+// ResolveFollowUp fills in what a follow-up query leaves implicit from the
+// previous turn: "something cheaper" keeps the previous search but lowers the
+// budget below the cheapest listing shown, and "by the same author" searches
+// for the author of the first listing shown
+func ResolveFollowUp(query string, current, previous BookIntent, shown []models.Book) BookIntent {
+	text := strings.ToLower(query)
+	resolved := current
+
+	// A query that names no subject continues the previous search
+	if len(current.Genres) == 0 && current.Author == "" && current.Exam == "" && len(current.Keywords) == 0 {
+		resolved.Genres = previous.Genres
+		resolved.Author = previous.Author
+		resolved.Exam = previous.Exam
+		resolved.Keywords = previous.Keywords
+		if resolved.MinPrice == 0 && resolved.MaxPrice == 0 {
+			resolved.MinPrice, resolved.MaxPrice = previous.MinPrice, previous.MaxPrice
+		}
+	}
+
+	if sameAuthorPattern.MatchString(text) {
+		switch {
+		case len(shown) > 0:
+			resolved.Author = shown[0].Author
+		case previous.Author != "":
+			resolved.Author = previous.Author
+		}
+		// The author replaces whatever topic the previous search was about
+		resolved.Genres, resolved.Keywords, resolved.Exam = current.Genres, current.Keywords, current.Exam
+	}
+
+	if cheaperPattern.MatchString(text) && current.MaxPrice == 0 {
+		cheapest := math.Inf(1)
+		for _, book := range shown {
+			cheapest = math.Min(cheapest, book.Price)
+		}
+		switch {
+		case !math.IsInf(cheapest, 1):
+			resolved.MaxPrice = math.Max(cheapest-1, 0)
+		case previous.MaxPrice > 0:
+			resolved.MaxPrice = previous.MaxPrice * 0.8
+		}
+		if resolved.MinPrice >= resolved.MaxPrice {
+			resolved.MinPrice = 0
+		}
+	}
+
+	return resolved
+}
+
+// SummarizeConversation folds turns into a running conversation summary. The
+// offline provider keeps an extractive summary of the user's requests instead
+// of calling a model.
+func SummarizeConversation(ctx context.Context, provider LLMProvider, summary string, turns []LLMMessage) (string, LLMUsage, error) {
+	if provider.Name() == ProviderOffline {
+		return extractiveSummary(summary, turns), LLMUsage{}, nil
+	}
+
+	var transcript strings.Builder
+	if summary != "" {
+		fmt.Fprintf(&transcript, "Summary so far: %s\n\n", summary)
+	}
+	for _, t := range turns {
+		fmt.Fprintf(&transcript, "%s: %s\n", t.Role, t.Content)
+	}
+
+	completion, err := provider.Generate(ctx, LLMRequest{
+		System:   `Summarise this conversation between a user and BookBridge's book recommendation assistant in under 120 words. Keep the user's stated preferences (genres, authors, budget, exams) and the listing markers such as [#12] that were recommended. Write in the third person and output only the summary.`,
+		Messages: []LLMMessage{{Role: "user", Content: transcript.String()}},
+	})
+	if err != nil {
+		return "", LLMUsage{}, err
+	}
+	return strings.TrimSpace(completion.Text), completion.Usage, nil
+}
+
+// extractiveSummary appends the user's requests to the summary, keeping the most recent text
+func extractiveSummary(summary string, turns []LLMMessage) string {
+	var requests []string
+	for _, t := range turns {
+		if t.Role == "user" {
+			requests = append(requests, strings.TrimSpace(t.Content))
+		}
+	}
+	if len(requests) == 0 {
+		return summary
+	}
+
+	next := "The user asked for: " + strings.Join(requests, "; ") + "."
+	if summary != "" {
+		next = summary + " " + next
+	}
+	if runes := []rune(next); len(runes) > offlineSummaryLength {
+		next = "…" + string(runes[len(runes)-offlineSummaryLength:])
+	}
+	return next
+}
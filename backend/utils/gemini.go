@@ -1,131 +1,295 @@
 package utils
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
 	"os"
 	"strings"
 )
 
 const (
-	geminiEndpoint = "https://generativelanguage.googleapis.com/v1beta/models/gemini-2.0-flash:generateContent"
+	geminiBaseURL      = "https://generativelanguage.googleapis.com/v1beta/models"
+	defaultGeminiModel = "gemini-2.0-flash"
 )
 
 // GeminiClient represents a client for the Gemini API
 type GeminiClient struct {
-	APIKey string
+	APIKey     string
+	Model      string
+	HTTPClient *http.Client
 }
 
 // GeminiRequest represents a request to the Gemini API
 type GeminiRequest struct {
-	Contents []Content `json:"contents"`
+	SystemInstruction *Content     `json:"systemInstruction,omitempty"`
+	Contents          []Content    `json:"contents"`
+	Tools             []geminiTool `json:"tools,omitempty"`
+}
+
+// geminiTool declares the functions the model may call
+type geminiTool struct {
+	FunctionDeclarations []geminiFunctionDeclaration `json:"functionDeclarations"`
+}
+
+// geminiFunctionDeclaration describes one callable function
+type geminiFunctionDeclaration struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+}
+
+// geminiFunctionCall is a call the model asks for
+type geminiFunctionCall struct {
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+// geminiFunctionResponse returns a call's result to the model
+type geminiFunctionResponse struct {
+	Name     string          `json:"name"`
+	Response json.RawMessage `json:"response"`
 }
 
 // Content represents the content of a Gemini request
 type Content struct {
+	Role  string `json:"role,omitempty"`
 	Parts []Part `json:"parts"`
 }
 
 // Part represents a part of the content in a Gemini request
 type Part struct {
-	Text string `json:"text"`
+	Text             string                  `json:"text,omitempty"`
+	FunctionCall     *geminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *geminiFunctionResponse `json:"functionResponse,omitempty"`
 }
 
 // GeminiResponse represents a response from the Gemini API
 type GeminiResponse struct {
 	Candidates []struct {
 		Content struct {
-			Parts []struct {
-				Text string `json:"text"`
-			} `json:"parts"`
+			Parts []Part `json:"parts"`
 		} `json:"content"`
 	} `json:"candidates"`
+	UsageMetadata struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+		TotalTokenCount      int `json:"totalTokenCount"`
+	} `json:"usageMetadata"`
 }
 
-// NewGeminiClient creates a new Gemini client
+// NewGeminiClient creates a new Gemini client. GEMINI_MODEL overrides the model.
 func NewGeminiClient() (*GeminiClient, error) {
 	apiKey := os.Getenv("GEMINI_API_KEY")
 	if apiKey == "" {
 		return nil, fmt.Errorf("GEMINI_API_KEY environment variable is not set")
 	}
-	return &GeminiClient{APIKey: apiKey}, nil
+	model := os.Getenv("GEMINI_MODEL")
+	if model == "" {
+		model = defaultGeminiModel
+	}
+	return &GeminiClient{APIKey: apiKey, Model: model, HTTPClient: &http.Client{}}, nil
 }
 
-// GenerateContent sends a request to the Gemini API to generate content
-func (c *GeminiClient) GenerateContent(ctx context.Context, prompt string) (string, error) {
-	// Create the request body
-	requestBody := GeminiRequest{
-		Contents: []Content{
-			{
-				Parts: []Part{
-					{
-						Text: prompt,
-					},
-				},
-			},
-		},
-	}
-
-	// Convert the request body to JSON
-	jsonBody, err := json.Marshal(requestBody)
+// Name identifies the provider
+func (c *GeminiClient) Name() string {
+	return ProviderGemini
+}
+
+// Generate sends a request to the Gemini API and returns the completion with token usage
+func (c *GeminiClient) Generate(ctx context.Context, req LLMRequest) (LLMCompletion, error) {
+	resp, err := c.send(ctx, "generateContent", req)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal request body: %v", err)
+		return LLMCompletion{}, err
 	}
+	defer resp.Body.Close()
 
-	// Create the HTTP request
-	url := fmt.Sprintf("%s?key=%s", geminiEndpoint, c.APIKey)
-	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(string(jsonBody)))
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %v", err)
+		return LLMCompletion{}, fmt.Errorf("failed to read response body: %v", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	// Send the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	var geminiResponse GeminiResponse
+	if err := json.Unmarshal(body, &geminiResponse); err != nil {
+		return LLMCompletion{}, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	if len(geminiResponse.Candidates) == 0 || len(geminiResponse.Candidates[0].Content.Parts) == 0 {
+		return LLMCompletion{}, fmt.Errorf("no content generated")
+	}
+
+	var text strings.Builder
+	var calls []LLMToolCall
+	for _, part := range geminiResponse.Candidates[0].Content.Parts {
+		text.WriteString(part.Text)
+		if part.FunctionCall != nil {
+			calls = append(calls, geminiToolCall(len(calls), part.FunctionCall))
+		}
+	}
+
+	completion := c.completion(req, text.String(), geminiResponse)
+	completion.ToolCalls = calls
+	return completion, nil
+}
+
+// Stream sends a request to the Gemini API and forwards text as it is generated
+func (c *GeminiClient) Stream(ctx context.Context, req LLMRequest, onToken func(string) error) (LLMCompletion, error) {
+	resp, err := c.send(ctx, "streamGenerateContent?alt=sse", req)
 	if err != nil {
-		return "", fmt.Errorf("failed to send request: %v", err)
+		return LLMCompletion{}, err
 	}
 	defer resp.Body.Close()
 
-	// Read the response
-	body, err := ioutil.ReadAll(resp.Body)
+	var text strings.Builder
+	var calls []LLMToolCall
+	var last GeminiResponse
+	err = readServerSentEvents(resp.Body, func(data []byte) error {
+		var chunk GeminiResponse
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return fmt.Errorf("failed to unmarshal stream chunk: %v", err)
+		}
+		last = chunk
+		if len(chunk.Candidates) == 0 {
+			return nil
+		}
+		for _, part := range chunk.Candidates[0].Content.Parts {
+			// Function calls arrive whole rather than in pieces
+			if part.FunctionCall != nil {
+				calls = append(calls, geminiToolCall(len(calls), part.FunctionCall))
+			}
+			if part.Text == "" {
+				continue
+			}
+			text.WriteString(part.Text)
+			if err := onToken(part.Text); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to read response body: %v", err)
+		return LLMCompletion{}, err
+	}
+	if text.Len() == 0 && len(calls) == 0 {
+		return LLMCompletion{}, fmt.Errorf("no content generated")
 	}
 
-	// Check if the response is successful
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API request failed with status code %d: %s", resp.StatusCode, string(body))
+	// Usage is cumulative, so the final chunk carries the totals
+	completion := c.completion(req, text.String(), last)
+	completion.ToolCalls = calls
+	return completion, nil
+}
+
+// send posts a request to a Gemini method and returns the successful response
+func (c *GeminiClient) send(ctx context.Context, method string, req LLMRequest) (*http.Response, error) {
+	jsonBody, err := json.Marshal(newGeminiRequest(req))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body: %v", err)
 	}
 
-	// Parse the response
-	var geminiResponse GeminiResponse
-	if err := json.Unmarshal(body, &geminiResponse); err != nil {
-		return "", fmt.Errorf("failed to unmarshal response: %v", err)
+	// The key goes in a header so it doesn't end up in proxy or access logs
+	url := fmt.Sprintf("%s/%s:%s", geminiBaseURL, c.Model, method)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jsonBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("x-goog-api-key", c.APIKey)
 
-	// Extract the generated text
-	if len(geminiResponse.Candidates) == 0 || len(geminiResponse.Candidates[0].Content.Parts) == 0 {
-		return "", fmt.Errorf("no content generated")
+	resp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("API request failed with status code %d: %s", resp.StatusCode, string(body))
 	}
+	return resp, nil
+}
 
-	return geminiResponse.Candidates[0].Content.Parts[0].Text, nil
+// completion assembles the result, estimating usage if Gemini didn't report it
+func (c *GeminiClient) completion(req LLMRequest, text string, resp GeminiResponse) LLMCompletion {
+	usage := LLMUsage{
+		PromptTokens:     resp.UsageMetadata.PromptTokenCount,
+		CompletionTokens: resp.UsageMetadata.CandidatesTokenCount,
+		TotalTokens:      resp.UsageMetadata.TotalTokenCount,
+	}
+	if usage.TotalTokens == 0 {
+		usage = estimateUsage(req, text)
+	}
+	return LLMCompletion{Text: text, Provider: ProviderGemini, Model: c.Model, Usage: usage}
 }
 
-// CreateBookRecommendationPrompt creates a prompt for book recommendations
-func CreateBookRecommendationPrompt(userQuery string, userID int) string {
-	return fmt.Sprintf(`
-**System Instructions:**
-You are BookBridge's helpful AI book recommendation assistant. Your goal is to understand the user's reading preferences and recommend relevant books available in a second-hand marketplace context (mentioning genres, authors, or themes). Be friendly, engaging, and focus specifically on recommending books or asking clarifying questions to narrow down recommendations. Do not discuss topics unrelated to books or BookBridge. Do not invent book titles or authors; speak generally about types of books based on the user's description.
+// GenerateContent sends a single prompt to the Gemini API and returns the generated text
+func (c *GeminiClient) GenerateContent(ctx context.Context, prompt string) (string, error) {
+	completion, err := c.Generate(ctx, LLMRequest{Messages: []LLMMessage{{Role: "user", Content: prompt}}})
+	if err != nil {
+		return "", err
+	}
+	return completion.Text, nil
+}
+
+// newGeminiRequest converts a provider-independent request to Gemini's format.
+// Gemini has no call IDs, so results are matched to calls by function name.
+func newGeminiRequest(req LLMRequest) GeminiRequest {
+	var body GeminiRequest
+	if system := req.SystemPrompt(); system != "" {
+		body.SystemInstruction = &Content{Parts: []Part{{Text: system}}}
+	}
+	if len(req.Tools) > 0 {
+		tool := geminiTool{}
+		for _, t := range req.Tools {
+			tool.FunctionDeclarations = append(tool.FunctionDeclarations, geminiFunctionDeclaration{
+				Name: t.Name, Description: t.Description, Parameters: t.Parameters,
+			})
+		}
+		body.Tools = []geminiTool{tool}
+	}
+
+	for _, m := range req.Messages {
+		switch m.Role {
+		case "assistant":
+			content := Content{Role: "model"}
+			if m.Content != "" {
+				content.Parts = append(content.Parts, Part{Text: m.Content})
+			}
+			for _, call := range m.ToolCalls {
+				args := call.Arguments
+				if len(args) == 0 {
+					args = json.RawMessage("{}")
+				}
+				content.Parts = append(content.Parts, Part{FunctionCall: &geminiFunctionCall{Name: call.Name, Args: args}})
+			}
+			body.Contents = append(body.Contents, content)
+		case "tool":
+			part := Part{FunctionResponse: &geminiFunctionResponse{Name: m.ToolName, Response: geminiToolResponse(m.Content)}}
+			// Results of calls made in the same turn go back together
+			if n := len(body.Contents); n > 0 && body.Contents[n-1].Role == "user" && body.Contents[n-1].Parts[0].FunctionResponse != nil {
+				body.Contents[n-1].Parts = append(body.Contents[n-1].Parts, part)
+				continue
+			}
+			body.Contents = append(body.Contents, Content{Role: "user", Parts: []Part{part}})
+		default:
+			body.Contents = append(body.Contents, Content{Role: "user", Parts: []Part{{Text: m.Content}}})
+		}
+	}
+	return body
+}
 
-**User's Book Preference:**
-%s
+// geminiToolCall converts a function call from a response
+func geminiToolCall(index int, call *geminiFunctionCall) LLMToolCall {
+	return LLMToolCall{ID: fmt.Sprintf("call_%d", index), Name: call.Name, Arguments: call.Args}
+}
 
-**Task:**
-Based on the user's preference, suggest types of books or authors they might enjoy. Ask clarifying questions if needed to provide better recommendations.
-`, userQuery)
+// geminiToolResponse wraps a tool result, since Gemini requires the response to be an object
+func geminiToolResponse(result string) json.RawMessage {
+	if strings.HasPrefix(strings.TrimSpace(result), "{") && json.Valid([]byte(result)) {
+		return json.RawMessage(result)
+	}
+	wrapped, _ := json.Marshal(map[string]string{"result": result})
+	return wrapped
 }
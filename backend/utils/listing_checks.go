@@ -0,0 +1,231 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	_ "image/gif"  // register GIF decoder for listing images
+	_ "image/jpeg" // register JPEG decoder for listing images
+	_ "image/png"  // register PNG decoder for listing images
+	"io"
+	"math/bits"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+)
+
+// maxListingImageBytes caps how much of a listing image is downloaded for hashing
+const maxListingImageBytes = 5 << 20
+
+var (
+	urlPattern   = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+|\b[a-z0-9-]+\.(?:com|in|net|org|io|co|me|ly|link|xyz|shop)(?:/\S*)?\b`)
+	emailPattern = regexp.MustCompile(`(?i)[a-z0-9._%+-]+@[a-z0-9.-]+\.[a-z]{2,}`)
+	phonePattern = regexp.MustCompile(`(?:\+?\d[\s\-.()]*){10,13}`)
+
+	// sharedAddressSpace is the carrier-grade NAT range, which isn't public either
+	sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+	// listingImageClient downloads listing images from public addresses only and
+	// doesn't follow redirects, so a listing can't make the server fetch from
+	// its own network
+	listingImageClient = &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: refuseNonPublicAddress}).DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	// contactKeywords are phrases sellers use to move a deal off the platform
+	contactKeywords = []string{
+		"whatsapp", "whats app", "telegram", "signal app", "instagram", "insta id",
+		"call me", "text me", "dm me", "message me on", "contact me on", "reach me at",
+		"pay outside", "upi id", "gpay", "paytm", "phonepe",
+	}
+)
+
+// NormalizeListingText lowercases text and strips punctuation and extra whitespace
+// so that "The Alchemist!" and "the  alchemist" compare equal
+func NormalizeListingText(s string) string {
+	var b strings.Builder
+	lastSpace := true
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+			lastSpace = false
+		case !lastSpace:
+			b.WriteRune(' ')
+			lastSpace = true
+		}
+	}
+	normalized := strings.TrimSpace(b.String())
+	for _, article := range []string{"the ", "a ", "an "} {
+		normalized = strings.TrimPrefix(normalized, article)
+	}
+	return normalized
+}
+
+// FindOffPlatformContact returns a reason for every off-platform contact attempt
+// found in a listing description (links, emails, phone numbers, messaging apps)
+func FindOffPlatformContact(text string) []string {
+	var reasons []string
+
+	if urlPattern.MatchString(text) {
+		reasons = append(reasons, "description contains a link")
+	}
+	if emailPattern.MatchString(text) {
+		reasons = append(reasons, "description contains an email address")
+	}
+	for _, match := range phonePattern.FindAllString(text, -1) {
+		var digits strings.Builder
+		for _, r := range match {
+			if unicode.IsDigit(r) {
+				digits.WriteRune(r)
+			}
+		}
+		// ISBN-13s are common in textbook listings and are not phone numbers
+		number := digits.String()
+		if len(number) == 13 && (strings.HasPrefix(number, "978") || strings.HasPrefix(number, "979")) {
+			continue
+		}
+		if len(number) >= 10 {
+			reasons = append(reasons, "description contains a phone number")
+			break
+		}
+	}
+
+	lower := strings.ToLower(text)
+	for _, keyword := range contactKeywords {
+		if strings.Contains(lower, keyword) {
+			reasons = append(reasons, fmt.Sprintf("description mentions off-platform contact (%q)", keyword))
+			break
+		}
+	}
+
+	return reasons
+}
+
+// ImageHash downloads a listing image and returns its 64-bit difference hash
+// encoded as hex. Visually similar images produce hashes with a small Hamming distance.
+func ImageHash(ctx context.Context, imageURL string) (string, error) {
+	data, err := fetchListingImage(ctx, imageURL)
+	if err != nil {
+		return "", err
+	}
+	return ImageDataHash(data)
+}
+
+// ImageDataHash returns the difference hash of an encoded image
+func ImageDataHash(data []byte) (string, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	return fmt.Sprintf("%016x", differenceHash(img)), nil
+}
+
+// ImageHashDistance returns the number of differing bits between two hex image hashes
+func ImageHashDistance(a, b string) (int, error) {
+	x, err := strconv.ParseUint(a, 16, 64)
+	if err != nil {
+		return 0, err
+	}
+	y, err := strconv.ParseUint(b, 16, 64)
+	if err != nil {
+		return 0, err
+	}
+	return bits.OnesCount64(x ^ y), nil
+}
+
+// fetchListingImage reads image bytes from an http(s) or base64 data URL
+func fetchListingImage(ctx context.Context, imageURL string) ([]byte, error) {
+	if strings.HasPrefix(imageURL, "data:") {
+		comma := strings.Index(imageURL, ",")
+		if comma < 0 || !strings.Contains(imageURL[:comma], ";base64") {
+			return nil, fmt.Errorf("unsupported data URL")
+		}
+		return base64.StdEncoding.DecodeString(imageURL[comma+1:])
+	}
+
+	if !strings.HasPrefix(imageURL, "http://") && !strings.HasPrefix(imageURL, "https://") {
+		return nil, fmt.Errorf("unsupported image URL scheme")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", imageURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	resp, err := listingImageClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download image: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("image download failed with status code %d", resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxListingImageBytes))
+}
+
+// refuseNonPublicAddress stops a dial to a loopback, private, link-local or
+// otherwise non-public address. It runs after DNS resolution, so a public
+// hostname that resolves to an internal address is refused too.
+func refuseNonPublicAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("refusing to fetch image from non-public address %s", host)
+	}
+	return nil
+}
+
+// differenceHash shrinks the image to a 9x8 grayscale grid and records whether
+// each pixel is brighter than its right-hand neighbour
+func differenceHash(img image.Image) uint64 {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return 0
+	}
+
+	var grid [8][9]float64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 9; x++ {
+			// Sample the centre of each grid cell
+			px := bounds.Min.X + (2*x+1)*width/18
+			py := bounds.Min.Y + (2*y+1)*height/16
+			r, g, b, _ := img.At(px, py).RGBA()
+			grid[y][x] = 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if grid[y][x] > grid[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
@@ -0,0 +1,211 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// LLM provider names accepted by LLM_PROVIDER
+const (
+	ProviderGemini  = "gemini"
+	ProviderOpenAI  = "openai"
+	ProviderOffline = "offline"
+)
+
+// LLMMessage is one turn of a conversation
+type LLMMessage struct {
+	Role    string // "user", "assistant" or "tool"
+	Content string
+	// ToolCalls are the functions an assistant turn asked to call
+	ToolCalls []LLMToolCall
+	// ToolCallID and ToolName identify the call a "tool" turn holds the JSON result of
+	ToolCallID string
+	ToolName   string
+}
+
+// LLMTool describes a function the model may ask to call
+type LLMTool struct {
+	Name        string
+	Description string
+	Parameters  map[string]interface{} // JSON schema of the arguments
+}
+
+// LLMToolCall is a function call requested by the model
+type LLMToolCall struct {
+	ID        string
+	Name      string
+	Arguments json.RawMessage
+}
+
+// LLMDocument is retrieved context the model may cite by ID
+type LLMDocument struct {
+	ID   int
+	Text string
+}
+
+// LLMRequest is a provider-independent generation request
+type LLMRequest struct {
+	System    string
+	Documents []LLMDocument
+	Messages  []LLMMessage
+	Tools     []LLMTool
+}
+
+// LLMUsage counts the tokens consumed by a request
+type LLMUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// LLMCompletion is the generated text and what it cost. When ToolCalls is
+// set the model wants their results before it finishes the reply.
+type LLMCompletion struct {
+	Text      string
+	ToolCalls []LLMToolCall
+	Provider  string
+	Model     string
+	Usage     LLMUsage
+}
+
+// LLMProvider generates chat completions
+type LLMProvider interface {
+	Name() string
+	Generate(ctx context.Context, req LLMRequest) (LLMCompletion, error)
+	// Stream calls onToken with each piece of text as it is generated and
+	// returns the whole completion. An error from onToken aborts the request.
+	Stream(ctx context.Context, req LLMRequest, onToken func(string) error) (LLMCompletion, error)
+}
+
+// LastUserMessage returns the content of the most recent user turn
+func (r LLMRequest) LastUserMessage() string {
+	for i := len(r.Messages) - 1; i >= 0; i-- {
+		if r.Messages[i].Role == "user" {
+			return r.Messages[i].Content
+		}
+	}
+	return ""
+}
+
+// SystemPrompt returns the system instructions followed by the retrieved
+// documents, each tagged with the citation marker the model should use.
+// Documents are seller-written, so each is delimited as untrusted text.
+func (r LLMRequest) SystemPrompt() string {
+	if len(r.Documents) == 0 {
+		return r.System
+	}
+	var b strings.Builder
+	b.WriteString(r.System)
+	b.WriteString("\n\nAvailable listings:\n")
+	for _, d := range r.Documents {
+		fmt.Fprintf(&b, "%s %s\n", CitationMarker(d.ID), QuoteUntrusted("listing", d.Text))
+	}
+	return b.String()
+}
+
+// ToolResult returns a "tool" turn holding the JSON result of a call
+func ToolResult(call LLMToolCall, result interface{}) LLMMessage {
+	content, err := json.Marshal(result)
+	if err != nil {
+		content, _ = json.Marshal(map[string]string{"error": err.Error()})
+	}
+	return LLMMessage{Role: "tool", Content: string(content), ToolCallID: call.ID, ToolName: call.Name}
+}
+
+// CitationMarker is how a reply refers to a listing, e.g. [#42]
+func CitationMarker(id int) string {
+	return fmt.Sprintf("[#%d]", id)
+}
+
+// NewLLMProvider builds the provider selected by LLM_PROVIDER. When unset,
+// Gemini is used if GEMINI_API_KEY is present and the offline provider otherwise,
+// so the chatbot works in development without a cloud key.
+func NewLLMProvider() (LLMProvider, error) {
+	name := strings.ToLower(strings.TrimSpace(os.Getenv("LLM_PROVIDER")))
+	if name == "" {
+		name = ProviderOffline
+		if os.Getenv("GEMINI_API_KEY") != "" {
+			name = ProviderGemini
+		}
+	}
+
+	switch name {
+	case ProviderGemini:
+		return NewGeminiClient()
+	case ProviderOpenAI:
+		return NewOpenAIClient()
+	case ProviderOffline:
+		return NewOfflineProvider(), nil
+	default:
+		return nil, fmt.Errorf("unknown LLM_PROVIDER %q", name)
+	}
+}
+
+var (
+	defaultProvider     LLMProvider
+	defaultProviderOnce sync.Once
+)
+
+// DefaultLLMProvider returns the shared provider configured from the environment,
+// falling back to the offline provider if the configured one can't be created
+func DefaultLLMProvider() LLMProvider {
+	defaultProviderOnce.Do(func() {
+		provider, err := NewLLMProvider()
+		if err != nil {
+			log.Printf("Error creating LLM provider, using offline provider: %v", err)
+			provider = NewOfflineProvider()
+		}
+		defaultProvider = provider
+	})
+	return defaultProvider
+}
+
+// EstimateTokens approximates a token count for providers that don't report one
+func EstimateTokens(text string) int {
+	if text == "" {
+		return 0
+	}
+	// Roughly four characters per token for English text
+	return (len(text) + 3) / 4
+}
+
+// estimateUsage fills in usage from the request and completion text
+func estimateUsage(req LLMRequest, completion string) LLMUsage {
+	prompt := EstimateTokens(req.SystemPrompt())
+	for _, m := range req.Messages {
+		prompt += EstimateTokens(m.Content)
+	}
+	out := EstimateTokens(completion)
+	return LLMUsage{PromptTokens: prompt, CompletionTokens: out, TotalTokens: prompt + out}
+}
+
+// readServerSentEvents calls handle with the data of each event in a
+// server-sent event stream until the stream ends or sends [DONE]
+func readServerSentEvents(r io.Reader, handle func(data []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "" {
+			continue
+		}
+		if data == "[DONE]" {
+			return nil
+		}
+		if err := handle([]byte(data)); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,241 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// offlineModel is reported as the model name of the offline provider
+	offlineModel = "rule-based-v1"
+	// offlineMaxListings caps how many listings an offline reply cites
+	offlineMaxListings = 5
+)
+
+// offlineTopics map keywords in a query to the topic the offline provider talks about
+var offlineTopics = []struct {
+	topic    string
+	keywords []string
+}{
+	{"academic and exam preparation", []string{"jee", "neet", "exam", "textbook", "physics", "chemistry", "maths", "math", "biology", "upsc", "gate", "academic"}},
+	{"fantasy", []string{"fantasy", "magic", "dragon", "wizard"}},
+	{"science fiction", []string{"sci-fi", "science fiction", "space", "robot", "future"}},
+	{"mystery and thriller", []string{"mystery", "thriller", "detective", "crime", "suspense"}},
+	{"romance", []string{"romance", "love", "romantic"}},
+	{"self-help", []string{"self-help", "self help", "motivation", "productivity", "habits"}},
+	{"biography", []string{"biography", "memoir", "autobiography"}},
+	{"children's", []string{"kids", "children", "child"}},
+	{"fiction", []string{"novel", "fiction", "story", "stories"}},
+}
+
+// offlineToolPatterns map requests about a specific listing to the tool that handles them
+var offlineToolPatterns = []struct {
+	tool    string
+	pattern *regexp.Regexp
+}{
+	{"add_to_cart", regexp.MustCompile(`\b(add|put)\b.*\b(cart|basket)\b`)},
+	{"add_to_favorites", regexp.MustCompile(`\b(favou?rites?|wishlist|bookmark|save (it|this|that|book|\[?#))`)},
+	{"get_price_estimate", regexp.MustCompile(`\b(price estimate|estimate|fair price|resale value)\b`)},
+}
+
+var (
+	// offlineBookReference matches a listing named in a message, e.g. [#12], #12 or "book 12"
+	offlineBookReference = regexp.MustCompile(`(?:#|\bbook\s+)(\d+)`)
+)
+
+// OfflineProvider is a deterministic rule-based provider used when no language
+// model is configured. It never makes network calls.
+type OfflineProvider struct{}
+
+// NewOfflineProvider creates the rule-based provider
+func NewOfflineProvider() *OfflineProvider {
+	return &OfflineProvider{}
+}
+
+// Name identifies the provider
+func (p *OfflineProvider) Name() string {
+	return ProviderOffline
+}
+
+// Generate lists the retrieved listings, or builds a reply from the topics
+// mentioned in the last user message when there are none
+func (p *OfflineProvider) Generate(ctx context.Context, req LLMRequest) (LLMCompletion, error) {
+	if err := ctx.Err(); err != nil {
+		return LLMCompletion{}, err
+	}
+
+	// Report tool results, or call a tool when asked to act on a listing
+	if n := len(req.Messages); n > 0 && req.Messages[n-1].Role == "tool" {
+		text := describeToolResults(req.Messages)
+		return LLMCompletion{Text: text, Provider: ProviderOffline, Model: offlineModel, Usage: estimateUsage(req, text)}, nil
+	}
+	if call, ok := offlineToolCall(req); ok {
+		return LLMCompletion{ToolCalls: []LLMToolCall{call}, Provider: ProviderOffline, Model: offlineModel, Usage: estimateUsage(req, "")}, nil
+	}
+
+	topics := matchOfflineTopics(req.LastUserMessage())
+
+	var text string
+	switch {
+	case len(req.Documents) > 0:
+		var b strings.Builder
+		b.WriteString("Here are some listings that match what you're looking for:\n")
+		for i, d := range req.Documents {
+			if i == offlineMaxListings {
+				break
+			}
+			fmt.Fprintf(&b, "\n%s %s", CitationMarker(d.ID), d.Text)
+		}
+		b.WriteString("\n\nTell me your budget or a favourite author if you'd like me to narrow these down.")
+		text = b.String()
+	case len(topics) == 0:
+		text = "I can help you find second-hand books on BookBridge. Tell me a genre, an author you like, an exam you're preparing for or your budget, and I'll point you to matching listings."
+	default:
+		text = fmt.Sprintf("I couldn't find any available %s books matching that right now. Try a different author, a wider budget or check back soon as new listings arrive daily.",
+			strings.Join(topics, " or "))
+	}
+
+	return LLMCompletion{Text: text, Provider: ProviderOffline, Model: offlineModel, Usage: estimateUsage(req, text)}, nil
+}
+
+// offlineToolCall picks a tool for a request to act on one listing. The listing
+// is the one the message names, or else the first one the previous reply cited.
+func offlineToolCall(req LLMRequest) (LLMToolCall, bool) {
+	available := make(map[string]bool, len(req.Tools))
+	for _, t := range req.Tools {
+		available[t.Name] = true
+	}
+	query := strings.ToLower(req.LastUserMessage())
+
+	for _, p := range offlineToolPatterns {
+		if !available[p.tool] || !p.pattern.MatchString(query) {
+			continue
+		}
+		bookID := offlineReferencedBook(req, query)
+		if bookID == 0 {
+			return LLMToolCall{}, false
+		}
+		args, _ := json.Marshal(map[string]int{"book_id": bookID})
+		return LLMToolCall{ID: "offline_0", Name: p.tool, Arguments: args}, true
+	}
+	return LLMToolCall{}, false
+}
+
+// offlineReferencedBook returns the listing a query refers to, or 0 if there is none
+func offlineReferencedBook(req LLMRequest, query string) int {
+	if m := offlineBookReference.FindStringSubmatch(query); m != nil {
+		id, _ := strconv.Atoi(m[1])
+		return id
+	}
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		if req.Messages[i].Role != "assistant" {
+			continue
+		}
+		if m := citationPattern.FindStringSubmatch(req.Messages[i].Content); m != nil {
+			id, _ := strconv.Atoi(m[1])
+			return id
+		}
+		break
+	}
+	if len(req.Documents) == 1 {
+		return req.Documents[0].ID
+	}
+	return 0
+}
+
+// describeToolResults turns the results after the last assistant turn into a reply
+func describeToolResults(messages []LLMMessage) string {
+	start := len(messages)
+	for start > 0 && messages[start-1].Role == "tool" {
+		start--
+	}
+
+	var b strings.Builder
+	for _, m := range messages[start:] {
+		var result struct {
+			Message string `json:"message"`
+			Error   string `json:"error"`
+			Books   []struct {
+				ID     int     `json:"id"`
+				Title  string  `json:"title"`
+				Author string  `json:"author"`
+				Price  float64 `json:"price"`
+			} `json:"books"`
+		}
+		if err := json.Unmarshal([]byte(m.Content), &result); err != nil {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\n\n")
+		}
+		if result.Error != "" {
+			fmt.Fprintf(&b, "Sorry, I couldn't do that: %s", result.Error)
+			continue
+		}
+		b.WriteString(result.Message)
+		for i, book := range result.Books {
+			if i == offlineMaxListings {
+				break
+			}
+			fmt.Fprintf(&b, "\n%s %s by %s, ₹%.0f", CitationMarker(book.ID), book.Title, book.Author, book.Price)
+		}
+	}
+	if b.Len() == 0 {
+		return "Done."
+	}
+	return b.String()
+}
+
+// matchOfflineTopics returns the topics whose keywords appear in the query, in table order
+func matchOfflineTopics(query string) []string {
+	query = strings.ToLower(query)
+	words := make(map[string]bool)
+	for _, w := range strings.FieldsFunc(query, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-')
+	}) {
+		words[w] = true
+	}
+
+	var topics []string
+	for _, t := range offlineTopics {
+		for _, keyword := range t.keywords {
+			if words[keyword] || (strings.Contains(keyword, " ") && strings.Contains(query, keyword)) {
+				topics = append(topics, t.topic)
+				break
+			}
+		}
+	}
+	return topics
+}
+
+// Stream generates the reply and emits it a word at a time
+func (p *OfflineProvider) Stream(ctx context.Context, req LLMRequest, onToken func(string) error) (LLMCompletion, error) {
+	completion, err := p.Generate(ctx, req)
+	if err != nil {
+		return LLMCompletion{}, err
+	}
+
+	text := completion.Text
+	for len(text) > 0 {
+		if err := ctx.Err(); err != nil {
+			return LLMCompletion{}, err
+		}
+		// Each token is a word with the whitespace that follows it
+		end := strings.IndexAny(text, " \n")
+		if end < 0 {
+			end = len(text) - 1
+		}
+		for end+1 < len(text) && (text[end+1] == ' ' || text[end+1] == '\n') {
+			end++
+		}
+		if err := onToken(text[:end+1]); err != nil {
+			return LLMCompletion{}, err
+		}
+		text = text[end+1:]
+	}
+	return completion, nil
+}
@@ -0,0 +1,280 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	defaultOpenAIBaseURL = "http://localhost:11434/v1"
+	defaultOpenAIModel   = "llama3.1"
+)
+
+// OpenAIClient talks to any server implementing the OpenAI chat completions
+// API, such as a local llama.cpp server, Ollama or OpenAI itself
+type OpenAIClient struct {
+	BaseURL    string
+	APIKey     string // optional for local servers
+	Model      string
+	HTTPClient *http.Client
+}
+
+// openAIMessage is a message in the chat completions format
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    string           `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+// openAIToolCall is a function call in a message, or a piece of one in a stream
+type openAIToolCall struct {
+	Index    *int   `json:"index,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// openAITool declares a function the model may call
+type openAITool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string                 `json:"name"`
+		Description string                 `json:"description"`
+		Parameters  map[string]interface{} `json:"parameters,omitempty"`
+	} `json:"function"`
+}
+
+// openAIRequest is the body of a chat completions request
+type openAIRequest struct {
+	Model         string               `json:"model"`
+	Messages      []openAIMessage      `json:"messages"`
+	Tools         []openAITool         `json:"tools,omitempty"`
+	Stream        bool                 `json:"stream,omitempty"`
+	StreamOptions *openAIStreamOptions `json:"stream_options,omitempty"`
+}
+
+// openAIStreamOptions asks for usage to be reported at the end of a stream
+type openAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// openAIResponse is the body of a chat completions response, or one chunk of a stream
+type openAIResponse struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message openAIMessage `json:"message"`
+		Delta   openAIMessage `json:"delta"`
+	} `json:"choices"`
+	Usage *LLMUsage `json:"usage"`
+}
+
+// NewOpenAIClient creates a client from OPENAI_BASE_URL, OPENAI_API_KEY and
+// OPENAI_MODEL. The defaults point at a local Ollama server.
+func NewOpenAIClient() (*OpenAIClient, error) {
+	baseURL := os.Getenv("OPENAI_BASE_URL")
+	if baseURL == "" {
+		baseURL = defaultOpenAIBaseURL
+	}
+	model := os.Getenv("OPENAI_MODEL")
+	if model == "" {
+		model = defaultOpenAIModel
+	}
+	return &OpenAIClient{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		APIKey:     os.Getenv("OPENAI_API_KEY"),
+		Model:      model,
+		HTTPClient: &http.Client{},
+	}, nil
+}
+
+// Name identifies the provider
+func (c *OpenAIClient) Name() string {
+	return ProviderOpenAI
+}
+
+// Generate requests a chat completion and returns it with token usage
+func (c *OpenAIClient) Generate(ctx context.Context, req LLMRequest) (LLMCompletion, error) {
+	resp, err := c.send(ctx, openAIRequest{Model: c.Model, Messages: openAIMessages(req), Tools: openAITools(req)})
+	if err != nil {
+		return LLMCompletion{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return LLMCompletion{}, fmt.Errorf("failed to read response body: %v", err)
+	}
+
+	var completion openAIResponse
+	if err := json.Unmarshal(body, &completion); err != nil {
+		return LLMCompletion{}, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+	if len(completion.Choices) == 0 {
+		return LLMCompletion{}, fmt.Errorf("no content generated")
+	}
+
+	message := completion.Choices[0].Message
+	result := c.completion(req, message.Content, completion.Model, completion.Usage)
+	for _, call := range message.ToolCalls {
+		result.ToolCalls = append(result.ToolCalls, LLMToolCall{ID: call.ID, Name: call.Function.Name, Arguments: json.RawMessage(call.Function.Arguments)})
+	}
+	return result, nil
+}
+
+// Stream requests a streamed chat completion and forwards text as it is generated
+func (c *OpenAIClient) Stream(ctx context.Context, req LLMRequest, onToken func(string) error) (LLMCompletion, error) {
+	resp, err := c.send(ctx, openAIRequest{
+		Model:         c.Model,
+		Messages:      openAIMessages(req),
+		Tools:         openAITools(req),
+		Stream:        true,
+		StreamOptions: &openAIStreamOptions{IncludeUsage: true},
+	})
+	if err != nil {
+		return LLMCompletion{}, err
+	}
+	defer resp.Body.Close()
+
+	var text strings.Builder
+	var model string
+	var usage *LLMUsage
+	// Tool calls stream as pieces keyed by index, with the arguments split across chunks
+	var calls []openAIToolCall
+	err = readServerSentEvents(resp.Body, func(data []byte) error {
+		var chunk openAIResponse
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return fmt.Errorf("failed to unmarshal stream chunk: %v", err)
+		}
+		if chunk.Model != "" {
+			model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+		if len(chunk.Choices) == 0 {
+			return nil
+		}
+		delta := chunk.Choices[0].Delta
+		for _, piece := range delta.ToolCalls {
+			index := len(calls)
+			if piece.Index != nil {
+				index = *piece.Index
+			}
+			for len(calls) <= index {
+				calls = append(calls, openAIToolCall{})
+			}
+			if piece.ID != "" {
+				calls[index].ID = piece.ID
+			}
+			if piece.Function.Name != "" {
+				calls[index].Function.Name = piece.Function.Name
+			}
+			calls[index].Function.Arguments += piece.Function.Arguments
+		}
+		if delta.Content == "" {
+			return nil
+		}
+		text.WriteString(delta.Content)
+		return onToken(delta.Content)
+	})
+	if err != nil {
+		return LLMCompletion{}, err
+	}
+	if text.Len() == 0 && len(calls) == 0 {
+		return LLMCompletion{}, fmt.Errorf("no content generated")
+	}
+
+	result := c.completion(req, text.String(), model, usage)
+	for i, call := range calls {
+		if call.ID == "" {
+			call.ID = fmt.Sprintf("call_%d", i)
+		}
+		result.ToolCalls = append(result.ToolCalls, LLMToolCall{ID: call.ID, Name: call.Function.Name, Arguments: json.RawMessage(call.Function.Arguments)})
+	}
+	return result, nil
+}
+
+// send posts a chat completions request and returns the successful response
+func (c *OpenAIClient) send(ctx context.Context, body openAIRequest) (*http.Response, error) {
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body: %v", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/chat/completions", bytes.NewReader(jsonBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if c.APIKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+
+	resp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("API request failed with status code %d: %s", resp.StatusCode, string(body))
+	}
+	return resp, nil
+}
+
+// completion assembles the result, estimating usage if the server didn't report it
+func (c *OpenAIClient) completion(req LLMRequest, text, model string, usage *LLMUsage) LLMCompletion {
+	result := LLMCompletion{Text: text, Provider: ProviderOpenAI, Model: model, Usage: estimateUsage(req, text)}
+	if usage != nil {
+		result.Usage = *usage
+	}
+	if result.Model == "" {
+		result.Model = c.Model
+	}
+	return result
+}
+
+// openAIMessages converts a provider-independent request to chat messages
+func openAIMessages(req LLMRequest) []openAIMessage {
+	var messages []openAIMessage
+	if system := req.SystemPrompt(); system != "" {
+		messages = append(messages, openAIMessage{Role: "system", Content: system})
+	}
+	for _, m := range req.Messages {
+		message := openAIMessage{Role: m.Role, Content: m.Content, ToolCallID: m.ToolCallID}
+		for _, call := range m.ToolCalls {
+			tc := openAIToolCall{ID: call.ID, Type: "function"}
+			tc.Function.Name = call.Name
+			tc.Function.Arguments = string(call.Arguments)
+			if tc.Function.Arguments == "" {
+				tc.Function.Arguments = "{}"
+			}
+			message.ToolCalls = append(message.ToolCalls, tc)
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+// openAITools converts the request's tools to function declarations
+func openAITools(req LLMRequest) []openAITool {
+	var tools []openAITool
+	for _, t := range req.Tools {
+		tool := openAITool{Type: "function"}
+		tool.Function.Name = t.Name
+		tool.Function.Description = t.Description
+		tool.Function.Parameters = t.Parameters
+		tools = append(tools, tool)
+	}
+	return tools
+}
@@ -190,13 +190,13 @@ function showMessage(message, type = 'info') {
 }
 
 /**
- * Load recommended books based on the current book
+ * Load books similar to the current one (cheaper copies of the same title first)
  */
 function loadRecommendedBooks() {
     const urlParams = new URLSearchParams(window.location.search);
     const bookId = urlParams.get('id');
     
-    fetch(`api/books/${bookId}/recommendations`, {
+    fetch(`api/books/${bookId}/similar`, {
         headers: getAuthHeaders()
     })
     .then(response => {
@@ -142,6 +142,7 @@ function loadRecommendedBooks() {
         
         booksToShow.forEach(book => {
             const bookCard = createBookCard(book);
+            decorateRecommendationCard(bookCard, book, books.indexOf(book) + 1);
             container.appendChild(bookCard);
         });
         
@@ -160,6 +161,50 @@ function loadRecommendedBooks() {
     });
 }
 
+/**
+ * Add the recommendation reason, click tracking and feedback actions to a card
+ * @param {HTMLElement} card - Card created by createBookCard
+ * @param {Object} book - Recommended book with its reason
+ * @param {number} position - Position in the recommendation list
+ */
+function decorateRecommendationCard(card, book, position) {
+    const body = card.querySelector('.card-body');
+    if (book.reason) {
+        const reason = document.createElement('p');
+        reason.className = 'card-text small text-info';
+        reason.textContent = book.reason;
+        body.prepend(reason);
+    }
+    
+    const sendFeedback = (path, payload) => fetch(`/api/recommendations/${book.id}/${path}`, {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+            ...getAuthHeaders()
+        },
+        body: JSON.stringify(payload)
+    });
+    
+    card.querySelector('a[href^="book-detail.html"]').addEventListener('click', () => {
+        sendFeedback('click', { position });
+    });
+    
+    const actions = document.createElement('div');
+    actions.className = 'small mt-2';
+    actions.innerHTML = `
+        <a href="#" class="text-muted me-2" data-feedback="not_interested">Not interested</a>
+        <a href="#" class="text-muted" data-feedback="already_own">I already own this</a>
+    `;
+    actions.querySelectorAll('[data-feedback]').forEach(link => {
+        link.addEventListener('click', event => {
+            event.preventDefault();
+            sendFeedback('feedback', { type: link.dataset.feedback })
+                .then(() => card.remove());
+        });
+    });
+    body.appendChild(actions);
+}
+
 /**
  * Create a book card element
  * @param {Object} book - Book data
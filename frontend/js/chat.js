@@ -8,6 +8,8 @@ let socket = null;
 let activeChats = [];
 let deepChatInstance = null;
 let chatbotInstance = null; // Separate instance for the chatbot assistant
+let lastMessageIds = {}; // Newest message ID seen per chat, to sync what was missed on reconnect
+let seenMessageIds = new Set(); // Message IDs already shown, since replays can repeat live messages
 
 /**
  * Initialize the chat system
@@ -40,6 +42,29 @@ function initializeChat() {
         startNewChat(bookId, sellerId);
     }
     
+    // Send typing indicators while the user types
+    const messageInput = document.getElementById('message-input');
+    if (messageInput) {
+        messageInput.addEventListener('input', sendTyping);
+    }
+    
+    // Photos and meetup locations
+    const photoInput = document.getElementById('photo-input');
+    const attachPhotoButton = document.getElementById('attach-photo-btn');
+    if (photoInput && attachPhotoButton) {
+        attachPhotoButton.addEventListener('click', () => photoInput.click());
+        photoInput.addEventListener('change', function() {
+            if (photoInput.files.length > 0) {
+                sendPhoto(photoInput.files[0]);
+                photoInput.value = '';
+            }
+        });
+    }
+    const shareLocationButton = document.getElementById('share-location-btn');
+    if (shareLocationButton) {
+        shareLocationButton.addEventListener('click', shareLocation);
+    }
+    
     // Set up message form
     const messageForm = document.getElementById('message-form');
     if (messageForm) {
@@ -75,6 +100,10 @@ function initializeWebSocket() {
     }
     if (chatId) {
         wsUrl += `&chat_id=${chatId}`;
+        // Ask for anything sent while we were disconnected
+        if (lastMessageIds[chatId]) {
+            wsUrl += `&since=${lastMessageIds[chatId]}`;
+        }
     }
     socket = new WebSocket(wsUrl);
     // Set up WebSocket event handlers
@@ -105,11 +134,31 @@ function handleWebSocketMessage(message) {
     switch (message.type) {
         case 'message':
             appendMessage(message);
+            markChatRead(message);
             break;
         case 'chat_created':
             currentChatId = message.chat_id;
             loadChat(message.chat_id);
             break;
+        case 'chat_joined':
+            currentChatId = message.chat_id;
+            markChatRead(message);
+            break;
+        case 'read':
+            showReadReceipt(message);
+            break;
+        case 'typing':
+            showTypingIndicator(message);
+            break;
+        case 'presence':
+            showPresence(message);
+            break;
+        case 'synced':
+            // Missed messages come in batches; ask for the next one
+            if (message.data && message.data.more) {
+                socket.send(JSON.stringify({ type: 'sync', chat_id: message.chat_id, since: message.id }));
+            }
+            break;
         case 'error':
             displayError(message.content);
             break;
@@ -119,9 +168,10 @@ function handleWebSocketMessage(message) {
 }
 
 /**
- * Load user's chat sessions
+ * Load user's chat sessions, most recently active first
+ * @param {String} before - The next_before cursor of the previous page, to load more
  */
-function loadChatSessions() {
+function loadChatSessions(before) {
     const chatList = document.getElementById('chat-list');
     const chatsLoading = document.getElementById('chats-loading');
     const noChatsMessage = document.getElementById('no-chats-message');
@@ -133,7 +183,7 @@ function loadChatSessions() {
     }
     
     // Show loading indicator
-    if (chatsLoading) chatsLoading.style.display = 'block';
+    if (chatsLoading && !before) chatsLoading.style.display = 'block';
     if (noChatsMessage) noChatsMessage.style.display = 'none';
     
     // Make sure we have a valid authentication token
@@ -172,7 +222,7 @@ function loadChatSessions() {
     
     // Add a timestamp to prevent caching
     const timestamp = new Date().getTime();
-    const url = `/api/chats?_=${timestamp}`;
+    const url = `/api/chats?_=${timestamp}${before ? `&before=${encodeURIComponent(before)}` : ''}`;
     
     fetch(url, {
         headers: getAuthHeaders(),
@@ -188,28 +238,24 @@ function loadChatSessions() {
         }
         return response.json();
     })
-    .then(chats => {
+    .then(page => {
         // Log the successful response for debugging
-        console.log('Chats response:', chats);
+        console.log('Chats response:', page);
         
-        // Handle case where response is not an array
-        if (!Array.isArray(chats)) {
-            console.error('Expected array of chats but got:', typeof chats);
-            // Initialize as empty array to prevent errors
-            chats = [];
-        }
+        // Handle case where response has no chats array
+        const chats = page && Array.isArray(page.chats) ? page.chats : [];
         
-        // Store the chats
-        activeChats = chats;
+        // Store the chats, adding to those already listed when loading more
+        activeChats = before ? activeChats.concat(chats) : chats;
         
         // Hide loading indicator
         if (chatsLoading) chatsLoading.style.display = 'none';
         
-        // Clear the chat list
-        const existingItems = chatList.querySelectorAll('.chat-list-item, .chat-error-message');
+        // Clear the chat list, or just the previous "load more" button
+        const existingItems = chatList.querySelectorAll(before ? '.chat-load-more' : '.chat-list-item, .chat-error-message, .chat-load-more');
         existingItems.forEach(item => item.remove());
         
-        if (chats.length === 0) {
+        if (activeChats.length === 0) {
             // Show no chats message
             if (noChatsMessage) noChatsMessage.style.display = 'block';
             return;
@@ -224,6 +270,16 @@ function loadChatSessions() {
                 console.error('Error creating chat list item:', err, chat);
             }
         });
+        
+        // Older chats load a page at a time
+        if (page.next_before) {
+            const loadMore = document.createElement('button');
+            loadMore.type = 'button';
+            loadMore.className = 'list-group-item list-group-item-action text-center text-primary chat-load-more';
+            loadMore.textContent = 'Load older conversations';
+            loadMore.addEventListener('click', () => loadChatSessions(page.next_before));
+            chatList.appendChild(loadMore);
+        }
     })
     .catch(error => {
         console.error('Error loading chats:', error);
@@ -231,7 +287,7 @@ function loadChatSessions() {
         if (chatsLoading) chatsLoading.style.display = 'none';
         
         // Clear existing items
-        const existingItems = chatList.querySelectorAll('.chat-list-item, .chat-error-message');
+        const existingItems = chatList.querySelectorAll('.chat-list-item, .chat-error-message, .chat-load-more');
         existingItems.forEach(item => item.remove());
         
         // Show error message
@@ -253,15 +309,15 @@ function loadChatSessions() {
 function createChatListItem(chat) {
     const user = getUserData();
     
-    // Determine the other user's name (buyer or seller)
-    const otherUserName = user.role === 'buyer' ? chat.seller_name : chat.buyer_name;
+    // The other participant, whichever side of the sale they are on
+    const otherUserName = chat.counterpart_name;
     
     // Get the last message if available
     let lastMessagePreview = 'No messages yet';
     let lastMessageTime = '';
     
-    if (chat.messages && chat.messages.length > 0) {
-        const lastMessage = chat.messages[0];
+    if (chat.last_message) {
+        const lastMessage = chat.last_message;
         lastMessagePreview = lastMessage.content;
         
         // Format the timestamp
@@ -277,12 +333,25 @@ function createChatListItem(chat) {
     listItem.dataset.bookId = chat.book_id;
     listItem.dataset.bookTitle = chat.book_title;
     
+    // Unread messages, and whether the other participant is waiting for a reply
+    const unreadBadge = chat.unread_count > 0
+        ? `<span class="badge bg-primary rounded-pill ms-2">${chat.unread_count}</span>`
+        : '';
+    const awaitingReply = chat.awaiting_reply
+        ? '<small class="text-warning ms-2">Awaiting reply</small>'
+        : '';
+    const presence = chat.counterpart && chat.counterpart.online
+        ? '<span class="text-success" title="Online">&#9679;</span>'
+        : '';
+    const muted = chat.muted ? '<small class="text-muted ms-2" title="Notifications muted">Muted</small>' : '';
+    const blocked = chat.blocked ? '<small class="text-danger ms-2">Blocked</small>' : '';
+    
     listItem.innerHTML = `
         <div class="d-flex justify-content-between align-items-center">
-            <h6 class="mb-1">${otherUserName}</h6>
+            <h6 class="mb-1">${presence} ${otherUserName}${unreadBadge}${muted}${blocked}</h6>
             <small class="text-muted">${lastMessageTime}</small>
         </div>
-        <p class="mb-1 text-muted">Book: ${chat.book_title}</p>
+        <p class="mb-1 text-muted">Book: ${chat.book_title}${awaitingReply}</p>
         <small class="chat-preview">${lastMessagePreview}</small>
     `;
     
@@ -639,6 +708,19 @@ function connectToWebSocket(chatId) {
                         // Regular chat message
                         console.log('Chat message received:', message);
                         addMessageToChat(message);
+                        markChatRead(message);
+                        break;
+                    
+                    case 'read':
+                        showReadReceipt(message);
+                        break;
+                    
+                    case 'typing':
+                        showTypingIndicator(message);
+                        break;
+                    
+                    case 'presence':
+                        showPresence(message);
                         break;
                     
                     case 'chat_created':
@@ -657,12 +739,18 @@ function connectToWebSocket(chatId) {
                         setTimeout(loadChatSessions, 1000);
                         break;
                     
+                    case 'chat_joined':
+                        // The server bound this connection to the chat
+                        currentChatId = message.chat_id;
+                        markChatRead(message);
+                        break;
+                    
                     case 'connection_success':
                         console.log('Connection success:', message.content);
                         break;
                     
                     case 'error':
-                        console.error('WebSocket error message:', message.content);
+                        console.error('WebSocket error message:', message.code, message.content);
                         displayConnectionError(message.content);
                         break;
                     
@@ -745,6 +833,81 @@ function addMessageToChat(message) {
     chatMessages.appendChild(messageDiv);
 }
 
+/**
+ * Tell the other participant their messages in the current chat were read
+ * @param {Object} message - The message or chat_joined event that was received
+ */
+function markChatRead(message) {
+    const user = getUserData();
+    if (!user || message.sender_id === user.id || Number(message.chat_id) !== Number(currentChatId)) return;
+    if (socket && socket.readyState === WebSocket.OPEN) {
+        socket.send(JSON.stringify({ type: 'read', chat_id: message.chat_id }));
+    }
+}
+
+/**
+ * Show that the other participant has read our messages
+ * @param {Object} message - The read event
+ */
+function showReadReceipt(message) {
+    const user = getUserData();
+    if (!user || message.sender_id === user.id || Number(message.chat_id) !== Number(currentChatId)) return;
+    const chatStatus = document.getElementById('chat-status');
+    if (chatStatus) {
+        chatStatus.textContent = 'Seen';
+    }
+}
+
+let typingTimer = null;
+
+/**
+ * Show that the other participant is typing, until they stop for a few seconds
+ * @param {Object} message - The typing event
+ */
+function showTypingIndicator(message) {
+    const user = getUserData();
+    if (!user || message.sender_id === user.id || Number(message.chat_id) !== Number(currentChatId)) return;
+    const chatStatus = document.getElementById('chat-status');
+    if (!chatStatus) return;
+    chatStatus.textContent = `${message.sender_name} is typing...`;
+    clearTimeout(typingTimer);
+    typingTimer = setTimeout(() => { chatStatus.textContent = ''; }, 4000);
+}
+
+/**
+ * Show whether the other participant is online or when they were last seen
+ * @param {Object} message - The presence event
+ */
+function showPresence(message) {
+    const user = getUserData();
+    const status = message.data;
+    if (!user || !status || status.user_id === user.id || Number(message.chat_id) !== Number(currentChatId)) return;
+    const presenceStatus = document.getElementById('presence-status');
+    if (!presenceStatus) return;
+    if (status.online) {
+        presenceStatus.textContent = 'Online';
+        presenceStatus.className = 'text-success small';
+    } else {
+        const lastSeen = status.last_seen_at ? new Date(status.last_seen_at).toLocaleString() : 'a while ago';
+        presenceStatus.textContent = `Last seen ${lastSeen}`;
+        presenceStatus.className = 'text-muted small';
+    }
+}
+
+let lastTypingSent = 0;
+
+/**
+ * Let the other participant know we're typing, at most every two seconds
+ */
+function sendTyping() {
+    const now = Date.now();
+    if (!currentChatId || now - lastTypingSent < 2000) return;
+    if (socket && socket.readyState === WebSocket.OPEN) {
+        socket.send(JSON.stringify({ type: 'typing', chat_id: Number(currentChatId) }));
+        lastTypingSent = now;
+    }
+}
+
 /**
  * Send a message in the current chat
  */
@@ -768,8 +931,10 @@ function sendMessage() {
     if (socket && socket.readyState === WebSocket.OPEN) {
         socket.send(JSON.stringify({
             type: 'message',
-            chat_id: currentChatId,
-            content: message
+            chat_id: Number(currentChatId),
+            content: message,
+            // Lets the server drop this message if a retry sends it twice
+            client_id: newClientMessageId()
         }));
     } else {
         displayError('Connection lost. Please try again.');
@@ -778,6 +943,135 @@ function sendMessage() {
     }
 }
 
+/**
+ * Escape text for display in a message
+ * @param {String} text - Text from a message
+ * @returns {String} HTML-safe text
+ */
+function escapeChatText(text) {
+    const div = document.createElement('div');
+    div.textContent = text || '';
+    return div.innerHTML;
+}
+
+/**
+ * Render the photo, listing card or location a message carries
+ * @param {Object} message - The message
+ * @returns {String} HTML for the payload, or an empty string for text messages
+ */
+function renderMessagePayload(message) {
+    const payload = message.payload;
+    if (!payload) return '';
+    
+    if (payload.image) {
+        const url = escapeChatText(payload.image.url);
+        return `<a href="${url}" target="_blank" rel="noopener"><img src="${url}" class="img-fluid rounded mb-1" style="max-height: 200px;" alt="Photo"></a>`;
+    }
+    if (payload.book) {
+        const book = payload.book;
+        const status = book.status === 'available' ? '' : `<span class="badge bg-secondary ms-1">${escapeChatText(book.status)}</span>`;
+        const link = book.status === 'removed' ? '' : `<a href="book-detail.html?id=${Number(book.book_id)}" class="stretched-link"></a>`;
+        return `
+            <div class="card mb-1 position-relative" style="max-width: 260px;">
+                <div class="card-body p-2">
+                    <div class="fw-bold">${escapeChatText(book.title)}${status}</div>
+                    <div class="small text-muted">${escapeChatText(book.author)}</div>
+                    <div>₹${Number(book.price).toFixed(2)}</div>
+                    ${link}
+                </div>
+            </div>`;
+    }
+    if (payload.location) {
+        const location = payload.location;
+        const lat = Number(location.latitude);
+        const lng = Number(location.longitude);
+        const label = location.label ? escapeChatText(location.label) : `${lat.toFixed(5)}, ${lng.toFixed(5)}`;
+        return `<a href="https://www.openstreetmap.org/?mlat=${lat}&mlon=${lng}#map=17/${lat}/${lng}" target="_blank" rel="noopener" class="d-block mb-1">📍 ${label}</a>`;
+    }
+    return '';
+}
+
+/**
+ * Send a typed message in the current chat
+ * @param {String} kind - image, book or location
+ * @param {Object} payload - The payload for that kind
+ * @param {String} caption - Optional text shown with it
+ */
+function sendTypedMessage(kind, payload, caption) {
+    if (!currentChatId) {
+        displayError('No active chat selected');
+        return;
+    }
+    if (!socket || socket.readyState !== WebSocket.OPEN) {
+        displayError('Connection lost. Please try again.');
+        return;
+    }
+    socket.send(JSON.stringify({
+        type: 'message',
+        chat_id: Number(currentChatId),
+        kind: kind,
+        payload: payload,
+        content: caption || '',
+        client_id: newClientMessageId()
+    }));
+}
+
+/**
+ * Upload a photo and send it in the current chat
+ * @param {File} file - The chosen image
+ */
+function sendPhoto(file) {
+    const formData = new FormData();
+    formData.append('file', file);
+    const headers = getAuthHeaders();
+    // Let the browser set the multipart boundary
+    delete headers['Content-Type'];
+    
+    fetch('/api/uploads', { method: 'POST', headers: headers, body: formData })
+        .then(response => response.json().then(data => {
+            if (!response.ok) {
+                throw new Error(data.error || 'Failed to upload photo');
+            }
+            return data;
+        }))
+        .then(upload => sendTypedMessage('image', { image: { upload_id: upload.id } }))
+        .catch(error => displayError(error.message));
+}
+
+/**
+ * Share the current position as a meetup location
+ */
+function shareLocation() {
+    if (!navigator.geolocation) {
+        displayError('Location sharing is not supported by this browser');
+        return;
+    }
+    navigator.geolocation.getCurrentPosition(
+        position => {
+            const label = prompt('Name this meetup spot (optional):') || '';
+            sendTypedMessage('location', {
+                location: {
+                    latitude: position.coords.latitude,
+                    longitude: position.coords.longitude,
+                    label: label
+                }
+            });
+        },
+        () => displayError('Could not get your location')
+    );
+}
+
+/**
+ * Generate an ID for an outgoing message
+ * @returns {String} A unique message ID
+ */
+function newClientMessageId() {
+    if (window.crypto && crypto.randomUUID) {
+        return crypto.randomUUID();
+    }
+    return `${Date.now()}-${Math.random().toString(36).slice(2)}`;
+}
+
 /**
  * Append a message to the chat window
  * @param {Object} message - The message to append
@@ -786,6 +1080,14 @@ function appendMessage(message) {
     const chatArea = document.getElementById('chat-area');
     if (!chatArea) return;
     
+    // Skip messages already shown and remember the newest one for reconnects
+    if (message.id) {
+        if (seenMessageIds.has(message.id)) return;
+        seenMessageIds.add(message.id);
+        const chatId = message.chat_id || currentChatId;
+        lastMessageIds[chatId] = Math.max(lastMessageIds[chatId] || 0, message.id);
+    }
+    
     const user = getUserData();
     const isSelf = message.sender_id === user.id;
     
@@ -796,13 +1098,26 @@ function appendMessage(message) {
     const timestamp = new Date(message.timestamp);
     const timeString = timestamp.toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
     
+    const reportLink = !isSelf && message.id
+        ? `<a href="#" class="report-message-link small text-muted ms-2" data-message-id="${message.id}">Report</a>`
+        : '';
+    
     messageElement.innerHTML = `
         <div class="message-content">
-            <div class="message-text">${message.content}</div>
-            <div class="message-time">${timeString}</div>
+            ${renderMessagePayload(message)}
+            <div class="message-text">${escapeChatText(message.content)}</div>
+            <div class="message-time">${timeString}${reportLink}</div>
         </div>
     `;
     
+    const report = messageElement.querySelector('.report-message-link');
+    if (report) {
+        report.addEventListener('click', function(e) {
+            e.preventDefault();
+            submitReport({ message_id: message.id });
+        });
+    }
+    
     chatArea.appendChild(messageElement);
     chatArea.scrollTop = chatArea.scrollHeight;
 }
@@ -856,6 +1171,7 @@ function loadChat(chatId) {
         
         // Set current chat ID
         currentChatId = chatId;
+        renderChatActions(chatId);
         
         // Update URL
         const currentUrl = new URL(window.location.href);
@@ -869,6 +1185,125 @@ function loadChat(chatId) {
     });
 }
 
+/**
+ * Add mute, block and report buttons for the open chat to its header
+ * @param {Number} chatId - The open chat's ID
+ */
+function renderChatActions(chatId) {
+    const chat = activeChats.find(c => Number(c.chat_id) === Number(chatId));
+    const header = document.getElementById('chat-header');
+    if (!chat || !header) return;
+    
+    const user = getUserData();
+    const otherUserId = chat.buyer_id === user.id ? chat.seller_id : chat.buyer_id;
+    
+    // Only blocks the user made can be lifted from here
+    fetch('/api/blocks', { headers: getAuthHeaders() })
+    .then(response => response.ok ? response.json() : [])
+    .then(blocks => {
+        const blockedByMe = blocks.some(b => b.user_id === otherUserId);
+        
+        const existing = document.getElementById('chat-actions');
+        if (existing) existing.remove();
+        
+        const actions = document.createElement('div');
+        actions.id = 'chat-actions';
+        actions.className = 'btn-group btn-group-sm';
+        actions.innerHTML = `
+            <button type="button" class="btn btn-outline-secondary" id="mute-chat-btn">${chat.muted ? 'Unmute' : 'Mute'}</button>
+            <button type="button" class="btn btn-outline-danger" id="block-user-btn">${blockedByMe ? 'Unblock' : 'Block'}</button>
+            <button type="button" class="btn btn-outline-warning" id="report-user-btn">Report</button>
+            <button type="button" class="btn btn-outline-secondary" id="export-chat-btn">Export</button>
+        `;
+        header.appendChild(actions);
+        
+        document.getElementById('mute-chat-btn').addEventListener('click', function() {
+            fetch(`/api/chats/${chatId}/mute`, {
+                method: chat.muted ? 'DELETE' : 'PUT',
+                headers: getAuthHeaders()
+            })
+            .then(response => {
+                if (!response.ok) throw new Error('Failed to update notifications');
+                chat.muted = !chat.muted;
+                this.textContent = chat.muted ? 'Unmute' : 'Mute';
+            })
+            .catch(error => displayError(error.message));
+        });
+        
+        document.getElementById('block-user-btn').addEventListener('click', function() {
+            if (!blockedByMe && !confirm('Block this user? Neither of you will be able to message the other, and their listings will be hidden from you.')) {
+                return;
+            }
+            fetch(`/api/blocks/${otherUserId}`, {
+                method: blockedByMe ? 'DELETE' : 'POST',
+                headers: getAuthHeaders()
+            })
+            .then(response => {
+                if (!response.ok) throw new Error('Failed to update block');
+                loadChatSessions();
+                renderChatActions(chatId);
+            })
+            .catch(error => displayError(error.message));
+        });
+        
+        document.getElementById('report-user-btn').addEventListener('click', function() {
+            submitReport({ user_id: otherUserId });
+        });
+        
+        document.getElementById('export-chat-btn').addEventListener('click', function() {
+            exportChat(chatId);
+        });
+    });
+}
+
+/**
+ * Download a plain text transcript of a chat
+ * @param {Number} chatId - The chat to export
+ */
+function exportChat(chatId) {
+    fetch(`/api/chats/${chatId}/export?format=text`, { headers: getAuthHeaders() })
+    .then(response => {
+        if (!response.ok) throw new Error('Failed to export chat');
+        return response.blob();
+    })
+    .then(blob => {
+        const link = document.createElement('a');
+        link.href = URL.createObjectURL(blob);
+        link.download = `bookbridge-chat-${chatId}.txt`;
+        document.body.appendChild(link);
+        link.click();
+        link.remove();
+        URL.revokeObjectURL(link.href);
+    })
+    .catch(error => displayError(error.message));
+}
+
+/**
+ * Report a user or a chat message to the moderators
+ * @param {Object} target - { user_id } or { message_id }
+ */
+function submitReport(target) {
+    const reasons = ['spam', 'scam', 'harassment', 'inappropriate', 'other'];
+    const reason = (prompt(`Why are you reporting this? (${reasons.join(', ')})`, 'spam') || '').trim().toLowerCase();
+    if (!reason) return;
+    if (!reasons.includes(reason)) {
+        displayError(`Please choose one of: ${reasons.join(', ')}`);
+        return;
+    }
+    const details = prompt('Anything else the moderators should know? (optional)') || '';
+    
+    fetch('/api/reports', {
+        method: 'POST',
+        headers: getAuthHeaders(),
+        body: JSON.stringify({ ...target, reason, details })
+    })
+    .then(response => response.json().then(data => {
+        if (!response.ok) throw new Error(data.error || 'Failed to submit report');
+        alert('Thanks, your report was sent to the moderators.');
+    }))
+    .catch(error => displayError(error.message));
+}
+
 /**
  * Display an error message to the user
  * @param {String} message - The error message to display
@@ -92,6 +92,108 @@ function sendMessage() {
     // Show typing indicator
     const typingIndicator = addTypingIndicator();
     
+    // Continue the current conversation so follow-up questions have context
+    const conversationId = sessionStorage.getItem('chatbotConversationId');
+    
+    // Stream the reply as it is generated when the browser supports it
+    if (window.EventSource) {
+        streamMessage(message, conversationId, typingIndicator);
+    } else {
+        requestMessage(message, conversationId, typingIndicator);
+    }
+}
+
+// streamMessage shows the reply token by token over server-sent events
+function streamMessage(message, conversationId, typingIndicator) {
+    const params = new URLSearchParams({ query: message });
+    if (conversationId) {
+        params.set('conversation_id', conversationId);
+    }
+    if (typeof isAuthenticated === 'function' && isAuthenticated()) {
+        params.set('token', localStorage.getItem('token'));
+    }
+    
+    const source = new EventSource(`/api/chatbot/stream?${params.toString()}`);
+    let messageDiv = null;
+    let text = '';
+    
+    source.addEventListener('token', event => {
+        if (!messageDiv) {
+            typingIndicator.remove();
+            messageDiv = addMessage('', 'bot');
+        }
+        text += JSON.parse(event.data).text;
+        renderMessageText(messageDiv, text);
+    });
+    
+    source.addEventListener('books', event => {
+        source.close();
+        typingIndicator.remove();
+        const data = JSON.parse(event.data);
+        
+        if (data.conversation_id) {
+            sessionStorage.setItem('chatbotConversationId', data.conversation_id);
+        }
+        
+        // The final reply has any invalid citations removed
+        if (!messageDiv) {
+            messageDiv = addMessage('', 'bot');
+        }
+        renderMessageText(messageDiv, data.response || "Sorry, I couldn't process your request.");
+        applyChatbotActions(data.actions);
+        
+        if (data.books && data.books.length > 0) {
+            addBookRecommendations(data.books);
+        }
+    });
+    
+    source.addEventListener('error', event => {
+        source.close();
+        typingIndicator.remove();
+        
+        let error = 'Sorry, there was an error processing your request. Please try again.';
+        if (event.data) {
+            error = JSON.parse(event.data).error || error;
+            if (error === 'Conversation not found') {
+                // The conversation was deleted; the next message starts a new one
+                sessionStorage.removeItem('chatbotConversationId');
+            }
+        }
+        addMessage(error, 'bot');
+    });
+}
+
+// applyChatbotActions reflects what the assistant's tools did. The cart lives
+// in the browser, so books the assistant adds to it are added here.
+function applyChatbotActions(actions) {
+    (actions || []).forEach(action => {
+        if (action.type !== 'add_to_cart') {
+            return;
+        }
+        const book = {
+            id: action.book.id,
+            title: action.book.title,
+            author: action.book.author,
+            price: action.book.price,
+            image: action.book.image_url
+        };
+        if (typeof addToCart === 'function') {
+            addToCart(book);
+            return;
+        }
+        const cart = JSON.parse(localStorage.getItem('cart')) || [];
+        const existing = cart.find(item => item.id === book.id);
+        if (existing) {
+            existing.quantity += 1;
+        } else {
+            cart.push({ ...book, image: book.image || '/images/book-placeholder.jpg', quantity: 1 });
+        }
+        localStorage.setItem('cart', JSON.stringify(cart));
+    });
+}
+
+// requestMessage sends the query in one request and shows the whole reply
+function requestMessage(message, conversationId, typingIndicator) {
     // Prepare headers
     const headers = {
         'Content-Type': 'application/json'
@@ -104,14 +206,30 @@ function sendMessage() {
     }
     
     // Send request to backend
+    const payload = { query: message };
+    if (conversationId) {
+        payload.conversation_id = parseInt(conversationId, 10);
+    }
+    
     fetch('/api/chatbot', {
         method: 'POST',
         headers: headers,
-        body: JSON.stringify({ query: message })
+        body: JSON.stringify(payload)
     })
     .then(response => {
+        if (response.status === 404) {
+            // The conversation was deleted; the next message starts a new one
+            sessionStorage.removeItem('chatbotConversationId');
+        }
         if (!response.ok) {
-            throw new Error('Network response was not ok');
+            // Refusals and quota limits come back with a message to show
+            return response.json()
+                .catch(() => ({}))
+                .then(body => {
+                    const error = new Error(body.error || 'Network response was not ok');
+                    error.userMessage = body.error;
+                    throw error;
+                });
         }
         return response.json();
     })
@@ -119,9 +237,14 @@ function sendMessage() {
         // Remove typing indicator
         typingIndicator.remove();
         
+        if (data.conversation_id) {
+            sessionStorage.setItem('chatbotConversationId', data.conversation_id);
+        }
+        
         // Add bot response
         const response = data.response || "Sorry, I couldn't process your request.";
         addMessage(response, 'bot');
+        applyChatbotActions(data.actions);
         
         // Add book recommendations if available
         if (data.books && data.books.length > 0) {
@@ -133,7 +256,7 @@ function sendMessage() {
         typingIndicator.remove();
         
         // Add error message
-        addMessage('Sorry, there was an error processing your request. Please try again.', 'bot');
+        addMessage(error.userMessage || 'Sorry, there was an error processing your request. Please try again.', 'bot');
         console.error('Error sending message to chatbot:', error);
     });
 }
@@ -148,14 +271,23 @@ function addMessage(text, sender) {
         messageDiv.className = 'p-3 bg-light rounded-3 align-self-start';
     }
     
+    renderMessageText(messageDiv, text);
+    messagesContainer.appendChild(messageDiv);
+    
+    return messageDiv;
+}
+
+function renderMessageText(messageDiv, text) {
     // Convert markdown links to HTML
     text = text.replace(/\[(.*?)\]\((.*?)\)/g, '<a href="$2" target="_blank" class="text-decoration-none">$1</a>');
     
+    // Link listing citations such as [#42] to the book page
+    text = text.replace(/\[#(\d+)\]/g, '<a href="book-detail.html?id=$1" class="text-decoration-none">[#$1]</a>');
+    
     // Replace line breaks with <br> tags
     text = text.replace(/\n/g, '<br>');
     
     messageDiv.innerHTML = text;
-    messagesContainer.appendChild(messageDiv);
     
     // Scroll to bottom
     const chatBody = document.getElementById('chat-messages');
@@ -1,101 +1,242 @@
-// BookBridge Community Chat Frontend
-
-let communitySocket = null;
-
-function initializeCommunityChat() {
-    // Check if user is authenticated
-    if (!isAuthenticated()) {
-        window.location.href = 'login.html';
-        return;
-    }
-    
-    // Set username in navbar
-    const user = getUserData();
-    const usernameDisplay = document.getElementById('username-display');
-    if (usernameDisplay) {
-        usernameDisplay.textContent = user.username;
-    }
-
-    // Connect to WebSocket
-    connectCommunityWebSocket();
-
-    // Handle message form
-    const form = document.getElementById('community-message-form');
-    if (form) {
-        form.addEventListener('submit', function(e) {
-            e.preventDefault();
-            sendCommunityMessage();
-        });
-    }
-}
-
-function connectCommunityWebSocket() {
-    const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-    const token = localStorage.getItem('token');
-    const wsUrl = `${protocol}//${window.location.host}/ws/community?token=${encodeURIComponent(token)}`;
-    communitySocket = new WebSocket(wsUrl);
-
-    communitySocket.onopen = function() {
-        console.log('Connected to community chat');
-    };
-    communitySocket.onmessage = function(event) {
-        const message = JSON.parse(event.data);
-        appendCommunityMessage(message);
-    };
-    communitySocket.onerror = function(error) {
-        console.error('Community WebSocket error:', error);
-        showCommunityError('Connection error. Please try again.');
-    };
-    communitySocket.onclose = function() {
-        console.log('Community WebSocket closed. Reconnecting in 5s...');
-        setTimeout(connectCommunityWebSocket, 5000);
-    };
-}
-
-function sendCommunityMessage() {
-    const input = document.getElementById('community-message-input');
-    const text = input.value.trim();
-    if (!text) return;
-    input.value = '';
-    if (communitySocket && communitySocket.readyState === WebSocket.OPEN) {
-        communitySocket.send(JSON.stringify({
-            type: 'message',
-            content: text
-        }));
-    } else {
-        showCommunityError('Not connected. Please wait and try again.');
-    }
-}
-
-function appendCommunityMessage(message) {
-    const container = document.getElementById('community-messages');
-    if (!container) return;
-    const user = getUserData();
-    const isSelf = message.sender_id === user.id;
-    const msgDiv = document.createElement('div');
-    msgDiv.className = 'message ' + (isSelf ? 'message-self' : 'message-other');
-    const time = new Date(message.timestamp).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
-    msgDiv.innerHTML = `
-        <div class="message-content">
-            <div class="message-text"><strong>${message.sender_name || 'User'}:</strong> ${message.content}</div>
-            <div class="message-time">${time}</div>
-        </div>
-    `;
-    container.appendChild(msgDiv);
-    container.scrollTop = container.scrollHeight;
-}
-
-function showCommunityError(msg) {
-    const container = document.querySelector('.container');
-    const alert = document.createElement('div');
-    alert.className = 'alert alert-danger alert-dismissible fade show';
-    alert.role = 'alert';
-    alert.innerHTML = `
-        ${msg}
-        <button type="button" class="btn-close" data-bs-dismiss="alert" aria-label="Close"></button>
-    `;
-    container.insertBefore(alert, container.firstChild);
-    setTimeout(() => alert.remove(), 5000);
-}
-
+// BookBridge Community Chat Frontend
+
+let communitySocket = null;
+let communityRoom = new URLSearchParams(window.location.search).get('room') || 'general';
+let olderMessagesBefore = null; // next_before of the history page to load next
+
+function initializeCommunityChat() {
+    // Check if user is authenticated
+    if (!isAuthenticated()) {
+        window.location.href = 'login.html';
+        return;
+    }
+    
+    // Set username in navbar
+    const user = getUserData();
+    const usernameDisplay = document.getElementById('username-display');
+    if (usernameDisplay) {
+        usernameDisplay.textContent = user.username;
+    }
+
+    // Load the rooms, then connect to the current one
+    loadCommunityRooms();
+    connectCommunityWebSocket();
+
+    const olderButton = document.getElementById('community-load-older');
+    if (olderButton) {
+        olderButton.addEventListener('click', loadOlderCommunityMessages);
+    }
+
+    // Handle message form
+    const form = document.getElementById('community-message-form');
+    if (form) {
+        form.addEventListener('submit', function(e) {
+            e.preventDefault();
+            sendCommunityMessage();
+        });
+    }
+}
+
+function connectCommunityWebSocket() {
+    const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
+    const token = localStorage.getItem('token');
+    const wsUrl = `${protocol}//${window.location.host}/ws/community?token=${encodeURIComponent(token)}&room=${encodeURIComponent(communityRoom)}`;
+    const socket = new WebSocket(wsUrl);
+    communitySocket = socket;
+
+    communitySocket.onopen = function() {
+        console.log('Connected to community chat');
+    };
+    communitySocket.onmessage = function(event) {
+        const message = JSON.parse(event.data);
+        handleCommunityMessage(message);
+    };
+    communitySocket.onerror = function(error) {
+        console.error('Community WebSocket error:', error);
+        showCommunityError('Connection error. Please try again.');
+    };
+    communitySocket.onclose = function() {
+        // A socket replaced by switching rooms, or closed for a ban, stays closed
+        if (socket !== communitySocket || socket.banned) return;
+        console.log('Community WebSocket closed. Reconnecting in 5s...');
+        setTimeout(connectCommunityWebSocket, 5000);
+    };
+}
+
+function sendCommunityMessage() {
+    const input = document.getElementById('community-message-input');
+    const text = input.value.trim();
+    if (!text) return;
+    input.value = '';
+    if (communitySocket && communitySocket.readyState === WebSocket.OPEN) {
+        communitySocket.send(JSON.stringify({
+            type: 'message',
+            content: text
+        }));
+    } else {
+        showCommunityError('Not connected. Please wait and try again.');
+    }
+}
+
+function handleCommunityMessage(message) {
+    switch (message.type) {
+        case 'history':
+            // The room and its latest messages, sent on connect
+            showCommunityHistory(message.data);
+            break;
+        case 'message':
+            appendCommunityMessage(message);
+            break;
+        case 'message_deleted':
+            removeCommunityMessage(message.id);
+            break;
+        case 'error':
+            if (message.code === 'banned') {
+                communitySocket.banned = true;
+            }
+            showCommunityError(message.content);
+            break;
+        default:
+            console.log('Unknown community message type:', message.type);
+    }
+}
+
+function loadCommunityRooms() {
+    const select = document.getElementById('community-room-select');
+    if (!select) return;
+    fetch('/api/community/rooms')
+        .then(response => response.json())
+        .then(rooms => {
+            select.innerHTML = '';
+            rooms.forEach(room => {
+                const option = document.createElement('option');
+                option.value = room.slug;
+                option.textContent = room.name;
+                option.selected = room.slug === communityRoom;
+                select.appendChild(option);
+            });
+            select.onchange = function() {
+                switchCommunityRoom(select.value);
+            };
+        })
+        .catch(error => console.error('Error loading community rooms:', error));
+}
+
+function switchCommunityRoom(slug) {
+    communityRoom = slug;
+    const url = new URL(window.location.href);
+    url.searchParams.set('room', slug);
+    window.history.replaceState({}, '', url);
+    if (communitySocket) {
+        communitySocket.close();
+    }
+    connectCommunityWebSocket();
+}
+
+function showCommunityHistory(data) {
+    const container = document.getElementById('community-messages');
+    if (!container || !data) return;
+    container.querySelectorAll('.message').forEach(el => el.remove());
+
+    const roomName = document.getElementById('community-room-name');
+    if (roomName && data.room) {
+        roomName.textContent = data.room.name;
+    }
+
+    const messages = data.messages || [];
+    messages.forEach(message => appendCommunityMessage(toCommunityFrame(message)));
+    setOlderMessagesBefore(messages.length > 0 ? messages[0].id : null);
+}
+
+function loadOlderCommunityMessages() {
+    if (!olderMessagesBefore) return;
+    fetch(`/api/community/rooms/${encodeURIComponent(communityRoom)}/messages?before=${olderMessagesBefore}`, {
+        headers: getAuthHeaders()
+    })
+        .then(response => {
+            if (!response.ok) {
+                throw new Error('Failed to load older messages');
+            }
+            return response.json();
+        })
+        .then(page => {
+            // Insert oldest last so the page reads in order above what's shown
+            page.messages.slice().reverse().forEach(message => {
+                appendCommunityMessage(toCommunityFrame(message), true);
+            });
+            setOlderMessagesBefore(page.next_before || null);
+        })
+        .catch(error => showCommunityError(error.message));
+}
+
+function setOlderMessagesBefore(before) {
+    olderMessagesBefore = before;
+    const olderButton = document.getElementById('community-load-older');
+    if (olderButton) {
+        olderButton.style.display = before ? 'inline-block' : 'none';
+    }
+}
+
+// toCommunityFrame shapes a stored message like a live one
+function toCommunityFrame(message) {
+    return {
+        id: message.id,
+        content: message.content,
+        sender_id: message.sender_id,
+        sender_name: message.sender_name,
+        timestamp: message.created_at
+    };
+}
+
+function removeCommunityMessage(id) {
+    const msgDiv = document.querySelector(`#community-messages [data-message-id="${id}"]`);
+    if (msgDiv) {
+        msgDiv.remove();
+    }
+}
+
+function escapeCommunityText(text) {
+    const div = document.createElement('div');
+    div.textContent = text;
+    return div.innerHTML;
+}
+
+function appendCommunityMessage(message, prepend) {
+    const container = document.getElementById('community-messages');
+    if (!container) return;
+    const user = getUserData();
+    const isSelf = message.sender_id === user.id;
+    const msgDiv = document.createElement('div');
+    msgDiv.className = 'message ' + (isSelf ? 'message-self' : 'message-other');
+    msgDiv.dataset.messageId = message.id;
+    const time = new Date(message.timestamp).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
+    msgDiv.innerHTML = `
+        <div class="message-content">
+            <div class="message-text"><strong>${escapeCommunityText(message.sender_name || 'User')}:</strong> ${escapeCommunityText(message.content)}</div>
+            <div class="message-time">${time}</div>
+        </div>
+    `;
+    if (prepend) {
+        // After the "load older" button, before the oldest message shown
+        const firstMessage = container.querySelector('.message');
+        container.insertBefore(msgDiv, firstMessage);
+        return;
+    }
+    container.appendChild(msgDiv);
+    container.scrollTop = container.scrollHeight;
+}
+
+function showCommunityError(msg) {
+    const container = document.querySelector('.container');
+    const alert = document.createElement('div');
+    alert.className = 'alert alert-danger alert-dismissible fade show';
+    alert.role = 'alert';
+    alert.innerHTML = `
+        ${msg}
+        <button type="button" class="btn-close" data-bs-dismiss="alert" aria-label="Close"></button>
+    `;
+    container.insertBefore(alert, container.firstChild);
+    setTimeout(() => alert.remove(), 5000);
+}
+
 document.addEventListener('DOMContentLoaded', initializeCommunityChat); 
\ No newline at end of file
@@ -100,7 +100,7 @@ function createBookRow(book) {
     let statusBadgeClass = 'bg-success';
     if (book.status === 'sold') {
         statusBadgeClass = 'bg-danger';
-    } else if (book.status === 'reserved') {
+    } else if (book.status === 'reserved' || book.status === 'pending_review') {
         statusBadgeClass = 'bg-warning';
     }
     
@@ -215,12 +215,14 @@ function loadRecentMessages() {
         </div>
     `;
     
-    // Fetch chats from API
-    fetch('/api/chats', {
+    // Fetch the three most recently active chats from the API
+    fetch('/api/chats?limit=3', {
         headers: getAuthHeaders()
     })
     .then(response => response.json())
-    .then(chats => {
+    .then(page => {
+        const chats = page.chats || [];
+        
         // Clear container
         messagesContainer.innerHTML = '';
         
@@ -238,33 +240,18 @@ function loadRecentMessages() {
         }
         
         // Update stats
-        document.getElementById('total-messages').textContent = chats.length;
-        
-        // Sort chats by most recent message
-        chats.sort((a, b) => {
-            if (!a.messages || a.messages.length === 0) return 1;
-            if (!b.messages || b.messages.length === 0) return -1;
-            
-            const aDate = new Date(a.messages[0].created_at);
-            const bDate = new Date(b.messages[0].created_at);
-            return bDate - aDate;
-        });
-        
-        // Display the most recent 3 chats
-        const recentChats = chats.slice(0, 3);
+        document.getElementById('total-messages').textContent = page.total;
         
-        recentChats.forEach(chat => {
-            const user = getUserData();
-            
-            // Determine the other user's name (buyer or seller)
-            const otherUserName = user.role === 'buyer' ? chat.seller_name : chat.buyer_name;
+        chats.forEach(chat => {
+            // The other participant, whichever side of the sale they are on
+            const otherUserName = chat.counterpart_name;
             
             // Get the last message if available
             let lastMessagePreview = 'No messages yet';
             let lastMessageTime = '';
             
-            if (chat.messages && chat.messages.length > 0) {
-                const lastMessage = chat.messages[0];
+            if (chat.last_message) {
+                const lastMessage = chat.last_message;
                 lastMessagePreview = lastMessage.content;
                 
                 // Format the timestamp
@@ -365,6 +352,19 @@ function initializeAddBookForm() {
                 currency: 'INR',
                 maximumFractionDigits: 0
             }).format(predictedPrice);
+            const formatINR = value => new Intl.NumberFormat('en-IN', {
+                style: 'currency',
+                currency: 'INR',
+                maximumFractionDigits: 0
+            }).format(value);
+            
+            // Explain the estimate with its per-feature contributions and comparable sales
+            const reasons = (data.contributions || [])
+                .map(contribution => `<li>${contribution.label}</li>`)
+                .join('');
+            const comparables = (data.comparables || [])
+                .map(book => `<li>"${book.title}" (${book.condition}) sold for ${formatINR(book.price)}</li>`)
+                .join('');
             
             // Update the price guidance element
             priceGuidance.innerHTML = `
@@ -373,13 +373,13 @@ function initializeAddBookForm() {
                         <i data-feather="info" class="me-2"></i>
                         <div>
                             <strong>Recommended Price:</strong> ${formattedPrice}
+                            ${data.low_price && data.high_price ? `<div class="small">Typical range: ${formatINR(data.low_price)} – ${formatINR(data.high_price)}</div>` : ''}
                             <div class="small">Based on similar books in our marketplace</div>
                             <div class="mt-2">
                                 <ul>
-                                    <li>Books in "${condition}" condition typically sell for this price</li>
-                                    <li>Pricing within 10% of recommendation increases sale chances by 3x</li>
-                                    <li>Most similar books in this genre sell within this range</li>
+                                    ${reasons || `<li>Books in "${condition}" condition typically sell for this price</li>`}
                                 </ul>
+                                ${comparables ? `<div class="small"><strong>Comparable sales:</strong><ul>${comparables}</ul></div>` : ''}
                             </div>
                         </div>
                     </div>
@@ -544,7 +544,11 @@ function initializeAddBookForm() {
             priceGuidance.style.display = 'none';
             
             // Show success message
-            alert('Book added successfully!');
+            if (data.book && data.book.status === 'pending_review') {
+                alert('Your listing was submitted for review:\n- ' + (data.reasons || []).join('\n- '));
+            } else {
+                alert('Book added successfully!');
+            }
             
             // Reload books
             loadSellerBooks();